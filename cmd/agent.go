@@ -30,13 +30,20 @@ import (
 	"time"
 
 	"github.com/cenkalti/backoff/v3"
+	"github.com/dustin/go-humanize"
+	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 
 	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
 	"github.com/bizflycloud/bizfly-backup/pkg/broker/mqtt"
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/hooks"
+	"github.com/bizflycloud/bizfly-backup/pkg/jobs"
+	"github.com/bizflycloud/bizfly-backup/pkg/ratelimit"
 	"github.com/bizflycloud/bizfly-backup/pkg/server"
+	"github.com/bizflycloud/bizfly-backup/pkg/source"
 )
 
 var defaultAddr = "unix://" + filepath.Join(os.TempDir(), "bizfly-backup.sock")
@@ -50,12 +57,35 @@ var agentCmd = &cobra.Command{
 		accessKey := viper.GetString("access_key")
 		secretKey := viper.GetString("secret_key")
 		apiUrl := viper.GetString("api_url")
-		backupClient, err := backupapi.NewClient(
+		clientOpts := []backupapi.ClientOption{
 			backupapi.WithAccessKey(accessKey),
 			backupapi.WithSecretKey(secretKey),
 			backupapi.WithServerURL(apiUrl),
 			backupapi.WithID(machineID),
-		)
+		}
+		if viper.IsSet("bandwidth_limit") {
+			var bandwidthLimit ratelimit.Config
+			if err := viper.UnmarshalKey("bandwidth_limit", &bandwidthLimit); err != nil {
+				logger.Fatal("failed to read bandwidth limit", zap.Error(err))
+				os.Exit(1)
+			}
+			limiter, err := ratelimit.NewFromConfig(bandwidthLimit)
+			if err != nil {
+				logger.Fatal("invalid bandwidth limit", zap.Error(err))
+				os.Exit(1)
+			}
+			clientOpts = append(clientOpts, backupapi.WithRateLimiter(limiter))
+		}
+		if viper.IsSet("upload_part_size") {
+			clientOpts = append(clientOpts, backupapi.WithUploadPartSize(int(viper.GetSizeInBytes("upload_part_size"))))
+		}
+		if viper.IsSet("upload_concurrency") {
+			clientOpts = append(clientOpts, backupapi.WithUploadConcurrency(viper.GetInt("upload_concurrency")))
+		}
+		if viper.IsSet("upload_memory_limit") {
+			clientOpts = append(clientOpts, backupapi.WithUploadMemoryLimit(int(viper.GetSizeInBytes("upload_memory_limit"))))
+		}
+		backupClient, err := backupapi.NewClient(clientOpts...)
 		if err != nil {
 			logger.Error("failed to create new backup client", zap.Error(err))
 			os.Exit(1)
@@ -89,14 +119,91 @@ var agentCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
+		stateDir := viper.GetString("state_dir")
+		if stateDir == "" {
+			home, err := homedir.Dir()
+			if err != nil {
+				logger.Fatal("failed to get home directory", zap.Error(err))
+				os.Exit(1)
+			}
+			stateDir = filepath.Join(home, ".bizfly-backup")
+		}
+
 		logger.Debug("Listening address: " + addr)
-		s, err := server.New(
+		opts := []server.Option{
 			server.WithAddr(addr),
 			server.WithBroker(b),
 			server.WithSubscribeTopics("agent/default", "agent/"+agentID),
-			server.WithPublishTopic("agent/"+agentID),
+			server.WithPublishTopic("agent/" + agentID),
 			server.WithBackupClient(backupClient),
-		)
+			server.WithStateDir(stateDir),
+			server.WithEncryptionPassphrase(viper.GetString("encryption_passphrase")),
+		}
+		if viper.IsSet("download_concurrency") {
+			opts = append(opts, server.WithDownloadConcurrency(viper.GetInt("download_concurrency")))
+		}
+		if viper.IsSet("job_concurrency") {
+			opts = append(opts, server.WithJobConcurrency(viper.GetInt("job_concurrency")))
+		}
+		if viper.IsSet("job_history_max_age") || viper.IsSet("job_history_max_jobs") {
+			retention := jobs.DefaultRetention
+			if viper.IsSet("job_history_max_age") {
+				retention.MaxAge = viper.GetDuration("job_history_max_age")
+			}
+			if viper.IsSet("job_history_max_jobs") {
+				retention.MaxJobs = viper.GetInt("job_history_max_jobs")
+			}
+			opts = append(opts, server.WithJobHistoryRetention(retention))
+		}
+		if cacheDir := viper.GetString("cache_dir"); cacheDir != "" {
+			maxSize := uint64(0)
+			if viper.IsSet("cache_max_size") {
+				if maxSize, err = humanize.ParseBytes(viper.GetString("cache_max_size")); err != nil {
+					logger.Fatal("invalid cache max size", zap.Error(err))
+					os.Exit(1)
+				}
+			}
+			c, err := cache.Open(cacheDir, viper.GetInt("cache_max_archives"), int64(maxSize))
+			if err != nil {
+				logger.Fatal("failed to open cache", zap.Error(err))
+				os.Exit(1)
+			}
+			opts = append(opts, server.WithCache(c))
+		}
+		if viper.IsSet("auto_prune") {
+			opts = append(opts, server.WithAutoPrune(viper.GetBool("auto_prune")))
+		}
+		if viper.IsSet("max_incrementals") {
+			opts = append(opts, server.WithMaxIncrementals(viper.GetInt("max_incrementals")))
+		}
+		if viper.IsSet("filters") {
+			var filters map[string]backupapi.BackupDirectoryFilter
+			if err := viper.UnmarshalKey("filters", &filters); err != nil {
+				logger.Fatal("failed to read filters", zap.Error(err))
+				os.Exit(1)
+			}
+			opts = append(opts, server.WithFilters(filters))
+		}
+		if viper.IsSet("hooks") {
+			var configs map[string]hooks.Config
+			if err := viper.UnmarshalKey("hooks", &configs); err != nil {
+				logger.Fatal("failed to read hooks", zap.Error(err))
+				os.Exit(1)
+			}
+			opts = append(opts, server.WithHooks(configs))
+		}
+		if viper.IsSet("allow_server_commands") {
+			opts = append(opts, server.WithServerCommands(viper.GetBool("allow_server_commands")))
+		}
+		if viper.IsSet("sources") {
+			var sources map[string]source.Config
+			if err := viper.UnmarshalKey("sources", &sources); err != nil {
+				logger.Fatal("failed to read sources", zap.Error(err))
+				os.Exit(1)
+			}
+			opts = append(opts, server.WithSources(sources))
+		}
+		s, err := server.New(opts...)
 		if err != nil {
 			logger.Fatal("failed to create new server", zap.Error(err))
 			os.Exit(1)
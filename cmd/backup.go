@@ -20,8 +20,6 @@ package cmd
 import (
 	"bytes"
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -29,6 +27,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -37,17 +36,40 @@ import (
 	"github.com/spf13/viper"
 
 	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
+	"github.com/bizflycloud/bizfly-backup/pkg/progress"
+	"github.com/bizflycloud/bizfly-backup/pkg/server"
 )
 
 var (
-	listBackupHeaders         = []string{"ID", "Name", "Path", "PolicyID", "Pattern", "Activated"}
+	listBackupHeaders         = []string{"ID", "Name", "Path", "PolicyID", "Pattern", "Activated", "Rules"}
 	listRecoveryPointsHeaders = []string{"ID", "Name", "Status", "Type"}
+	verifyHeaders             = []string{"RecoveryPointID", "Files", "Mismatches"}
+	pruneHeaders              = []string{"ID", "Name", "CreatedAt", "Type", "Action", "Reasons"}
 	backupID                  string
 	backupName                string
 	recoveryPointID           string
 	backupDownloadOutFile     string
+	progressFormat            string
+	runLocal                  bool
+	pruneDryRun               bool
 )
 
+// progressReportInterval is the interval between progress reports rendered by commands.
+const progressReportInterval = 200 * time.Millisecond
+
+// newProgressReporter returns the reporter rendering progress to w in format: bar, json or none.
+func newProgressReporter(format string, w io.Writer) (progress.Reporter, error) {
+	switch format {
+	case "bar":
+		return progress.NewBar(w), nil
+	case "json":
+		return progress.NewJSON(w), nil
+	case "none":
+		return progress.ReporterFunc(func(progress.Snapshot) {}), nil
+	}
+	return nil, fmt.Errorf("unknown progress format %q", format)
+}
+
 // backupCmd represents the backup command
 var backupCmd = &cobra.Command{
 	Use:   "backup",
@@ -84,14 +106,15 @@ var backupListCmd = &cobra.Command{
 		}
 		var data [][]string
 		for _, bd := range c.BackupDirectories {
+			rules := bd.Filter.String()
 			if len(bd.Policies) == 0 {
 				activated := fmt.Sprintf("%v", bd.Activated)
-				row := []string{bd.ID, bd.Name, bd.Path, "", "", activated}
+				row := []string{bd.ID, bd.Name, bd.Path, "", "", activated, rules}
 				data = append(data, row)
 			}
 			for _, policy := range bd.Policies {
 				activated := fmt.Sprintf("%v", bd.Activated)
-				row := []string{bd.ID, bd.Name, bd.Path, policy.ID, policy.SchedulePattern, activated}
+				row := []string{bd.ID, bd.Name, bd.Path, policy.ID, policy.SchedulePattern, activated, rules}
 				data = append(data, row)
 			}
 		}
@@ -141,11 +164,6 @@ var backupDownloadRecoveryPointCmd = &cobra.Command{
 			},
 		}
 
-		req, err := http.NewRequest(http.MethodGet, "http://unix/recovery-points/"+recoveryPointID+"/download", nil)
-		if err != nil {
-			logger.Error(err.Error())
-			os.Exit(1)
-		}
 		machineID := viper.GetString("machine_id")
 		secretKey := viper.GetString("secret_key")
 		if machineID == "" || secretKey == "" {
@@ -153,35 +171,87 @@ var backupDownloadRecoveryPointCmd = &cobra.Command{
 			os.Exit(1)
 		}
 		createdAt := time.Now().UTC().Format(http.TimeFormat)
-		req.Header.Add("X-Session-Created-At", createdAt)
-		req.Header.Add("X-Restore-Session-Key", restoreSessionKey(secretKey, machineID, createdAt, recoveryPointID))
+		restoreSessionKey := backupapi.RestoreSessionKey(secretKey, machineID, createdAt, recoveryPointID)
 
-		resp, err := httpc.Do(req)
-		if err != nil {
-			logger.Error(err.Error())
-			os.Exit(1)
-		}
-		defer resp.Body.Close()
 		if backupDownloadOutFile == "" {
 			backupDownloadOutFile = recoveryPointID + ".zip"
 		}
-		f, err := os.Create(backupDownloadOutFile)
+		// Content is downloaded to a partial file first, running the command again resumes the download.
+		partial := backupDownloadOutFile + ".part"
+		d := &backupapi.Downloader{
+			NewRequest: func(ctx context.Context) (*http.Request, error) {
+				req, err := http.NewRequest(http.MethodGet, "http://unix/recovery-points/"+recoveryPointID+"/download", nil)
+				if err != nil {
+					return nil, err
+				}
+				req.Header.Add("X-Session-Created-At", createdAt)
+				req.Header.Add("X-Restore-Session-Key", restoreSessionKey)
+				return req, nil
+			},
+			Do: httpc.Do,
+		}
+		r, err := newProgressReporter(progressFormat, os.Stderr)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
-		pw := backupapi.NewProgressWriter(os.Stderr)
-		if _, err := io.Copy(f, io.TeeReader(resp.Body, pw)); err != nil {
+		tracker := progress.NewTracker(r, progressReportInterval)
+		tracker.Start(progress.PhaseDownloading, 0, 0)
+		if err := d.Download(context.Background(), partial, tracker); err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
-		if err := f.Close(); err != nil {
+		tracker.Done()
+		if err := os.Rename(partial, backupDownloadOutFile); err != nil {
 			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
 	},
 }
 
+var backupVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verify every file of a recovery point against its manifest.",
+	Run: func(cmd *cobra.Command, args []string) {
+		httpc := http.Client{
+			Transport: &http.Transport{
+				DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+					return net.Dial("unix", strings.TrimPrefix(addr, "unix://"))
+				},
+			},
+		}
+		resp, err := httpc.Post("http://unix/recovery-points/"+recoveryPointID+"/verify", postContentType, nil)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			_, _ = io.Copy(os.Stderr, resp.Body)
+			fmt.Fprintln(os.Stderr)
+			os.Exit(1)
+		}
+		var reports []server.VerifyReport
+		if err := json.NewDecoder(resp.Body).Decode(&reports); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		failed := false
+		data := make([][]string, 0, len(reports))
+		for _, r := range reports {
+			data = append(data, []string{r.RecoveryPointID, strconv.Itoa(r.Files), strconv.Itoa(len(r.Mismatches))})
+			for _, m := range r.Mismatches {
+				failed = true
+				fmt.Fprintf(os.Stderr, "%s: %s: %s\n", r.RecoveryPointID, m.Path, m.Reason)
+			}
+		}
+		formatter.Output(verifyHeaders, data)
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
 // backupRunCmd represents the backup run command
 var backupRunCmd = &cobra.Command{
 	Use:   "run",
@@ -198,10 +268,14 @@ var backupRunCmd = &cobra.Command{
 			ID          string `json:"id"`
 			BackupName  string `json:"name"`
 			StorageType string `json:"storage_type"`
+			Wait        bool   `json:"wait"`
+			Local       bool   `json:"local"`
 		}
 		body.ID = backupID
 		body.BackupName = backupName
 		body.StorageType = "S3"
+		body.Wait = jobFollow || jobWait
+		body.Local = runLocal
 		buf, _ := json.Marshal(body)
 
 		resp, err := httpc.Post("http://unix/backups", postContentType, bytes.NewBuffer(buf))
@@ -210,10 +284,73 @@ var backupRunCmd = &cobra.Command{
 			os.Exit(1)
 		}
 		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			_, _ = io.Copy(os.Stderr, resp.Body)
+			fmt.Fprintln(os.Stderr)
+			os.Exit(1)
+		}
+		if body.Wait {
+			followJobEvents(resp.Body, os.Stderr, !jobFollow)
+			return
+		}
 		_, _ = io.Copy(os.Stderr, resp.Body)
 	},
 }
 
+var backupPruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Delete recovery points not kept by the retention policies of a directory.",
+	Run: func(cmd *cobra.Command, args []string) {
+		httpc := http.Client{
+			Transport: &http.Transport{
+				DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+					return net.Dial("unix", strings.TrimPrefix(addr, "unix://"))
+				},
+			},
+		}
+		buf, _ := json.Marshal(map[string]bool{"dry_run": pruneDryRun})
+		resp, err := httpc.Post("http://unix/backups/"+backupID+"/prune", postContentType, bytes.NewBuffer(buf))
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			_, _ = io.Copy(os.Stderr, resp.Body)
+			fmt.Fprintln(os.Stderr)
+			os.Exit(1)
+		}
+		var report server.PruneReport
+		if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		failed := false
+		data := make([][]string, 0, len(report.RecoveryPoints))
+		for _, rp := range report.RecoveryPoints {
+			action := "keep"
+			switch {
+			case rp.Keep:
+			case report.DryRun:
+				action = "remove"
+			case rp.Skipped:
+				action = "skipped"
+			case rp.Error != "":
+				action = "failed"
+				failed = true
+				fmt.Fprintf(os.Stderr, "%s: %s\n", rp.ID, rp.Error)
+			default:
+				action = "removed"
+			}
+			data = append(data, []string{rp.ID, rp.Name, rp.CreatedAt, rp.RecoveryPointType, action, strings.Join(rp.Reasons, "; ")})
+		}
+		formatter.Output(pruneHeaders, data)
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
 var backupSyncCmd = &cobra.Command{
 	Use:   "sync",
 	Short: "Sync backup config from server.",
@@ -246,21 +383,29 @@ func init() {
 
 	backupDownloadRecoveryPointCmd.PersistentFlags().StringVar(&recoveryPointID, "recovery-point-id", "", "The ID of recovery point")
 	backupDownloadRecoveryPointCmd.PersistentFlags().StringVar(&backupDownloadOutFile, "outfile", "", "Output backup download to file")
+	backupDownloadRecoveryPointCmd.PersistentFlags().StringVar(&progressFormat, "progress", "bar", "Progress output format: bar, json or none")
 	_ = backupDownloadRecoveryPointCmd.MarkPersistentFlagRequired("recovery-point-id")
 	backupCmd.AddCommand(backupListRecoveryPointCmd)
 	backupCmd.AddCommand(backupDownloadRecoveryPointCmd)
 
+	backupVerifyCmd.PersistentFlags().StringVar(&recoveryPointID, "recovery-point-id", "", "The ID of recovery point")
+	_ = backupVerifyCmd.MarkPersistentFlagRequired("recovery-point-id")
+	backupCmd.AddCommand(backupVerifyCmd)
+
 	backupRunCmd.PersistentFlags().StringVar(&backupID, "backup-id", "", "The ID of backup directory")
 	_ = backupRunCmd.MarkPersistentFlagRequired("backup-id")
 	backupRunCmd.PersistentFlags().StringVar(&backupName, "backup-name", "", "The Name of recovery point backup")
 	_ = backupRunCmd.MarkPersistentFlagRequired("backup-name")
+	backupRunCmd.PersistentFlags().BoolVar(&runLocal, "local", false, "Run the backup in the agent right away, without a round trip through the backup server")
+	backupRunCmd.PersistentFlags().BoolVar(&jobFollow, "follow", false, "Show the progress of the backup until it finishes, exit with an error if it fails")
+	backupRunCmd.PersistentFlags().BoolVar(&jobWait, "wait", false, "Wait for the backup to finish, exit with an error if it fails")
+	backupRunCmd.PersistentFlags().StringVar(&progressFormat, "progress", "bar", "Progress output format with --follow: bar, json or none")
 	backupCmd.AddCommand(backupRunCmd)
 
-	backupCmd.AddCommand(backupSyncCmd)
-}
+	backupPruneCmd.PersistentFlags().StringVar(&backupID, "backup-id", "", "The ID of backup directory")
+	_ = backupPruneCmd.MarkPersistentFlagRequired("backup-id")
+	backupPruneCmd.PersistentFlags().BoolVar(&pruneDryRun, "dry-run", false, "Show the recovery points which would be kept or removed, without removing them")
+	backupCmd.AddCommand(backupPruneCmd)
 
-func restoreSessionKey(key, machineID, createdAt, recoveryPointID string) string {
-	s := strings.Join([]string{key, machineID, createdAt, recoveryPointID}, "")
-	hash := sha256.Sum256([]byte(s))
-	return hex.EncodeToString(hash[:])
+	backupCmd.AddCommand(backupSyncCmd)
 }
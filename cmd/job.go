@@ -0,0 +1,303 @@
+// This file is part of bizfly-backup
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bizflycloud/bizflyctl/formatter"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/jobs"
+	"github.com/bizflycloud/bizfly-backup/pkg/progress"
+	"github.com/bizflycloud/bizfly-backup/pkg/server"
+)
+
+var (
+	listJobsHeaders = []string{"ID", "Kind", "BackupDirectoryID", "RecoveryPointID", "State", "StartedAt", "Duration", "Files", "Size"}
+	jobState        string
+	jobLimit        int
+	jobFollow       bool
+	jobWait         bool
+)
+
+// followJobEvents reads events of a job from body until it finishes, rendering its progress and state changes to
+// w unless quiet. It exits with a non-zero status unless the job succeeded.
+func followJobEvents(body io.Reader, w io.Writer, quiet bool) {
+	r := progress.Reporter(progress.ReporterFunc(func(progress.Snapshot) {}))
+	if !quiet {
+		var err error
+		if r, err = newProgressReporter(progressFormat, w); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	// drawing is true while a progress bar is drawn on the current line.
+	drawing := false
+	var job *jobs.Job
+	dec := json.NewDecoder(body)
+	for {
+		var e server.JobEvent
+		err := dec.Decode(&e)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		switch e.Type {
+		case server.JobEventProgress:
+			r.Report(*e.Progress)
+			drawing = progressFormat == "bar" && e.Progress.Phase != progress.PhaseDone
+		case server.JobEventState:
+			job = e.Job
+			if quiet {
+				continue
+			}
+			if drawing {
+				fmt.Fprintln(w)
+				drawing = false
+			}
+			fmt.Fprintf(w, "job %s %s\n", job.ID, job.State)
+		case server.JobEventError:
+			fmt.Fprintln(os.Stderr, e.Error)
+			os.Exit(1)
+		}
+	}
+	if job == nil || !job.Finished() {
+		fmt.Fprintln(os.Stderr, "job events ended before the job finished")
+		os.Exit(1)
+	}
+	if job.State != jobs.StateSucceeded {
+		fmt.Fprintf(os.Stderr, "job %s %s: %s\n", job.ID, job.State, job.Error)
+		os.Exit(1)
+	}
+}
+
+// jobCmd represents the jobs command
+var jobCmd = &cobra.Command{
+	Use:     "jobs",
+	Aliases: []string{"job"},
+	Short:   "Manage backup and restore jobs of the agent.",
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := cmd.Help(); err != nil {
+			logger.Error(err.Error())
+		}
+	},
+}
+
+// jobListCmd represents the jobs list command
+var jobListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List recent jobs, the last one first.",
+	Run: func(cmd *cobra.Command, args []string) {
+		httpc := http.Client{
+			Transport: &http.Transport{
+				DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+					return net.Dial("unix", strings.TrimPrefix(addr, "unix://"))
+				},
+			},
+		}
+		q := url.Values{}
+		q.Set("backup_directory_id", backupID)
+		q.Set("state", jobState)
+		q.Set("limit", strconv.Itoa(jobLimit))
+		resp, err := httpc.Get("http://unix/jobs?" + q.Encode())
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			_, _ = io.Copy(os.Stderr, resp.Body)
+			fmt.Fprintln(os.Stderr)
+			os.Exit(1)
+		}
+		var list []jobs.Job
+		if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		data := make([][]string, 0, len(list))
+		for i := len(list) - 1; i >= 0; i-- {
+			j := list[i]
+			started, duration := "", ""
+			if j.StartedAt != nil {
+				started = j.StartedAt.Local().Format(time.RFC3339)
+				end := time.Now()
+				if j.FinishedAt != nil {
+					end = *j.FinishedAt
+				}
+				duration = end.Sub(*j.StartedAt).Round(time.Second).String()
+			}
+			data = append(data, []string{j.ID, j.Kind, j.BackupDirectoryID, j.RecoveryPointID, string(j.State), started, duration,
+				strconv.Itoa(j.Files), humanize.Bytes(uint64(j.Bytes))})
+		}
+		formatter.Output(listJobsHeaders, data)
+	},
+}
+
+// jobShowCmd represents the jobs show command
+var jobShowCmd = &cobra.Command{
+	Use:   "show <job-id>",
+	Short: "Show details of a job.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		httpc := http.Client{
+			Transport: &http.Transport{
+				DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+					return net.Dial("unix", strings.TrimPrefix(addr, "unix://"))
+				},
+			},
+		}
+		resp, err := httpc.Get("http://unix/jobs/" + args[0])
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			_, _ = io.Copy(os.Stderr, resp.Body)
+			fmt.Fprintln(os.Stderr)
+			os.Exit(1)
+		}
+		var j jobs.Job
+		if err := json.NewDecoder(resp.Body).Decode(&j); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		formatTime := func(t *time.Time) string {
+			if t == nil {
+				return ""
+			}
+			return t.Local().Format(time.RFC3339)
+		}
+		data := [][]string{
+			{"ID", j.ID},
+			{"Kind", j.Kind},
+			{"Path", j.Path},
+			{"BackupDirectoryID", j.BackupDirectoryID},
+			{"PolicyID", j.PolicyID},
+			{"RecoveryPointID", j.RecoveryPointID},
+			{"State", string(j.State)},
+			{"CreatedAt", formatTime(&j.CreatedAt)},
+			{"StartedAt", formatTime(j.StartedAt)},
+			{"FinishedAt", formatTime(j.FinishedAt)},
+			{"Files", strconv.Itoa(j.Files)},
+			{"Size", humanize.Bytes(uint64(j.Bytes))},
+			{"Error", j.Error},
+		}
+		formatter.Output([]string{"Field", "Value"}, data)
+		for _, h := range j.Hooks {
+			status := "succeeded"
+			if h.Error != "" {
+				status = h.Error
+			}
+			fmt.Printf("\nHook %s (exit code %d, %s): %s\n%s", h.Name, h.ExitCode, time.Duration(h.Duration)*time.Millisecond, status, h.Output)
+		}
+		if j.State == jobs.StateFailed {
+			os.Exit(1)
+		}
+	},
+}
+
+// jobFollowCmd represents the jobs follow command
+var jobFollowCmd = &cobra.Command{
+	Use:   "follow <job-id>",
+	Short: "Follow the progress of a job until it finishes.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		httpc := http.Client{
+			Transport: &http.Transport{
+				DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+					return net.Dial("unix", strings.TrimPrefix(addr, "unix://"))
+				},
+			},
+		}
+		resp, err := httpc.Get("http://unix/jobs/" + args[0] + "/events")
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			_, _ = io.Copy(os.Stderr, resp.Body)
+			fmt.Fprintln(os.Stderr)
+			os.Exit(1)
+		}
+		followJobEvents(resp.Body, os.Stderr, false)
+	},
+}
+
+// jobCancelCmd represents the jobs cancel command
+var jobCancelCmd = &cobra.Command{
+	Use:   "cancel <job-id>",
+	Short: "Cancel a queued or running job.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		httpc := http.Client{
+			Transport: &http.Transport{
+				DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+					return net.Dial("unix", strings.TrimPrefix(addr, "unix://"))
+				},
+			},
+		}
+
+		req, err := http.NewRequest(http.MethodDelete, "http://unix/jobs/"+args[0], nil)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		resp, err := httpc.Do(req)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			_, _ = io.Copy(os.Stderr, resp.Body)
+			fmt.Fprintln(os.Stderr)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(jobCmd)
+
+	jobListCmd.PersistentFlags().StringVar(&backupID, "backup-id", "", "Only list jobs of the backup directory")
+	jobListCmd.PersistentFlags().StringVar(&jobState, "state", "", "Only list jobs in the state: queued, running, succeeded, failed or canceled")
+	jobListCmd.PersistentFlags().IntVar(&jobLimit, "limit", 20, "Number of jobs listed, 0 lists all of them")
+	jobCmd.AddCommand(jobListCmd)
+	jobCmd.AddCommand(jobShowCmd)
+	jobFollowCmd.PersistentFlags().StringVar(&progressFormat, "progress", "bar", "Progress output format: bar, json or none")
+	jobCmd.AddCommand(jobFollowCmd)
+	jobCmd.AddCommand(jobCancelCmd)
+}
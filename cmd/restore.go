@@ -21,6 +21,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net"
 	"net/http"
@@ -28,11 +29,17 @@ import (
 	"strings"
 
 	"github.com/spf13/cobra"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/restore"
 )
 
 const postContentType = "application/octet-stream"
 
-var restoreDir string
+var (
+	restoreDir     string
+	restoreMode    string
+	restoreInclude []string
+)
 
 // restoreCmd represents the restore command
 var restoreCmd = &cobra.Command{
@@ -50,9 +57,17 @@ var restoreCmd = &cobra.Command{
 			restoreDir = recoveryPointID
 		}
 		var body struct {
-			Path string `json:"path"`
+			Path           string   `json:"path"`
+			RestoreMode    string   `json:"restore_mode"`
+			RestoreInclude []string `json:"restore_include,omitempty"`
+			Wait           bool     `json:"wait"`
+			Local          bool     `json:"local"`
 		}
 		body.Path = restoreDir
+		body.RestoreMode = restoreMode
+		body.RestoreInclude = restoreInclude
+		body.Wait = jobFollow || jobWait
+		body.Local = runLocal
 		buf, _ := json.Marshal(body)
 
 		resp, err := httpc.Post("http://unix/recovery-points/"+recoveryPointID+"/restore", postContentType, bytes.NewBuffer(buf))
@@ -61,13 +76,30 @@ var restoreCmd = &cobra.Command{
 			os.Exit(1)
 		}
 		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			_, _ = io.Copy(os.Stderr, resp.Body)
+			fmt.Fprintln(os.Stderr)
+			os.Exit(1)
+		}
+		if body.Wait {
+			followJobEvents(resp.Body, os.Stderr, !jobFollow)
+			return
+		}
 		_, _ = io.Copy(os.Stderr, resp.Body)
 	},
 }
 
 func init() {
 	restoreCmd.PersistentFlags().StringVar(&restoreDir, "dest-directory", "", "The destination directory to restore")
+	restoreCmd.PersistentFlags().StringVar(&restoreMode, "mode", string(restore.DefaultMode),
+		"How to handle files existing in the destination directory: overwrite, skip-existing, keep-newer or rename-conflicts")
+	restoreCmd.PersistentFlags().StringArrayVar(&restoreInclude, "include", nil,
+		"Restore only files matching the pattern, like 'etc/nginx/**', can be repeated")
 	restoreCmd.PersistentFlags().StringVar(&recoveryPointID, "recovery-point-id", "", "The ID of recovery point")
 	_ = restoreCmd.MarkPersistentFlagRequired("recovery-point-id")
+	restoreCmd.PersistentFlags().BoolVar(&runLocal, "local", false, "Run the restore in the agent right away, without a round trip through the backup server")
+	restoreCmd.PersistentFlags().BoolVar(&jobFollow, "follow", false, "Show the progress of the restore until it finishes, exit with an error if it fails")
+	restoreCmd.PersistentFlags().BoolVar(&jobWait, "wait", false, "Wait for the restore to finish, exit with an error if it fails")
+	restoreCmd.PersistentFlags().StringVar(&progressFormat, "progress", "bar", "Progress output format with --follow: bar, json or none")
 	rootCmd.AddCommand(restoreCmd)
 }
@@ -12,6 +12,7 @@ require (
 	github.com/hashicorp/go-retryablehttp v0.6.7
 	github.com/inconshreveable/go-update v0.0.0-20160112193335-8152e7eb6ccf
 	github.com/jpillora/backoff v1.0.0
+	github.com/klauspost/compress v1.11.4
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/ory/dockertest/v3 v3.6.0
 	github.com/robfig/cron/v3 v3.0.1
@@ -19,6 +20,8 @@ require (
 	github.com/spf13/viper v1.7.0
 	github.com/stretchr/testify v1.4.0
 	go.uber.org/zap v1.15.0
+	golang.org/x/crypto v0.0.0-20190605123033-f99c8df09eb5
 	golang.org/x/mod v0.1.0
+	golang.org/x/sys v0.0.0-20200121082415-34d275377bf9
 	gopkg.in/yaml.v2 v2.2.7
 )
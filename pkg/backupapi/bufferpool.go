@@ -0,0 +1,73 @@
+package backupapi
+
+import (
+	"fmt"
+	"sync"
+)
+
+// bufferPool hands out part buffers, keeping the total size of the buffers it allocated, in use or free, under a
+// limit. Buffers are reused once their part is uploaded, callers wait when the limit is reached.
+type bufferPool struct {
+	limit int
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	allocated int
+	free      [][]byte
+}
+
+func newBufferPool(limit int) *bufferPool {
+	p := &bufferPool{limit: limit}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// get returns a buffer of length size, waiting until enough memory is released if necessary.
+func (p *bufferPool) get(size int) ([]byte, error) {
+	if size > p.limit {
+		return nil, fmt.Errorf("part size %d exceeds upload memory limit %d", size, p.limit)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		for i, b := range p.free {
+			if cap(b) >= size {
+				p.free = append(p.free[:i], p.free[i+1:]...)
+				return b[:size], nil
+			}
+		}
+		// Free buffers are too small once part size has grown, drop them to make room.
+		for len(p.free) > 0 && p.allocated+size > p.limit {
+			p.allocated -= cap(p.free[0])
+			p.free = p.free[1:]
+		}
+		if p.allocated+size <= p.limit {
+			p.allocated += size
+			return make([]byte, size), nil
+		}
+		p.cond.Wait()
+	}
+}
+
+// adopt accounts for b, allocated elsewhere, as a buffer of the pool in use.
+func (p *bufferPool) adopt(b []byte) {
+	p.mu.Lock()
+	p.allocated += cap(b)
+	p.mu.Unlock()
+}
+
+// put returns b to the pool, it must not be used anymore.
+func (p *bufferPool) put(b []byte) {
+	p.mu.Lock()
+	p.free = append(p.free, b)
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
+
+// discard releases the memory of b without reusing it, for buffers which may still be read by a failed request.
+func (p *bufferPool) discard(b []byte) {
+	p.mu.Lock()
+	p.allocated -= cap(b)
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
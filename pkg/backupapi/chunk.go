@@ -0,0 +1,74 @@
+package backupapi
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+func (c *Client) chunkPath(id string) string {
+	return fmt.Sprintf("/agent/chunks/%s", id)
+}
+
+// HasChunk reports whether the chunk with given id is already stored on server.
+func (c *Client) HasChunk(ctx context.Context, id string) (bool, error) {
+	req, err := c.NewRequest(http.MethodHead, c.chunkPath(id), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err := checkResponse(resp); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// PutChunk uploads a chunk with given id to server.
+func (c *Client) PutChunk(ctx context.Context, id string, data []byte) error {
+	reqURL, err := c.urlStringFromRelPath(c.chunkPath(id))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, reqURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(c.newRetryClient().StandardClient(), req.WithContext(ctx), "application/octet-stream")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	return err
+}
+
+// GetChunk downloads the chunk with given id from server.
+func (c *Client) GetChunk(ctx context.Context, id string) ([]byte, error) {
+	req, err := c.NewRequest(http.MethodGet, c.chunkPath(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,92 @@
+package backupapi
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/ratelimit"
+)
+
+func TestClient_Chunks(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	var mu sync.Mutex
+	chunks := map[string][]byte{}
+	mux.HandleFunc("/api/v1/agent/chunks/", func(w http.ResponseWriter, r *http.Request) {
+		id := path.Base(r.URL.Path)
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodHead, http.MethodGet:
+			data, ok := chunks[id]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if r.Method == http.MethodGet {
+				_, _ = w.Write(data)
+			}
+		case http.MethodPut:
+			assert.Equal(t, "application/octet-stream", r.Header.Get("Content-Type"))
+			data, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			chunks[id] = data
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+
+	ctx := context.Background()
+	ok, err := client.HasChunk(ctx, "abc")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, client.PutChunk(ctx, "abc", []byte("foo")))
+
+	ok, err = client.HasChunk(ctx, "abc")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	data, err := client.GetChunk(ctx, "abc")
+	require.NoError(t, err)
+	assert.Equal(t, "foo", string(data))
+
+	_, err = client.GetChunk(ctx, "def")
+	assert.Error(t, err)
+}
+
+func TestClient_RateLimiter(t *testing.T) {
+	setUp()
+	defer tearDown()
+	mux.HandleFunc("/api/v1/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+	})
+
+	l, err := ratelimit.NewFromConfig(ratelimit.Config{Rate: "200KB"})
+	require.NoError(t, err)
+	c, err := NewClient(WithServerURL(client.ServerURL.String()), WithRateLimiter(l))
+	require.NoError(t, err)
+
+	// The limit applies to concurrent requests together.
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, c.PutChunk(context.Background(), "id", make([]byte, 100*1024)))
+		}()
+	}
+	wg.Wait()
+	// The first 200KB are the initial burst.
+	assert.True(t, time.Since(start) >= 400*time.Millisecond, time.Since(start))
+}
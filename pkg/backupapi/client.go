@@ -2,15 +2,21 @@ package backupapi
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
+
+	"github.com/hashicorp/go-retryablehttp"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/ratelimit"
 )
 
 const (
@@ -26,6 +32,12 @@ type Client struct {
 	Id        string
 	accessKey string
 	secretKey string
+	// limiter throttles transfers of every request, nil means unlimited.
+	limiter *ratelimit.Limiter
+	// uploadPartSize, uploadConcurrency and uploadMemoryLimit configure multipart uploads.
+	uploadPartSize    int
+	uploadConcurrency int
+	uploadMemoryLimit int
 
 	userAgent string
 }
@@ -46,8 +58,11 @@ func NewClient(opts ...ClientOption) (*Client, error) {
 			},
 			Timeout: 10 * time.Second,
 		},
-		ServerURL: serverUrl,
-		userAgent: userAgent,
+		ServerURL:         serverUrl,
+		userAgent:         userAgent,
+		uploadPartSize:    MultipartUploadLowerBound,
+		uploadConcurrency: DefaultUploadConcurrency,
+		uploadMemoryLimit: DefaultUploadMemoryLimit,
 	}
 
 	for _, opt := range opts {
@@ -55,6 +70,14 @@ func NewClient(opts ...ClientOption) (*Client, error) {
 			return nil, err
 		}
 	}
+	// Besides the part being uploaded, a part must fit in memory while it is read.
+	if c.uploadMemoryLimit < 2*c.uploadPartSize {
+		return nil, fmt.Errorf("upload memory limit %d must be at least twice the part size %d", c.uploadMemoryLimit, c.uploadPartSize)
+	}
+	// Requests are throttled by c.limiter, and by the limiter of their context if any.
+	hc := *c.client
+	hc.Transport = ratelimit.NewTransport(hc.Transport, c.limiter)
+	c.client = &hc
 
 	return c, nil
 }
@@ -109,6 +132,46 @@ func WithSecretKey(secretKey string) ClientOption {
 	}
 }
 
+// WithRateLimiter sets the Limiter throttling every transfer of Client, shared by concurrent requests.
+func WithRateLimiter(l *ratelimit.Limiter) ClientOption {
+	return func(c *Client) error {
+		c.limiter = l
+		return nil
+	}
+}
+
+// WithUploadPartSize sets the initial part size of multipart uploads, which grows for large uploads to stay under
+// MaxUploadParts parts.
+func WithUploadPartSize(size int) ClientOption {
+	return func(c *Client) error {
+		if size < MinUploadPartSize || size > MaxUploadPartSize {
+			return fmt.Errorf("upload part size must be between %d and %d", MinUploadPartSize, MaxUploadPartSize)
+		}
+		c.uploadPartSize = size
+		return nil
+	}
+}
+
+// WithUploadConcurrency sets the number of parts of a multipart upload uploaded in parallel.
+func WithUploadConcurrency(n int) ClientOption {
+	return func(c *Client) error {
+		if n < 1 {
+			return errors.New("upload concurrency must be positive")
+		}
+		c.uploadConcurrency = n
+		return nil
+	}
+}
+
+// WithUploadMemoryLimit sets the limit of memory used by part buffers of a multipart upload. Fewer parts are
+// uploaded in parallel when it is reached.
+func WithUploadMemoryLimit(limit int) ClientOption {
+	return func(c *Client) error {
+		c.uploadMemoryLimit = limit
+		return nil
+	}
+}
+
 // NewRequest create new http request
 func (c *Client) NewRequest(method, relPath string, body interface{}) (*http.Request, error) {
 	buf := new(bytes.Buffer)
@@ -135,13 +198,34 @@ func (c *Client) Do(req *http.Request) (*http.Response, error) {
 	return c.do(c.client, req, "application/json")
 }
 
+// transferDo sends requests transferring recovery point content. Unlike Do, it does not time out once response
+// headers are received, since throttled transfers of large content can take long.
+func (c *Client) transferDo(req *http.Request) (*http.Response, error) {
+	hc := *c.client
+	hc.Timeout = 0
+	return c.do(&hc, req, "application/json")
+}
+
+// newRetryClient returns a client retrying failed requests, throttled like c.
+func (c *Client) newRetryClient() *retryablehttp.Client {
+	rc := retryablehttp.NewClient()
+	rc.RetryMax = 50 // TODO: configurable?
+	rc.HTTPClient.Transport = ratelimit.NewTransport(rc.HTTPClient.Transport, c.limiter)
+	return rc
+}
+
 func (c *Client) do(httpClient *http.Client, req *http.Request, contentType string) (*http.Response, error) {
+	c.setHeaders(req, contentType)
+	return httpClient.Do(req)
+}
+
+// setHeaders sets the headers authenticating req.
+func (c *Client) setHeaders(req *http.Request, contentType string) {
 	req.Header.Add("User-Agent", c.userAgent)
 	now := time.Now().UTC().Format(http.TimeFormat)
 	req.Header.Add("Date", now)
 	req.Header.Add("Authorization", c.authorizationHeaderValue(req.Method, now))
 	req.Header.Add("Content-Type", contentType)
-	return httpClient.Do(req)
 }
 
 func (c *Client) authorizationHeaderValue(method, now string) string {
@@ -150,6 +234,17 @@ func (c *Client) authorizationHeaderValue(method, now string) string {
 	return "VBS " + strings.Join([]string{c.accessKey, hex.EncodeToString(hash[:])}, ":")
 }
 
+// ManifestKey returns the key signing manifests of recovery points, derived from the secret key. It is nil
+// when the client has no secret key.
+func (c *Client) ManifestKey() []byte {
+	if c.secretKey == "" {
+		return nil
+	}
+	mac := hmac.New(sha256.New, []byte(c.secretKey))
+	_, _ = mac.Write([]byte("bizfly-backup manifest"))
+	return mac.Sum(nil)
+}
+
 type Version struct {
 	Ver     string            `json:"lastest_version"`
 	Linux   map[string]string `json:"linux"`
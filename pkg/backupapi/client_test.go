@@ -11,6 +11,8 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/ratelimit"
 )
 
 var (
@@ -40,12 +42,22 @@ func TestClientOptions(t *testing.T) {
 		wantErr    bool
 		assertFunc func(c *Client) bool
 	}{
-		{"valid http client", WithHTTPClient(http.DefaultClient), false, func(c *Client) bool { return c.client == http.DefaultClient }},
+		{"valid http client", WithHTTPClient(http.DefaultClient), false, func(c *Client) bool {
+			// Requests are sent by the transport of the client, throttled by limiters of their context.
+			tr, ok := c.client.Transport.(*ratelimit.Transport)
+			return ok && tr.Base == http.DefaultClient.Transport
+		}},
 		{"nil http client", WithHTTPClient(nil), true, nil},
 		{"valid server url", WithServerURL("https://foo.bar/api/v1"), false, func(c *Client) bool { return c.ServerURL.Host == "foo.bar" && c.ServerURL.Path == "/api/v1" }},
 		{"invalid server url", WithServerURL("https://:foo.bar/api/v1"), true, nil},
 		{"access key", WithAccessKey("access_key"), false, func(c *Client) bool { return c.accessKey == "access_key" }},
 		{"secret key", WithSecretKey("secret_key"), false, func(c *Client) bool { return c.secretKey == "secret_key" }},
+		{"upload part size", WithUploadPartSize(32 << 20), false, func(c *Client) bool { return c.uploadPartSize == 32<<20 }},
+		{"small upload part size", WithUploadPartSize(1 << 20), true, nil},
+		{"upload concurrency", WithUploadConcurrency(2), false, func(c *Client) bool { return c.uploadConcurrency == 2 }},
+		{"invalid upload concurrency", WithUploadConcurrency(0), true, nil},
+		{"upload memory limit", WithUploadMemoryLimit(64 << 20), false, func(c *Client) bool { return c.uploadMemoryLimit == 64<<20 }},
+		{"small upload memory limit", WithUploadMemoryLimit(16 << 20), true, nil},
 	}
 
 	for _, tc := range tests {
@@ -65,6 +77,21 @@ func TestClientOptions(t *testing.T) {
 	}
 }
 
+func TestClient_ManifestKey(t *testing.T) {
+	c, err := NewClient()
+	require.NoError(t, err)
+	assert.Nil(t, c.ManifestKey())
+
+	c1, err := NewClient(WithSecretKey("secret1"))
+	require.NoError(t, err)
+	c2, err := NewClient(WithSecretKey("secret2"))
+	require.NoError(t, err)
+	assert.Len(t, c1.ManifestKey(), 32)
+	assert.Equal(t, c1.ManifestKey(), c1.ManifestKey())
+	assert.NotEqual(t, c1.ManifestKey(), c2.ManifestKey())
+	assert.NotContains(t, string(c1.ManifestKey()), "secret1")
+}
+
 func TestDo(t *testing.T) {
 	setUp()
 	defer tearDown()
@@ -2,9 +2,29 @@ package backupapi
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/filter"
+	"github.com/bizflycloud/bizfly-backup/pkg/hooks"
+	"github.com/bizflycloud/bizfly-backup/pkg/ratelimit"
+	"github.com/bizflycloud/bizfly-backup/pkg/retention"
+	"github.com/bizflycloud/bizfly-backup/pkg/source"
+)
+
+const (
+	// ArchiveFormatZip stores each recovery point as a single zip archive. This is the default.
+	ArchiveFormatZip = "zip"
+	// ArchiveFormatChunked stores file content as deduplicated chunks, and each recovery point as an index of them.
+	ArchiveFormatChunked = "chunked"
+	// ArchiveFormatTar stores each recovery point as a compressed tar archive, preserving ownership, permissions,
+	// timestamps, hard links, extended attributes and ACLs.
+	ArchiveFormatTar = "tar"
 )
 
 // BackupDirectoryConfig is the cron policies for given directory.
@@ -14,6 +34,84 @@ type BackupDirectoryConfig struct {
 	Path      string                        `json:"path" yaml:"path"`
 	Policies  []BackupDirectoryConfigPolicy `json:"policies" yaml:"policies"`
 	Activated bool                          `json:"activated" yaml:"activated"`
+	// ArchiveFormat is one of ArchiveFormat* constants, empty means ArchiveFormatZip.
+	ArchiveFormat string `json:"archive_format,omitempty" yaml:"archive_format,omitempty"`
+	// Compression is the name of the compression codec of zip and tar archives, one of compression package
+	// codecs. Empty means deflate for zip archives and gzip for tar archives.
+	Compression string `json:"compression,omitempty" yaml:"compression,omitempty"`
+	// CompressionLevel is the codec specific compression level, zero means the default level of the codec.
+	CompressionLevel int `json:"compression_level,omitempty" yaml:"compression_level,omitempty"`
+	// Filter selects the files of the directory to back up.
+	Filter BackupDirectoryFilter `json:"filter,omitempty" yaml:"filter,omitempty"`
+	// Hooks are commands run before and after backups of the directory, and restores into it.
+	Hooks hooks.Config `json:"hooks,omitempty" yaml:"hooks,omitempty"`
+	// Source is what is backed up, the whole directory at Path if its type is empty.
+	Source source.Config `json:"source,omitempty" yaml:"source,omitempty"`
+}
+
+// BackupDirectoryFilter selects the files of a backup directory, see filter package for the pattern syntax.
+// Patterns of .bizflyignore files inside the directory are applied on top of Exclude.
+type BackupDirectoryFilter struct {
+	// Include restricts backed up files to those matching one of the patterns, empty means all files.
+	Include []string `json:"include,omitempty" yaml:"include,omitempty" mapstructure:"include"`
+	Exclude []string `json:"exclude,omitempty" yaml:"exclude,omitempty" mapstructure:"exclude"`
+	// MaxFileSize excludes files larger than it in bytes, zero means no limit.
+	MaxFileSize int64 `json:"max_file_size,omitempty" yaml:"max_file_size,omitempty" mapstructure:"max_file_size"`
+	// ExcludeOlderThan excludes files not modified for this duration, like "720h". Empty means no limit.
+	ExcludeOlderThan string `json:"exclude_older_than,omitempty" yaml:"exclude_older_than,omitempty" mapstructure:"exclude_older_than"`
+}
+
+// Override returns f with the fields set in o replacing its own.
+func (f BackupDirectoryFilter) Override(o BackupDirectoryFilter) BackupDirectoryFilter {
+	if o.Include != nil {
+		f.Include = o.Include
+	}
+	if o.Exclude != nil {
+		f.Exclude = o.Exclude
+	}
+	if o.MaxFileSize != 0 {
+		f.MaxFileSize = o.MaxFileSize
+	}
+	if o.ExcludeOlderThan != "" {
+		f.ExcludeOlderThan = o.ExcludeOlderThan
+	}
+	return f
+}
+
+// Rules returns the filter rules of f, relative to now.
+func (f BackupDirectoryFilter) Rules(now time.Time) (filter.Rules, error) {
+	rules := filter.Rules{
+		Include:     f.Include,
+		Exclude:     f.Exclude,
+		MaxFileSize: f.MaxFileSize,
+		IgnoreFile:  filter.DefaultIgnoreFile,
+	}
+	if f.ExcludeOlderThan != "" {
+		d, err := time.ParseDuration(f.ExcludeOlderThan)
+		if err != nil {
+			return filter.Rules{}, fmt.Errorf("invalid exclude_older_than: %w", err)
+		}
+		rules.ModifiedBefore = now.Add(-d)
+	}
+	return rules, nil
+}
+
+// String returns a short description of f.
+func (f BackupDirectoryFilter) String() string {
+	var parts []string
+	if len(f.Include) > 0 {
+		parts = append(parts, "include "+strings.Join(f.Include, ","))
+	}
+	if len(f.Exclude) > 0 {
+		parts = append(parts, "exclude "+strings.Join(f.Exclude, ","))
+	}
+	if f.MaxFileSize > 0 {
+		parts = append(parts, "max size "+strconv.FormatInt(f.MaxFileSize, 10))
+	}
+	if f.ExcludeOlderThan != "" {
+		parts = append(parts, "older than "+f.ExcludeOlderThan)
+	}
+	return strings.Join(parts, "; ")
 }
 
 // BackupDirectoryConfigPolicy is the cron policy.
@@ -21,12 +119,88 @@ type BackupDirectoryConfigPolicy struct {
 	ID              string `json:"id" yaml:"id"`
 	Name            string `json:"name" yaml:"name"`
 	SchedulePattern string `json:"schedule_pattern" yaml:"schedule_pattern"`
+	// BandwidthLimit throttles uploads of backups and downloads of restores of the policy, on top of the agent limit.
+	// It applies to the aggregate throughput of the jobs of the policy.
+	BandwidthLimit ratelimit.Config `json:"bandwidth_limit,omitempty" yaml:"bandwidth_limit,omitempty"`
+	// MaxDuration is the maximum duration of backups run by the policy, like "6h", they are canceled when exceeded.
+	// Empty means no limit.
+	MaxDuration string `json:"max_duration,omitempty" yaml:"max_duration,omitempty"`
+	// Retention* are the number of hourly, daily, weekly and monthly recovery points of the policy kept by pruning.
+	// The agent config is the only way agent gets policies, so the backup server must send the retention fields of
+	// its Policy here, under the same names. All zero, like from servers which do not send them yet, means no
+	// pruning: every recovery point of the policy is kept.
+	RetentionHours  int `json:"retention_hours,omitempty" yaml:"retention_hours,omitempty"`
+	RetentionDays   int `json:"retention_days,omitempty" yaml:"retention_days,omitempty"`
+	RetentionWeeks  int `json:"retention_weeks,omitempty" yaml:"retention_weeks,omitempty"`
+	RetentionMonths int `json:"retention_months,omitempty" yaml:"retention_months,omitempty"`
+}
+
+// Retention returns the retention policy of p.
+func (p BackupDirectoryConfigPolicy) Retention() retention.Policy {
+	return retention.Policy{Hours: p.RetentionHours, Days: p.RetentionDays, Weeks: p.RetentionWeeks, Months: p.RetentionMonths}
+}
+
+// Policy returns the policy of bd with given id.
+func (bd BackupDirectoryConfig) Policy(id string) (BackupDirectoryConfigPolicy, bool) {
+	for _, p := range bd.Policies {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return BackupDirectoryConfigPolicy{}, false
 }
 
 type Config struct {
 	BackupDirectories []BackupDirectoryConfig `json:"backup_directories" yaml:"backup_directories"`
 }
 
+// OverrideFilters replaces filter fields of backup directories with those set in filters, keyed by backup directory ID.
+func (cfg *Config) OverrideFilters(filters map[string]BackupDirectoryFilter) {
+	for i, bd := range cfg.BackupDirectories {
+		if f, ok := filters[bd.ID]; ok {
+			cfg.BackupDirectories[i].Filter = bd.Filter.Override(f)
+		}
+	}
+}
+
+// OverrideHooks replaces hooks of backup directories with those set in hooks, keyed by backup directory ID.
+func (cfg *Config) OverrideHooks(configs map[string]hooks.Config) {
+	for i, bd := range cfg.BackupDirectories {
+		if h, ok := configs[bd.ID]; ok {
+			cfg.BackupDirectories[i].Hooks = bd.Hooks.Override(h)
+		}
+	}
+}
+
+// OverrideSources replaces sources of backup directories with those set in sources, keyed by backup directory ID.
+func (cfg *Config) OverrideSources(sources map[string]source.Config) {
+	for i, bd := range cfg.BackupDirectories {
+		if src, ok := sources[bd.ID]; ok {
+			cfg.BackupDirectories[i].Source = src
+		}
+	}
+}
+
+// BackupDirectory returns the config of backup directory with given id.
+func (cfg *Config) BackupDirectory(id string) (BackupDirectoryConfig, bool) {
+	for _, bd := range cfg.BackupDirectories {
+		if bd.ID == id {
+			return bd, true
+		}
+	}
+	return BackupDirectoryConfig{}, false
+}
+
+// Policy returns the policy with given id, of any backup directory.
+func (cfg *Config) Policy(id string) (BackupDirectoryConfigPolicy, bool) {
+	for _, bd := range cfg.BackupDirectories {
+		if p, ok := bd.Policy(id); ok {
+			return p, true
+		}
+	}
+	return BackupDirectoryConfigPolicy{}, false
+}
+
 func (c *Client) configPath() string {
 	return "/agent/config"
 }
@@ -4,9 +4,15 @@ import (
 	"context"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/hooks"
+	"github.com/bizflycloud/bizfly-backup/pkg/ratelimit"
+	"github.com/bizflycloud/bizfly-backup/pkg/retention"
+	"github.com/bizflycloud/bizfly-backup/pkg/source"
 )
 
 const configContent = `
@@ -14,7 +20,25 @@ backup_directories:
 - activated: true
   id: 6dd19ea8-a690-4fa0-8935-2b04f3c663ef
   name: backup images
+  archive_format: tar
+  compression: zstd
+  compression_level: 19
+  filter:
+    exclude:
+    - '*.tmp'
+    - cache/
+    max_file_size: 1048576
+  hooks:
+    pre_backup:
+      command: pg_dump -f /var/backups/db.sql app
+      timeout: 30m
+      abort_on_failure: true
   path: home/ducpx/images
+  source:
+    type: files
+    files:
+    - cover.jpg
+    - raw/
   policies:
   - id: a48cfe94-a4f6-4689-9a6d-e94654cda08a
     name: null
@@ -22,11 +46,21 @@ backup_directories:
 - activated: false
   id: dbf88cc0-947d-493f-8cb4-44dfefaa0628
   name: backup video
+  archive_format: chunked
   path: home/ducpx/video
   policies:
   - id: c9312fff-457b-4e4b-8703-139c270a53ce
     name: backup daily
     schedule_pattern: '***'
+    bandwidth_limit:
+      rate: 10MB
+      schedule:
+      - from: "08:00"
+        to: "18:00"
+        rate: 2MB
+    max_duration: 6h
+    retention_days: 7
+    retention_weeks: 4
 `
 
 func TestClient_GetConfig(t *testing.T) {
@@ -48,4 +82,66 @@ func TestClient_GetConfig(t *testing.T) {
 		assert.NotEmpty(t, bd.Path)
 		assert.Len(t, bd.Policies, 1)
 	}
+
+	bd, ok := cfg.BackupDirectory("dbf88cc0-947d-493f-8cb4-44dfefaa0628")
+	require.True(t, ok)
+	assert.Equal(t, ArchiveFormatChunked, bd.ArchiveFormat)
+	policy, ok := bd.Policy("c9312fff-457b-4e4b-8703-139c270a53ce")
+	require.True(t, ok)
+	assert.Equal(t, ratelimit.Config{
+		Rate:     "10MB",
+		Schedule: []ratelimit.Window{{From: "08:00", To: "18:00", Rate: "2MB"}},
+	}, policy.BandwidthLimit)
+	assert.Equal(t, "6h", policy.MaxDuration)
+	assert.Equal(t, retention.Policy{Days: 7, Weeks: 4}, policy.Retention())
+	bd, ok = cfg.BackupDirectory("6dd19ea8-a690-4fa0-8935-2b04f3c663ef")
+	require.True(t, ok)
+	assert.Equal(t, ArchiveFormatTar, bd.ArchiveFormat)
+	assert.Equal(t, "zstd", bd.Compression)
+	assert.Equal(t, 19, bd.CompressionLevel)
+	assert.Equal(t, BackupDirectoryFilter{Exclude: []string{"*.tmp", "cache/"}, MaxFileSize: 1048576}, bd.Filter)
+	assert.Equal(t, hooks.Config{PreBackup: &hooks.Hook{Command: "pg_dump -f /var/backups/db.sql app", Timeout: "30m", AbortOnFailure: true}}, bd.Hooks)
+	assert.Equal(t, source.Config{Type: source.TypeFiles, Files: []string{"cover.jpg", "raw/"}}, bd.Source)
+	_, ok = cfg.BackupDirectory("not-found")
+	assert.False(t, ok)
+}
+
+func TestConfig_OverrideFilters(t *testing.T) {
+	cfg := &Config{BackupDirectories: []BackupDirectoryConfig{
+		{ID: "a", Filter: BackupDirectoryFilter{Exclude: []string{"*.tmp"}, MaxFileSize: 10}},
+		{ID: "b", Filter: BackupDirectoryFilter{Include: []string{"src/"}}},
+	}}
+	cfg.OverrideFilters(map[string]BackupDirectoryFilter{
+		"a": {Exclude: []string{"*.log"}, ExcludeOlderThan: "720h"},
+	})
+	assert.Equal(t, BackupDirectoryFilter{Exclude: []string{"*.log"}, MaxFileSize: 10, ExcludeOlderThan: "720h"}, cfg.BackupDirectories[0].Filter)
+	assert.Equal(t, BackupDirectoryFilter{Include: []string{"src/"}}, cfg.BackupDirectories[1].Filter)
+	assert.Equal(t, "exclude *.log; max size 10; older than 720h", cfg.BackupDirectories[0].Filter.String())
+
+	now := time.Now()
+	rules, err := cfg.BackupDirectories[0].Filter.Rules(now)
+	require.NoError(t, err)
+	assert.Equal(t, now.Add(-720*time.Hour), rules.ModifiedBefore)
+	assert.Equal(t, ".bizflyignore", rules.IgnoreFile)
+	_, err = BackupDirectoryFilter{ExcludeOlderThan: "a month"}.Rules(now)
+	assert.Error(t, err)
+}
+
+func TestConfig_OverrideHooks(t *testing.T) {
+	pre, post := &hooks.Hook{Command: "pre"}, &hooks.Hook{Command: "post"}
+	cfg := &Config{BackupDirectories: []BackupDirectoryConfig{
+		{ID: "a", Hooks: hooks.Config{PreBackup: pre}},
+		{ID: "b", Hooks: hooks.Config{PreBackup: pre}},
+	}}
+	cfg.OverrideHooks(map[string]hooks.Config{"a": {PostBackup: post}})
+	assert.Equal(t, hooks.Config{PreBackup: pre, PostBackup: post}, cfg.BackupDirectories[0].Hooks)
+	assert.Equal(t, hooks.Config{PreBackup: pre}, cfg.BackupDirectories[1].Hooks)
+}
+
+func TestConfig_OverrideSources(t *testing.T) {
+	cfg := &Config{BackupDirectories: []BackupDirectoryConfig{{ID: "a"}, {ID: "b"}}}
+	src := source.Config{Type: source.TypeCommand, Command: "pg_dump app"}
+	cfg.OverrideSources(map[string]source.Config{"a": src})
+	assert.Equal(t, src, cfg.BackupDirectories[0].Source)
+	assert.Equal(t, source.Config{}, cfg.BackupDirectories[1].Source)
 }
@@ -0,0 +1,624 @@
+package backupapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDownloadPartSize is the size of ranges fetched in parallel by Downloader.
+	DefaultDownloadPartSize = 16 * 1024 * 1024
+
+	defaultDownloadRetries = 5
+	// downloadStateSuffix is appended to the downloaded file name to name the state of a parallel download.
+	downloadStateSuffix = ".parts"
+	// minReadAhead and maxReadAhead bound the size fetched by RangeReader, so small sequential reads do not each
+	// send a request. The size doubles while reads are sequential.
+	minReadAhead = 64 * 1024
+	maxReadAhead = 8 * 1024 * 1024
+)
+
+var (
+	// ErrRangeNotSupported indicates that server does not support range requests.
+	ErrRangeNotSupported = errors.New("server does not support range requests")
+	// errRangeMismatch indicates that server answered a range request with another range.
+	errRangeMismatch = errors.New("server returned unexpected content range")
+)
+
+// Downloader downloads content to a local file with HTTP range requests. Content already in the file is kept,
+// so an interrupted download is resumed by downloading to the same file again.
+type Downloader struct {
+	// NewRequest returns a GET request for the content, Downloader sets its Range header.
+	NewRequest func(ctx context.Context) (*http.Request, error)
+	// Do sends requests, http.DefaultClient is used if nil.
+	Do func(req *http.Request) (*http.Response, error)
+	// Concurrency is the number of ranges fetched in parallel, content is fetched sequentially if it is less than 2.
+	Concurrency int
+	// PartSize is the size of ranges fetched in parallel, DefaultDownloadPartSize if zero.
+	PartSize int64
+	// Retries is the number of consecutive failed requests before giving up.
+	Retries int
+
+	// retryWait is the base delay between retries, one second if zero.
+	retryWait time.Duration
+	// afterStateSaved is called between saving the state of a parallel download and resizing the file, tests use
+	// it to interrupt the download there.
+	afterStateSaved func() error
+}
+
+// downloadState is the state of a parallel download, persisted next to the downloaded file.
+type downloadState struct {
+	Size     int64        `json:"size"`
+	PartSize int64        `json:"part_size"`
+	Done     map[int]bool `json:"done"`
+}
+
+// Download downloads the content to file at name, progress is reported to pw.
+func (d *Downloader) Download(ctx context.Context, name string, pw io.Writer) error {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	state, err := loadDownloadState(name + downloadStateSuffix)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		// Continue from the end of the file, switching to parallel download if content is large enough.
+		state, err = d.downloadSequential(ctx, f, pw)
+		if err != nil {
+			return err
+		}
+	}
+	if state != nil {
+		if err := d.downloadParts(ctx, f, name+downloadStateSuffix, state, pw); err != nil {
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Remove(name + downloadStateSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (d *Downloader) partSize() int64 {
+	if d.PartSize > 0 {
+		return d.PartSize
+	}
+	return DefaultDownloadPartSize
+}
+
+func (d *Downloader) retries() int {
+	if d.Retries > 0 {
+		return d.Retries
+	}
+	return defaultDownloadRetries
+}
+
+// get requests content from start to end inclusive, or to the end of content if end is negative.
+func (d *Downloader) get(ctx context.Context, start, end int64) (*http.Response, error) {
+	req, err := d.NewRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rng := "bytes=" + strconv.FormatInt(start, 10) + "-"
+	if end >= 0 {
+		rng += strconv.FormatInt(end, 10)
+	}
+	req.Header.Set("Range", rng)
+	do := d.Do
+	if do == nil {
+		do = http.DefaultClient.Do
+	}
+	return do(req.WithContext(ctx))
+}
+
+// wait sleeps before retrying a failed request, it returns an error if no retry is left.
+func (d *Downloader) wait(ctx context.Context, failures int, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if failures > d.retries() {
+		return err
+	}
+	base := d.retryWait
+	if base == 0 {
+		base = time.Second
+	}
+	select {
+	case <-time.After(time.Duration(failures) * base):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// downloadSequential appends the rest of content to f. It returns the state of a parallel download instead,
+// if the remaining content is large enough to be downloaded in parallel.
+func (d *Downloader) downloadSequential(ctx context.Context, f *os.File, pw io.Writer) (*downloadState, error) {
+	failures := 0
+	for {
+		offset, err := f.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := d.get(ctx, offset, -1)
+		if err != nil {
+			failures++
+			if err := d.wait(ctx, failures, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		switch resp.StatusCode {
+		case http.StatusRequestedRangeNotSatisfiable:
+			resp.Body.Close()
+			_, _, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+			if ok && total == offset && offset == 0 {
+				return nil, nil
+			}
+			// A file of the size of content without download state may be the preallocated file of a parallel
+			// download whose state was lost, it is downloaded again.
+			if ok && total == offset {
+				if err := f.Truncate(0); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			// The file is larger than content, it is not a part of it.
+			if offset == 0 {
+				return nil, errRangeMismatch
+			}
+			if err := f.Truncate(0); err != nil {
+				return nil, err
+			}
+			continue
+		case http.StatusOK:
+			// Server does not support ranges.
+			if err := f.Truncate(0); err != nil {
+				resp.Body.Close()
+				return nil, err
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				resp.Body.Close()
+				return nil, err
+			}
+			if resp.ContentLength >= 0 {
+				setTotal(pw, resp.ContentLength, 0)
+			}
+		case http.StatusPartialContent:
+			start, _, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+			if !ok || start != offset {
+				resp.Body.Close()
+				return nil, errRangeMismatch
+			}
+			if d.Concurrency > 1 && total-offset > 2*d.partSize() {
+				resp.Body.Close()
+				return newDownloadState(total, d.partSize(), offset), nil
+			}
+			setTotal(pw, total, offset)
+		default:
+			err := checkResponse(resp)
+			resp.Body.Close()
+			if resp.StatusCode < http.StatusInternalServerError {
+				return nil, err
+			}
+			failures++
+			if err := d.wait(ctx, failures, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		n, err := io.Copy(io.MultiWriter(f, pw), resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			return nil, nil
+		}
+		if n > 0 {
+			failures = 0
+		}
+		failures++
+		if err := d.wait(ctx, failures, err); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// totalSetter is implemented by progress writers which track the size of the downloaded content, like
+// progress.Tracker.
+type totalSetter interface {
+	SetTotal(total, done int64)
+}
+
+// setTotal tells pw that content has total bytes, done of which are already downloaded.
+func setTotal(pw io.Writer, total, done int64) {
+	if ts, ok := pw.(totalSetter); ok {
+		ts.SetTotal(total, done)
+	}
+}
+
+func newDownloadState(size, partSize, offset int64) *downloadState {
+	state := &downloadState{Size: size, PartSize: partSize, Done: make(map[int]bool)}
+	// Parts entirely in the file are already downloaded.
+	for i := 0; int64(i+1)*partSize <= offset; i++ {
+		state.Done[i] = true
+	}
+	return state
+}
+
+// downloadParts downloads the missing parts of state to f in parallel, the state is saved to statePath
+// after each part.
+func (d *Downloader) downloadParts(ctx context.Context, f *os.File, statePath string, state *downloadState, pw io.Writer) error {
+	// The state is saved before the file is resized, a file of the size of content is never left without state.
+	if err := state.save(statePath); err != nil {
+		return err
+	}
+	if d.afterStateSaved != nil {
+		if err := d.afterStateSaved(); err != nil {
+			return err
+		}
+	}
+	if err := f.Truncate(state.Size); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var mu sync.Mutex
+	var firstErr error
+	var done int64
+	for part, ok := range state.Done {
+		if ok {
+			done += state.partLen(part)
+		}
+	}
+	setTotal(pw, state.Size, done)
+	pw = &lockedWriter{w: pw}
+
+	parts := make(chan int)
+	var wg sync.WaitGroup
+	concurrency := d.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range parts {
+				err := d.downloadPart(ctx, f, state, part, pw)
+				mu.Lock()
+				if err == nil {
+					state.Done[part] = true
+					err = state.save(statePath)
+				}
+				if err != nil && firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	numParts := int((state.Size + state.PartSize - 1) / state.PartSize)
+loop:
+	for part := 0; part < numParts; part++ {
+		mu.Lock()
+		done := state.Done[part]
+		mu.Unlock()
+		if done {
+			continue
+		}
+		select {
+		case parts <- part:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(parts)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+func (d *Downloader) downloadPart(ctx context.Context, f *os.File, state *downloadState, part int, pw io.Writer) error {
+	start := int64(part) * state.PartSize
+	end := start + state.partLen(part)
+	return d.getRange(ctx, start, end, state.Size, io.MultiWriter(&offsetWriter{w: f, off: start}, pw))
+}
+
+// getRange writes content from start to end exclusive to w, retrying failed requests from where they stopped.
+// size is the size of content.
+func (d *Downloader) getRange(ctx context.Context, start, end, size int64, w io.Writer) error {
+	failures := 0
+	for start < end {
+		resp, err := d.get(ctx, start, end-1)
+		if err == nil && resp.StatusCode != http.StatusPartialContent {
+			err = checkResponse(resp)
+			if err == nil {
+				err = fmt.Errorf("unexpected status %d for range request", resp.StatusCode)
+			}
+			resp.Body.Close()
+			if resp.StatusCode < http.StatusInternalServerError {
+				return err
+			}
+		}
+		if err != nil {
+			failures++
+			if err := d.wait(ctx, failures, err); err != nil {
+				return err
+			}
+			continue
+		}
+		if rs, _, total, ok := parseContentRange(resp.Header.Get("Content-Range")); !ok || rs != start || total != size {
+			resp.Body.Close()
+			return errRangeMismatch
+		}
+
+		n, err := io.Copy(w, io.LimitReader(resp.Body, end-start))
+		resp.Body.Close()
+		start += n
+		if err == nil && start < end {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			if n > 0 {
+				failures = 0
+			}
+			failures++
+			if err := d.wait(ctx, failures, err); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ReaderAt returns a RangeReader of the content. It returns ErrRangeNotSupported if server does not support
+// range requests.
+func (d *Downloader) ReaderAt(ctx context.Context) (*RangeReader, error) {
+	failures := 0
+	for {
+		resp, err := d.get(ctx, 0, 0)
+		if err == nil {
+			switch resp.StatusCode {
+			case http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+				resp.Body.Close()
+				// Empty content can not satisfy any range, its size is still reported.
+				_, _, total, ok := parseContentRange(resp.Header.Get("Content-Range"))
+				if !ok {
+					return nil, errRangeMismatch
+				}
+				return &RangeReader{d: d, ctx: ctx, size: total}, nil
+			case http.StatusOK:
+				resp.Body.Close()
+				return nil, ErrRangeNotSupported
+			}
+			err = checkResponse(resp)
+			resp.Body.Close()
+			if resp.StatusCode < http.StatusInternalServerError {
+				return nil, err
+			}
+		}
+		failures++
+		if err := d.wait(ctx, failures, err); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// RangeReader reads content at arbitrary offsets with range requests, so only the parts read are downloaded.
+// It is safe for concurrent use.
+type RangeReader struct {
+	d    *Downloader
+	ctx  context.Context
+	size int64
+
+	// mu guards the last fetched range, which serves small sequential reads.
+	mu        sync.Mutex
+	bufOff    int64
+	buf       []byte
+	readAhead int64
+}
+
+// Size returns the size of content.
+func (r *RangeReader) Size() int64 {
+	return r.size
+}
+
+// ReadAt implements io.ReaderAt interface.
+func (r *RangeReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	n := 0
+	for n < len(p) && off < r.size {
+		r.mu.Lock()
+		if off >= r.bufOff && off < r.bufOff+int64(len(r.buf)) {
+			c := copy(p[n:], r.buf[off-r.bufOff:])
+			r.mu.Unlock()
+			n += c
+			off += int64(c)
+			continue
+		}
+		readAhead := int64(minReadAhead)
+		if off == r.bufOff+int64(len(r.buf)) && r.readAhead > 0 {
+			readAhead = r.readAhead * 2
+			if readAhead > maxReadAhead {
+				readAhead = maxReadAhead
+			}
+		}
+		r.mu.Unlock()
+
+		end := off + int64(len(p)-n)
+		if end < off+readAhead {
+			end = off + readAhead
+		}
+		if end > r.size {
+			end = r.size
+		}
+		var buf bytes.Buffer
+		buf.Grow(int(end - off))
+		if err := r.d.getRange(r.ctx, off, end, r.size, &buf); err != nil {
+			return n, err
+		}
+		r.mu.Lock()
+		r.bufOff, r.buf, r.readAhead = off, buf.Bytes(), readAhead
+		r.mu.Unlock()
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func loadDownloadState(name string) (*downloadState, error) {
+	buf, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state downloadState
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return nil, err
+	}
+	if state.Size < 0 || state.PartSize <= 0 {
+		return nil, fmt.Errorf("invalid download state: %s", name)
+	}
+	if state.Done == nil {
+		state.Done = make(map[int]bool)
+	}
+	return &state, nil
+}
+
+// partLen returns the size of part, the last part may be shorter than the others.
+func (s *downloadState) partLen(part int) int64 {
+	start := int64(part) * s.PartSize
+	if start+s.PartSize > s.Size {
+		return s.Size - start
+	}
+	return s.PartSize
+}
+
+func (s *downloadState) save(name string) error {
+	buf, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := name + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// parseContentRange parses Content-Range header value, of form "bytes start-end/total" or "bytes */total".
+// start and end are -1 in the latter form.
+func parseContentRange(s string) (start, end, total int64, ok bool) {
+	s = strings.TrimPrefix(s, "bytes ")
+	slash := strings.IndexByte(s, '/')
+	if slash < 0 {
+		return 0, 0, 0, false
+	}
+	total, err := strconv.ParseInt(s[slash+1:], 10, 64)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	if s[:slash] == "*" {
+		return -1, -1, total, true
+	}
+	dash := strings.IndexByte(s[:slash], '-')
+	if dash < 0 {
+		return 0, 0, 0, false
+	}
+	start, err = strconv.ParseInt(s[:dash], 10, 64)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	end, err = strconv.ParseInt(s[dash+1:slash], 10, 64)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	return start, end, total, true
+}
+
+type offsetWriter struct {
+	w   io.WriterAt
+	off int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.off)
+	o.off += int64(n)
+	return n, err
+}
+
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// DownloadFile downloads content of given recovery point to file at name. Content already in the file is
+// kept, so an interrupted download is resumed by calling DownloadFile again with the same name.
+func (c *Client) DownloadFile(ctx context.Context, createdAt string, restoreSessionKey string, recoveryPointID string, name string, pw io.Writer, concurrency int) error {
+	d := &Downloader{
+		NewRequest: func(ctx context.Context) (*http.Request, error) {
+			return c.downloadFileContentRequest(createdAt, restoreSessionKey, recoveryPointID)
+		},
+		Do:          c.transferDo,
+		Concurrency: concurrency,
+	}
+	return d.Download(ctx, name, pw)
+}
+
+// DiscardDownload removes the file at name, along with the state of its interrupted download if any, so the next
+// DownloadFile to name starts over.
+func DiscardDownload(name string) error {
+	for _, n := range []string{name, name + downloadStateSuffix} {
+		if err := os.Remove(n); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// OpenFile returns a RangeReader of content of given recovery point, which downloads only the parts read.
+// It returns ErrRangeNotSupported if server does not support range requests.
+func (c *Client) OpenFile(ctx context.Context, createdAt string, restoreSessionKey string, recoveryPointID string) (*RangeReader, error) {
+	d := &Downloader{
+		NewRequest: func(ctx context.Context) (*http.Request, error) {
+			return c.downloadFileContentRequest(createdAt, restoreSessionKey, recoveryPointID)
+		},
+		Do: c.transferDo,
+	}
+	return d.ReaderAt(ctx)
+}
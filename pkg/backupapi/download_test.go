@@ -0,0 +1,293 @@
+package backupapi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cutWriter stops writing the response after limit bytes, as if the connection was lost.
+type cutWriter struct {
+	http.ResponseWriter
+	limit int
+}
+
+func (c *cutWriter) Write(p []byte) (int, error) {
+	if len(p) > c.limit {
+		p = p[:c.limit]
+	}
+	n, err := c.ResponseWriter.Write(p)
+	c.limit -= n
+	if err == nil && c.limit == 0 {
+		return n, http.ErrAbortHandler
+	}
+	return n, err
+}
+
+type rangeServer struct {
+	content []byte
+	noRange bool
+
+	mu       sync.Mutex
+	cutAfter int
+	requests []string
+}
+
+func (rs *rangeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rs.mu.Lock()
+	rs.requests = append(rs.requests, r.Header.Get("Range"))
+	cutAfter := rs.cutAfter
+	rs.cutAfter = 0
+	rs.mu.Unlock()
+	if rs.noRange {
+		r.Header.Del("Range")
+	}
+	if cutAfter > 0 {
+		w = &cutWriter{ResponseWriter: w, limit: cutAfter}
+	}
+	http.ServeContent(w, r, "content", time.Time{}, bytes.NewReader(rs.content))
+}
+
+// totalRecorder records the totals and the bytes reported by a download.
+type totalRecorder struct {
+	mu           sync.Mutex
+	total, bytes int64
+}
+
+func (r *totalRecorder) SetTotal(total, done int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.total, r.bytes = total, done
+}
+
+func (r *totalRecorder) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bytes += int64(len(p))
+	return len(p), nil
+}
+
+func newTestDownloader(t *testing.T, rs *rangeServer) (*Downloader, func()) {
+	srv := httptest.NewServer(rs)
+	return &Downloader{
+		NewRequest: func(ctx context.Context) (*http.Request, error) {
+			return http.NewRequest(http.MethodGet, srv.URL, nil)
+		},
+		retryWait: time.Millisecond,
+	}, srv.Close
+}
+
+func tempDownloadFile(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "bizfly-backup-download-test-*")
+	require.NoError(t, err)
+	return filepath.Join(dir, "content"), func() { os.RemoveAll(dir) }
+}
+
+func TestDownloader_Sequential(t *testing.T) {
+	content := make([]byte, 100000)
+	_, _ = rand.Read(content)
+	rs := &rangeServer{content: content, cutAfter: 30000}
+	d, closeServer := newTestDownloader(t, rs)
+	defer closeServer()
+	name, cleanup := tempDownloadFile(t)
+	defer cleanup()
+
+	// Content already in the file is not downloaded again.
+	require.NoError(t, ioutil.WriteFile(name, content[:1000], 0600))
+	progress := &totalRecorder{}
+	require.NoError(t, d.Download(context.Background(), name, progress))
+	got, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+	assert.Equal(t, int64(len(content)), progress.total)
+	assert.Equal(t, int64(len(content)), progress.bytes)
+	require.Len(t, rs.requests, 2)
+	assert.Equal(t, "bytes=1000-", rs.requests[0])
+	assert.Equal(t, "bytes=31000-", rs.requests[1])
+
+	// A file of the size of content without download state is downloaded again, it may be the preallocated file
+	// of a parallel download.
+	require.NoError(t, ioutil.WriteFile(name, make([]byte, len(content)), 0600))
+	rs.requests = nil
+	require.NoError(t, d.Download(context.Background(), name, ioutil.Discard))
+	got, err = ioutil.ReadFile(name)
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+	assert.Equal(t, []string{"bytes=100000-", "bytes=0-"}, rs.requests)
+}
+
+func TestDownloader_NoRangeSupport(t *testing.T) {
+	content := []byte(strings.Repeat("content", 1000))
+	rs := &rangeServer{content: content, noRange: true}
+	d, closeServer := newTestDownloader(t, rs)
+	defer closeServer()
+	name, cleanup := tempDownloadFile(t)
+	defer cleanup()
+
+	require.NoError(t, ioutil.WriteFile(name, content[:100], 0600))
+	require.NoError(t, d.Download(context.Background(), name, ioutil.Discard))
+	got, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+}
+
+func TestDownloader_Parallel(t *testing.T) {
+	content := make([]byte, 100000)
+	_, _ = rand.Read(content)
+	rs := &rangeServer{content: content}
+	d, closeServer := newTestDownloader(t, rs)
+	defer closeServer()
+	d.Concurrency = 4
+	d.PartSize = 10000
+	name, cleanup := tempDownloadFile(t)
+	defer cleanup()
+
+	// Resume an interrupted parallel download, only missing parts are downloaded.
+	require.NoError(t, ioutil.WriteFile(name, content, 0600))
+	state := newDownloadState(int64(len(content)), d.PartSize, 0)
+	for i := 0; i < 10; i++ {
+		state.Done[i] = i%2 == 0
+	}
+	require.NoError(t, state.save(name+downloadStateSuffix))
+	// Scramble missing parts.
+	f, err := os.OpenFile(name, os.O_RDWR, 0600)
+	require.NoError(t, err)
+	_, err = f.WriteAt(make([]byte, 10000), 10000)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	rs.cutAfter = 5000
+	progress := &totalRecorder{}
+	require.NoError(t, d.Download(context.Background(), name, progress))
+	got, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+	assert.Len(t, rs.requests, 6)
+	assert.Equal(t, int64(len(content)), progress.total)
+	assert.Equal(t, int64(len(content)), progress.bytes)
+	_, err = os.Stat(name + downloadStateSuffix)
+	assert.True(t, os.IsNotExist(err))
+
+	// Downloading from scratch switches to parallel download after the first request.
+	require.NoError(t, os.Remove(name))
+	rs.requests = nil
+	require.NoError(t, d.Download(context.Background(), name, ioutil.Discard))
+	got, err = ioutil.ReadFile(name)
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+	assert.Len(t, rs.requests, 11)
+}
+
+func TestDownloader_ParallelInterruptedBeforeResize(t *testing.T) {
+	content := make([]byte, 100000)
+	_, _ = rand.Read(content)
+	rs := &rangeServer{content: content}
+	d, closeServer := newTestDownloader(t, rs)
+	defer closeServer()
+	d.Concurrency = 4
+	d.PartSize = 10000
+	name, cleanup := tempDownloadFile(t)
+	defer cleanup()
+
+	require.NoError(t, ioutil.WriteFile(name, content[:25000], 0600))
+	interrupted := errors.New("interrupted")
+	d.afterStateSaved = func() error { return interrupted }
+	assert.Equal(t, interrupted, d.Download(context.Background(), name, ioutil.Discard))
+	// The state is saved, the file is not resized yet.
+	info, err := os.Stat(name)
+	require.NoError(t, err)
+	assert.Equal(t, int64(25000), info.Size())
+	state, err := loadDownloadState(name + downloadStateSuffix)
+	require.NoError(t, err)
+	require.NotNil(t, state)
+	assert.Equal(t, map[int]bool{0: true, 1: true}, state.Done)
+
+	d.afterStateSaved = nil
+	require.NoError(t, d.Download(context.Background(), name, ioutil.Discard))
+	got, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	assert.Equal(t, content, got)
+}
+
+func TestDownloader_ReaderAt(t *testing.T) {
+	content := make([]byte, 3*1024*1024)
+	_, _ = rand.Read(content)
+	rs := &rangeServer{content: content}
+	d, closeServer := newTestDownloader(t, rs)
+	defer closeServer()
+
+	r, err := d.ReaderAt(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), r.Size())
+
+	off := int64(2*1024*1024 + 100)
+	p := make([]byte, 100)
+	n, err := r.ReadAt(p, off)
+	require.NoError(t, err)
+	assert.Equal(t, 100, n)
+	assert.Equal(t, content[off:off+100], p)
+	// The next read is served by the range already fetched.
+	_, err = r.ReadAt(p, off+100)
+	require.NoError(t, err)
+	assert.Equal(t, content[off+100:off+200], p)
+	// Sequential reads fetch larger ranges.
+	p = make([]byte, minReadAhead)
+	_, err = r.ReadAt(p, off+minReadAhead)
+	require.NoError(t, err)
+	assert.Equal(t, content[off+minReadAhead:off+2*minReadAhead], p)
+	assert.Equal(t, []string{"bytes=0-0", "bytes=2097252-2162787", "bytes=2162788-2293859"}, rs.requests)
+
+	// An interrupted range is resumed.
+	rs.cutAfter = 1000
+	p = make([]byte, 5000)
+	_, err = r.ReadAt(p, 10)
+	require.NoError(t, err)
+	assert.Equal(t, content[10:5010], p)
+
+	n, err = r.ReadAt(p, int64(len(content))-10)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 10, n)
+
+	rs.noRange = true
+	_, err = d.ReaderAt(context.Background())
+	assert.Equal(t, ErrRangeNotSupported, err)
+}
+
+func Test_parseContentRange(t *testing.T) {
+	start, end, total, ok := parseContentRange("bytes 10-19/100")
+	assert.True(t, ok)
+	assert.Equal(t, []int64{10, 19, 100}, []int64{start, end, total})
+	_, _, total, ok = parseContentRange("bytes */100")
+	assert.True(t, ok)
+	assert.Equal(t, int64(100), total)
+	_, _, _, ok = parseContentRange("")
+	assert.False(t, ok)
+}
+
+func TestDiscardDownload(t *testing.T) {
+	name, cleanup := tempDownloadFile(t)
+	defer cleanup()
+	require.NoError(t, ioutil.WriteFile(name, []byte("partial"), 0600))
+	require.NoError(t, ioutil.WriteFile(name+downloadStateSuffix, []byte("{}"), 0600))
+	require.NoError(t, DiscardDownload(name))
+	_, err := os.Stat(name)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(name + downloadStateSuffix)
+	assert.True(t, os.IsNotExist(err))
+	// Nothing to discard is fine.
+	assert.NoError(t, DiscardDownload(name))
+}
@@ -3,20 +3,45 @@ package backupapi
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/go-retryablehttp"
 )
 
-const MultipartUploadLowerBound = 15 * 1000 * 1000
+const (
+	// MultipartUploadLowerBound is the default part size of multipart uploads. Content smaller than the part size
+	// is uploaded in a single request.
+	MultipartUploadLowerBound = 15 * 1000 * 1000
+	// MinUploadPartSize and MaxUploadPartSize bound the part size of multipart uploads.
+	MinUploadPartSize = 5 * 1024 * 1024
+	MaxUploadPartSize = 1024 * 1024 * 1024
+	// MaxUploadParts is the maximum number of parts of a multipart upload.
+	MaxUploadParts = 10000
+	// DefaultUploadConcurrency is the default number of parts uploaded in parallel.
+	DefaultUploadConcurrency = 8
+	// DefaultUploadMemoryLimit is the default limit of memory used by part buffers of a multipart upload.
+	DefaultUploadMemoryLimit = 256 * 1024 * 1024
+
+	// partSizeGrowth is the number of parts after which the part size of a multipart upload doubles.
+	partSizeGrowth = 1000
+)
 
 // File ...
 type File struct {
@@ -27,6 +52,9 @@ type File struct {
 	UpdatedAt   string `json:"updated_at"`
 	ContentType string `json:"content_type"`
 	Etag        string `json:"eTag"`
+	// SHA256 is the hex encoded SHA-256 of the whole file content, recorded by server once the upload completes.
+	// It is empty for files recorded by older servers.
+	SHA256 string `json:"sha256,omitempty"`
 }
 
 // Multipart ...
@@ -40,12 +68,122 @@ type Part struct {
 	PartNumber int    `json:"part_number"`
 	Size       int    `json:"size"`
 	Etag       string `json:"etag"`
+	// SHA256 is the hex encoded SHA-256 of the part content.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+const (
+	// PartMD5Header and PartSHA256Header carry checksums of the content of an uploaded part, base64 encoded MD5
+	// like Content-MD5 and hex encoded SHA-256. Server must reject parts not matching them.
+	PartMD5Header    = "X-Part-Content-MD5"
+	PartSHA256Header = "X-Part-Content-SHA256"
+
+	// maxPartAttempts is the number of times a part acknowledged with a mismatching ETag or size is sent.
+	maxPartAttempts = 3
+	// abortTimeout bounds the time spent aborting a canceled multipart upload.
+	abortTimeout = 30 * time.Second
+)
+
+var (
+	// ErrUploadContentChanged indicates that a resumed upload does not have the same content as the interrupted one.
+	ErrUploadContentChanged = errors.New("content changed since the upload was started")
+	// ErrPartMismatch indicates that server acknowledged an uploaded part with another size or checksum.
+	ErrPartMismatch = errors.New("uploaded part does not match")
+)
+
+// UploadState is the state of a multipart upload, enough to resume it after an interruption.
+type UploadState struct {
+	UploadID string `json:"upload_id"`
+	PartSize int    `json:"part_size"`
+	// MaxPartSize bounds the part size as it grows, so parts fit in the upload memory limit.
+	MaxPartSize int `json:"max_part_size,omitempty"`
+	// Parts are the parts acknowledged by server.
+	Parts []Part `json:"parts"`
+	// Checksums maps part number to SHA-256 of the part content, for every part which has been sent.
+	Checksums map[int]string `json:"checksums"`
+}
+
+type uploadOptions struct {
+	state *UploadState
+	save  func(*UploadState) error
+	// size is the size of content, or -1 if unknown.
+	size int64
+}
+
+func newUploadOptions(opts []UploadOption) *uploadOptions {
+	o := &uploadOptions{size: -1}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// UploadOption configures an upload.
+type UploadOption func(o *uploadOptions)
+
+// WithUploadState returns an UploadOption which resumes the multipart upload from state, and keeps state updated
+// as the upload progresses. save is called on every change, so the state can be persisted.
+func WithUploadState(state *UploadState, save func(*UploadState) error) UploadOption {
+	return func(o *uploadOptions) {
+		o.state = state
+		o.save = save
+	}
+}
+
+// readerSize returns the size of the content left in r, or -1 if unknown.
+func readerSize(r io.Reader) int64 {
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len())
+	case *os.File:
+		fi, err := r.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			return -1
+		}
+		offset, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		return fi.Size() - offset
+	}
+	return -1
+}
+
+// WithContentSize returns an UploadOption telling the size of the uploaded content, so the part size is scaled up
+// to stay under MaxUploadParts parts, and content too large to be uploaded is refused before uploading anything.
+func WithContentSize(size int64) UploadOption {
+	return func(o *uploadOptions) {
+		o.size = size
+	}
 }
 
 func (c *Client) uploadFilePath(recoveryPointID string) string {
 	return fmt.Sprintf("/agent/recovery-points/%s/file", recoveryPointID)
 }
 
+// GetFile returns the record of the file of given recovery point kept by server.
+func (c *Client) GetFile(ctx context.Context, recoveryPointID string) (*File, error) {
+	req, err := c.NewRequest(http.MethodGet, c.uploadFilePath(recoveryPointID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(resp); err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var f File
+	if err := json.NewDecoder(resp.Body).Decode(&f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
 func (c *Client) urlStringFromRelPath(relPath string) (string, error) {
 	if c.ServerURL.Path != "" && c.ServerURL.Path != "/" {
 		relPath = path.Join(c.ServerURL.Path, relPath)
@@ -59,148 +197,458 @@ func (c *Client) urlStringFromRelPath(relPath string) (string, error) {
 	return u.String(), nil
 }
 
-func (c *Client) uploadFile(fn string, r io.Reader, pw io.Writer) error {
-	bodyBuf := &bytes.Buffer{}
-	bodyWriter := multipart.NewWriter(bodyBuf)
-	fileWriter, err := bodyWriter.CreateFormFile("data", fn)
+func (c *Client) uploadFile(ctx context.Context, fn string, r io.Reader, pw io.Writer) error {
+	data, err := ioutil.ReadAll(r)
 	if err != nil {
-		return fmt.Errorf("bodyWriter.CreateFormFile: %w", err)
+		return err
 	}
-
-	_, err = io.Copy(fileWriter, r)
+	reqURL, err := c.urlStringFromRelPath(c.uploadFilePath(fn))
 	if err != nil {
 		return err
 	}
+	rc := c.newRetryClient()
+	defer rc.HTTPClient.CloseIdleConnections()
+	resp, err := c.sendFormFile(ctx, rc, http.MethodPost, reqURL, fn, data, nil, pw)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
 
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	return err
+}
+
+// sendFormFile sends data as the "data" file of a multipart form, with additional headers. The form is streamed
+// around data without copying it, and data is read again when rc retries the request, so it must not be modified
+// until sendFormFile returns.
+func (c *Client) sendFormFile(ctx context.Context, rc *retryablehttp.Client, method, reqURL, filename string, data []byte, header http.Header, pw io.Writer) (*http.Response, error) {
+	var envelope bytes.Buffer
+	bodyWriter := multipart.NewWriter(&envelope)
+	if _, err := bodyWriter.CreateFormFile("data", filename); err != nil {
+		return nil, fmt.Errorf("bodyWriter.CreateFormFile: %w", err)
+	}
+	head := len(envelope.Bytes())
 	contentType := bodyWriter.FormDataContentType()
 	if err := bodyWriter.Close(); err != nil {
-		return err
+		return nil, err
 	}
+	formHead, formTail := envelope.Bytes()[:head], envelope.Bytes()[head:]
 
-	reqURL, err := c.urlStringFromRelPath(c.uploadFilePath(fn))
-	if err != nil {
-		return err
+	body := func() (io.Reader, error) {
+		return io.MultiReader(bytes.NewReader(formHead), io.TeeReader(bytes.NewReader(data), pw), bytes.NewReader(formTail)), nil
 	}
-	req, err := http.NewRequest(http.MethodPost, reqURL, io.TeeReader(bodyBuf, pw))
+	req, err := retryablehttp.NewRequest(method, reqURL, body)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = int64(len(formHead) + len(data) + len(formTail))
+	for k, v := range header {
+		req.Header[k] = v
 	}
+	c.setHeaders(req.Request, contentType)
+	return rc.Do(req)
+}
 
-	retryClient := retryablehttp.NewClient()
-	retryClient.RetryMax = 50 // Should configurable this?
-	resp, err := c.do(retryClient.StandardClient(), req, contentType)
-	if err != nil {
-		return err
+// uploadPartSize returns the size of part partNum of a multipart upload started with part size base. The size
+// doubles every partSizeGrowth parts up to max, so large content of unknown size fits in MaxUploadParts parts,
+// while the part size of a resumed upload is known from its state alone.
+func uploadPartSize(base, max, partNum int) int {
+	size := base
+	for i := (partNum - 1) / partSizeGrowth; i > 0 && size < max; i-- {
+		size *= 2
 	}
-	defer resp.Body.Close()
+	if size > max {
+		size = max
+	}
+	return size
+}
 
-	_, err = io.Copy(ioutil.Discard, resp.Body)
-	return err
+// maxPartSize returns the largest part size of multipart uploads, so that a part being read and another being
+// uploaded fit in the upload memory limit.
+func (c *Client) maxPartSize() int {
+	max := c.uploadMemoryLimit / 2
+	if max > MaxUploadPartSize {
+		max = MaxUploadPartSize
+	}
+	return max
 }
 
-func (c *Client) uploadMultipart(recoveryPointID string, r io.Reader, pw io.Writer) error {
-	ctx := context.Background()
-	m, err := c.InitMultipart(ctx, recoveryPointID)
-	if err != nil {
-		return err
+// partSizeFor returns the initial part size of a multipart upload of content of given size, or of unknown size if
+// negative. The part size is scaled up so that content fits in MaxUploadParts parts, an error is returned if it
+// does not fit under the largest part size.
+func (c *Client) partSizeFor(size int64) (int, error) {
+	partSize := c.uploadPartSize
+	if size < 0 {
+		return partSize, nil
+	}
+	needed := (size + MaxUploadParts - 1) / MaxUploadParts
+	if needed <= int64(partSize) {
+		return partSize, nil
+	}
+	const mib = 1024 * 1024
+	needed = (needed + mib - 1) / mib * mib
+	if needed > int64(c.maxPartSize()) {
+		return 0, fmt.Errorf("content of %d bytes does not fit in %d parts of at most %d bytes, raise the upload memory limit",
+			size, MaxUploadParts, c.maxPartSize())
+	}
+	return int(needed), nil
+}
+
+// uploadMultipart uploads content read from r in parts, uploading up to c.uploadConcurrency parts in parallel
+// while keeping part buffers under c.uploadMemoryLimit. first, if not nil, is the content of the first part,
+// already read from r.
+//
+// If ctx is canceled, the upload is aborted on server and the upload state is reset.
+func (c *Client) uploadMultipart(ctx context.Context, recoveryPointID string, r io.Reader, pw io.Writer, first []byte, opts ...UploadOption) error {
+	o := newUploadOptions(opts)
+	if o.state == nil {
+		o.state = &UploadState{}
+	}
+	state := o.state
+	pw = &lockedWriter{w: pw}
+	var mu sync.Mutex
+	// saveState must be called with mu held.
+	saveState := func() error {
+		if o.save == nil {
+			return nil
+		}
+		return o.save(state)
+	}
+
+	if state.UploadID == "" {
+		partSize, err := c.partSizeFor(o.size)
+		if err != nil {
+			return err
+		}
+		m, err := c.InitMultipart(ctx, recoveryPointID)
+		if err != nil {
+			return err
+		}
+		*state = UploadState{
+			UploadID:    m.UploadID,
+			PartSize:    partSize,
+			MaxPartSize: c.maxPartSize(),
+			Checksums:   make(map[int]string),
+		}
+		if err := saveState(); err != nil {
+			return err
+		}
+	}
+	if state.Checksums == nil {
+		state.Checksums = make(map[int]string)
+	}
+	if state.PartSize <= 0 {
+		state.PartSize = MultipartUploadLowerBound
+	}
+	// States saved by older agents have no maximum part size.
+	if state.MaxPartSize <= 0 {
+		state.MaxPartSize = c.maxPartSize()
+	}
+	if first != nil && len(first) != state.PartSize {
+		return fmt.Errorf("first part has size %d, want %d", len(first), state.PartSize)
+	}
+	acked := make(map[int]bool, len(state.Parts))
+	for _, p := range state.Parts {
+		acked[p.PartNumber] = true
 	}
 
-	bufCh := make(chan []byte, 30)
+	// Parts are read into buffers of pool, which bounds the memory used by parts being read or uploaded. Buffers
+	// are reused only once their part is uploaded.
+	pool := newBufferPool(c.uploadMemoryLimit)
+	if first != nil {
+		pool.adopt(first)
+	}
+	bufCh := make(chan []byte)
+	done := make(chan struct{})
+	var readErr error
 	go func() {
 		defer close(bufCh)
-		b := make([]byte, MultipartUploadLowerBound)
-		for {
-			n, err := r.Read(b)
+		for partNum := 1; ; partNum++ {
+			var b []byte
+			var n int
+			var err error
+			if partNum == 1 && first != nil {
+				b, n = first, len(first)
+			} else {
+				if b, err = pool.get(uploadPartSize(state.PartSize, state.MaxPartSize, partNum)); err != nil {
+					readErr = err
+					return
+				}
+				n, err = io.ReadFull(r, b)
+			}
+			if n > 0 && partNum > MaxUploadParts {
+				readErr = fmt.Errorf("content exceeds %d parts of at most %d bytes, raise the upload memory limit", MaxUploadParts, state.MaxPartSize)
+				return
+			}
+			if n > 0 {
+				select {
+				case bufCh <- b[:n]:
+				case <-done:
+					return
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return
+			}
 			if err != nil {
+				readErr = err
 				return
 			}
-			bufCh <- b[:n]
 		}
 	}()
-
 	partNum := 0
 	var wg sync.WaitGroup
 	var errs []error
-	var mu sync.Mutex
-	sem := make(chan struct{}, 15)
-	rc := retryablehttp.NewClient()
-	rc.RetryMax = 50 // TODO: configurable?
-	rcStd := rc.StandardClient()
+	addErr := func(err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+	}
+	sem := make(chan struct{}, c.uploadConcurrency)
+	rc := c.newRetryClient()
+	var changed bool
 	for buf := range bufCh {
-		sem <- struct{}{}
-		buf := buf
+		if ctx.Err() != nil {
+			pool.put(buf)
+			break
+		}
 		partNum++
+		sum := sha256.Sum256(buf)
+		checksum := hex.EncodeToString(sum[:])
+
+		// A part recorded by a previous attempt must have the same content, otherwise the upload would mix
+		// two different contents.
+		mu.Lock()
+		prevChecksum, seen := state.Checksums[partNum]
+		if seen && prevChecksum != checksum {
+			mu.Unlock()
+			pool.put(buf)
+			changed = true
+			break
+		}
+		if acked[partNum] {
+			mu.Unlock()
+			pool.put(buf)
+			continue
+		}
+		state.Checksums[partNum] = checksum
+		err := saveState()
+		mu.Unlock()
+		if err != nil {
+			pool.put(buf)
+			addErr(err)
+			break
+		}
+
+		sem <- struct{}{}
 		wg.Add(1)
 		go func(buf []byte, partNum int) {
 			defer func() {
 				<-sem
 				wg.Done()
 			}()
-			b := new(bytes.Buffer)
-			bodyWriter := multipart.NewWriter(b)
-			fileWriter, err := bodyWriter.CreateFormFile("data", recoveryPointID+"-"+strconv.Itoa(partNum))
-			if err != nil {
-				return
-			}
-			_, _ = fileWriter.Write(buf)
-			contentType := bodyWriter.FormDataContentType()
-			if err := bodyWriter.Close(); err != nil {
-				mu.Lock()
-				errs = append(errs, err)
-				mu.Unlock()
-				return
-			}
-
-			reqURL, err := c.urlStringFromRelPath(c.uploadPartPath(recoveryPointID))
+			part, err := c.uploadPart(ctx, rc, recoveryPointID, state.UploadID, partNum, buf, pw)
 			if err != nil {
-				mu.Lock()
-				errs = append(errs, err)
-				mu.Unlock()
-				return
-			}
-			req, err := http.NewRequest(http.MethodPut, reqURL, io.TeeReader(b, pw))
-			if err != nil {
-				mu.Lock()
-				errs = append(errs, err)
-				mu.Unlock()
+				// A failed request may still be reading buf.
+				pool.discard(buf)
+				addErr(err)
 				return
 			}
-			q := req.URL.Query()
-			q.Add("part_number", strconv.Itoa(partNum))
-			q.Add("upload_id", m.UploadID)
-			req.URL.RawQuery = q.Encode()
-
-			resp, err := c.do(rcStd, req, contentType)
-			if err != nil {
-				mu.Lock()
-				errs = append(errs, err)
-				mu.Unlock()
-				return
-			}
-			defer resp.Body.Close()
-
-			if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
-				mu.Lock()
+			pool.put(buf)
+			mu.Lock()
+			defer mu.Unlock()
+			state.Parts = append(state.Parts, *part)
+			if err := saveState(); err != nil {
 				errs = append(errs, err)
-				mu.Unlock()
 			}
 		}(buf, partNum)
 	}
+	// Stop the reader, which may be waiting to send a part.
+	close(done)
 	wg.Wait()
+	rc.HTTPClient.CloseIdleConnections()
 
+	if ctx.Err() != nil {
+		return c.abortMultipart(recoveryPointID, state, saveState, ctx.Err())
+	}
+	if changed {
+		return ErrUploadContentChanged
+	}
 	if len(errs) > 0 {
 		return fmt.Errorf("upload multiparts fails: %v", errs)
 	}
-	rc.HTTPClient.CloseIdleConnections()
+	if readErr != nil {
+		return readErr
+	}
+
+	parts, err := completedParts(state, partNum)
+	if err != nil {
+		return err
+	}
+	return c.CompleteMultipart(ctx, recoveryPointID, state.UploadID, parts)
+}
+
+// abortMultipart aborts the multipart upload of state on server, resets state and returns cause.
+func (c *Client) abortMultipart(recoveryPointID string, state *UploadState, saveState func() error, cause error) error {
+	// The upload context is canceled already.
+	ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+	if err := c.AbortMultipart(ctx, recoveryPointID, state.UploadID); err != nil {
+		return fmt.Errorf("%w, and failed to abort upload: %v", cause, err)
+	}
+	*state = UploadState{}
+	if err := saveState(); err != nil {
+		return fmt.Errorf("%w, and failed to save upload state: %v", cause, err)
+	}
+	return cause
+}
+
+// completedParts returns the parts 1 to numParts of state sorted by part number, failing if one is missing.
+func completedParts(state *UploadState, numParts int) ([]Part, error) {
+	byNumber := make(map[int]Part, len(state.Parts))
+	for _, p := range state.Parts {
+		byNumber[p.PartNumber] = p
+	}
+	parts := make([]Part, 0, numParts)
+	for i := 1; i <= numParts; i++ {
+		p, ok := byNumber[i]
+		if !ok {
+			return nil, fmt.Errorf("part %d was not acknowledged by server", i)
+		}
+		// Parts acknowledged before checksums were recorded in parts.
+		if p.SHA256 == "" {
+			p.SHA256 = state.Checksums[i]
+		}
+		parts = append(parts, p)
+	}
+	return parts, nil
+}
+
+// uploadPart uploads a part of a multipart upload, and returns the part acknowledged by server. The part is
+// sent with its checksums, and sent again if server acknowledges it with another size or MD5 ETag.
+func (c *Client) uploadPart(ctx context.Context, rc *retryablehttp.Client, recoveryPointID string, uploadID string, partNum int, buf []byte, pw io.Writer) (*Part, error) {
+	reqURL, err := c.urlStringFromRelPath(c.uploadPartPath(recoveryPointID))
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(reqURL)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Add("part_number", strconv.Itoa(partNum))
+	q.Add("upload_id", uploadID)
+	u.RawQuery = q.Encode()
+
+	md5Sum := md5.Sum(buf)
+	sha256Sum := sha256.Sum256(buf)
+	want := Part{PartNumber: partNum, Size: len(buf), Etag: hex.EncodeToString(md5Sum[:]), SHA256: hex.EncodeToString(sha256Sum[:])}
+	header := http.Header{}
+	header.Set(PartMD5Header, base64.StdEncoding.EncodeToString(md5Sum[:]))
+	header.Set(PartSHA256Header, want.SHA256)
+
+	for attempt := 1; ; attempt++ {
+		part, err := c.sendPart(ctx, rc, u.String(), recoveryPointID, buf, header, want, pw)
+		if errors.Is(err, ErrPartMismatch) && attempt < maxPartAttempts {
+			continue
+		}
+		return part, err
+	}
+}
+
+// sendPart sends a part of a multipart upload once, and checks the part acknowledged by server against want.
+func (c *Client) sendPart(ctx context.Context, rc *retryablehttp.Client, reqURL, recoveryPointID string, buf []byte, header http.Header, want Part, pw io.Writer) (*Part, error) {
+	resp, err := c.sendFormFile(ctx, rc, http.MethodPut, reqURL, recoveryPointID+"-"+strconv.Itoa(want.PartNumber), buf, header, pw)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp); err != nil {
+		return nil, fmt.Errorf("part %d: %w", want.PartNumber, err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Server describes the part in its response, or only sets the ETag header.
+	var got Part
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &got); err != nil {
+			return nil, fmt.Errorf("part %d: invalid response: %w", want.PartNumber, err)
+		}
+	}
+	if got.Etag == "" {
+		got.Etag = resp.Header.Get("ETag")
+	}
+	got.Etag = parseETag(got.Etag)
+	switch {
+	case got.Etag == "":
+		return nil, fmt.Errorf("part %d: server returned no ETag", want.PartNumber)
+	case got.PartNumber != 0 && got.PartNumber != want.PartNumber:
+		return nil, fmt.Errorf("part %d: server acknowledged part %d: %w", want.PartNumber, got.PartNumber, ErrPartMismatch)
+	case got.Size != 0 && got.Size != want.Size:
+		return nil, fmt.Errorf("part %d: server stored %d bytes, sent %d: %w", want.PartNumber, got.Size, want.Size, ErrPartMismatch)
+	case got.SHA256 != "" && got.SHA256 != want.SHA256:
+		return nil, fmt.Errorf("part %d: SHA-256 mismatch: %w", want.PartNumber, ErrPartMismatch)
+	// An ETag is the MD5 of the part content, unless server encrypts parts.
+	case isMD5(got.Etag) && got.Etag != want.Etag:
+		return nil, fmt.Errorf("part %d: ETag %s does not match MD5 %s: %w", want.PartNumber, got.Etag, want.Etag, ErrPartMismatch)
+	}
+	return &Part{PartNumber: want.PartNumber, Size: want.Size, Etag: got.Etag, SHA256: want.SHA256}, nil
+}
+
+// parseETag returns the value of an ETag header, without quotes and weak prefix.
+func parseETag(etag string) string {
+	etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+	return strings.Trim(etag, `"`)
+}
+
+func isMD5(s string) bool {
+	if len(s) != 2*md5.Size {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
 
-	return c.CompleteMultipart(ctx, recoveryPointID, m.UploadID)
+// UploadStream uploads content read from r until EOF to server. The content is uploaded in a single request
+// if it is smaller than the part size of c, in parts read on the fly otherwise, so the total size does not
+// need to be known in advance. Its size is used to scale the part size if known, from WithContentSize or from r.
+//
+// With WithUploadState, an interrupted multipart upload is resumed: parts already acknowledged by server are
+// skipped, provided that r produces the same content again. ErrUploadContentChanged is returned otherwise,
+// and the upload must be restarted with an empty state.
+func (c *Client) UploadStream(ctx context.Context, recoveryPointID string, r io.Reader, pw io.Writer, opts ...UploadOption) error {
+	o := newUploadOptions(opts)
+	if o.state != nil && o.state.UploadID != "" {
+		return c.uploadMultipart(ctx, recoveryPointID, r, pw, nil, opts...)
+	}
+	if o.size < 0 {
+		o.size = readerSize(r)
+		opts = append(opts, WithContentSize(o.size))
+	}
+	partSize, err := c.partSizeFor(o.size)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, partSize)
+	n, err := io.ReadFull(r, buf)
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		return c.uploadFile(ctx, recoveryPointID, bytes.NewReader(buf[:n]), pw)
+	case err != nil:
+		return err
+	}
+	return c.uploadMultipart(ctx, recoveryPointID, r, pw, buf, opts...)
 }
 
 // UploadFile uploads given file to server.
-func (c *Client) UploadFile(fn string, r io.Reader, pw io.Writer, batch bool) error {
+func (c *Client) UploadFile(ctx context.Context, fn string, r io.Reader, pw io.Writer, batch bool) error {
 	if batch {
-		return c.uploadMultipart(fn, r, pw)
+		return c.uploadMultipart(ctx, fn, r, pw, nil, WithContentSize(readerSize(r)))
 
 	}
-	return c.uploadFile(fn, r, pw)
+	return c.uploadFile(ctx, fn, r, pw)
 }
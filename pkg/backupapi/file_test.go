@@ -2,7 +2,13 @@ package backupapi
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -10,6 +16,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -42,7 +49,22 @@ func TestClient_uploadFile(t *testing.T) {
 	})
 
 	pw := NewProgressWriter(ioutil.Discard)
-	assert.NoError(t, client.UploadFile(fn, buf, pw, false))
+	assert.NoError(t, client.UploadFile(context.Background(), fn, buf, pw, false))
+}
+
+func TestClient_GetFile(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	mux.HandleFunc("/api/v1"+client.uploadFilePath("rp1"), func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodGet, r.Method)
+		_, _ = w.Write([]byte(`{"id": 1, "name": "rp1", "size": 4, "sha256": "b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c"}`))
+	})
+
+	f, err := client.GetFile(context.Background(), "rp1")
+	require.NoError(t, err)
+	assert.Equal(t, 4, f.Size)
+	assert.Equal(t, "b5bb9d8014a0f9b1d61e21e796d78dccdf1352f23cd32812f4850b878ae4944c", f.SHA256)
 }
 
 func TestClient_uploadMultipart(t *testing.T) {
@@ -73,6 +95,7 @@ func TestClient_uploadMultipart(t *testing.T) {
 		partNumStr := r.URL.Query().Get("part_number")
 		partNum, _ := strconv.ParseInt(partNumStr, 10, 64)
 		assert.Greater(t, partNum, int64(0))
+		acknowledgePart(t, w, r)
 	})
 
 	mux.HandleFunc("/api/v1"+client.completeMultipartPath(fn), func(w http.ResponseWriter, r *http.Request) {
@@ -82,6 +105,398 @@ func TestClient_uploadMultipart(t *testing.T) {
 	})
 
 	pw := NewProgressWriter(ioutil.Discard)
-	assert.NoError(t, client.UploadFile(fn, buf, pw, true))
+	assert.NoError(t, client.UploadFile(context.Background(), fn, buf, pw, true))
+
+}
+
+// acknowledgePart reads the content of an uploaded part, and sets its ETag to the MD5 of the content like S3 does.
+func acknowledgePart(t *testing.T, w http.ResponseWriter, r *http.Request) []byte {
+	file, _, err := r.FormFile("data")
+	require.NoError(t, err)
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	require.NoError(t, err)
+	sum := md5.Sum(data)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	return data
+}
+
+// shortReader returns at most 1000 bytes per Read, like a pipe does.
+type shortReader struct {
+	r   io.Reader
+	err error
+}
+
+func (s *shortReader) Read(p []byte) (int, error) {
+	if len(p) > 1000 {
+		p = p[:1000]
+	}
+	n, err := s.r.Read(p)
+	if err == io.EOF && s.err != nil {
+		err = s.err
+	}
+	return n, err
+}
+
+func TestClient_UploadStream(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	small := "test-upload-stream-small"
+	uploaded := false
+	mux.HandleFunc("/api/v1"+client.uploadFilePath(small), func(w http.ResponseWriter, r *http.Request) {
+		uploaded = true
+		assert.Equal(t, http.MethodPost, r.Method)
+	})
+	pw := NewProgressWriter(ioutil.Discard)
+	require.NoError(t, client.UploadStream(context.Background(), small, &shortReader{r: strings.NewReader("foo")}, pw))
+	assert.True(t, uploaded)
+
+	fn := "test-upload-stream"
+	mux.HandleFunc("/api/v1"+client.initMultipartPath(fn), func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(&Multipart{UploadID: "foo"})
+	})
+	var mu sync.Mutex
+	sizes := map[string]int{}
+	mux.HandleFunc("/api/v1"+client.uploadPartPath(fn), func(w http.ResponseWriter, r *http.Request) {
+		data := acknowledgePart(t, w, r)
+		mu.Lock()
+		sizes[r.URL.Query().Get("part_number")] = len(data)
+		mu.Unlock()
+	})
+	completed := 0
+	mux.HandleFunc("/api/v1"+client.completeMultipartPath(fn), func(w http.ResponseWriter, r *http.Request) {
+		completed++
+	})
+
+	content := strings.Repeat("a", MultipartUploadLowerBound+10)
+	require.NoError(t, client.UploadStream(context.Background(), fn, &shortReader{r: strings.NewReader(content)}, pw))
+	assert.Equal(t, map[string]int{"1": MultipartUploadLowerBound, "2": 10}, sizes)
+	assert.Equal(t, 1, completed)
+
+	// A failing source must fail the upload, not complete it with truncated content.
+	readErr := errors.New("archive failed")
+	err := client.UploadStream(context.Background(), fn, &shortReader{r: strings.NewReader(content), err: readErr}, pw)
+	assert.Equal(t, readErr, err)
+	assert.Equal(t, 1, completed)
+}
+
+func TestClient_UploadStreamResume(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	fn := "test-upload-stream-resume"
+	inits := 0
+	mux.HandleFunc("/api/v1"+client.initMultipartPath(fn), func(w http.ResponseWriter, r *http.Request) {
+		inits++
+		_ = json.NewEncoder(w).Encode(&Multipart{UploadID: "foo"})
+	})
+	var mu sync.Mutex
+	uploads := map[string]int{}
+	failPart := "2"
+	mux.HandleFunc("/api/v1"+client.uploadPartPath(fn), func(w http.ResponseWriter, r *http.Request) {
+		partNum := r.URL.Query().Get("part_number")
+		assert.Equal(t, "foo", r.URL.Query().Get("upload_id"))
+		mu.Lock()
+		defer mu.Unlock()
+		if partNum == failPart {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		uploads[partNum]++
+		w.Header().Set("ETag", "etag-"+partNum)
+	})
+	completed := 0
+	mux.HandleFunc("/api/v1"+client.completeMultipartPath(fn), func(w http.ResponseWriter, r *http.Request) {
+		completed++
+	})
+
+	content := strings.Repeat("a", MultipartUploadLowerBound) + strings.Repeat("b", 10)
+	var state UploadState
+	saves := 0
+	save := func(s *UploadState) error {
+		saves++
+		return nil
+	}
+	pw := NewProgressWriter(ioutil.Discard)
+	err := client.UploadStream(context.Background(), fn, &shortReader{r: strings.NewReader(content)}, pw, WithUploadState(&state, save))
+	require.Error(t, err)
+	assert.Equal(t, 0, completed)
+	assert.Equal(t, "foo", state.UploadID)
+	assert.Equal(t, []Part{{PartNumber: 1, Size: MultipartUploadLowerBound, Etag: "etag-1", SHA256: state.Checksums[1]}}, state.Parts)
+	assert.Len(t, state.Checksums, 2)
+	assert.NotZero(t, saves)
+
+	// Resuming only uploads the missing part.
+	failPart = ""
+	require.NoError(t, client.UploadStream(context.Background(), fn, &shortReader{r: strings.NewReader(content)}, pw, WithUploadState(&state, save)))
+	assert.Equal(t, 1, inits)
+	assert.Equal(t, map[string]int{"1": 1, "2": 1}, uploads)
+	assert.Equal(t, 1, completed)
+
+	// Resuming with another content is refused.
+	state.Parts = state.Parts[:1]
+	changed := strings.Repeat("c", MultipartUploadLowerBound) + strings.Repeat("b", 10)
+	err = client.UploadStream(context.Background(), fn, &shortReader{r: strings.NewReader(changed)}, pw, WithUploadState(&state, save))
+	assert.Equal(t, ErrUploadContentChanged, err)
+	assert.Equal(t, 1, completed)
+}
+
+func TestClient_UploadStreamMemoryLimit(t *testing.T) {
+	setUp()
+	defer tearDown()
+	client.uploadPartSize = 1000
+	client.uploadConcurrency = 8
+	client.uploadMemoryLimit = 3000
+
+	fn := "test-upload-stream-memory"
+	mux.HandleFunc("/api/v1"+client.initMultipartPath(fn), func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(&Multipart{UploadID: "foo"})
+	})
+	var mu sync.Mutex
+	parts := map[int][]byte{}
+	inFlight, maxInFlight := 0, 0
+	mux.HandleFunc("/api/v1"+client.uploadPartPath(fn), func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+
+		data := acknowledgePart(t, w, r)
+		partNum, err := strconv.Atoi(r.URL.Query().Get("part_number"))
+		require.NoError(t, err)
+		mu.Lock()
+		parts[partNum] = data
+		inFlight--
+		mu.Unlock()
+	})
+	mux.HandleFunc("/api/v1"+client.completeMultipartPath(fn), func(w http.ResponseWriter, r *http.Request) {})
+
+	// Every part has distinct content, so a buffer reused while its part is uploaded would corrupt the upload.
+	var content bytes.Buffer
+	for i := 0; i < 20; i++ {
+		content.Write(bytes.Repeat([]byte{byte('a' + i)}, 1000))
+	}
+	content.WriteString("end")
+	pw := NewProgressWriter(ioutil.Discard)
+	require.NoError(t, client.UploadStream(context.Background(), fn, &shortReader{r: bytes.NewReader(content.Bytes())}, pw))
+
+	require.Len(t, parts, 21)
+	var got []byte
+	for i := 1; i <= len(parts); i++ {
+		got = append(got, parts[i]...)
+	}
+	assert.Equal(t, content.Bytes(), got)
+	// One buffer is being filled while the others are uploaded.
+	assert.LessOrEqual(t, maxInFlight, 3)
+}
+
+func Test_uploadPartSize(t *testing.T) {
+	assert.Equal(t, 1000, uploadPartSize(1000, 8000, 1))
+	assert.Equal(t, 1000, uploadPartSize(1000, 8000, partSizeGrowth))
+	assert.Equal(t, 2000, uploadPartSize(1000, 8000, partSizeGrowth+1))
+	assert.Equal(t, 8000, uploadPartSize(1000, 8000, 3*partSizeGrowth+1))
+	// The part size does not grow beyond max.
+	assert.Equal(t, 5000, uploadPartSize(1000, 5000, 3*partSizeGrowth+1))
+	assert.Equal(t, MaxUploadPartSize, uploadPartSize(MaxUploadPartSize/2, MaxUploadPartSize, MaxUploadParts))
+
+	// With the default settings, content of about a terabyte fits in MaxUploadParts parts, each of them fitting in
+	// the memory limit along with another one.
+	c, err := NewClient()
+	require.NoError(t, err)
+	var total int64
+	for i := 1; i <= MaxUploadParts; i++ {
+		size := uploadPartSize(c.uploadPartSize, c.maxPartSize(), i)
+		assert.LessOrEqual(t, 2*size, DefaultUploadMemoryLimit)
+		total += int64(size)
+	}
+	assert.Greater(t, total, int64(900)<<30)
+}
+
+func TestClient_partSizeFor(t *testing.T) {
+	c, err := NewClient()
+	require.NoError(t, err)
+	size, err := c.partSizeFor(-1)
+	require.NoError(t, err)
+	assert.Equal(t, MultipartUploadLowerBound, size)
+	size, err = c.partSizeFor(1 << 30)
+	require.NoError(t, err)
+	assert.Equal(t, MultipartUploadLowerBound, size)
+
+	// Large content is uploaded in larger parts, so it fits in MaxUploadParts parts.
+	size, err = c.partSizeFor(1 << 40)
+	require.NoError(t, err)
+	assert.Equal(t, 105<<20, size)
+	assert.GreaterOrEqual(t, int64(size)*MaxUploadParts, int64(1)<<40)
+
+	// Content which would need parts larger than the memory limit allows is refused.
+	_, err = c.partSizeFor(2 << 40)
+	assert.Error(t, err)
+}
+
+func TestClient_UploadStreamTooLarge(t *testing.T) {
+	setUp()
+	defer tearDown()
+	client.uploadPartSize = 1000
+	client.uploadMemoryLimit = 4000
+
+	fn := "test-upload-stream-too-large"
+	inits := 0
+	mux.HandleFunc("/api/v1"+client.initMultipartPath(fn), func(w http.ResponseWriter, r *http.Request) {
+		inits++
+		_ = json.NewEncoder(w).Encode(&Multipart{UploadID: "foo"})
+	})
+	err := client.UploadStream(context.Background(), fn, strings.NewReader(""), ioutil.Discard, WithContentSize(int64(MaxUploadParts)*2000+1))
+	assert.Error(t, err)
+	assert.Equal(t, 0, inits)
+}
+
+func Test_bufferPool(t *testing.T) {
+	p := newBufferPool(3000)
+	a, err := p.get(1000)
+	require.NoError(t, err)
+	b, err := p.get(2000)
+	require.NoError(t, err)
+	_, err = p.get(4000)
+	assert.Error(t, err)
+
+	got := make(chan []byte)
+	go func() {
+		c, err := p.get(1500)
+		assert.NoError(t, err)
+		got <- c
+	}()
+	select {
+	case <-got:
+		t.Fatal("pool exceeded its limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+	// The released buffer is reused, not reallocated.
+	p.put(b)
+	c := <-got
+	assert.Len(t, c, 1500)
+	assert.Equal(t, &b[0], &c[0])
+
+	// Smaller free buffers are dropped to make room for larger ones.
+	p.put(a)
+	p.put(c)
+	d, err := p.get(3000)
+	require.NoError(t, err)
+	assert.Len(t, d, 3000)
+	p.discard(d)
+	assert.Equal(t, 0, p.allocated)
+}
+
+func TestClient_uploadPartIntegrity(t *testing.T) {
+	setUp()
+	defer tearDown()
+	client.uploadPartSize = 1000
+
+	fn := "test-upload-part-integrity"
+	mux.HandleFunc("/api/v1"+client.initMultipartPath(fn), func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(&Multipart{UploadID: "foo"})
+	})
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	corrupt := map[string]int{"2": 1}
+	mux.HandleFunc("/api/v1"+client.uploadPartPath(fn), func(w http.ResponseWriter, r *http.Request) {
+		partNum := r.URL.Query().Get("part_number")
+		file, _, err := r.FormFile("data")
+		require.NoError(t, err)
+		defer file.Close()
+		data, err := ioutil.ReadAll(file)
+		require.NoError(t, err)
+		md5Sum := md5.Sum(data)
+		sha256Sum := sha256.Sum256(data)
+		assert.Equal(t, base64.StdEncoding.EncodeToString(md5Sum[:]), r.Header.Get(PartMD5Header))
+		assert.Equal(t, hex.EncodeToString(sha256Sum[:]), r.Header.Get(PartSHA256Header))
+
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[partNum]++
+		// Simulate parts corrupted on their way to storage.
+		if corrupt[partNum] > 0 {
+			corrupt[partNum]--
+			data = append(data, 'x')
+		}
+		sum := md5.Sum(data)
+		_ = json.NewEncoder(w).Encode(&Part{Size: len(data), Etag: `"` + hex.EncodeToString(sum[:]) + `"`})
+	})
+	var completed CompleteMultipartRequest
+	mux.HandleFunc("/api/v1"+client.completeMultipartPath(fn), func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "foo", r.URL.Query().Get("upload_id"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&completed))
+	})
+
+	content := strings.Repeat("a", 1000) + strings.Repeat("b", 1000) + "c"
+	pw := NewProgressWriter(ioutil.Discard)
+	require.NoError(t, client.UploadStream(context.Background(), fn, strings.NewReader(content), pw))
+	assert.Equal(t, map[string]int{"1": 1, "2": 2, "3": 1}, attempts)
+	require.Len(t, completed.Parts, 3)
+	for i, p := range completed.Parts {
+		data := content[i*1000:]
+		if len(data) > 1000 {
+			data = data[:1000]
+		}
+		md5Sum := md5.Sum([]byte(data))
+		sha256Sum := sha256.Sum256([]byte(data))
+		assert.Equal(t, Part{PartNumber: i + 1, Size: len(data), Etag: hex.EncodeToString(md5Sum[:]), SHA256: hex.EncodeToString(sha256Sum[:])}, p)
+	}
+
+	// A part which keeps being corrupted fails the upload.
+	corrupt["2"] = maxPartAttempts
+	completed = CompleteMultipartRequest{}
+	err := client.UploadStream(context.Background(), fn, strings.NewReader(content), pw)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), ErrPartMismatch.Error())
+	assert.Empty(t, completed.Parts)
+}
+
+func TestClient_UploadStreamCanceled(t *testing.T) {
+	setUp()
+	defer tearDown()
+	client.uploadPartSize = 1000
+
+	fn := "test-upload-stream-canceled"
+	mux.HandleFunc("/api/v1"+client.initMultipartPath(fn), func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(&Multipart{UploadID: "foo"})
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	mux.HandleFunc("/api/v1"+client.uploadPartPath(fn), func(w http.ResponseWriter, r *http.Request) {
+		acknowledgePart(t, w, r)
+		// Cancel once the first part is uploaded.
+		cancel()
+	})
+	completed := 0
+	mux.HandleFunc("/api/v1"+client.completeMultipartPath(fn), func(w http.ResponseWriter, r *http.Request) {
+		completed++
+	})
+	aborted := ""
+	mux.HandleFunc("/api/v1"+client.abortMultipartPath(fn), func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		aborted = r.URL.Query().Get("upload_id")
+	})
+
+	var state UploadState
+	save := func(*UploadState) error { return nil }
+	pw := NewProgressWriter(ioutil.Discard)
+	// The content never ends, only cancellation stops the upload.
+	content := io.MultiReader(strings.NewReader(strings.Repeat("a", 1000)), infiniteReader{})
+	err := client.UploadStream(ctx, fn, content, pw, WithUploadState(&state, save))
+	assert.True(t, errors.Is(err, context.Canceled), err)
+	assert.Equal(t, "foo", aborted)
+	assert.Equal(t, 0, completed)
+	assert.Equal(t, UploadState{}, state)
+}
+
+type infiniteReader struct{}
 
+func (infiniteReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'b'
+	}
+	return len(p), nil
 }
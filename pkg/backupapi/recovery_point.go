@@ -2,12 +2,16 @@ package backupapi
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"time"
 )
 
 const (
@@ -34,6 +38,19 @@ type RecoveryPoint struct {
 	UpdatedAt         string `json:"updated_at"`
 }
 
+// recoveryPointTimeLayouts are the layouts of recovery point times sent by the server.
+var recoveryPointTimeLayouts = []string{time.RFC3339Nano, http.TimeFormat, "2006-01-02T15:04:05", "2006-01-02 15:04:05"}
+
+// CreatedTime returns the creation time of rp, times without time zone are UTC.
+func (rp RecoveryPoint) CreatedTime() (time.Time, error) {
+	for _, layout := range recoveryPointTimeLayouts {
+		if t, err := time.Parse(layout, rp.CreatedAt); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid creation time %q of recovery point %s", rp.CreatedAt, rp.ID)
+}
+
 // CreateRecoveryPointResponse is the server response when creating recovery point
 type CreateRecoveryPointResponse struct {
 	ID            string         `json:"id"`
@@ -53,6 +70,10 @@ type CreateRecoveryPointRequest struct {
 type CreateRestoreRequest struct {
 	MachineID string `json:"machine_id"`
 	Path      string `json:"path"`
+	// RestoreMode is the policy for files existing in Path, empty means the agent default.
+	RestoreMode string `json:"restore_mode,omitempty"`
+	// RestoreInclude restricts the restore to files matching one of the patterns, empty means all files.
+	RestoreInclude []string `json:"restore_include,omitempty"`
 }
 
 // UpdateRecoveryPointRequest represents a request to update a recovery point.
@@ -88,6 +109,10 @@ func (c *Client) completeMultipartPath(recoveryPointID string) string {
 	return fmt.Sprintf("/agent/recovery-points/%s/file/multipart/complete", recoveryPointID)
 }
 
+func (c *Client) abortMultipartPath(recoveryPointID string) string {
+	return fmt.Sprintf("/agent/recovery-points/%s/file/multipart/abort", recoveryPointID)
+}
+
 func (c *Client) CreateRecoveryPoint(ctx context.Context, backupDirectoryID string, crpr *CreateRecoveryPointRequest) (*CreateRecoveryPointResponse, error) {
 	req, err := c.NewRequest(http.MethodPost, c.recoveryPointPath(backupDirectoryID), crpr)
 	if err != nil {
@@ -134,19 +159,27 @@ func (c *Client) UpdateRecoveryPoint(ctx context.Context, backupDirectoryID stri
 	return nil
 }
 
-// DownloadFileContent downloads file content at given recovery point id, write the content to writer.
-func (c *Client) DownloadFileContent(ctx context.Context, createdAt string, restoreSessionKey string, recoveryPointID string, w io.Writer) error {
+func (c *Client) downloadFileContentRequest(createdAt string, restoreSessionKey string, recoveryPointID string) (*http.Request, error) {
 	req, err := c.NewRequest(http.MethodGet, c.downloadFileContentPath(recoveryPointID), nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	req.Header.Add("X-Session-Created-At", createdAt)
 	req.Header.Add("X-Restore-Session-Key", restoreSessionKey)
 	q := req.URL.Query()
 	q.Set("name", recoveryPointID+".zip")
 	req.URL.RawQuery = q.Encode()
+	return req, nil
+}
 
-	resp, err := c.Do(req.WithContext(ctx))
+// DownloadFileContent downloads file content at given recovery point id, write the content to writer.
+func (c *Client) DownloadFileContent(ctx context.Context, createdAt string, restoreSessionKey string, recoveryPointID string, w io.Writer) error {
+	req, err := c.downloadFileContentRequest(createdAt, restoreSessionKey, recoveryPointID)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.transferDo(req.WithContext(ctx))
 	if err != nil {
 		return err
 	}
@@ -159,6 +192,19 @@ func (c *Client) DownloadFileContent(ctx context.Context, createdAt string, rest
 	return err
 }
 
+// RestoreSessionKey returns the key which authorizes downloading content of given recovery point,
+// for a restore session created at createdAt.
+func RestoreSessionKey(secretKey, machineID, createdAt, recoveryPointID string) string {
+	s := strings.Join([]string{secretKey, machineID, createdAt, recoveryPointID}, "")
+	hash := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(hash[:])
+}
+
+// RestoreSessionKey returns the restore session key of client machine for given recovery point.
+func (c *Client) RestoreSessionKey(createdAt, recoveryPointID string) string {
+	return RestoreSessionKey(c.secretKey, c.Id, createdAt, recoveryPointID)
+}
+
 // ListRecoveryPoints list all recovery points of given backup directory.
 func (c *Client) ListRecoveryPoints(ctx context.Context, backupDirectoryID string) ([]RecoveryPoint, error) {
 	req, err := c.NewRequest(http.MethodGet, c.recoveryPointPath(backupDirectoryID), nil)
@@ -182,6 +228,21 @@ func (c *Client) ListRecoveryPoints(ctx context.Context, backupDirectoryID strin
 	return rps, nil
 }
 
+// DeleteRecoveryPoint deletes the recovery point of given backup directory, along with its stored file.
+func (c *Client) DeleteRecoveryPoint(ctx context.Context, backupDirectoryID string, recoveryPointID string) error {
+	req, err := c.NewRequest(http.MethodDelete, c.recoveryPointItemPath(backupDirectoryID, recoveryPointID), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
 func (c *Client) InitMultipart(ctx context.Context, recoveryPointID string) (*Multipart, error) {
 	req, err := c.NewRequest(http.MethodPost, c.initMultipartPath(recoveryPointID), nil)
 	if err != nil {
@@ -204,8 +265,15 @@ func (c *Client) InitMultipart(ctx context.Context, recoveryPointID string) (*Mu
 	return &m, nil
 }
 
-func (c *Client) CompleteMultipart(ctx context.Context, recoveryPointID, uploadID string) error {
-	req, err := c.NewRequest(http.MethodPost, c.completeMultipartPath(recoveryPointID), nil)
+// CompleteMultipartRequest lists the parts of a completed multipart upload, so server can check that the parts it
+// assembles are the uploaded ones.
+type CompleteMultipartRequest struct {
+	Parts []Part `json:"parts"`
+}
+
+// CompleteMultipart completes a multipart upload made of parts, sorted by part number.
+func (c *Client) CompleteMultipart(ctx context.Context, recoveryPointID, uploadID string, parts []Part) error {
+	req, err := c.NewRequest(http.MethodPost, c.completeMultipartPath(recoveryPointID), &CompleteMultipartRequest{Parts: parts})
 	if err != nil {
 		return err
 	}
@@ -226,6 +294,24 @@ func (c *Client) CompleteMultipart(ctx context.Context, recoveryPointID, uploadI
 	return err
 }
 
+// AbortMultipart aborts a multipart upload, server discards its uploaded parts.
+func (c *Client) AbortMultipart(ctx context.Context, recoveryPointID, uploadID string) error {
+	req, err := c.NewRequest(http.MethodPost, c.abortMultipartPath(recoveryPointID), nil)
+	if err != nil {
+		return err
+	}
+	q := req.URL.Query()
+	q.Add("upload_id", uploadID)
+	req.URL.RawQuery = q.Encode()
+
+	resp, err := c.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp)
+}
+
 // RequestRestore requests restore
 func (c *Client) RequestRestore(recoveryPointID string, crr *CreateRestoreRequest) error {
 	req, err := c.NewRequest(http.MethodPost, c.recoveryPointActionPath(recoveryPointID), crr)
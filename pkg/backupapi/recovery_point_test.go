@@ -81,3 +81,40 @@ func TestClient_ListRecoveryPoints(t *testing.T) {
 	require.NoError(t, err)
 	assert.Len(t, rps, 2)
 }
+
+func TestClient_DeleteRecoveryPoint(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	mux.HandleFunc(path.Join("/api/v1/", client.recoveryPointItemPath("1", "2")), func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodDelete, r.Method)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc(path.Join("/api/v1/", client.recoveryPointItemPath("1", "3")), func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	require.NoError(t, client.DeleteRecoveryPoint(context.Background(), "1", "2"))
+	assert.Error(t, client.DeleteRecoveryPoint(context.Background(), "1", "3"))
+}
+
+func TestRecoveryPoint_CreatedTime(t *testing.T) {
+	want := time.Date(2026, 10, 17, 8, 30, 0, 0, time.UTC)
+	for _, createdAt := range []string{"2026-10-17T08:30:00Z", "2026-10-17T15:30:00+07:00", "Sat, 17 Oct 2026 08:30:00 GMT", "2026-10-17T08:30:00", "2026-10-17 08:30:00"} {
+		got, err := RecoveryPoint{CreatedAt: createdAt}.CreatedTime()
+		require.NoError(t, err, createdAt)
+		assert.True(t, want.Equal(got), createdAt)
+	}
+	_, err := RecoveryPoint{CreatedAt: "yesterday"}.CreatedTime()
+	assert.Error(t, err)
+}
+
+func TestRestoreSessionKey(t *testing.T) {
+	c, err := NewClient(WithID("machine-id"), WithSecretKey("secret"))
+	require.NoError(t, err)
+	createdAt := "Mon, 02 Jan 2006 15:04:05 GMT"
+	key := RestoreSessionKey("secret", "machine-id", createdAt, "rp-id")
+	assert.Len(t, key, 64)
+	assert.Equal(t, key, c.RestoreSessionKey(createdAt, "rp-id"))
+	assert.NotEqual(t, key, c.RestoreSessionKey(createdAt, "other-rp-id"))
+}
@@ -20,6 +20,7 @@ const (
 	ConfigUpdateActionAddDirectory      = "add_directory"
 	ConfigUpdateActionDelDirectory      = "del_directory"
 	StatusNotify                        = "status_notify"
+	JobCancel                           = "cancel_job"
 )
 
 // ErrUnknownEventType is raised when receiving unhandled event from broker.
@@ -48,6 +49,13 @@ type Message struct {
 	RecoveryPointID      string `json:"recovery_point_id"`
 	RestoreSessionKey    string `json:"restore_session_key"`
 	ActionId             string `json:"action_id"`
+	// RestoreMode is the policy for files existing in DestinationDirectory, empty means the agent default.
+	RestoreMode string `json:"restore_mode"`
+	// RestoreInclude restricts the restore to files matching one of the patterns, empty means all files.
+	RestoreInclude []string `json:"restore_include"`
+
+	// For canceling jobs, by ID, or else the jobs of BackupDirectoryID or RecoveryPointID.
+	JobID string `json:"job_id"`
 
 	// For config update
 	BackupDirectories []backupapi.BackupDirectoryConfig `json:"backup_directories"`
@@ -0,0 +1,300 @@
+// Package cache keeps local copies of the files of recent recovery points, so restoring them does not download
+// them from the backup server.
+//
+// A file is cached as it is uploaded, encrypted if the recovery point is. The cache keeps the newest files up to
+// a number of files and a total size, evicting the oldest ones. Each file is stored next to a JSON entry holding
+// its SHA-256, which callers compare with the record of the backup server before using the copy.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	fileSuffix  = ".archive"
+	entrySuffix = ".json"
+	tempPrefix  = "tmp-"
+)
+
+// ErrNotFound indicates that a recovery point is not in the cache.
+var ErrNotFound = errors.New("recovery point is not cached")
+
+// Entry describes a cached recovery point file.
+type Entry struct {
+	RecoveryPointID   string    `json:"recovery_point_id"`
+	BackupDirectoryID string    `json:"backup_directory_id,omitempty"`
+	Size              int64     `json:"size"`
+	SHA256            string    `json:"sha256"`
+	CreatedAt         time.Time `json:"created_at"`
+}
+
+// Cache is a directory of recovery point files. It is safe for concurrent use.
+type Cache struct {
+	dir        string
+	maxEntries int
+	maxBytes   int64
+
+	mu sync.Mutex
+}
+
+// Open returns the cache in dir, keeping at most maxEntries files of at most maxBytes in total. Zero means no
+// limit, but at least one of them must be set. Files left by interrupted writes are removed.
+func Open(dir string, maxEntries int, maxBytes int64) (*Cache, error) {
+	if maxEntries < 0 || maxBytes < 0 {
+		return nil, errors.New("negative cache limit")
+	}
+	if maxEntries == 0 && maxBytes == 0 {
+		return nil, errors.New("cache has no limit, set a maximum number of files or size")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	c := &Cache{dir: dir, maxEntries: maxEntries, maxBytes: maxBytes}
+	names, err := filepath.Glob(filepath.Join(dir, tempPrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		_ = os.Remove(name)
+	}
+	return c, nil
+}
+
+func (c *Cache) filePath(recoveryPointID string) string {
+	return filepath.Join(c.dir, recoveryPointID+fileSuffix)
+}
+
+func (c *Cache) entryPath(recoveryPointID string) string {
+	return filepath.Join(c.dir, recoveryPointID+entrySuffix)
+}
+
+// Get returns the entry of the recovery point, if it is cached.
+func (c *Cache) Get(recoveryPointID string) (Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, err := c.readEntry(c.entryPath(recoveryPointID))
+	if err != nil {
+		return Entry{}, false
+	}
+	if _, err := os.Stat(c.filePath(recoveryPointID)); err != nil {
+		return Entry{}, false
+	}
+	return e, true
+}
+
+// Entries returns the entries of the cache, newest first.
+func (c *Cache) Entries() ([]Entry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries()
+}
+
+// entries returns the entries of the cache newest first, c.mu must be held.
+func (c *Cache) entries() ([]Entry, error) {
+	names, err := filepath.Glob(filepath.Join(c.dir, "*"+entrySuffix))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, 0, len(names))
+	for _, name := range names {
+		if strings.HasPrefix(filepath.Base(name), tempPrefix) {
+			continue
+		}
+		e, err := c.readEntry(name)
+		if err != nil {
+			// An unreadable entry does not describe its file anymore.
+			id := strings.TrimSuffix(filepath.Base(name), entrySuffix)
+			_ = os.Remove(c.filePath(id))
+			_ = os.Remove(name)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.After(entries[j].CreatedAt)
+	})
+	return entries, nil
+}
+
+func (c *Cache) readEntry(name string) (Entry, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return Entry{}, err
+	}
+	var e Entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return Entry{}, err
+	}
+	return e, nil
+}
+
+// CopyTo copies the cached file of the recovery point to a new file at name. It fails if the copy does not have
+// the SHA-256 of the entry, in which case the corrupted file is removed from the cache.
+func (c *Cache) CopyTo(recoveryPointID string, name string) error {
+	e, ok := c.Get(recoveryPointID)
+	if !ok {
+		return ErrNotFound
+	}
+	src, err := os.Open(c.filePath(recoveryPointID))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(dst, h), src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && (n != e.Size || hex.EncodeToString(h.Sum(nil)) != e.SHA256) {
+		_ = c.Remove(recoveryPointID)
+		err = fmt.Errorf("cached file of recovery point %s is corrupted", recoveryPointID)
+	}
+	if err != nil {
+		_ = os.Remove(name)
+		return err
+	}
+	return nil
+}
+
+// Remove removes the recovery point from the cache.
+func (c *Cache) Remove(recoveryPointID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.remove(recoveryPointID)
+}
+
+func (c *Cache) remove(recoveryPointID string) error {
+	// The entry goes first, a file without entry is never used.
+	if err := os.Remove(c.entryPath(recoveryPointID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(c.filePath(recoveryPointID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// evict removes the oldest entries beyond the limits of c, c.mu must be held.
+func (c *Cache) evict() error {
+	entries, err := c.entries()
+	if err != nil {
+		return err
+	}
+	var size int64
+	for i, e := range entries {
+		size += e.Size
+		if (c.maxEntries > 0 && i >= c.maxEntries) || (c.maxBytes > 0 && size > c.maxBytes) {
+			if err := c.remove(e.RecoveryPointID); err != nil {
+				return err
+			}
+			size -= e.Size
+		}
+	}
+	return nil
+}
+
+// Writer writes a recovery point file to the cache. Writes never fail, so a Writer can be teed with an upload
+// without failing it: errors are returned by Commit.
+type Writer struct {
+	c     *Cache
+	entry Entry
+	f     *os.File
+	h     hash.Hash
+	err   error
+}
+
+// Create returns a Writer caching the file of a recovery point of the backup directory, once committed.
+func (c *Cache) Create(recoveryPointID string, backupDirectoryID string) (*Writer, error) {
+	f, err := ioutil.TempFile(c.dir, tempPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{
+		c:     c,
+		entry: Entry{RecoveryPointID: recoveryPointID, BackupDirectoryID: backupDirectoryID},
+		f:     f,
+		h:     sha256.New(),
+	}, nil
+}
+
+// Write writes p to the cached file. It stops writing after an error, and a file larger than the size limit of
+// the cache is not written further since it would not be kept.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return len(p), nil
+	}
+	if w.c.maxBytes > 0 && w.entry.Size+int64(len(p)) > w.c.maxBytes {
+		w.err = errors.New("file is larger than the cache")
+		return len(p), nil
+	}
+	if _, err := w.f.Write(p); err != nil {
+		w.err = err
+		return len(p), nil
+	}
+	w.h.Write(p)
+	w.entry.Size += int64(len(p))
+	return len(p), nil
+}
+
+// Abort discards the written file.
+func (w *Writer) Abort() {
+	_ = w.f.Close()
+	_ = os.Remove(w.f.Name())
+}
+
+// Commit adds the written file to the cache, and evicts the oldest files beyond the limits of the cache.
+func (w *Writer) Commit() (Entry, error) {
+	if w.err != nil {
+		w.Abort()
+		return Entry{}, w.err
+	}
+	if err := w.f.Close(); err != nil {
+		w.Abort()
+		return Entry{}, err
+	}
+	w.entry.SHA256 = hex.EncodeToString(w.h.Sum(nil))
+	w.entry.CreatedAt = time.Now()
+	data, err := json.Marshal(w.entry)
+	if err != nil {
+		w.Abort()
+		return Entry{}, err
+	}
+
+	c := w.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := w.entry.RecoveryPointID
+	if err := os.Rename(w.f.Name(), c.filePath(id)); err != nil {
+		w.Abort()
+		return Entry{}, err
+	}
+	// The entry is written last, a file without entry is never used.
+	tmp := filepath.Join(c.dir, tempPrefix+id+entrySuffix)
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		_ = os.Remove(c.filePath(id))
+		return Entry{}, err
+	}
+	if err := os.Rename(tmp, c.entryPath(id)); err != nil {
+		_ = os.Remove(tmp)
+		_ = os.Remove(c.filePath(id))
+		return Entry{}, err
+	}
+	return w.entry, c.evict()
+}
@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func put(t *testing.T, c *Cache, id string, content string) Entry {
+	w, err := c.Create(id, "bd1")
+	require.NoError(t, err)
+	_, err = w.Write([]byte(content))
+	require.NoError(t, err)
+	e, err := w.Commit()
+	require.NoError(t, err)
+	// Entries are ordered by creation time.
+	time.Sleep(10 * time.Millisecond)
+	return e
+}
+
+func ids(t *testing.T, c *Cache) []string {
+	entries, err := c.Entries()
+	require.NoError(t, err)
+	var ids []string
+	for _, e := range entries {
+		ids = append(ids, e.RecoveryPointID)
+	}
+	return ids
+}
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bizfly-backup-cache-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	_, err = Open(dir, 0, 0)
+	assert.Error(t, err)
+	c, err := Open(dir, 2, 0)
+	require.NoError(t, err)
+
+	e := put(t, c, "rp1", "first")
+	assert.Equal(t, int64(5), e.Size)
+	assert.Equal(t, "a7937b64b8caa58f03721bb6bacf5c78cb235febe0e70b1b84cd99541461a08e", e.SHA256)
+	got, ok := c.Get("rp1")
+	require.True(t, ok)
+	assert.Equal(t, e.SHA256, got.SHA256)
+	assert.Equal(t, "bd1", got.BackupDirectoryID)
+
+	name := filepath.Join(dir, "..", filepath.Base(dir)+".copy")
+	defer os.Remove(name)
+	require.NoError(t, c.CopyTo("rp1", name))
+	data, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(data))
+	assert.Equal(t, ErrNotFound, c.CopyTo("rp0", name))
+
+	// The oldest file is evicted beyond the limit.
+	put(t, c, "rp2", "second")
+	put(t, c, "rp3", "third")
+	assert.Equal(t, []string{"rp3", "rp2"}, ids(t, c))
+	_, ok = c.Get("rp1")
+	assert.False(t, ok)
+
+	// A corrupted file is removed.
+	require.NoError(t, ioutil.WriteFile(c.filePath("rp2"), []byte("changed"), 0600))
+	assert.Error(t, c.CopyTo("rp2", name))
+	_, ok = c.Get("rp2")
+	assert.False(t, ok)
+
+	// An aborted file is not cached.
+	w, err := c.Create("rp4", "bd1")
+	require.NoError(t, err)
+	_, _ = w.Write([]byte("aborted"))
+	w.Abort()
+	assert.Equal(t, []string{"rp3"}, ids(t, c))
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+}
+
+func TestCache_maxBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bizfly-backup-cache-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c, err := Open(dir, 0, 10)
+	require.NoError(t, err)
+
+	put(t, c, "rp1", "12345")
+	put(t, c, "rp2", "1234")
+	put(t, c, "rp3", "123")
+	assert.Equal(t, []string{"rp3", "rp2"}, ids(t, c))
+
+	// A file larger than the cache is not kept, but writes do not fail.
+	w, err := c.Create("big", "bd1")
+	require.NoError(t, err)
+	n, err := w.Write([]byte(strings.Repeat("x", 11)))
+	require.NoError(t, err)
+	assert.Equal(t, 11, n)
+	_, err = w.Commit()
+	assert.Error(t, err)
+	assert.Equal(t, []string{"rp3", "rp2"}, ids(t, c))
+}
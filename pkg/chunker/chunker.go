@@ -0,0 +1,162 @@
+// Package chunker splits a stream into content-defined chunks.
+//
+// Chunk boundaries are chosen by a gear rolling hash over the data (FastCDC), so inserting or removing
+// bytes only changes the chunks around the edit, and unchanged data produces the same chunks across backups.
+package chunker
+
+import (
+	"errors"
+	"io"
+	"math/bits"
+)
+
+const (
+	// MinSize is the default minimum chunk size.
+	MinSize = 512 * 1024
+	// AvgSize is the default average chunk size.
+	AvgSize = 1024 * 1024
+	// MaxSize is the default maximum chunk size.
+	MaxSize = 8 * 1024 * 1024
+
+	// gearSeed seeds the gear table. Changing it changes every chunk boundary, so it must never change.
+	gearSeed = 0x6269_7a66_6c79_6263
+)
+
+var gear [256]uint64
+
+func init() {
+	// splitmix64, fixed seed: the table must be identical across builds and platforms.
+	x := uint64(gearSeed)
+	for i := range gear {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// Chunker reads from an io.Reader and returns content-defined chunks.
+type Chunker struct {
+	r   io.Reader
+	buf []byte
+	// data in buf[start:end] is pending.
+	start, end int
+	eof        bool
+
+	minSize, avgSize, maxSize int
+	maskS, maskL              uint64
+}
+
+// Option configures a Chunker.
+type Option func(c *Chunker) error
+
+// WithSizes returns an Option which set the min, average and max chunk size.
+// The average size must be a power of two.
+func WithSizes(min, avg, max int) Option {
+	return func(c *Chunker) error {
+		if min <= 0 || min > avg || avg > max {
+			return errors.New("invalid chunk sizes")
+		}
+		if avg&(avg-1) != 0 {
+			return errors.New("average chunk size must be a power of two")
+		}
+		c.minSize, c.avgSize, c.maxSize = min, avg, max
+		return nil
+	}
+}
+
+// New creates a Chunker reading from r.
+func New(r io.Reader, opts ...Option) (*Chunker, error) {
+	c := &Chunker{
+		r:       r,
+		minSize: MinSize,
+		avgSize: AvgSize,
+		maxSize: MaxSize,
+	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+	// Normalized chunking: a harder mask before the average size, an easier one after it,
+	// which narrows the chunk size distribution around avgSize.
+	n := bits.TrailingZeros(uint(c.avgSize))
+	c.maskS = topBits(n + 2)
+	c.maskL = topBits(n - 2)
+	c.buf = make([]byte, 2*c.maxSize)
+	return c, nil
+}
+
+func topBits(n int) uint64 {
+	if n <= 0 {
+		return 0
+	}
+	return ^uint64(0) << uint(64-n)
+}
+
+// Next returns the next chunk, or io.EOF when the stream is exhausted.
+//
+// The returned slice is only valid until the next call to Next.
+func (c *Chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	data := c.buf[c.start:c.end]
+	n := c.cut(data)
+	c.start += n
+	return data[:n], nil
+}
+
+// fill makes sure at least maxSize bytes are pending, unless the reader is exhausted.
+func (c *Chunker) fill() error {
+	if c.eof || c.end-c.start >= c.maxSize {
+		return nil
+	}
+	copy(c.buf, c.buf[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+	n, err := io.ReadFull(c.r, c.buf[c.end:])
+	c.end += n
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		c.eof = true
+	case err != nil:
+		return err
+	}
+	return nil
+}
+
+// cut returns the length of the first chunk in data.
+func (c *Chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.minSize {
+		return n
+	}
+	if n > c.maxSize {
+		n = c.maxSize
+	}
+	normal := c.avgSize
+	if n < normal {
+		normal = n
+	}
+
+	var h uint64
+	i := c.minSize
+	for ; i < normal; i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		h = (h << 1) + gear[data[i]]
+		if h&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
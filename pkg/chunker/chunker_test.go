@@ -0,0 +1,97 @@
+package chunker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func randomData(t *testing.T, seed int64, n int) []byte {
+	buf := make([]byte, n)
+	_, err := rand.New(rand.NewSource(seed)).Read(buf)
+	require.NoError(t, err)
+	return buf
+}
+
+func chunkAll(t *testing.T, data []byte, opts ...Option) [][32]byte {
+	c, err := New(bytes.NewReader(data), opts...)
+	require.NoError(t, err)
+	var (
+		ids   [][32]byte
+		total bytes.Buffer
+	)
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		total.Write(chunk)
+		ids = append(ids, sha256.Sum256(chunk))
+	}
+	require.Equal(t, data, total.Bytes())
+	return ids
+}
+
+func TestChunkerSizes(t *testing.T) {
+	data := randomData(t, 1, 32*1024*1024)
+	c, err := New(bytes.NewReader(data))
+	require.NoError(t, err)
+	count := 0
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		count++
+		assert.LessOrEqual(t, len(chunk), MaxSize)
+		if c.eof && c.start == c.end {
+			// The last chunk may be shorter than MinSize.
+			continue
+		}
+		assert.GreaterOrEqual(t, len(chunk), MinSize)
+	}
+	assert.Greater(t, count, 8)
+}
+
+func TestChunkerEmpty(t *testing.T) {
+	c, err := New(bytes.NewReader(nil))
+	require.NoError(t, err)
+	_, err = c.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestChunkerInvalidSizes(t *testing.T) {
+	_, err := New(nil, WithSizes(1024, 1000, 4096))
+	assert.Error(t, err)
+	_, err = New(nil, WithSizes(4096, 1024, 8192))
+	assert.Error(t, err)
+}
+
+func TestChunkerShiftResistance(t *testing.T) {
+	opt := WithSizes(16*1024, 64*1024, 256*1024)
+	data := randomData(t, 2, 4*1024*1024)
+	shifted := append([]byte("inserted bytes at the beginning"), data...)
+
+	a := chunkAll(t, data, opt)
+	b := chunkAll(t, shifted, opt)
+
+	seen := make(map[[32]byte]bool, len(a))
+	for _, id := range a {
+		seen[id] = true
+	}
+	same := 0
+	for _, id := range b {
+		if seen[id] {
+			same++
+		}
+	}
+	// Only the chunks around the insertion should differ.
+	assert.GreaterOrEqual(t, same, len(a)-2)
+}
@@ -0,0 +1,181 @@
+// Package compression implements the codecs used to compress backup archives.
+//
+// Streams compressed by a codec are self-describing: Detect finds the codec of a stream from its first bytes,
+// except for Store which leaves data as is.
+package compression
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Names of built-in codecs.
+const (
+	Store   = "store"
+	Deflate = "deflate"
+	Gzip    = "gzip"
+	Zstd    = "zstd"
+)
+
+// HeaderSize is the number of bytes Detect needs to find the codec of a stream.
+const HeaderSize = 4
+
+// ErrUnknownCodec indicates that no codec is registered with given name.
+var ErrUnknownCodec = errors.New("unknown compression codec")
+
+// Codec compresses and decompresses streams.
+type Codec interface {
+	// Name returns the name of the codec, as used in configuration.
+	Name() string
+	// NewWriter returns a writer compressing to w at given level, zero means the default level of the codec.
+	// Compressed data is complete once the writer is closed.
+	NewWriter(w io.Writer, level int) (io.WriteCloser, error)
+	// NewReader returns a reader decompressing r.
+	NewReader(r io.Reader) (io.ReadCloser, error)
+	// Match reports whether header, the first HeaderSize bytes of a stream, is produced by the codec.
+	Match(header []byte) bool
+}
+
+var (
+	mu     sync.RWMutex
+	codecs = make(map[string]Codec)
+)
+
+func init() {
+	Register(storeCodec{})
+	Register(deflateCodec{})
+	Register(gzipCodec{})
+	Register(zstdCodec{})
+}
+
+// Register makes codec available by its name, replacing a codec registered with the same name.
+func Register(codec Codec) {
+	mu.Lock()
+	defer mu.Unlock()
+	codecs[codec.Name()] = codec
+}
+
+// Lookup returns the codec registered with given name.
+func Lookup(name string) (Codec, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCodec, name)
+	}
+	return c, nil
+}
+
+// Detect returns the codec which produced a stream starting with header, or nil if none matches.
+func Detect(header []byte) Codec {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if codecs[name].Match(header) {
+			return codecs[name]
+		}
+	}
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+type storeCodec struct{}
+
+func (storeCodec) Name() string { return Store }
+
+func (storeCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (storeCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(r), nil
+}
+
+// Match returns false, stored data can not be told apart from any other data.
+func (storeCodec) Match(header []byte) bool { return false }
+
+func flateLevel(level int) int {
+	if level == 0 {
+		return flate.DefaultCompression
+	}
+	return level
+}
+
+// deflateCodec produces zlib streams, which are deflate streams with a header identifying them.
+type deflateCodec struct{}
+
+func (deflateCodec) Name() string { return Deflate }
+
+func (deflateCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return zlib.NewWriterLevel(w, flateLevel(level))
+}
+
+func (deflateCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return zlib.NewReader(r)
+}
+
+// Match checks the zlib header of RFC 1950: deflate method, and a check value making the header a multiple of 31.
+func (deflateCodec) Match(header []byte) bool {
+	return len(header) >= 2 && header[0]&0x0f == 8 && header[0]>>4 <= 7 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return Gzip }
+
+func (gzipCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, flateLevel(level))
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func (gzipCodec) Match(header []byte) bool {
+	return bytes.HasPrefix(header, []byte{0x1f, 0x8b})
+}
+
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string { return Zstd }
+
+// NewWriter returns a zstd writer, level is a zstd level from 1 to 22 mapped to the closest supported level.
+func (zstdCodec) NewWriter(w io.Writer, level int) (io.WriteCloser, error) {
+	opts := []zstd.EOption{zstd.WithEncoderCRC(true)}
+	if level != 0 {
+		opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	}
+	return zstd.NewWriter(w, opts...)
+}
+
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
+func (zstdCodec) Match(header []byte) bool {
+	return bytes.HasPrefix(header, []byte{0x28, 0xb5, 0x2f, 0xfd})
+}
@@ -0,0 +1,56 @@
+package compression
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodecs(t *testing.T) {
+	plain := []byte(strings.Repeat("log line\n", 10000))
+	for _, name := range []string{Store, Deflate, Gzip, Zstd} {
+		for _, level := range []int{0, 1, 9} {
+			codec, err := Lookup(name)
+			require.NoError(t, err)
+			var buf bytes.Buffer
+			w, err := codec.NewWriter(&buf, level)
+			require.NoError(t, err, name)
+			_, err = w.Write(plain)
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+			if name != Store {
+				assert.Less(t, buf.Len(), len(plain)/10, "%s level %d", name, level)
+			}
+
+			detected := Detect(buf.Bytes()[:HeaderSize])
+			if name == Store {
+				assert.Nil(t, detected)
+			} else {
+				require.NotNil(t, detected, name)
+				assert.Equal(t, name, detected.Name())
+			}
+
+			r, err := codec.NewReader(&buf)
+			require.NoError(t, err)
+			got, err := ioutil.ReadAll(r)
+			require.NoError(t, err)
+			require.NoError(t, r.Close())
+			assert.Equal(t, plain, got, "%s level %d", name, level)
+		}
+	}
+}
+
+func TestDetect(t *testing.T) {
+	assert.Nil(t, Detect([]byte("PK\x03\x04")))
+	assert.Nil(t, Detect(nil))
+}
+
+func TestLookupUnknown(t *testing.T) {
+	_, err := Lookup("lz4")
+	assert.True(t, errors.Is(err, ErrUnknownCodec))
+}
@@ -0,0 +1,325 @@
+// Package encryption implements authenticated encryption of backup archives.
+//
+// An encrypted stream starts with a header holding the salt used to derive the key from the passphrase,
+// followed by segments of at most SegmentSize bytes sealed with AES-256-GCM. Segment nonces are made of a
+// random per-stream prefix, the segment counter and a flag marking the last segment, so segments can not
+// be reordered, dropped or truncated without detection.
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	magic = "BZBKENC1"
+	// SegmentSize is the size of plaintext sealed in each segment.
+	SegmentSize = 64 * 1024
+
+	saltSize        = 16
+	noncePrefixSize = 7
+	keyCheckSize    = 16
+	// HeaderSize is the size of the stream header.
+	HeaderSize = len(magic) + saltSize + noncePrefixSize + keyCheckSize
+
+	keySize    = 32
+	iterations = 200000
+	tagSize    = 16
+)
+
+var (
+	// ErrNotEncrypted indicates that the stream does not start with an encryption header.
+	ErrNotEncrypted = errors.New("data is not encrypted")
+	// ErrWrongPassphrase indicates that the stream was encrypted with another passphrase.
+	ErrWrongPassphrase = errors.New("wrong encryption passphrase")
+	// ErrTampered indicates that the stream has been modified or truncated.
+	ErrTampered = errors.New("encrypted data is corrupted or has been tampered with")
+	// ErrNoPassphrase indicates that data is encrypted but no passphrase is configured.
+	ErrNoPassphrase = errors.New("data is encrypted but no encryption passphrase is configured")
+)
+
+// IsEncrypted reports whether header is the beginning of an encrypted stream.
+func IsEncrypted(header []byte) bool {
+	return bytes.HasPrefix(header, []byte(magic))
+}
+
+type key struct {
+	salt  []byte
+	aead  cipher.AEAD
+	check []byte
+}
+
+// Keyring derives keys from a passphrase, and caches them since derivation is deliberately slow.
+type Keyring struct {
+	passphrase []byte
+
+	mu       sync.Mutex
+	writeKey *key
+	keys     map[string]*key
+}
+
+// NewKeyring creates a Keyring for given passphrase.
+func NewKeyring(passphrase string) *Keyring {
+	return &Keyring{
+		passphrase: []byte(passphrase),
+		keys:       make(map[string]*key),
+	}
+}
+
+func (kr *Keyring) key(salt []byte) (*key, error) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if k, ok := kr.keys[string(salt)]; ok {
+		return k, nil
+	}
+	dk := pbkdf2.Key(kr.passphrase, salt, iterations, 2*keySize, sha256.New)
+	block, err := aes.NewCipher(dk[:keySize])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, dk[keySize:])
+	_, _ = mac.Write([]byte(magic))
+	k := &key{
+		salt:  append([]byte(nil), salt...),
+		aead:  aead,
+		check: mac.Sum(nil)[:keyCheckSize],
+	}
+	kr.keys[string(salt)] = k
+	return k, nil
+}
+
+// NewWriter returns a Writer encrypting to w.
+func (kr *Keyring) NewWriter(w io.Writer) (*Writer, error) {
+	kr.mu.Lock()
+	k := kr.writeKey
+	kr.mu.Unlock()
+	if k == nil {
+		salt := make([]byte, saltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		var err error
+		if k, err = kr.key(salt); err != nil {
+			return nil, err
+		}
+		kr.mu.Lock()
+		kr.writeKey = k
+		kr.mu.Unlock()
+	}
+
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, HeaderSize)
+	header = append(header, magic...)
+	header = append(header, k.salt...)
+	header = append(header, prefix...)
+	header = append(header, k.check...)
+	return newWriter(w, k, header), nil
+}
+
+// ResumeWriter returns a Writer encrypting to w with the key and nonces of the stream which started with header,
+// so encrypting the same plaintext produces the same stream again. It must only be used to redo a stream
+// whose plaintext is verified to be the same, reusing nonces for another plaintext breaks confidentiality.
+func (kr *Keyring) ResumeWriter(w io.Writer, header []byte) (*Writer, error) {
+	k, err := kr.headerKey(header)
+	if err != nil {
+		return nil, err
+	}
+	return newWriter(w, k, append([]byte(nil), header...)), nil
+}
+
+func newWriter(w io.Writer, k *key, header []byte) *Writer {
+	return &Writer{
+		w:      w,
+		k:      k,
+		header: header,
+		prefix: header[len(magic)+saltSize : len(magic)+saltSize+noncePrefixSize],
+		buf:    make([]byte, 0, SegmentSize),
+		out:    make([]byte, 0, SegmentSize+tagSize),
+	}
+}
+
+// headerKey returns the key of stream header, checking that it is derived from keyring passphrase.
+func (kr *Keyring) headerKey(header []byte) (*key, error) {
+	if len(header) != HeaderSize || !IsEncrypted(header) {
+		return nil, ErrNotEncrypted
+	}
+	salt := header[len(magic) : len(magic)+saltSize]
+	check := header[len(magic)+saltSize+noncePrefixSize:]
+	k, err := kr.key(salt)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(check, k.check) {
+		return nil, ErrWrongPassphrase
+	}
+	return k, nil
+}
+
+// NewReader returns a Reader decrypting r.
+func (kr *Keyring) NewReader(r io.Reader) (io.Reader, error) {
+	header := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrNotEncrypted
+		}
+		return nil, err
+	}
+	k, err := kr.headerKey(header)
+	if err != nil {
+		return nil, err
+	}
+	return &reader{
+		r:      r,
+		k:      k,
+		header: header,
+		prefix: header[len(magic)+saltSize : len(magic)+saltSize+noncePrefixSize],
+		in:     make([]byte, SegmentSize+tagSize),
+	}, nil
+}
+
+func nonce(prefix []byte, counter uint32, last bool) []byte {
+	n := make([]byte, 0, 12)
+	n = append(n, prefix...)
+	n = append(n, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(n[noncePrefixSize:], counter)
+	if last {
+		n[11] = 1
+	}
+	return n
+}
+
+// Writer encrypts data written to it. The header is written to the underlying writer along with the first segment.
+type Writer struct {
+	w             io.Writer
+	k             *key
+	header        []byte
+	headerWritten bool
+	prefix        []byte
+	counter       uint32
+	buf           []byte
+	out           []byte
+	closed        bool
+}
+
+// Header returns the header of the encrypted stream.
+func (w *Writer) Header() []byte {
+	return w.header
+}
+
+// Write implements io.Writer interface.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed encryption writer")
+	}
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+		// A full segment is only sealed once more data arrives, the last segment is always shorter.
+		if len(w.buf) == cap(w.buf) && len(p) > 0 {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *Writer) seal(last bool) error {
+	if w.counter == ^uint32(0) {
+		return errors.New("encrypted stream is too long")
+	}
+	if len(w.buf) == cap(w.buf) && last {
+		// Keep the invariant that the last segment is shorter than SegmentSize.
+		if err := w.seal(false); err != nil {
+			return err
+		}
+	}
+	if !w.headerWritten {
+		if _, err := w.w.Write(w.header); err != nil {
+			return err
+		}
+		w.headerWritten = true
+	}
+	w.out = w.k.aead.Seal(w.out[:0], nonce(w.prefix, w.counter, last), w.buf, w.header)
+	w.counter++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(w.out)
+	return err
+}
+
+// Close seals the last segment, it does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.seal(true)
+}
+
+type reader struct {
+	r       io.Reader
+	k       *key
+	header  []byte
+	prefix  []byte
+	counter uint32
+	in      []byte
+	plain   []byte
+	done    bool
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *reader) next() error {
+	n, err := io.ReadFull(r.r, r.in)
+	last := false
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	}
+	if n < tagSize {
+		return fmt.Errorf("truncated segment: %w", ErrTampered)
+	}
+	plain, err := r.k.aead.Open(r.in[:0], nonce(r.prefix, r.counter, last), r.in[:n], r.header)
+	if err != nil {
+		return ErrTampered
+	}
+	r.counter++
+	r.plain = plain
+	r.done = last
+	return nil
+}
@@ -0,0 +1,139 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func encrypt(t *testing.T, kr *Keyring, plain []byte) []byte {
+	var buf bytes.Buffer
+	w, err := kr.NewWriter(&buf)
+	require.NoError(t, err)
+	_, err = w.Write(plain)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func decrypt(kr *Keyring, data []byte) ([]byte, error) {
+	r, err := kr.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestRoundTrip(t *testing.T) {
+	kr := NewKeyring("passphrase")
+	for _, size := range []int{0, 1, SegmentSize - 1, SegmentSize, SegmentSize + 1, 3*SegmentSize + 100} {
+		plain := make([]byte, size)
+		_, _ = rand.Read(plain)
+		data := encrypt(t, kr, plain)
+		assert.True(t, IsEncrypted(data))
+		got, err := decrypt(NewKeyring("passphrase"), data)
+		require.NoError(t, err, "size %d", size)
+		assert.Equal(t, plain, got, "size %d", size)
+	}
+}
+
+func TestSmallWrites(t *testing.T) {
+	kr := NewKeyring("passphrase")
+	plain := make([]byte, 2*SegmentSize+10)
+	_, _ = rand.Read(plain)
+	var buf bytes.Buffer
+	w, err := kr.NewWriter(&buf)
+	require.NoError(t, err)
+	for i := 0; i < len(plain); i += 1000 {
+		end := i + 1000
+		if end > len(plain) {
+			end = len(plain)
+		}
+		_, err := w.Write(plain[i:end])
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	got, err := decrypt(kr, buf.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, plain, got)
+}
+
+func TestWrongPassphrase(t *testing.T) {
+	data := encrypt(t, NewKeyring("passphrase"), []byte("foo"))
+	_, err := decrypt(NewKeyring("other"), data)
+	assert.Equal(t, ErrWrongPassphrase, err)
+}
+
+func TestTampered(t *testing.T) {
+	kr := NewKeyring("passphrase")
+	plain := bytes.Repeat([]byte("a"), 2*SegmentSize+10)
+	data := encrypt(t, kr, plain)
+
+	modified := append([]byte(nil), data...)
+	modified[HeaderSize+SegmentSize+100] ^= 1
+	_, err := decrypt(kr, modified)
+	assert.Equal(t, ErrTampered, err)
+
+	// Dropping the last segment must be detected.
+	_, err = decrypt(kr, data[:HeaderSize+2*(SegmentSize+tagSize)])
+	assert.Error(t, err)
+
+	// Changing the header must be detected too.
+	modified = append([]byte(nil), data...)
+	modified[len(magic)+saltSize] ^= 1
+	_, err = decrypt(kr, modified)
+	assert.Equal(t, ErrTampered, err)
+}
+
+func TestNotEncrypted(t *testing.T) {
+	_, err := decrypt(NewKeyring("passphrase"), []byte("PK\x03\x04 this is a zip file, not encrypted data"))
+	assert.Equal(t, ErrNotEncrypted, err)
+	_, err = decrypt(NewKeyring("passphrase"), []byte("short"))
+	assert.Equal(t, ErrNotEncrypted, err)
+}
+
+func TestPBKDF2(t *testing.T) {
+	// RFC 7914, section 11.
+	expected := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	assert.Equal(t, expected, hex.EncodeToString(pbkdf2.Key([]byte("passwd"), []byte("salt"), 1, 64, sha256.New)))
+
+	// Keys of existing streams must not change.
+	k, err := NewKeyring("passphrase").key([]byte("0123456789abcdef"))
+	require.NoError(t, err)
+	assert.Equal(t, "40e7e1d213e24af956e07c12b5246ad8", hex.EncodeToString(k.check))
+}
+
+func TestResumeWriter(t *testing.T) {
+	kr := NewKeyring("passphrase")
+	plain := bytes.Repeat([]byte("a"), SegmentSize+10)
+
+	var first bytes.Buffer
+	w, err := kr.NewWriter(&first)
+	require.NoError(t, err)
+	// Nothing is written before the first segment is sealed.
+	assert.Equal(t, 0, first.Len())
+	_, err = w.Write(plain)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	var second bytes.Buffer
+	rw, err := NewKeyring("passphrase").ResumeWriter(&second, w.Header())
+	require.NoError(t, err)
+	_, err = rw.Write(plain)
+	require.NoError(t, err)
+	require.NoError(t, rw.Close())
+	assert.Equal(t, first.Bytes(), second.Bytes())
+
+	_, err = NewKeyring("other").ResumeWriter(&second, w.Header())
+	assert.Equal(t, ErrWrongPassphrase, err)
+	_, err = kr.ResumeWriter(&second, []byte("foo"))
+	assert.Equal(t, ErrNotEncrypted, err)
+}
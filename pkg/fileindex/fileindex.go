@@ -0,0 +1,99 @@
+// Package fileindex keeps the local index of files seen by the last backup of a directory,
+// which is used to find what changed since then.
+package fileindex
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Entry is the state of a file at the time it was backed up.
+type Entry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Inode   uint64    `json:"inode"`
+	Hash    string    `json:"hash,omitempty"`
+}
+
+// Index maps file path, relative to the backup directory, to its Entry.
+type Index struct {
+	// RecoveryPointID is the recovery point which contains the files of this index.
+	RecoveryPointID string `json:"recovery_point_id"`
+	// Incrementals is the number of incremental recovery points since the last initial replica.
+	Incrementals int              `json:"incrementals"`
+	Entries      map[string]Entry `json:"entries"`
+}
+
+// New creates an empty Index.
+func New() *Index {
+	return &Index{Entries: make(map[string]Entry)}
+}
+
+// NewEntry returns the Entry of given file info, without hash.
+func NewEntry(fi os.FileInfo) Entry {
+	return Entry{
+		Size:    fi.Size(),
+		ModTime: fi.ModTime().UTC(),
+		Inode:   inode(fi),
+	}
+}
+
+// SameMetadata reports whether e and o have the same size, mtime and inode.
+func (e Entry) SameMetadata(o Entry) bool {
+	return e.Size == o.Size && e.ModTime.Equal(o.ModTime) && e.Inode == o.Inode
+}
+
+// Load reads the Index stored at name. A missing file is returned as an empty Index.
+func Load(name string) (*Index, error) {
+	buf, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return New(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	idx := New()
+	if err := json.Unmarshal(buf, idx); err != nil {
+		return nil, err
+	}
+	if idx.Entries == nil {
+		idx.Entries = make(map[string]Entry)
+	}
+	return idx, nil
+}
+
+// Save writes idx to name atomically.
+func (idx *Index) Save(name string) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := json.NewEncoder(f).Encode(idx); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// Deleted returns the paths in idx which are not in current.
+func (idx *Index) Deleted(current *Index) []string {
+	var deleted []string
+	for p := range idx.Entries {
+		if _, ok := current.Entries[p]; !ok {
+			deleted = append(deleted, p)
+		}
+	}
+	sort.Strings(deleted)
+	return deleted
+}
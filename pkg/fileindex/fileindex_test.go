@@ -0,0 +1,64 @@
+package fileindex
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bizfly-backup-fileindex-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "index", "dir1.json")
+
+	idx, err := Load(name)
+	require.NoError(t, err)
+	assert.Empty(t, idx.RecoveryPointID)
+	assert.Empty(t, idx.Entries)
+
+	idx.RecoveryPointID = "rp1"
+	idx.Incrementals = 2
+	idx.Entries["foo.txt"] = Entry{Size: 3, ModTime: time.Unix(1600000000, 0).UTC(), Inode: 42, Hash: "abc"}
+	require.NoError(t, idx.Save(name))
+
+	loaded, err := Load(name)
+	require.NoError(t, err)
+	assert.Equal(t, idx, loaded)
+}
+
+func TestEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bizfly-backup-fileindex-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "foo.txt")
+	require.NoError(t, ioutil.WriteFile(name, []byte("foo"), 0644))
+
+	fi, err := os.Lstat(name)
+	require.NoError(t, err)
+	e := NewEntry(fi)
+	assert.Equal(t, int64(3), e.Size)
+	assert.True(t, e.SameMetadata(NewEntry(fi)))
+
+	mtime := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(name, mtime, mtime))
+	fi, err = os.Lstat(name)
+	require.NoError(t, err)
+	assert.False(t, e.SameMetadata(NewEntry(fi)))
+}
+
+func TestDeleted(t *testing.T) {
+	prev := New()
+	prev.Entries["a"] = Entry{}
+	prev.Entries["b"] = Entry{}
+	prev.Entries["c"] = Entry{}
+	cur := New()
+	cur.Entries["b"] = Entry{}
+	cur.Entries["d"] = Entry{}
+	assert.Equal(t, []string{"a", "c"}, prev.Deleted(cur))
+}
@@ -0,0 +1,8 @@
+package fileindex
+
+import "os"
+
+// inode is not available from os.FileInfo on windows, size and mtime are used alone.
+func inode(fi os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,300 @@
+// Package filter selects the files of a backup directory.
+//
+// Patterns follow gitignore syntax: "*", "?" and "[...]" match within a path component, "**" matches any
+// number of components, a leading "!" negates the pattern, a trailing "/" matches directories only, and a
+// pattern containing a "/" other than a trailing one is relative to the directory it is defined in,
+// otherwise it matches at any depth. When several exclude patterns match, the last one wins.
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultIgnoreFile is the name of files holding exclude patterns inside the backed up tree.
+const DefaultIgnoreFile = ".bizflyignore"
+
+// Rules selects files to back up.
+type Rules struct {
+	// Include restricts backed up files to those matching one of the patterns, or inside a matching directory.
+	// Empty means all files.
+	Include []string
+	// Exclude lists patterns of files and directories not backed up.
+	Exclude []string
+	// MaxFileSize excludes files larger than it, zero means no limit.
+	MaxFileSize int64
+	// ModifiedBefore excludes files last modified before it, zero means no limit.
+	ModifiedBefore time.Time
+	// IgnoreFile is the name of files holding additional exclude patterns, relative to the directory they are in.
+	// Empty disables them.
+	IgnoreFile string
+}
+
+type pattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// match reports whether name, relative to the directory the pattern is defined in, matches.
+func (p pattern) match(name string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	return p.re.MatchString(name)
+}
+
+// patternSet is a list of patterns defined in directory base.
+type patternSet struct {
+	base     string
+	patterns []pattern
+}
+
+// Filter decides whether files of a tree are excluded, it is safe for concurrent use.
+type Filter struct {
+	root    string
+	rules   Rules
+	include *Selection
+	exclude patternSet
+
+	mu sync.Mutex
+	// ignores caches patterns of ignore files by directory, nil when the directory has none.
+	ignores map[string]*patternSet
+}
+
+// New returns a Filter applying rules to the tree at root.
+func New(root string, rules Rules) (*Filter, error) {
+	include, err := NewSelection(rules.Include)
+	if err != nil {
+		return nil, err
+	}
+	f := &Filter{root: root, rules: rules, include: include, ignores: make(map[string]*patternSet)}
+	for _, s := range rules.Exclude {
+		p, ok, err := parsePattern(s)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			f.exclude.patterns = append(f.exclude.patterns, p)
+		}
+	}
+	return f, nil
+}
+
+// Excluded reports whether file at name, relative to root, with info returned by os.Lstat, is excluded.
+// Content of excluded directories is excluded too, the caller is expected not to walk them.
+// A nil Filter excludes nothing.
+func (f *Filter) Excluded(name string, info os.FileInfo) (bool, error) {
+	if f == nil {
+		return false, nil
+	}
+	name = filepath.ToSlash(name)
+	isDir := info.IsDir()
+	if !isDir {
+		if f.rules.MaxFileSize > 0 && info.Mode().IsRegular() && info.Size() > f.rules.MaxFileSize {
+			return true, nil
+		}
+		if !f.rules.ModifiedBefore.IsZero() && info.ModTime().Before(f.rules.ModifiedBefore) {
+			return true, nil
+		}
+		if !f.include.Match(name, false) {
+			return true, nil
+		}
+	}
+
+	sets := []*patternSet{&f.exclude}
+	if f.rules.IgnoreFile != "" {
+		// Ignore files of deeper directories take precedence.
+		var dirs []string
+		for dir := path.Dir(name); ; dir = path.Dir(dir) {
+			dirs = append(dirs, dir)
+			if dir == "." {
+				break
+			}
+		}
+		for i := len(dirs) - 1; i >= 0; i-- {
+			set, err := f.ignoreFile(dirs[i])
+			if err != nil {
+				return false, err
+			}
+			if set != nil {
+				sets = append(sets, set)
+			}
+		}
+	}
+
+	excluded := false
+	for _, set := range sets {
+		rel := name
+		if set.base != "." {
+			rel = strings.TrimPrefix(name, set.base+"/")
+		}
+		for _, p := range set.patterns {
+			if p.match(rel, isDir) {
+				excluded = !p.negate
+			}
+		}
+	}
+	return excluded, nil
+}
+
+// Selection selects files by include patterns: a file is selected if it or one of its parent directories
+// matches a pattern, the last matching pattern of the deepest matching path wins. A nil Selection selects
+// all files.
+type Selection struct {
+	patterns []pattern
+}
+
+// NewSelection returns the Selection of patterns, or nil if patterns are empty.
+func NewSelection(patterns []string) (*Selection, error) {
+	var sel Selection
+	for _, s := range patterns {
+		p, ok, err := parsePattern(s)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			sel.patterns = append(sel.patterns, p)
+		}
+	}
+	if len(sel.patterns) == 0 {
+		return nil, nil
+	}
+	return &sel, nil
+}
+
+// Match reports whether name, a slash separated path relative to the root, is selected.
+func (s *Selection) Match(name string, isDir bool) bool {
+	if s == nil {
+		return true
+	}
+	for dir := path.Clean(name); dir != "." && dir != "/"; dir, isDir = path.Dir(dir), true {
+		matched, selected := false, false
+		for _, p := range s.patterns {
+			if p.match(dir, isDir) {
+				matched, selected = true, !p.negate
+			}
+		}
+		if matched {
+			return selected
+		}
+	}
+	return false
+}
+
+// ignoreFile returns patterns of the ignore file in dir, relative to root, or nil if there is none.
+func (f *Filter) ignoreFile(dir string) (*patternSet, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if set, ok := f.ignores[dir]; ok {
+		return set, nil
+	}
+	patterns, err := readIgnoreFile(filepath.Join(f.root, filepath.FromSlash(dir), f.rules.IgnoreFile))
+	if err != nil {
+		return nil, err
+	}
+	var set *patternSet
+	if len(patterns) > 0 {
+		set = &patternSet{base: dir, patterns: patterns}
+	}
+	f.ignores[dir] = set
+	return set, nil
+}
+
+func readIgnoreFile(name string) ([]pattern, error) {
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var patterns []pattern
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		p, ok, err := parsePattern(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, line, err)
+		}
+		if ok {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns, scanner.Err()
+}
+
+// parsePattern parses a gitignore pattern, it returns false for blank lines and comments.
+func parsePattern(s string) (pattern, bool, error) {
+	s = strings.TrimRight(s, " \t\r")
+	if s == "" || strings.HasPrefix(s, "#") {
+		return pattern{}, false, nil
+	}
+	var p pattern
+	if strings.HasPrefix(s, "!") {
+		p.negate = true
+		s = s[1:]
+	} else if strings.HasPrefix(s, `\!`) || strings.HasPrefix(s, `\#`) {
+		s = s[1:]
+	}
+	if strings.HasSuffix(s, "/") {
+		p.dirOnly = true
+		s = strings.TrimRight(s, "/")
+	}
+	if s == "" {
+		return pattern{}, false, nil
+	}
+	anchored := strings.Contains(s, "/")
+	s = strings.TrimPrefix(s, "/")
+
+	var re strings.Builder
+	re.WriteString("^")
+	if !anchored {
+		re.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '*' && strings.HasPrefix(s[i:], "**/"):
+			re.WriteString("(?:.*/)?")
+			i += 2
+		case c == '*' && s[i:] == "**":
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(s[i+1:], ']')
+			if end < 0 {
+				return pattern{}, false, fmt.Errorf("invalid pattern %q: unterminated [", s)
+			}
+			class := s[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(s):
+			i++
+			re.WriteString(regexp.QuoteMeta(s[i : i+1]))
+		default:
+			re.WriteString(regexp.QuoteMeta(s[i : i+1]))
+		}
+	}
+	re.WriteString("$")
+	compiled, err := regexp.Compile(re.String())
+	if err != nil {
+		return pattern{}, false, fmt.Errorf("invalid pattern %q: %w", s, err)
+	}
+	p.re = compiled
+	return p, true, nil
+}
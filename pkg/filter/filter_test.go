@@ -0,0 +1,147 @@
+package filter
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parsePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		isDir   bool
+		match   bool
+	}{
+		{"*.log", "app.log", false, true},
+		{"*.log", "var/app.log", false, true},
+		{"*.log", "app.log.1", false, false},
+		{"/build", "build", true, true},
+		{"/build", "src/build", true, false},
+		{"node_modules/", "a/node_modules", true, true},
+		{"node_modules/", "a/node_modules", false, false},
+		{"doc/*.txt", "doc/a.txt", false, true},
+		{"doc/*.txt", "doc/sub/a.txt", false, false},
+		{"doc/**/*.txt", "doc/sub/deep/a.txt", false, true},
+		{"doc/**/*.txt", "doc/a.txt", false, true},
+		{"**/cache", "x/y/cache", true, true},
+		{"logs/**", "logs/a/b", false, true},
+		{"file?.[ch]", "file1.c", false, true},
+		{"file?.[!ch]", "file1.c", false, false},
+		{`\#notcomment`, "#notcomment", false, true},
+	}
+	for _, tc := range tests {
+		p, ok, err := parsePattern(tc.pattern)
+		require.NoError(t, err, tc.pattern)
+		require.True(t, ok, tc.pattern)
+		assert.Equal(t, tc.match, p.match(tc.name, tc.isDir), "%s ~ %s", tc.pattern, tc.name)
+	}
+
+	for _, s := range []string{"", "   ", "# comment"} {
+		_, ok, err := parsePattern(s)
+		require.NoError(t, err)
+		assert.False(t, ok, s)
+	}
+	_, _, err := parsePattern("[abc")
+	assert.Error(t, err)
+}
+
+func walk(t *testing.T, root string, f *Filter) []string {
+	var names []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		excluded, err := f.Excluded(name, info)
+		if err != nil {
+			return err
+		}
+		if excluded {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() {
+			names = append(names, filepath.ToSlash(name))
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	sort.Strings(names)
+	return names
+}
+
+func TestFilter(t *testing.T) {
+	root, err := ioutil.TempDir("", "bizfly-backup-filter-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	files := map[string]string{
+		"main.go":                   "package main",
+		"debug.log":                 "log",
+		"important.log":             "log",
+		"node_modules/lib/index.js": "js",
+		"src/app.go":                "package app",
+		"src/big.bin":               strings.Repeat("0", 100),
+		"src/.bizflyignore":         "*.tmp\n!keep.tmp\n",
+		"src/a.tmp":                 "tmp",
+		"src/keep.tmp":              "tmp",
+		"old.txt":                   "old",
+	}
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, ioutil.WriteFile(p, []byte(content), 0644))
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(root, "old.txt"), old, old))
+
+	f, err := New(root, Rules{
+		Exclude:        []string{"*.log", "!important.log", "node_modules/"},
+		MaxFileSize:    50,
+		ModifiedBefore: time.Now().Add(-24 * time.Hour),
+		IgnoreFile:     DefaultIgnoreFile,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"important.log", "main.go", "src/.bizflyignore", "src/app.go", "src/keep.tmp"}, walk(t, root, f))
+
+	f, err = New(root, Rules{Include: []string{"src/", "*.log"}, IgnoreFile: DefaultIgnoreFile})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"debug.log", "important.log", "src/.bizflyignore", "src/app.go", "src/big.bin", "src/keep.tmp"}, walk(t, root, f))
+
+	// Ignore files are not read when disabled.
+	f, err = New(root, Rules{Include: []string{"src/*.tmp"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"src/a.tmp", "src/keep.tmp"}, walk(t, root, f))
+
+	_, err = New(root, Rules{Exclude: []string{"[oops"}})
+	assert.Error(t, err)
+}
+
+func TestSelection(t *testing.T) {
+	sel, err := NewSelection(nil)
+	require.NoError(t, err)
+	assert.Nil(t, sel)
+	assert.True(t, sel.Match("any/file", false))
+
+	sel, err = NewSelection([]string{"etc/nginx/**", "!etc/nginx/ssl/**", "*.conf"})
+	require.NoError(t, err)
+	assert.True(t, sel.Match("etc/nginx/nginx.conf", false))
+	assert.True(t, sel.Match("etc/nginx/sites/default", false))
+	assert.False(t, sel.Match("etc/nginx/ssl/key.pem", false))
+	assert.True(t, sel.Match("etc/nginx/ssl/site.conf", false))
+	assert.True(t, sel.Match("var/app.conf", false))
+	assert.False(t, sel.Match("etc/passwd", false))
+	assert.False(t, sel.Match("etc", true))
+}
@@ -0,0 +1,192 @@
+// Package hooks runs commands configured around backups and restores, like dumping a database before it is backed
+// up or restarting a service once it is restored.
+//
+// A hook is a shell command run with a timeout. It is described to the command by environment variables, and its
+// combined output is captured to be recorded with the job it ran for.
+package hooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/shell"
+)
+
+// Names of hooks.
+const (
+	PreBackup   = "pre_backup"
+	PostBackup  = "post_backup"
+	PreRestore  = "pre_restore"
+	PostRestore = "post_restore"
+)
+
+// When a post hook runs, depending on the outcome of the job.
+const (
+	WhenAlways  = "always"
+	WhenSuccess = "on-success"
+	WhenFailure = "on-failure"
+)
+
+const (
+	// DefaultTimeout is the timeout of hooks which set none.
+	DefaultTimeout = 10 * time.Minute
+	// maxOutput is the number of bytes of output kept, the end of a longer output is kept.
+	maxOutput = 64 * 1024
+	// EnvPrefix is the prefix of environment variables describing the job to hooks.
+	EnvPrefix = "BIZFLY_BACKUP_"
+)
+
+// Config is the hooks of a backup directory, nil hooks are not run.
+type Config struct {
+	PreBackup   *Hook `json:"pre_backup,omitempty" yaml:"pre_backup,omitempty" mapstructure:"pre_backup"`
+	PostBackup  *Hook `json:"post_backup,omitempty" yaml:"post_backup,omitempty" mapstructure:"post_backup"`
+	PreRestore  *Hook `json:"pre_restore,omitempty" yaml:"pre_restore,omitempty" mapstructure:"pre_restore"`
+	PostRestore *Hook `json:"post_restore,omitempty" yaml:"post_restore,omitempty" mapstructure:"post_restore"`
+}
+
+// Hook is a command run before or after a job.
+type Hook struct {
+	// Command is run by the shell, sh on Unix and cmd on Windows.
+	Command string `json:"command" yaml:"command" mapstructure:"command"`
+	// Timeout is the duration after which the command is killed, like "30s". Empty means DefaultTimeout.
+	Timeout string `json:"timeout,omitempty" yaml:"timeout,omitempty" mapstructure:"timeout"`
+	// When is one of When* constants, for post hooks only. Empty means WhenAlways.
+	When string `json:"when,omitempty" yaml:"when,omitempty" mapstructure:"when"`
+	// AbortOnFailure aborts the job when a pre hook fails, otherwise the failure is only recorded.
+	AbortOnFailure bool `json:"abort_on_failure,omitempty" yaml:"abort_on_failure,omitempty" mapstructure:"abort_on_failure"`
+}
+
+// Result is the outcome of a hook run.
+type Result struct {
+	Name     string `json:"name"`
+	ExitCode int    `json:"exit_code"`
+	Output   string `json:"output,omitempty"`
+	Error    string `json:"error,omitempty"`
+	// Duration is the run time in milliseconds.
+	Duration int64 `json:"duration_ms"`
+}
+
+// Override returns c with the hooks set in o replacing its own.
+func (c Config) Override(o Config) Config {
+	if o.PreBackup != nil {
+		c.PreBackup = o.PreBackup
+	}
+	if o.PostBackup != nil {
+		c.PostBackup = o.PostBackup
+	}
+	if o.PreRestore != nil {
+		c.PreRestore = o.PreRestore
+	}
+	if o.PostRestore != nil {
+		c.PostRestore = o.PostRestore
+	}
+	return c
+}
+
+// Validate checks that the hooks of c are valid.
+func (c Config) Validate() error {
+	for name, h := range map[string]*Hook{PreBackup: c.PreBackup, PostBackup: c.PostBackup, PreRestore: c.PreRestore, PostRestore: c.PostRestore} {
+		if h == nil {
+			continue
+		}
+		if err := h.validate(); err != nil {
+			return fmt.Errorf("%s hook: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func (h *Hook) validate() error {
+	if strings.TrimSpace(h.Command) == "" {
+		return errors.New("empty command")
+	}
+	if _, err := h.timeout(); err != nil {
+		return err
+	}
+	switch h.When {
+	case "", WhenAlways, WhenSuccess, WhenFailure:
+		return nil
+	}
+	return fmt.Errorf("invalid when %q, want %s, %s or %s", h.When, WhenAlways, WhenSuccess, WhenFailure)
+}
+
+func (h *Hook) timeout() (time.Duration, error) {
+	if h.Timeout == "" {
+		return DefaultTimeout, nil
+	}
+	d, err := time.ParseDuration(h.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout: %w", err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid timeout %s", h.Timeout)
+	}
+	return d, nil
+}
+
+// RunsAfter reports whether post hook h runs after a job which failed or not.
+func (h *Hook) RunsAfter(failed bool) bool {
+	switch h.When {
+	case WhenSuccess:
+		return !failed
+	case WhenFailure:
+		return failed
+	}
+	return true
+}
+
+// Run runs h until it exits, ctx is done or its timeout is exceeded. Variables of env are added to the environment
+// of the agent, their names prefixed by EnvPrefix. The returned error is not nil if the hook did not succeed.
+func (h *Hook) Run(ctx context.Context, name string, env map[string]string) (Result, error) {
+	res := Result{Name: name, ExitCode: -1}
+	start := time.Now()
+	err := h.run(ctx, env, &res)
+	res.Duration = int64(time.Since(start) / time.Millisecond)
+	if err != nil {
+		res.Error = err.Error()
+		return res, fmt.Errorf("%s hook: %w", name, err)
+	}
+	return res, nil
+}
+
+func (h *Hook) run(ctx context.Context, env map[string]string, res *Result) error {
+	timeout, err := h.timeout()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := shell.Command(h.Command)
+	cmd.Env = os.Environ()
+	names := make([]string, 0, len(env))
+	for k := range env {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		cmd.Env = append(cmd.Env, EnvPrefix+k+"="+env[k])
+	}
+	out := &shell.TailBuffer{Max: maxOutput}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	wait, err := shell.Start(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	err = wait()
+	res.Output = out.String()
+	res.ExitCode = cmd.ProcessState.ExitCode()
+	if ctx.Err() != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("timed out after %s", timeout)
+		}
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,70 @@
+package hooks
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHookRun(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks are run by sh in tests")
+	}
+	h := &Hook{Command: `echo "$BIZFLY_BACKUP_PATH"; echo oops >&2`}
+	res, err := h.Run(context.Background(), PreBackup, map[string]string{"PATH": "/data"})
+	require.NoError(t, err)
+	assert.Equal(t, PreBackup, res.Name)
+	assert.Equal(t, 0, res.ExitCode)
+	assert.Equal(t, "/data\noops\n", res.Output)
+	assert.Empty(t, res.Error)
+
+	h = &Hook{Command: "echo failing; exit 3"}
+	res, err = h.Run(context.Background(), PostBackup, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), PostBackup)
+	assert.Equal(t, 3, res.ExitCode)
+	assert.Equal(t, "failing\n", res.Output)
+	assert.NotEmpty(t, res.Error)
+
+	// Processes started by the hook are killed on timeout too.
+	h = &Hook{Command: "sleep 10 & sleep 10", Timeout: "100ms"}
+	start := time.Now()
+	res, err = h.Run(context.Background(), PreRestore, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "timed out")
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+}
+
+func TestConfigValidate(t *testing.T) {
+	assert.NoError(t, Config{}.Validate())
+	assert.NoError(t, Config{PostBackup: &Hook{Command: "true", When: WhenFailure, Timeout: "1m"}}.Validate())
+	assert.Error(t, Config{PreBackup: &Hook{Command: " "}}.Validate())
+	assert.Error(t, Config{PostRestore: &Hook{Command: "true", When: "sometimes"}}.Validate())
+	assert.Error(t, Config{PreRestore: &Hook{Command: "true", Timeout: "soon"}}.Validate())
+}
+
+func TestHookRunsAfter(t *testing.T) {
+	for _, tc := range []struct {
+		when             string
+		success, failure bool
+	}{
+		{"", true, true},
+		{WhenAlways, true, true},
+		{WhenSuccess, true, false},
+		{WhenFailure, false, true},
+	} {
+		h := &Hook{When: tc.when}
+		assert.Equal(t, tc.success, h.RunsAfter(false), tc.when)
+		assert.Equal(t, tc.failure, h.RunsAfter(true), tc.when)
+	}
+}
+
+func TestConfigOverride(t *testing.T) {
+	pre, post, local := &Hook{Command: "pre"}, &Hook{Command: "post"}, &Hook{Command: "local"}
+	c := Config{PreBackup: pre, PostBackup: post}.Override(Config{PostBackup: local})
+	assert.Equal(t, Config{PreBackup: pre, PostBackup: local}, c)
+}
@@ -0,0 +1,224 @@
+package jobs
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultRetention keeps finished jobs for 30 days, up to 1000 of them.
+var DefaultRetention = Retention{MaxAge: 30 * 24 * time.Hour, MaxJobs: 1000}
+
+// errInterrupted is the error of jobs found unfinished in the history file, the agent stopped while they ran.
+const errInterrupted = "interrupted by agent stop"
+
+// Retention is how long a History keeps finished jobs.
+type Retention struct {
+	// MaxAge is the age of finished jobs after which they are removed, zero keeps them regardless of age.
+	MaxAge time.Duration
+	// MaxJobs is the number of finished jobs kept, older ones are removed. Zero keeps them all.
+	MaxJobs int
+}
+
+// History stores jobs in a local file, so they are known after the agent restarts. It is safe for concurrent use.
+//
+// The file has a JSON line per change of a job, the last one wins. It is compacted when it is opened and once it
+// holds too many stale lines.
+type History struct {
+	path      string
+	retention Retention
+	now       func() time.Time
+
+	mu   sync.Mutex
+	f    *os.File
+	jobs []Job
+	byID map[string]int
+	// lines is the number of lines of the file.
+	lines int
+}
+
+// OpenHistory opens the history stored at path, creating it if needed.
+func OpenHistory(path string, retention Retention) (*History, error) {
+	h := &History{
+		path:      path,
+		retention: retention,
+		now:       time.Now,
+		byID:      make(map[string]int),
+	}
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.compact(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *History) load() error {
+	f, err := os.Open(h.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var j Job
+		// A line may be partially written if the agent stopped while writing it.
+		if err := json.Unmarshal(sc.Bytes(), &j); err != nil || j.ID == "" {
+			continue
+		}
+		h.set(j)
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+	now := h.now()
+	for i := range h.jobs {
+		if !h.jobs[i].Finished() {
+			h.jobs[i].State = StateFailed
+			h.jobs[i].Error = errInterrupted
+			h.jobs[i].FinishedAt = &now
+		}
+	}
+	return nil
+}
+
+// set records j in memory, h.mu must be held.
+func (h *History) set(j Job) {
+	if i, ok := h.byID[j.ID]; ok {
+		h.jobs[i] = j
+		return
+	}
+	h.byID[j.ID] = len(h.jobs)
+	h.jobs = append(h.jobs, j)
+}
+
+// Put records the current state of j.
+func (h *History) Put(j Job) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, known := h.byID[j.ID]
+	h.set(j)
+	// Apply retention as new jobs arrive, and compact once most lines are stale.
+	if (!known && h.prune()) || h.lines > 2*len(h.jobs)+100 {
+		return h.compact()
+	}
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	if _, err := h.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	h.lines++
+	return nil
+}
+
+// Jobs returns the jobs of h, in submission order.
+func (h *History) Jobs() []Job {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]Job(nil), h.jobs...)
+}
+
+// Job returns the job with id.
+func (h *History) Job(id string) (Job, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i, ok := h.byID[id]
+	if !ok {
+		return Job{}, false
+	}
+	return h.jobs[i], true
+}
+
+// Close closes the file of h.
+func (h *History) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.f.Close()
+}
+
+// prune removes finished jobs beyond retention, and reports whether any was removed. h.mu must be held.
+func (h *History) prune() bool {
+	finished := 0
+	for _, j := range h.jobs {
+		if j.Finished() {
+			finished++
+		}
+	}
+	now := h.now()
+	kept := h.jobs[:0]
+	for _, j := range h.jobs {
+		if j.Finished() {
+			tooOld := h.retention.MaxAge > 0 && j.FinishedAt != nil && now.Sub(*j.FinishedAt) > h.retention.MaxAge
+			tooMany := h.retention.MaxJobs > 0 && finished > h.retention.MaxJobs
+			if tooOld || tooMany {
+				finished--
+				continue
+			}
+		}
+		kept = append(kept, j)
+	}
+	if len(kept) == len(h.jobs) {
+		return false
+	}
+	h.jobs = kept
+	h.byID = make(map[string]int, len(kept))
+	for i, j := range kept {
+		h.byID[j.ID] = i
+	}
+	return true
+}
+
+// compact applies retention, then rewrites the file with a line per job and reopens it for appending. h.mu must
+// be held.
+func (h *History) compact() error {
+	h.prune()
+	if err := os.MkdirAll(filepath.Dir(h.path), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(h.path), filepath.Base(h.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, j := range h.jobs {
+		if err := enc.Encode(j); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), h.path); err != nil {
+		return err
+	}
+	nf, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if h.f != nil {
+		h.f.Close()
+	}
+	h.f = nf
+	h.lines = len(h.jobs)
+	return nil
+}
@@ -0,0 +1,99 @@
+package jobs
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bizfly-backup-jobs-history-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "jobs.log")
+
+	running, err := OpenHistory(name, Retention{})
+	require.NoError(t, err)
+	m := NewManager(1)
+	m.OnChange(func(j Job) {
+		// Changes after the agent stopped are lost.
+		_ = running.Put(j)
+	})
+	j1 := m.Submit(Job{Kind: KindBackup, Name: "bd1", BackupDirectoryID: "bd1", PolicyID: "p1"}, func(ctx context.Context) error {
+		job, ok := Current(ctx)
+		assert.True(t, ok)
+		assert.Equal(t, "bd1", job.BackupDirectoryID)
+		Update(ctx, func(j *Job) {
+			j.RecoveryPointID = "rp1"
+			j.Files = 2
+			j.Bytes = 42
+			j.State = StateFailed
+		})
+		return nil
+	})
+	wait(t, m, j1.ID)
+	b := newBlocker()
+	j2 := m.Submit(Job{Kind: KindRestore, Name: "rp1", RecoveryPointID: "rp1"}, b.run)
+	require.True(t, b.isStarted())
+	require.NoError(t, running.Close())
+
+	// The agent stopped while j2 was running.
+	h, err := OpenHistory(name, Retention{})
+	require.NoError(t, err)
+	j, ok := h.Job(j1.ID)
+	require.True(t, ok)
+	assert.Equal(t, StateSucceeded, j.State)
+	assert.Equal(t, "rp1", j.RecoveryPointID)
+	assert.Equal(t, "p1", j.PolicyID)
+	assert.Equal(t, 2, j.Files)
+	assert.Equal(t, int64(42), j.Bytes)
+	assert.NotNil(t, j.FinishedAt)
+	j, ok = h.Job(j2.ID)
+	require.True(t, ok)
+	assert.Equal(t, StateFailed, j.State)
+	assert.Equal(t, errInterrupted, j.Error)
+	require.NoError(t, h.Close())
+	close(b.release)
+	wait(t, m, j2.ID)
+}
+
+func TestHistoryRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bizfly-backup-jobs-history-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "jobs.log")
+
+	h, err := OpenHistory(name, Retention{MaxAge: 24 * time.Hour, MaxJobs: 3})
+	require.NoError(t, err)
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+	require.NoError(t, h.Put(Job{ID: "old", State: StateSucceeded, FinishedAt: &old}))
+	require.NoError(t, h.Put(Job{ID: "running", State: StateRunning}))
+	for _, id := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, h.Put(Job{ID: id, State: StateFailed, FinishedAt: &now}))
+	}
+	ids := func(jobs []Job) []string {
+		var ids []string
+		for _, j := range jobs {
+			ids = append(ids, j.ID)
+		}
+		return ids
+	}
+	assert.Equal(t, []string{"running", "b", "c", "d"}, ids(h.Jobs()))
+	require.NoError(t, h.Close())
+
+	data, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	// Append a partially written line.
+	require.NoError(t, ioutil.WriteFile(name, append(data, `{"id": "e", "sta`...), 0600))
+	h, err = OpenHistory(name, Retention{MaxAge: 24 * time.Hour, MaxJobs: 3})
+	require.NoError(t, err)
+	defer h.Close()
+	assert.Equal(t, []string{"b", "c", "d"}, ids(h.Jobs()))
+}
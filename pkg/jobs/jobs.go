@@ -0,0 +1,388 @@
+// Package jobs runs backup and restore jobs of the agent in the background.
+//
+// A Manager runs queued jobs in submission order, up to a number of jobs at a time. Jobs working on the same
+// directory, or on nested directories, never run at the same time: a job waits for every job submitted before it
+// on an overlapping path.
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/hooks"
+)
+
+// State is the state of a job.
+type State string
+
+const (
+	StateQueued    State = "queued"
+	StateRunning   State = "running"
+	StateSucceeded State = "succeeded"
+	StateFailed    State = "failed"
+	StateCanceled  State = "canceled"
+)
+
+// Kinds of jobs.
+const (
+	KindBackup  = "backup"
+	KindRestore = "restore"
+)
+
+var (
+	// ErrNotFound indicates that a job is unknown, or finished long ago.
+	ErrNotFound = errors.New("job not found")
+	// ErrFinished indicates that a job can not be canceled since it is finished.
+	ErrFinished = errors.New("job is finished")
+)
+
+// maxFinished is the number of finished jobs kept by a Manager, older ones are forgotten.
+const maxFinished = 100
+
+// Job describes a job submitted to a Manager.
+type Job struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	// Name identifies what the job works on, like a backup directory or a recovery point.
+	Name string `json:"name"`
+	// Path is the local directory read or written by the job.
+	Path              string `json:"path"`
+	BackupDirectoryID string `json:"backup_directory_id,omitempty"`
+	PolicyID          string `json:"policy_id,omitempty"`
+	RecoveryPointID   string `json:"recovery_point_id,omitempty"`
+	// ActionID identifies the job on the backup server.
+	ActionID string `json:"action_id,omitempty"`
+	// Files and Bytes are the number and total size of files backed up or restored by the job.
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+	// Hooks are the results of hooks run for the job, in run order.
+	Hooks      []hooks.Result `json:"hooks,omitempty"`
+	State      State          `json:"state"`
+	Error      string         `json:"error,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+	StartedAt  *time.Time     `json:"started_at,omitempty"`
+	FinishedAt *time.Time     `json:"finished_at,omitempty"`
+}
+
+// Finished reports whether j is done, successfully or not.
+func (j Job) Finished() bool {
+	return j.State == StateSucceeded || j.State == StateFailed || j.State == StateCanceled
+}
+
+// Func is the work of a job, it must return soon after ctx is canceled.
+type Func func(ctx context.Context) error
+
+type entry struct {
+	job  Job
+	fn   Func
+	done chan struct{}
+	// cancel cancels the context of the job once it runs.
+	cancel   context.CancelFunc
+	canceled bool
+}
+
+// Manager queues and runs jobs. It is safe for concurrent use.
+type Manager struct {
+	concurrency int
+	now         func() time.Time
+
+	mu        sync.Mutex
+	entries   []*entry
+	byID      map[string]*entry
+	running   int
+	listeners []func(Job)
+	// changes are the changes of jobs not notified to listeners yet, in order, and done the entries of finished
+	// jobs to mark done once they are.
+	changes []Job
+	done    []*entry
+
+	// notifyMu serializes notifications of changes, so listeners get them in order.
+	notifyMu sync.Mutex
+}
+
+// NewManager returns a Manager running up to concurrency jobs at a time.
+func NewManager(concurrency int) *Manager {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &Manager{
+		concurrency: concurrency,
+		now:         time.Now,
+		byID:        make(map[string]*entry),
+	}
+}
+
+// Submit queues job, which runs fn. Its ID, state and times are set by m. It returns the job as queued.
+func (m *Manager) Submit(job Job, fn Func) Job {
+	if job.Path != "" {
+		job.Path = filepath.Clean(job.Path)
+	}
+	job.ID = newID()
+	job.State = StateQueued
+	job.StartedAt = nil
+	job.FinishedAt = nil
+	m.mu.Lock()
+	defer m.unlock()
+	job.CreatedAt = m.now()
+	e := &entry{
+		job:  job,
+		fn:   fn,
+		done: make(chan struct{}),
+	}
+	m.entries = append(m.entries, e)
+	m.byID[e.job.ID] = e
+	m.changed(e)
+	m.schedule()
+	return job
+}
+
+// OnChange registers fn to be called with a job each time it changes, starting with its submission. fn is called
+// in the order of changes, before the call changing the job returns but without m locked, so it may read jobs of m
+// but must not change them.
+func (m *Manager) OnChange(fn func(Job)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.listeners = append(m.listeners, fn)
+}
+
+// changed records a change of e to notify listeners of once m.mu is unlocked, m.mu must be held.
+func (m *Manager) changed(e *entry) {
+	if len(m.listeners) > 0 {
+		m.changes = append(m.changes, e.job)
+	}
+}
+
+// unlock unlocks m.mu, then notifies listeners of the changes made while it was held.
+func (m *Manager) unlock() {
+	m.mu.Unlock()
+	m.notifyMu.Lock()
+	defer m.notifyMu.Unlock()
+	m.mu.Lock()
+	changes, done, listeners := m.changes, m.done, m.listeners
+	m.changes, m.done = nil, nil
+	m.mu.Unlock()
+	for _, job := range changes {
+		for _, fn := range listeners {
+			fn(job)
+		}
+	}
+	// Waiters see finished jobs once listeners do.
+	for _, e := range done {
+		close(e.done)
+	}
+}
+
+type jobKey struct{}
+
+type runningJob struct {
+	m *Manager
+	e *entry
+}
+
+// Current returns the job of ctx, the context of a Func.
+func Current(ctx context.Context) (Job, bool) {
+	r, ok := ctx.Value(jobKey{}).(runningJob)
+	if !ok {
+		return Job{}, false
+	}
+	r.m.mu.Lock()
+	defer r.m.mu.Unlock()
+	return r.e.job, true
+}
+
+// Update applies fn to the running job of ctx, the context of a Func, to record details like the recovery point
+// or the number of files. It does nothing if ctx is not the context of a job.
+func Update(ctx context.Context, fn func(j *Job)) {
+	r, ok := ctx.Value(jobKey{}).(runningJob)
+	if !ok {
+		return
+	}
+	r.m.mu.Lock()
+	defer r.m.unlock()
+	job := r.e.job
+	fn(&job)
+	// The manager owns the identity and the state of the job.
+	job.ID, job.Kind, job.Path, job.State, job.Error = r.e.job.ID, r.e.job.Kind, r.e.job.Path, r.e.job.State, r.e.job.Error
+	job.CreatedAt, job.StartedAt, job.FinishedAt = r.e.job.CreatedAt, r.e.job.StartedAt, r.e.job.FinishedAt
+	r.e.job = job
+	r.m.changed(r.e)
+}
+
+// Jobs returns the queued, running and recently finished jobs, in submission order.
+func (m *Manager) Jobs() []Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jobs := make([]Job, 0, len(m.entries))
+	for _, e := range m.entries {
+		jobs = append(jobs, e.job)
+	}
+	return jobs
+}
+
+// Job returns the job with id.
+func (m *Manager) Job(id string) (Job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.byID[id]
+	if !ok {
+		return Job{}, false
+	}
+	return e.job, true
+}
+
+// Wait waits until the job with id is finished, and returns it.
+func (m *Manager) Wait(ctx context.Context, id string) (Job, error) {
+	m.mu.Lock()
+	e, ok := m.byID[id]
+	m.mu.Unlock()
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+		return Job{}, ctx.Err()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return e.job, nil
+}
+
+// Cancel cancels the job with id. A queued job is canceled right away, a running job is canceled once its Func
+// returns.
+func (m *Manager) Cancel(id string) error {
+	m.mu.Lock()
+	defer m.unlock()
+	e, ok := m.byID[id]
+	if !ok {
+		return ErrNotFound
+	}
+	switch e.job.State {
+	case StateQueued:
+		e.canceled = true
+		now := m.now()
+		e.job.FinishedAt = &now
+		e.job.State = StateCanceled
+		m.changed(e)
+		m.done = append(m.done, e)
+		m.forgetFinished()
+		// Jobs queued behind e may start now.
+		m.schedule()
+	case StateRunning:
+		e.canceled = true
+		e.cancel()
+	default:
+		return ErrFinished
+	}
+	return nil
+}
+
+// schedule starts the queued jobs which can run, m.mu must be held.
+func (m *Manager) schedule() {
+	// busy are the paths of running jobs, and of queued jobs ahead, which later jobs must wait for.
+	var busy []string
+	for _, e := range m.entries {
+		if e.job.State == StateRunning {
+			busy = append(busy, e.job.Path)
+		}
+	}
+	for _, e := range m.entries {
+		if e.job.State != StateQueued {
+			continue
+		}
+		if m.running < m.concurrency && !overlapsAny(e.job.Path, busy) {
+			m.start(e)
+		}
+		busy = append(busy, e.job.Path)
+	}
+}
+
+// start runs e in the background, m.mu must be held.
+func (m *Manager) start(e *entry) {
+	now := m.now()
+	e.job.State = StateRunning
+	e.job.StartedAt = &now
+	m.running++
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), jobKey{}, runningJob{m, e}))
+	e.cancel = cancel
+	m.changed(e)
+	go func() {
+		err := e.fn(ctx)
+		cancel()
+		m.finish(e, err)
+	}()
+}
+
+func (m *Manager) finish(e *entry, err error) {
+	m.mu.Lock()
+	defer m.unlock()
+	now := m.now()
+	e.job.FinishedAt = &now
+	e.job.State = StateSucceeded
+	if err != nil {
+		e.job.State = StateFailed
+		e.job.Error = err.Error()
+	}
+	if e.canceled {
+		e.job.State = StateCanceled
+	}
+	m.running--
+	m.changed(e)
+	m.done = append(m.done, e)
+	m.forgetFinished()
+	m.schedule()
+}
+
+// forgetFinished removes the oldest finished jobs beyond maxFinished, m.mu must be held.
+func (m *Manager) forgetFinished() {
+	finished := 0
+	for _, e := range m.entries {
+		if e.job.Finished() {
+			finished++
+		}
+	}
+	if finished <= maxFinished {
+		return
+	}
+	kept := m.entries[:0]
+	for _, e := range m.entries {
+		if e.job.Finished() && finished > maxFinished {
+			finished--
+			delete(m.byID, e.job.ID)
+			continue
+		}
+		kept = append(kept, e)
+	}
+	m.entries = kept
+}
+
+// overlapsAny reports whether path is, contains or is inside one of paths. Empty paths overlap nothing.
+func overlapsAny(path string, paths []string) bool {
+	for _, p := range paths {
+		if path != "" && p != "" && (within(path, p) || within(p, path)) {
+			return true
+		}
+	}
+	return false
+}
+
+// within reports whether path is dir or inside dir.
+func within(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,197 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// blocker is a job function which runs until released.
+type blocker struct {
+	started chan struct{}
+	release chan struct{}
+	err     error
+}
+
+func newBlocker() *blocker {
+	return &blocker{started: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (b *blocker) run(ctx context.Context) error {
+	close(b.started)
+	<-b.release
+	return b.err
+}
+
+func (b *blocker) isStarted() bool {
+	select {
+	case <-b.started:
+		return true
+	case <-time.After(20 * time.Millisecond):
+		return false
+	}
+}
+
+func wait(t *testing.T, m *Manager, id string) Job {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	j, err := m.Wait(ctx, id)
+	require.NoError(t, err)
+	return j
+}
+
+func TestManagerConcurrency(t *testing.T) {
+	m := NewManager(2)
+	b1, b2, b3 := newBlocker(), newBlocker(), newBlocker()
+	j1 := m.Submit(Job{Kind: KindBackup, Name: "a", Path: "/data/a"}, b1.run)
+	j2 := m.Submit(Job{Kind: KindBackup, Name: "b", Path: "/data/b"}, b2.run)
+	j3 := m.Submit(Job{Kind: KindRestore, Name: "c", Path: "/data/c"}, b3.run)
+
+	assert.True(t, b1.isStarted())
+	assert.True(t, b2.isStarted())
+	assert.False(t, b3.isStarted())
+	j, ok := m.Job(j3.ID)
+	require.True(t, ok)
+	assert.Equal(t, StateQueued, j.State)
+
+	b1.err = errors.New("boom")
+	close(b1.release)
+	assert.True(t, b3.isStarted())
+	j = wait(t, m, j1.ID)
+	assert.Equal(t, StateFailed, j.State)
+	assert.Equal(t, "boom", j.Error)
+	assert.NotNil(t, j.StartedAt)
+	assert.NotNil(t, j.FinishedAt)
+
+	close(b2.release)
+	close(b3.release)
+	assert.Equal(t, StateSucceeded, wait(t, m, j2.ID).State)
+	assert.Equal(t, StateSucceeded, wait(t, m, j3.ID).State)
+
+	var ids []string
+	for _, j := range m.Jobs() {
+		ids = append(ids, j.ID)
+	}
+	assert.Equal(t, []string{j1.ID, j2.ID, j3.ID}, ids)
+}
+
+func TestManagerSamePath(t *testing.T) {
+	m := NewManager(4)
+	b1, b2, b3, b4 := newBlocker(), newBlocker(), newBlocker(), newBlocker()
+	m.Submit(Job{Kind: KindBackup, Name: "a", Path: "/data/a"}, b1.run)
+	// Nested paths wait too, and so do later jobs on the path of a waiting job.
+	m.Submit(Job{Kind: KindRestore, Name: "a", Path: "/data/a/sub/"}, b2.run)
+	m.Submit(Job{Kind: KindBackup, Name: "a", Path: "/data/a/sub"}, b3.run)
+	m.Submit(Job{Kind: KindBackup, Name: "other", Path: "/data/ab"}, b4.run)
+
+	assert.True(t, b1.isStarted())
+	assert.True(t, b4.isStarted())
+	assert.False(t, b2.isStarted())
+	assert.False(t, b3.isStarted())
+
+	close(b1.release)
+	assert.True(t, b2.isStarted())
+	assert.False(t, b3.isStarted())
+	close(b2.release)
+	assert.True(t, b3.isStarted())
+	close(b3.release)
+	close(b4.release)
+}
+
+func TestManagerForgetFinished(t *testing.T) {
+	m := NewManager(8)
+	var wg sync.WaitGroup
+	var first string
+	for i := 0; i < maxFinished+10; i++ {
+		wg.Add(1)
+		j := m.Submit(Job{Kind: KindBackup, Name: "a"}, func(context.Context) error {
+			wg.Done()
+			return nil
+		})
+		if i == 0 {
+			first = j.ID
+		}
+	}
+	wg.Wait()
+	require.Eventually(t, func() bool {
+		return len(m.Jobs()) == maxFinished
+	}, time.Second, 10*time.Millisecond)
+	_, ok := m.Job(first)
+	assert.False(t, ok)
+	_, err := m.Wait(context.Background(), first)
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func Test_overlapsAny(t *testing.T) {
+	assert.True(t, overlapsAny("/a", []string{"/b", "/a"}))
+	assert.True(t, overlapsAny("/a/b", []string{"/a"}))
+	assert.True(t, overlapsAny("/a", []string{"/a/b"}))
+	assert.True(t, overlapsAny("/a", []string{"/"}))
+	assert.False(t, overlapsAny("/a", []string{"/ab", "/b/a"}))
+	assert.False(t, overlapsAny("", []string{"/a", ""}))
+}
+
+func TestManagerCancel(t *testing.T) {
+	m := NewManager(1)
+	started := make(chan struct{})
+	running := m.Submit(Job{Kind: KindBackup, Name: "a", Path: "/data/a"}, func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	b := newBlocker()
+	queued := m.Submit(Job{Kind: KindBackup, Name: "b", Path: "/data/b"}, b.run)
+	<-started
+
+	require.NoError(t, m.Cancel(queued.ID))
+	j := wait(t, m, queued.ID)
+	assert.Equal(t, StateCanceled, j.State)
+	assert.Nil(t, j.StartedAt)
+
+	require.NoError(t, m.Cancel(running.ID))
+	j = wait(t, m, running.ID)
+	assert.Equal(t, StateCanceled, j.State)
+	assert.Equal(t, context.Canceled.Error(), j.Error)
+	assert.False(t, b.isStarted())
+
+	assert.Equal(t, ErrFinished, m.Cancel(running.ID))
+	assert.Equal(t, ErrNotFound, m.Cancel("unknown"))
+}
+
+func TestManagerOnChange(t *testing.T) {
+	m := NewManager(1)
+	var mu sync.Mutex
+	var states []State
+	slow := make(chan struct{})
+	m.OnChange(func(j Job) {
+		// Listeners run without m locked, they may read jobs and take time.
+		current, ok := m.Job(j.ID)
+		assert.True(t, ok)
+		assert.NotEmpty(t, current.State)
+		if j.State == StateSucceeded {
+			<-slow
+		}
+		mu.Lock()
+		states = append(states, j.State)
+		mu.Unlock()
+	})
+	j := m.Submit(Job{Kind: KindBackup, Name: "a", Path: "/data/a"}, func(ctx context.Context) error { return nil })
+
+	// Jobs can be read while a listener is busy, waiters see the job once listeners do.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := m.Wait(ctx, j.ID)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Len(t, m.Jobs(), 1)
+	close(slow)
+	wait(t, m, j.ID)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []State{StateQueued, StateRunning, StateSucceeded}, states)
+}
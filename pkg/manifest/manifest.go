@@ -0,0 +1,187 @@
+// Package manifest records the path, size, mode and SHA-256 of every file stored in a recovery point, so its
+// content can be verified after download or restore.
+//
+// A Manifest is signed with an HMAC-SHA256 key, which proves that it was written by a holder of the key and has
+// not been modified since.
+package manifest
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+const version = 1
+
+var (
+	// ErrUnsigned indicates that a manifest expected to be signed has no signature.
+	ErrUnsigned = errors.New("manifest is not signed")
+	// ErrBadSignature indicates that a manifest has been modified, or was signed with another key.
+	ErrBadSignature = errors.New("manifest signature does not match")
+	// ErrNoKey indicates that a manifest is signed but no key is available to check its signature.
+	ErrNoKey = errors.New("manifest is signed but no signing key is configured")
+)
+
+// Entry describes a regular file.
+type Entry struct {
+	Path   string      `json:"path"`
+	Size   int64       `json:"size"`
+	Mode   os.FileMode `json:"mode"`
+	SHA256 string      `json:"sha256"`
+}
+
+// Manifest lists files of a recovery point.
+type Manifest struct {
+	Version   int     `json:"version"`
+	Files     []Entry `json:"files"`
+	Signature string  `json:"signature,omitempty"`
+}
+
+// New returns an empty Manifest.
+func New() *Manifest {
+	return &Manifest{Version: version}
+}
+
+// Parse decodes a Manifest encoded with json.Marshal.
+func Parse(data []byte) (*Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	if m.Version != version {
+		return nil, fmt.Errorf("unsupported manifest version: %d", m.Version)
+	}
+	return &m, nil
+}
+
+// Add appends e to the files of m.
+func (m *Manifest) Add(e Entry) {
+	m.Files = append(m.Files, e)
+}
+
+// Sign signs m with key, a nil key leaves m unsigned.
+func (m *Manifest) Sign(key []byte) error {
+	if key == nil {
+		m.Signature = ""
+		return nil
+	}
+	sig, err := m.signature(key)
+	if err != nil {
+		return err
+	}
+	m.Signature = sig
+	return nil
+}
+
+// CheckSignature checks that m is signed with key. Manifests written without a key are only accepted when key
+// is nil too.
+func (m *Manifest) CheckSignature(key []byte) error {
+	switch {
+	case key == nil && m.Signature == "":
+		return nil
+	case key == nil:
+		return ErrNoKey
+	case m.Signature == "":
+		return ErrUnsigned
+	}
+	sig, err := m.signature(key)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(sig), []byte(m.Signature)) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+func (m *Manifest) signature(key []byte) (string, error) {
+	data, err := json.Marshal(Manifest{Version: m.Version, Files: m.Files})
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// Compare compares files, keyed by path, with the files of m. Modes are compared only if compareMode is true,
+// since restoring a file does not always restore its mode exactly.
+func (m *Manifest) Compare(files map[string]Entry, compareMode bool) *Report {
+	r := &Report{Files: len(m.Files)}
+	listed := make(map[string]bool, len(m.Files))
+	for _, want := range m.Files {
+		listed[want.Path] = true
+		got, ok := files[want.Path]
+		switch {
+		case !ok:
+			r.add(want.Path, "missing")
+		case got.Size != want.Size:
+			r.add(want.Path, fmt.Sprintf("size is %d, want %d", got.Size, want.Size))
+		case got.SHA256 != want.SHA256:
+			r.add(want.Path, "checksum mismatch")
+		case compareMode && got.Mode != want.Mode:
+			r.add(want.Path, fmt.Sprintf("mode is %s, want %s", got.Mode, want.Mode))
+		}
+	}
+	for path := range files {
+		if !listed[path] {
+			r.add(path, "not in manifest")
+		}
+	}
+	sort.Slice(r.Mismatches, func(i, j int) bool {
+		return r.Mismatches[i].Path < r.Mismatches[j].Path
+	})
+	return r
+}
+
+// Sum returns the size and SHA-256 of content read from r.
+func Sum(r io.Reader) (int64, string, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// SumFile returns the size and SHA-256 of the file at name.
+func SumFile(name string) (int64, string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	return Sum(f)
+}
+
+// Mismatch is a file which does not match the manifest.
+type Mismatch struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// Report is the result of a verification.
+type Report struct {
+	// Files is the number of files verified.
+	Files      int        `json:"files"`
+	Mismatches []Mismatch `json:"mismatches,omitempty"`
+}
+
+func (r *Report) add(path, reason string) {
+	r.Mismatches = append(r.Mismatches, Mismatch{Path: path, Reason: reason})
+}
+
+// Err returns an error describing mismatches of r, or nil if there are none.
+func (r *Report) Err() error {
+	if len(r.Mismatches) == 0 {
+		return nil
+	}
+	first := r.Mismatches[0]
+	return fmt.Errorf("%d of %d files do not match manifest, first is %s: %s", len(r.Mismatches), r.Files, first.Path, first.Reason)
+}
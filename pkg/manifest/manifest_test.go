@@ -0,0 +1,73 @@
+package manifest
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func entry(t *testing.T, path string, content string) Entry {
+	size, sum, err := Sum(strings.NewReader(content))
+	require.NoError(t, err)
+	return Entry{Path: path, Size: size, Mode: 0644, SHA256: sum}
+}
+
+func TestSignature(t *testing.T) {
+	m := New()
+	m.Add(entry(t, "a.txt", "a"))
+	require.NoError(t, m.Sign([]byte("key")))
+
+	data, err := json.Marshal(m)
+	require.NoError(t, err)
+	parsed, err := Parse(data)
+	require.NoError(t, err)
+	assert.NoError(t, parsed.CheckSignature([]byte("key")))
+	assert.Equal(t, ErrBadSignature, parsed.CheckSignature([]byte("other")))
+	assert.Equal(t, ErrNoKey, parsed.CheckSignature(nil))
+
+	parsed.Files[0].Size++
+	assert.Equal(t, ErrBadSignature, parsed.CheckSignature([]byte("key")))
+
+	require.NoError(t, m.Sign(nil))
+	assert.NoError(t, m.CheckSignature(nil))
+	assert.Equal(t, ErrUnsigned, m.CheckSignature([]byte("key")))
+}
+
+func TestCompare(t *testing.T) {
+	m := New()
+	m.Add(entry(t, "a.txt", "a"))
+	m.Add(entry(t, "b.txt", "b"))
+	m.Add(entry(t, "c.txt", "c"))
+	m.Add(entry(t, "d.txt", "d"))
+
+	files := map[string]Entry{
+		"a.txt": entry(t, "a.txt", "a"),
+		"b.txt": entry(t, "b.txt", "B"),
+		"c.txt": entry(t, "c.txt", "c"),
+		"e.txt": entry(t, "e.txt", "e"),
+	}
+	c := files["c.txt"]
+	c.Mode = 0600
+	files["c.txt"] = c
+
+	r := m.Compare(files, false)
+	assert.Equal(t, 4, r.Files)
+	assert.Equal(t, []Mismatch{
+		{Path: "b.txt", Reason: "checksum mismatch"},
+		{Path: "d.txt", Reason: "missing"},
+		{Path: "e.txt", Reason: "not in manifest"},
+	}, r.Mismatches)
+	assert.Error(t, r.Err())
+
+	r = m.Compare(files, true)
+	assert.Len(t, r.Mismatches, 4)
+
+	delete(files, "e.txt")
+	files["b.txt"] = entry(t, "b.txt", "b")
+	files["c.txt"] = entry(t, "c.txt", "c")
+	files["d.txt"] = entry(t, "d.txt", "d")
+	assert.NoError(t, m.Compare(files, true).Err())
+}
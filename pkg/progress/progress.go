@@ -0,0 +1,284 @@
+// Package progress tracks the progress of backup and restore jobs, and reports it to terminals, JSON streams or
+// the backup server.
+//
+// A job goes through phases, each with its own counters of files and bytes. A Tracker knows the total of a phase
+// when it is given, from a scan of the backed up directory or the size of a download, and derives the percentage,
+// rate and remaining time from it.
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Phase is a step of a job.
+type Phase string
+
+const (
+	PhaseScanning    Phase = "scanning"
+	PhaseArchiving   Phase = "archiving"
+	PhaseUploading   Phase = "uploading"
+	PhaseDownloading Phase = "downloading"
+	PhaseRestoring   Phase = "restoring"
+	PhaseDone        Phase = "done"
+)
+
+// barWidth is the number of characters of the bar rendered by NewBar.
+const barWidth = 30
+
+// Snapshot is the progress of a job at some point.
+type Snapshot struct {
+	Phase      Phase `json:"phase"`
+	Files      int   `json:"files"`
+	TotalFiles int   `json:"total_files,omitempty"`
+	Bytes      int64 `json:"bytes"`
+	TotalBytes int64 `json:"total_bytes,omitempty"`
+	// Percent is the progress of the phase from 0 to 100, or -1 if its total is unknown.
+	Percent float64 `json:"percent"`
+	// Rate is the average number of bytes per second since the start of the phase.
+	Rate int64 `json:"bytes_per_second"`
+	// ETA is the estimated number of seconds until the end of the phase, or -1 if unknown.
+	ETA     int64 `json:"eta_seconds"`
+	Elapsed int64 `json:"elapsed_seconds"`
+}
+
+// Reporter receives the progress of a job.
+type Reporter interface {
+	Report(s Snapshot)
+}
+
+// ReporterFunc is a func used as Reporter.
+type ReporterFunc func(s Snapshot)
+
+// Report calls f(s).
+func (f ReporterFunc) Report(s Snapshot) {
+	f(s)
+}
+
+// Multi returns a Reporter which reports to every reporter of rs.
+func Multi(rs ...Reporter) Reporter {
+	return ReporterFunc(func(s Snapshot) {
+		for _, r := range rs {
+			r.Report(s)
+		}
+	})
+}
+
+// Throttle returns a Reporter forwarding snapshots to r at most once per interval, and at each phase change.
+func Throttle(r Reporter, interval time.Duration) Reporter {
+	var (
+		mu    sync.Mutex
+		phase Phase
+		last  time.Time
+	)
+	return ReporterFunc(func(s Snapshot) {
+		mu.Lock()
+		now := time.Now()
+		skip := s.Phase == phase && now.Sub(last) < interval
+		if !skip {
+			phase, last = s.Phase, now
+		}
+		mu.Unlock()
+		if !skip {
+			r.Report(s)
+		}
+	})
+}
+
+// Tracker counts files and bytes processed by a job, and reports its progress at most once per interval, and at
+// each phase change. It is safe for concurrent use, and a nil *Tracker tracks nothing.
+type Tracker struct {
+	r        Reporter
+	interval time.Duration
+	now      func() time.Time
+
+	mu         sync.Mutex
+	s          Snapshot
+	start      time.Time
+	phaseStart time.Time
+	// phaseBytes is the number of bytes of the phase processed before it started, like a resumed download.
+	phaseBytes int64
+	lastReport time.Time
+}
+
+// NewTracker returns a Tracker reporting to r at most once per interval.
+func NewTracker(r Reporter, interval time.Duration) *Tracker {
+	t := &Tracker{r: r, interval: interval, now: time.Now}
+	t.start = t.now()
+	t.phaseStart = t.start
+	return t
+}
+
+// Start starts phase, with its total number of files and bytes if known, zero otherwise.
+func (t *Tracker) Start(phase Phase, totalFiles int, totalBytes int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.s = Snapshot{Phase: phase, TotalFiles: totalFiles, TotalBytes: totalBytes}
+	t.phaseStart = t.now()
+	t.phaseBytes = 0
+	t.report(true)
+}
+
+// SetTotal sets the total number of bytes of the current phase, done of which are already processed.
+func (t *Tracker) SetTotal(total, done int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.s.TotalBytes = total
+	t.s.Bytes = done
+	t.phaseBytes = done
+	t.report(false)
+}
+
+// Write counts p as processed bytes, it never fails.
+func (t *Tracker) Write(p []byte) (int, error) {
+	t.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// Add counts n processed bytes.
+func (t *Tracker) Add(n int64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.s.Bytes += n
+	t.report(false)
+}
+
+// FileDone counts a processed file.
+func (t *Tracker) FileDone() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.s.Files++
+	t.report(false)
+}
+
+// Done reports the end of the job.
+func (t *Tracker) Done() {
+	t.Start(PhaseDone, 0, 0)
+}
+
+// Snapshot returns the current progress.
+func (t *Tracker) Snapshot() Snapshot {
+	if t == nil {
+		return Snapshot{Percent: -1, ETA: -1}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.snapshot()
+}
+
+// snapshot returns the current progress, t.mu must be held.
+func (t *Tracker) snapshot() Snapshot {
+	s := t.s
+	now := t.now()
+	s.Elapsed = int64(now.Sub(t.start) / time.Second)
+	s.Percent, s.ETA = -1, -1
+	if s.Phase == PhaseDone {
+		s.Percent, s.ETA = 100, 0
+	}
+	if elapsed := now.Sub(t.phaseStart).Seconds(); elapsed > 0 {
+		s.Rate = int64(float64(s.Bytes-t.phaseBytes) / elapsed)
+	}
+	if s.TotalBytes > 0 {
+		s.Percent = 100 * float64(s.Bytes) / float64(s.TotalBytes)
+		if s.Percent > 100 {
+			s.Percent = 100
+		}
+		if s.Rate > 0 {
+			s.ETA = 0
+			if s.Bytes < s.TotalBytes {
+				s.ETA = (s.TotalBytes - s.Bytes) / s.Rate
+			}
+		}
+	}
+	return s
+}
+
+// report reports progress if the interval is elapsed since the last report, or if force is true. t.mu must be held.
+func (t *Tracker) report(force bool) {
+	if t.r == nil {
+		return
+	}
+	now := t.now()
+	if !force && now.Sub(t.lastReport) < t.interval {
+		return
+	}
+	t.lastReport = now
+	t.r.Report(t.snapshot())
+}
+
+// NewJSON returns a Reporter writing snapshots to w as JSON lines.
+func NewJSON(w io.Writer) Reporter {
+	enc := json.NewEncoder(w)
+	return ReporterFunc(func(s Snapshot) {
+		_ = enc.Encode(s)
+	})
+}
+
+// NewBar returns a Reporter rendering snapshots to w as a progress bar redrawn in place, for terminals. Each phase
+// is drawn on its own line.
+func NewBar(w io.Writer) Reporter {
+	var (
+		phase Phase
+		width int
+	)
+	return ReporterFunc(func(s Snapshot) {
+		if phase != "" && s.Phase != phase {
+			_, _ = fmt.Fprintln(w)
+			width = 0
+		}
+		phase = s.Phase
+		if s.Phase == PhaseDone {
+			return
+		}
+		line := Format(s)
+		// Blank the rest of a longer previous line.
+		pad := ""
+		if len(line) < width {
+			pad = strings.Repeat(" ", width-len(line))
+		}
+		width = len(line)
+		_, _ = fmt.Fprintf(w, "\r%s%s", line, pad)
+	})
+}
+
+// Format returns s as a single line of text, with a bar if the percentage is known.
+func Format(s Snapshot) string {
+	var b strings.Builder
+	b.WriteString(string(s.Phase))
+	if s.Percent >= 0 {
+		filled := int(s.Percent / 100 * barWidth)
+		fmt.Fprintf(&b, " [%s%s] %5.1f%%", strings.Repeat("=", filled), strings.Repeat(" ", barWidth-filled), s.Percent)
+	}
+	fmt.Fprintf(&b, " %s", humanize.Bytes(uint64(s.Bytes)))
+	if s.TotalBytes > 0 {
+		fmt.Fprintf(&b, "/%s", humanize.Bytes(uint64(s.TotalBytes)))
+	}
+	if s.TotalFiles > 0 {
+		fmt.Fprintf(&b, " %d/%d files", s.Files, s.TotalFiles)
+	} else if s.Files > 0 {
+		fmt.Fprintf(&b, " %d files", s.Files)
+	}
+	fmt.Fprintf(&b, " %s/s", humanize.Bytes(uint64(s.Rate)))
+	if s.ETA >= 0 {
+		fmt.Fprintf(&b, " ETA %s", time.Duration(s.ETA)*time.Second)
+	}
+	return b.String()
+}
@@ -0,0 +1,115 @@
+package progress
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a clock advanced by tests.
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func newTestTracker(r Reporter, interval time.Duration) (*Tracker, *fakeClock) {
+	c := &fakeClock{t: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	t := NewTracker(r, interval)
+	t.now = c.now
+	t.start, t.phaseStart = c.t, c.t
+	return t, c
+}
+
+func TestTracker(t *testing.T) {
+	var reports []Snapshot
+	tr, clock := newTestTracker(ReporterFunc(func(s Snapshot) {
+		reports = append(reports, s)
+	}), time.Second)
+
+	tr.Start(PhaseArchiving, 4, 1000)
+	require.Len(t, reports, 1)
+	assert.Equal(t, Snapshot{Phase: PhaseArchiving, TotalFiles: 4, TotalBytes: 1000, Percent: 0, ETA: -1}, reports[0])
+
+	clock.t = clock.t.Add(2 * time.Second)
+	_, _ = tr.Write(make([]byte, 200))
+	tr.FileDone()
+	// Reports are at most once per interval.
+	require.Len(t, reports, 2)
+	s := tr.Snapshot()
+	assert.Equal(t, int64(200), s.Bytes)
+	assert.Equal(t, 1, s.Files)
+	assert.Equal(t, 20.0, s.Percent)
+	assert.Equal(t, int64(100), s.Rate)
+	assert.Equal(t, int64(8), s.ETA)
+	assert.Equal(t, int64(2), s.Elapsed)
+
+	tr.Start(PhaseDownloading, 0, 0)
+	require.Len(t, reports, 3)
+	assert.Equal(t, -1.0, reports[2].Percent)
+	clock.t = clock.t.Add(2 * time.Second)
+	// A resumed download does not count in the rate.
+	tr.SetTotal(1000, 500)
+	tr.Add(100)
+	s = tr.Snapshot()
+	assert.Equal(t, 60.0, s.Percent)
+	assert.Equal(t, int64(50), s.Rate)
+	assert.Equal(t, int64(8), s.ETA)
+
+	tr.Done()
+	assert.Equal(t, PhaseDone, reports[len(reports)-1].Phase)
+	assert.Equal(t, 100.0, reports[len(reports)-1].Percent)
+}
+
+func TestTrackerNil(t *testing.T) {
+	var tr *Tracker
+	tr.Start(PhaseArchiving, 1, 1)
+	n, err := tr.Write([]byte("abc"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	tr.FileDone()
+	tr.Done()
+	assert.Equal(t, -1.0, tr.Snapshot().Percent)
+}
+
+func TestNewJSON(t *testing.T) {
+	var buf bytes.Buffer
+	r := Multi(NewJSON(&buf), NewJSON(&buf))
+	r.Report(Snapshot{Phase: PhaseUploading, Bytes: 10, Percent: -1, ETA: -1})
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	var s Snapshot
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &s))
+	assert.Equal(t, PhaseUploading, s.Phase)
+	assert.Equal(t, int64(10), s.Bytes)
+}
+
+func TestNewBar(t *testing.T) {
+	var buf bytes.Buffer
+	r := NewBar(&buf)
+	r.Report(Snapshot{Phase: PhaseArchiving, Files: 1, TotalFiles: 2, Bytes: 500, TotalBytes: 1000, Percent: 50, Rate: 100, ETA: 5})
+	r.Report(Snapshot{Phase: PhaseRestoring, Bytes: 1, Percent: -1, ETA: -1})
+	r.Report(Snapshot{Phase: PhaseDone, Percent: 100})
+	assert.Equal(t, "\rarchiving [===============               ]  50.0% 500 B/1.0 kB 1/2 files 100 B/s ETA 5s\n"+
+		"\rrestoring 1 B 0 B/s\n", buf.String())
+}
+
+func TestThrottle(t *testing.T) {
+	var phases []Phase
+	r := Throttle(ReporterFunc(func(s Snapshot) {
+		phases = append(phases, s.Phase)
+	}), time.Hour)
+	r.Report(Snapshot{Phase: PhaseScanning})
+	r.Report(Snapshot{Phase: PhaseScanning})
+	r.Report(Snapshot{Phase: PhaseArchiving})
+	r.Report(Snapshot{Phase: PhaseArchiving})
+	r.Report(Snapshot{Phase: PhaseDone})
+	assert.Equal(t, []Phase{PhaseScanning, PhaseArchiving, PhaseDone}, phases)
+}
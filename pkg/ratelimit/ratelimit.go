@@ -0,0 +1,317 @@
+// Package ratelimit throttles transfers with a token bucket, whose rate may depend on the time of day.
+//
+// A Limiter is shared by every transfer it throttles, so the limit applies to their aggregate throughput.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxReadSize bounds the size of reads through throttled readers, so tokens are taken in small steps and
+// transfers sharing a Limiter progress evenly.
+const maxReadSize = 32 * 1024
+
+// Config is the configuration of a Limiter.
+type Config struct {
+	// Rate is the limit outside of Schedule windows, like "2MB" per second. Empty or "0" means unlimited.
+	Rate string `json:"rate,omitempty" yaml:"rate,omitempty" mapstructure:"rate"`
+	// Schedule lists windows of the day with their own rate, the first window containing a time applies.
+	Schedule []Window `json:"schedule,omitempty" yaml:"schedule,omitempty" mapstructure:"schedule"`
+}
+
+// Window is a time of day window with its own rate.
+type Window struct {
+	// From and To are local times of day like "08:00", a window with To before From spans midnight.
+	From string `json:"from" yaml:"from" mapstructure:"from"`
+	To   string `json:"to" yaml:"to" mapstructure:"to"`
+	// Rate is like Config.Rate.
+	Rate string `json:"rate" yaml:"rate" mapstructure:"rate"`
+}
+
+// IsZero reports whether c sets no limit at all.
+func (c Config) IsZero() bool {
+	return c.Rate == "" && len(c.Schedule) == 0
+}
+
+// String returns a short description of c.
+func (c Config) String() string {
+	rate := c.Rate
+	if rate == "" {
+		rate = "unlimited"
+	}
+	parts := []string{rate}
+	for _, w := range c.Schedule {
+		parts = append(parts, w.Rate+" "+w.From+"-"+w.To)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Parse returns the schedule of rates described by c.
+func (c Config) Parse() (*Schedule, error) {
+	rate, err := ParseRate(c.Rate)
+	if err != nil {
+		return nil, err
+	}
+	s := &Schedule{rate: rate}
+	for _, w := range c.Schedule {
+		from, err := parseTimeOfDay(w.From)
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseTimeOfDay(w.To)
+		if err != nil {
+			return nil, err
+		}
+		rate, err := ParseRate(w.Rate)
+		if err != nil {
+			return nil, err
+		}
+		s.windows = append(s.windows, window{from: from, to: to, rate: rate})
+	}
+	return s, nil
+}
+
+// ParseRate parses a rate in bytes per second, like "512KB", "2MB" or "1048576". Units are multiples of 1024,
+// the "B" suffix and a "/s" suffix are optional. Empty means zero, which is unlimited.
+func ParseRate(s string) (int64, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	v = strings.TrimSuffix(v, "/S")
+	if v == "" {
+		return 0, nil
+	}
+	v = strings.TrimSuffix(v, "B")
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(v, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(v, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(v, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		v = v[:len(v)-1]
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// parseTimeOfDay parses a time of day like "08:00" and returns it as a duration since midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, want HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+type window struct {
+	from, to time.Duration
+	rate     int64
+}
+
+func (w window) contains(d time.Duration) bool {
+	if w.from <= w.to {
+		return d >= w.from && d < w.to
+	}
+	return d >= w.from || d < w.to
+}
+
+// Schedule gives the rate limit at a time.
+type Schedule struct {
+	rate    int64
+	windows []window
+}
+
+// Rate returns the limit at t in bytes per second, zero means unlimited.
+func (s *Schedule) Rate(t time.Time) int64 {
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	for _, w := range s.windows {
+		if w.contains(d) {
+			return w.rate
+		}
+	}
+	return s.rate
+}
+
+// Limiter is a token bucket holding up to one second of transfer at the current rate. It is safe for
+// concurrent use, a nil Limiter does not limit anything.
+type Limiter struct {
+	schedule *Schedule
+	now      func() time.Time
+	sleep    func(ctx context.Context, d time.Duration) error
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// New returns a Limiter following schedule.
+func New(schedule *Schedule) *Limiter {
+	return &Limiter{schedule: schedule, now: time.Now, sleep: sleep}
+}
+
+// NewFromConfig returns a Limiter configured by c, or nil if c sets no limit.
+func NewFromConfig(c Config) (*Limiter, error) {
+	if c.IsZero() {
+		return nil, nil
+	}
+	s, err := c.Parse()
+	if err != nil {
+		return nil, err
+	}
+	return New(s), nil
+}
+
+// Wait blocks until n bytes can be transferred, or ctx is done.
+func (l *Limiter) Wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+	for n > 0 {
+		l.mu.Lock()
+		now := l.now()
+		rate := float64(l.schedule.Rate(now))
+		if rate <= 0 {
+			l.last = time.Time{}
+			l.mu.Unlock()
+			return nil
+		}
+		if l.last.IsZero() {
+			l.tokens = rate
+		} else {
+			l.tokens += now.Sub(l.last).Seconds() * rate
+		}
+		if l.tokens > rate {
+			l.tokens = rate
+		}
+		l.last = now
+		take := n
+		if float64(take) > rate {
+			take = int(rate)
+		}
+		// Tokens may go negative, later callers then wait for the debt to be paid, which keeps the order of callers.
+		l.tokens -= float64(take)
+		var wait time.Duration
+		if l.tokens < 0 {
+			wait = time.Duration(-l.tokens / rate * float64(time.Second))
+		}
+		l.mu.Unlock()
+
+		if wait > 0 {
+			if err := l.sleep(ctx, wait); err != nil {
+				return err
+			}
+		}
+		n -= take
+	}
+	return nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type reader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *Limiter
+}
+
+// NewReader returns a reader of r throttled by l.
+func NewReader(ctx context.Context, r io.Reader, l *Limiter) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &reader{ctx: ctx, r: r, l: l}
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) > maxReadSize {
+		p = p[:maxReadSize]
+	}
+	n, err := r.r.Read(p)
+	if werr := r.l.Wait(r.ctx, n); werr != nil {
+		return n, werr
+	}
+	return n, err
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying l, so transfers made with it through a Transport are throttled by l
+// in addition to the Transport's own Limiter.
+func NewContext(ctx context.Context, l *Limiter) context.Context {
+	if l == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the Limiter carried by ctx, or nil.
+func FromContext(ctx context.Context) *Limiter {
+	l, _ := ctx.Value(contextKey{}).(*Limiter)
+	return l
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Transport is a http.RoundTripper throttling request and response bodies by its Limiter and by the Limiter
+// carried by the request context, if any.
+type Transport struct {
+	// Base sends requests, http.DefaultTransport if nil.
+	Base    http.RoundTripper
+	Limiter *Limiter
+}
+
+// NewTransport returns a Transport throttling requests sent with base by l.
+func NewTransport(base http.RoundTripper, l *Limiter) *Transport {
+	return &Transport{Base: base, Limiter: l}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	ctx := req.Context()
+	limiters := []*Limiter{t.Limiter, FromContext(ctx)}
+	if req.Body != nil && req.Body != http.NoBody {
+		req = req.Clone(ctx)
+		req.Body = readCloser{throttle(ctx, req.Body, limiters), req.Body}
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = readCloser{throttle(ctx, resp.Body, limiters), resp.Body}
+	return resp, nil
+}
+
+func throttle(ctx context.Context, r io.Reader, limiters []*Limiter) io.Reader {
+	for _, l := range limiters {
+		r = NewReader(ctx, r, l)
+	}
+	return r
+}
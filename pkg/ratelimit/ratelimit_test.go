@@ -0,0 +1,173 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"", 0},
+		{"0", 0},
+		{"1048576", 1048576},
+		{"512KB", 512 * 1024},
+		{"2MB", 2 * 1024 * 1024},
+		{"2 MB/s", 2 * 1024 * 1024},
+		{"1.5m", 3 * 512 * 1024},
+		{"1G", 1024 * 1024 * 1024},
+	}
+	for _, tc := range tests {
+		got, err := ParseRate(tc.in)
+		require.NoError(t, err, tc.in)
+		assert.Equal(t, tc.want, got, tc.in)
+	}
+	for _, in := range []string{"fast", "-1MB", "1TB"} {
+		_, err := ParseRate(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	c := Config{
+		Rate: "10MB",
+		Schedule: []Window{
+			{From: "08:00", To: "18:00", Rate: "2MB"},
+			{From: "22:00", To: "06:00", Rate: "0"},
+		},
+	}
+	s, err := c.Parse()
+	require.NoError(t, err)
+	at := func(clock string) time.Time {
+		tm, err := time.Parse("15:04", clock)
+		require.NoError(t, err)
+		return tm
+	}
+	assert.Equal(t, int64(10<<20), s.Rate(at("07:59")))
+	assert.Equal(t, int64(2<<20), s.Rate(at("08:00")))
+	assert.Equal(t, int64(2<<20), s.Rate(at("17:59")))
+	assert.Equal(t, int64(10<<20), s.Rate(at("18:00")))
+	assert.Equal(t, int64(0), s.Rate(at("23:30")))
+	assert.Equal(t, int64(0), s.Rate(at("05:59")))
+
+	_, err = Config{Schedule: []Window{{From: "8h", To: "18:00", Rate: "1MB"}}}.Parse()
+	assert.Error(t, err)
+}
+
+// fakeClock advances when limiters sleep.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(_ context.Context, d time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	return nil
+}
+
+func TestLimiterAggregate(t *testing.T) {
+	s, err := Config{Rate: "1000"}.Parse()
+	require.NoError(t, err)
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 12, 0, 0, 0, time.Local)}
+	l := New(s)
+	l.now, l.sleep = clock.Now, clock.Sleep
+	start := clock.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				assert.NoError(t, l.Wait(context.Background(), 100))
+			}
+		}()
+	}
+	wg.Wait()
+	// 10000 bytes at 1000 bytes per second, the first second is the initial burst.
+	elapsed := clock.Now().Sub(start)
+	assert.True(t, elapsed >= 8*time.Second && elapsed <= 10*time.Second, elapsed)
+}
+
+func TestLimiterUnlimited(t *testing.T) {
+	var l *Limiter
+	assert.NoError(t, l.Wait(context.Background(), 1<<30))
+	l, err := NewFromConfig(Config{})
+	require.NoError(t, err)
+	assert.Nil(t, l)
+}
+
+func TestLimiterCanceled(t *testing.T) {
+	s, err := Config{Rate: "1"}.Parse()
+	require.NoError(t, err)
+	l := New(s)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NoError(t, l.Wait(ctx, 1))
+	assert.Equal(t, context.Canceled, l.Wait(ctx, 1))
+}
+
+func TestTransport(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 150*1024)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(body)
+	}))
+	defer srv.Close()
+
+	l, err := NewFromConfig(Config{Rate: "100KB"})
+	require.NoError(t, err)
+	client := &http.Client{Transport: NewTransport(nil, l)}
+	start := time.Now()
+	resp, err := client.Get(srv.URL)
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, body, got)
+	// The first 100KB are the initial burst.
+	assert.True(t, time.Since(start) >= 400*time.Millisecond, time.Since(start))
+}
+
+func TestTransportContextLimiter(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 150*1024)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(body)
+	}))
+	defer srv.Close()
+
+	l, err := NewFromConfig(Config{Rate: "100KB"})
+	require.NoError(t, err)
+	assert.Equal(t, l, FromContext(NewContext(context.Background(), l)))
+	assert.Nil(t, FromContext(context.Background()))
+
+	client := &http.Client{Transport: NewTransport(nil, nil)}
+	req, err := http.NewRequestWithContext(NewContext(context.Background(), l), http.MethodGet, srv.URL, nil)
+	require.NoError(t, err)
+	start := time.Now()
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, body, got)
+	assert.True(t, time.Since(start) >= 400*time.Millisecond, time.Since(start))
+}
@@ -0,0 +1,366 @@
+// Package repository implements the chunked, deduplicated backup format.
+//
+// Files are split into content-defined chunks which are stored once, addressed by their SHA-256.
+// Each recovery point is described by an Index listing every file and the chunks making up its content,
+// so unchanged data is never uploaded twice.
+package repository
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/chunker"
+	"github.com/bizflycloud/bizfly-backup/pkg/filter"
+	"github.com/bizflycloud/bizfly-backup/pkg/manifest"
+	"github.com/bizflycloud/bizfly-backup/pkg/restore"
+)
+
+const (
+	indexMagic   = "BZBKIDX1\n"
+	indexVersion = 1
+
+	NodeTypeFile    = "file"
+	NodeTypeDir     = "dir"
+	NodeTypeSymlink = "symlink"
+)
+
+// ErrChunkCorrupted indicates that a downloaded chunk does not match its id.
+var ErrChunkCorrupted = errors.New("chunk content does not match its id")
+
+// ChunkStore stores chunks addressed by their id.
+type ChunkStore interface {
+	HasChunk(ctx context.Context, id string) (bool, error)
+	PutChunk(ctx context.Context, id string, data []byte) error
+	GetChunk(ctx context.Context, id string) ([]byte, error)
+}
+
+// Index is the tree of a recovery point.
+type Index struct {
+	Version int    `json:"version"`
+	Nodes   []Node `json:"nodes"`
+}
+
+// Node is a file, directory or symlink in the Index.
+type Node struct {
+	Path       string      `json:"path"`
+	Type       string      `json:"type"`
+	Mode       os.FileMode `json:"mode"`
+	ModTime    time.Time   `json:"mtime"`
+	Size       int64       `json:"size"`
+	LinkTarget string      `json:"link_target,omitempty"`
+	Chunks     []string    `json:"chunks,omitempty"`
+}
+
+// Stats reports what a Backup did.
+type Stats struct {
+	Files         int
+	Bytes         int64
+	NewChunks     int
+	UploadedBytes int64
+}
+
+// ChunkID returns the id of given chunk data.
+func ChunkID(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// IsIndex reports whether header is the beginning of an encoded Index.
+func IsIndex(header []byte) bool {
+	return bytes.HasPrefix(header, []byte(indexMagic))
+}
+
+// WriteIndex encodes idx to w.
+func WriteIndex(w io.Writer, idx *Index) error {
+	if _, err := io.WriteString(w, indexMagic); err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(w)
+	if err := json.NewEncoder(zw).Encode(idx); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// ReadIndex decodes an Index written by WriteIndex.
+func ReadIndex(r io.Reader) (*Index, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(len(indexMagic))
+	if err != nil || !IsIndex(header) {
+		return nil, errors.New("not a recovery point index")
+	}
+	_, _ = br.Discard(len(indexMagic))
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	var idx Index
+	if err := json.NewDecoder(zr).Decode(&idx); err != nil {
+		return nil, err
+	}
+	if idx.Version != indexVersion {
+		return nil, fmt.Errorf("unsupported index version: %d", idx.Version)
+	}
+	return &idx, nil
+}
+
+// Backup walks src, stores every chunk not yet in store and returns the Index of src. Files excluded by f
+// are skipped, f may be nil.
+//
+// Every byte read from src is also written to progress.
+func Backup(ctx context.Context, store ChunkStore, src string, f *filter.Filter, progress io.Writer) (*Index, *Stats, error) {
+	srcAbs, err := filepath.Abs(src)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	idx := &Index{Version: indexVersion}
+	stats := &Stats{}
+	// seen avoids asking the store twice for chunks repeated inside this backup.
+	seen := make(map[string]bool)
+
+	storeChunk := func(data []byte) (string, error) {
+		id := ChunkID(data)
+		if seen[id] {
+			return id, nil
+		}
+		ok, err := store.HasChunk(ctx, id)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			if err := store.PutChunk(ctx, id, data); err != nil {
+				return "", err
+			}
+			stats.NewChunks++
+			stats.UploadedBytes += int64(len(data))
+		}
+		seen[id] = true
+		return id, nil
+	}
+
+	walker := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if path == srcAbs {
+			return nil
+		}
+		rel, err := filepath.Rel(srcAbs, path)
+		if err != nil {
+			return err
+		}
+		excluded, err := f.Excluded(rel, info)
+		if err != nil {
+			return err
+		}
+		if excluded {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		node := Node{
+			Path:    filepath.ToSlash(rel),
+			Mode:    info.Mode(),
+			ModTime: info.ModTime(),
+		}
+
+		switch {
+		case info.IsDir():
+			node.Type = NodeTypeDir
+		case info.Mode()&os.ModeSymlink != 0:
+			node.Type = NodeTypeSymlink
+			if node.LinkTarget, err = os.Readlink(path); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			node.Type = NodeTypeFile
+			fi, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer fi.Close()
+			c, err := chunker.New(fi)
+			if err != nil {
+				return err
+			}
+			for {
+				data, err := c.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return err
+				}
+				id, err := storeChunk(data)
+				if err != nil {
+					return err
+				}
+				node.Chunks = append(node.Chunks, id)
+				node.Size += int64(len(data))
+				_, _ = progress.Write(data)
+			}
+			stats.Files++
+			stats.Bytes += node.Size
+		default:
+			// Sockets, devices and pipes have no content to back up.
+			return nil
+		}
+		idx.Nodes = append(idx.Nodes, node)
+		return nil
+	}
+
+	if err := filepath.Walk(srcAbs, walker); err != nil {
+		return nil, nil, err
+	}
+	return idx, stats, nil
+}
+
+// Restore recreates the tree described by idx in t, fetching chunks from store. Only nodes selected by sel are
+// restored, so only their chunks are fetched, sel may be nil.
+func Restore(ctx context.Context, store ChunkStore, idx *Index, t *restore.Target, sel *filter.Selection) error {
+	var dirs []string
+	var dirNodes []Node
+	for _, node := range idx.Nodes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !sel.Match(node.Path, node.Type == NodeTypeDir) {
+			continue
+		}
+		switch node.Type {
+		case NodeTypeDir:
+			target, apply, err := t.Mkdir(node.Path, node.ModTime)
+			if err != nil {
+				return err
+			}
+			if apply {
+				dirs = append(dirs, target)
+				dirNodes = append(dirNodes, node)
+			}
+		case NodeTypeSymlink:
+			target, err := t.File(node.Path, node.ModTime)
+			if err != nil {
+				return err
+			}
+			if target == "" {
+				continue
+			}
+			if err := os.Symlink(node.LinkTarget, target); err != nil {
+				return err
+			}
+		case NodeTypeFile:
+			target, err := t.File(node.Path, node.ModTime)
+			if err != nil {
+				return err
+			}
+			if target == "" {
+				continue
+			}
+			if err := restoreFile(ctx, store, node, target); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown node type %q for %s", node.Type, node.Path)
+		}
+	}
+
+	// Directory attributes are set last, writing files inside would change their mtime.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i], dirNodes[i].Mode.Perm()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(dirs[i], dirNodes[i].ModTime, dirNodes[i].ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verify fetches every chunk of files of idx from store, and checks that it matches its id and that files have
+// their recorded size.
+func Verify(ctx context.Context, store ChunkStore, idx *Index) (*manifest.Report, error) {
+	report := &manifest.Report{}
+	// sizes caches sizes of verified chunks, -1 for corrupted ones.
+	sizes := make(map[string]int64)
+	for _, node := range idx.Nodes {
+		if node.Type != NodeTypeFile {
+			continue
+		}
+		report.Files++
+		var size int64
+		corrupted := false
+		for _, id := range node.Chunks {
+			n, ok := sizes[id]
+			if !ok {
+				data, err := store.GetChunk(ctx, id)
+				if err != nil {
+					return nil, fmt.Errorf("get chunk %s: %w", id, err)
+				}
+				n = int64(len(data))
+				if ChunkID(data) != id {
+					n = -1
+				}
+				sizes[id] = n
+			}
+			if n < 0 {
+				corrupted = true
+				break
+			}
+			size += n
+		}
+		switch {
+		case corrupted:
+			report.Mismatches = append(report.Mismatches, manifest.Mismatch{Path: node.Path, Reason: ErrChunkCorrupted.Error()})
+		case size != node.Size:
+			report.Mismatches = append(report.Mismatches, manifest.Mismatch{
+				Path:   node.Path,
+				Reason: fmt.Sprintf("size is %d, want %d", size, node.Size),
+			})
+		}
+	}
+	return report, nil
+}
+
+func restoreFile(ctx context.Context, store ChunkStore, node Node, target string) error {
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, node.Mode.Perm())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, id := range node.Chunks {
+		data, err := store.GetChunk(ctx, id)
+		if err != nil {
+			return fmt.Errorf("get chunk %s: %w", id, err)
+		}
+		if ChunkID(data) != id {
+			return fmt.Errorf("%s: %w", id, ErrChunkCorrupted)
+		}
+		if _, err := f.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(target, node.Mode.Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(target, node.ModTime, node.ModTime)
+}
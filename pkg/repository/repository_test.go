@@ -0,0 +1,182 @@
+package repository
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/filter"
+	"github.com/bizflycloud/bizfly-backup/pkg/restore"
+)
+
+type memStore struct {
+	mu     sync.Mutex
+	chunks map[string][]byte
+	puts   int
+}
+
+func newMemStore() *memStore {
+	return &memStore{chunks: make(map[string][]byte)}
+}
+
+func (m *memStore) HasChunk(_ context.Context, id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.chunks[id]
+	return ok, nil
+}
+
+func (m *memStore) PutChunk(_ context.Context, id string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.chunks[id] = append([]byte(nil), data...)
+	m.puts++
+	return nil
+}
+
+func (m *memStore) GetChunk(_ context.Context, id string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.chunks[id]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return data, nil
+}
+
+func makeTree(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "bizfly-backup-repository-test-*")
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "a", "b"), 0750))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "foo.txt"), []byte("foo\n"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a", "b", "bar.txt"), bytes.Repeat([]byte("bar"), 1000), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a", "copy.txt"), bytes.Repeat([]byte("bar"), 1000), 0644))
+	require.NoError(t, os.Symlink("foo.txt", filepath.Join(dir, "link")))
+	return dir
+}
+
+func newTarget(t *testing.T, dest string) *restore.Target {
+	target, err := restore.NewTarget(dest, restore.ModeOverwrite)
+	require.NoError(t, err)
+	return target
+}
+
+func TestBackupRestore(t *testing.T) {
+	src := makeTree(t)
+	defer os.RemoveAll(src)
+
+	store := newMemStore()
+	idx, stats, err := Backup(context.Background(), store, src, nil, ioutil.Discard)
+	require.NoError(t, err)
+	assert.Equal(t, 3, stats.Files)
+	// bar.txt and copy.txt share their only chunk.
+	assert.Equal(t, 2, stats.NewChunks)
+	assert.Len(t, idx.Nodes, 6)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteIndex(&buf, idx))
+	assert.True(t, IsIndex(buf.Bytes()))
+	decoded, err := ReadIndex(&buf)
+	require.NoError(t, err)
+
+	dest, err := ioutil.TempDir("", "bizfly-backup-repository-test-restore-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	require.NoError(t, Restore(context.Background(), store, decoded, newTarget(t, dest), nil))
+
+	content, err := ioutil.ReadFile(filepath.Join(dest, "a", "b", "bar.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, bytes.Repeat([]byte("bar"), 1000), content)
+	fi, err := os.Stat(filepath.Join(dest, "foo.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	target, err := os.Readlink(filepath.Join(dest, "link"))
+	require.NoError(t, err)
+	assert.Equal(t, "foo.txt", target)
+
+	// Backing up again uploads nothing.
+	_, stats, err = Backup(context.Background(), store, src, nil, ioutil.Discard)
+	require.NoError(t, err)
+	assert.Equal(t, 0, stats.NewChunks)
+	assert.Equal(t, 2, store.puts)
+}
+
+func TestRestoreSelection(t *testing.T) {
+	src := makeTree(t)
+	defer os.RemoveAll(src)
+	store := newMemStore()
+	idx, _, err := Backup(context.Background(), store, src, nil, ioutil.Discard)
+	require.NoError(t, err)
+
+	dest, err := ioutil.TempDir("", "bizfly-backup-repository-test-restore-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	sel, err := filter.NewSelection([]string{"a/b/"})
+	require.NoError(t, err)
+	require.NoError(t, Restore(context.Background(), store, idx, newTarget(t, dest), sel))
+
+	_, err = os.Stat(filepath.Join(dest, "a", "b", "bar.txt"))
+	assert.NoError(t, err)
+	for _, name := range []string{"foo.txt", "link", filepath.Join("a", "copy.txt")} {
+		_, err = os.Lstat(filepath.Join(dest, name))
+		assert.True(t, os.IsNotExist(err), name)
+	}
+}
+
+func TestRestoreCorruptedChunk(t *testing.T) {
+	src := makeTree(t)
+	defer os.RemoveAll(src)
+
+	store := newMemStore()
+	idx, _, err := Backup(context.Background(), store, src, nil, ioutil.Discard)
+	require.NoError(t, err)
+	for id := range store.chunks {
+		store.chunks[id] = []byte("garbage")
+	}
+
+	dest, err := ioutil.TempDir("", "bizfly-backup-repository-test-restore-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	err = Restore(context.Background(), store, idx, newTarget(t, dest), nil)
+	assert.True(t, errors.Is(err, ErrChunkCorrupted))
+}
+
+func TestVerify(t *testing.T) {
+	src := makeTree(t)
+	defer os.RemoveAll(src)
+	store := newMemStore()
+	idx, _, err := Backup(context.Background(), store, src, nil, ioutil.Discard)
+	require.NoError(t, err)
+
+	report, err := Verify(context.Background(), store, idx)
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.Files)
+	assert.Empty(t, report.Mismatches)
+
+	for _, node := range idx.Nodes {
+		if node.Path == "foo.txt" {
+			store.chunks[node.Chunks[0]] = []byte("garbage")
+		}
+	}
+	report, err = Verify(context.Background(), store, idx)
+	require.NoError(t, err)
+	require.Len(t, report.Mismatches, 1)
+	assert.Equal(t, "foo.txt", report.Mismatches[0].Path)
+}
+
+func TestRestoreRejectsEscapingPath(t *testing.T) {
+	idx := &Index{Version: indexVersion, Nodes: []Node{{Path: "../evil", Type: NodeTypeDir, Mode: os.ModeDir | 0755}}}
+	dest, err := ioutil.TempDir("", "bizfly-backup-repository-test-restore-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	err = Restore(context.Background(), newMemStore(), idx, newTarget(t, dest), nil)
+	assert.True(t, errors.Is(err, restore.ErrUnsafePath))
+}
@@ -0,0 +1,330 @@
+// Package restore decides where restored files are written in a destination directory.
+//
+// Every name is checked to stay inside the destination, including through symlinks already present in it, and
+// files existing before the restore are handled according to the restore Mode. Files restored earlier by the same
+// restore, like those of the parent of an incremental recovery point, are always replaced.
+package restore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mode is the policy applied to files existing in the destination before the restore.
+type Mode string
+
+const (
+	// ModeOverwrite replaces existing files.
+	ModeOverwrite Mode = "overwrite"
+	// ModeSkipExisting keeps existing files, their restored version is discarded.
+	ModeSkipExisting Mode = "skip-existing"
+	// ModeKeepNewer keeps existing files modified after their restored version, and replaces the others.
+	ModeKeepNewer Mode = "keep-newer"
+	// ModeRenameConflicts keeps existing files, and writes their restored version next to them with a
+	// ".restored" suffix. This is the default.
+	ModeRenameConflicts Mode = "rename-conflicts"
+)
+
+// DefaultMode is the mode of restores not choosing one.
+const DefaultMode = ModeRenameConflicts
+
+// conflictSuffix is appended to names of restored files renamed by ModeRenameConflicts.
+const conflictSuffix = ".restored"
+
+// ErrUnsafePath indicates that a restored name would be written outside of the destination.
+var ErrUnsafePath = errors.New("path escapes restore destination")
+
+// ParseMode returns the Mode named s, empty means DefaultMode.
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(s); m {
+	case "":
+		return DefaultMode, nil
+	case ModeOverwrite, ModeSkipExisting, ModeKeepNewer, ModeRenameConflicts:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown restore mode %q, must be one of %s, %s, %s or %s",
+		s, ModeOverwrite, ModeSkipExisting, ModeKeepNewer, ModeRenameConflicts)
+}
+
+// Target is a directory files are restored to. It is not safe for concurrent use.
+type Target struct {
+	dir     string
+	realDir string
+	mode    Mode
+	// restored maps names restored so far to the path they are written at.
+	restored map[string]string
+	// skipped holds names not restored, along with the content of directories.
+	skipped   map[string]bool
+	conflicts int
+}
+
+// NewTarget creates dir if needed, and returns a Target restoring to it with given mode.
+func NewTarget(dir string, mode Mode) (*Target, error) {
+	if _, err := ParseMode(string(mode)); err != nil {
+		return nil, err
+	}
+	if mode == "" {
+		mode = DefaultMode
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(abs, 0755); err != nil {
+		return nil, err
+	}
+	// The destination itself may be a symlink, only what is below it must not escape.
+	real, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return nil, err
+	}
+	return &Target{
+		dir:      abs,
+		realDir:  real,
+		mode:     mode,
+		restored: make(map[string]string),
+		skipped:  make(map[string]bool),
+	}, nil
+}
+
+// Dir returns the absolute path of the destination directory.
+func (t *Target) Dir() string {
+	return t.dir
+}
+
+// Mode returns the restore mode of t.
+func (t *Target) Mode() Mode {
+	return t.mode
+}
+
+// Conflicts returns the number of names which existed in the destination before the restore.
+func (t *Target) Conflicts() int {
+	return t.conflicts
+}
+
+// File returns the path where the non directory entry name, last modified at modTime, must be written, or an
+// empty path if it must not be restored. Nothing exists at the returned path, and its parent directory exists.
+func (t *Target) File(name string, modTime time.Time) (string, error) {
+	name, target, err := t.prepare(name)
+	if err != nil || target == "" {
+		return "", err
+	}
+	if _, ok := t.restored[name]; ok {
+		return target, removeAll(target)
+	}
+	fi, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		t.restored[name] = target
+		return target, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if target, err = t.conflict(name, target, fi, modTime); target == "" && err == nil {
+		t.skipped[name] = true
+	}
+	return target, err
+}
+
+// Mkdir creates directory entry name, last modified at modTime, and returns its path, or an empty path if it and
+// its content must not be restored. It also reports whether metadata of the directory must be restored, which
+// is not the case of directories existing before the restore, unless t overwrites them.
+func (t *Target) Mkdir(name string, modTime time.Time) (string, bool, error) {
+	name, target, err := t.prepare(name)
+	if err != nil || target == "" {
+		return "", false, err
+	}
+	fi, err := os.Lstat(target)
+	switch {
+	case os.IsNotExist(err):
+		t.restored[name] = target
+		return target, true, os.Mkdir(target, 0755)
+	case err != nil:
+		return "", false, err
+	case fi.IsDir():
+		_, ok := t.restored[name]
+		return target, ok || t.mode == ModeOverwrite, nil
+	}
+	if _, ok := t.restored[name]; !ok {
+		if target, err = t.conflict(name, target, fi, modTime); err != nil {
+			return "", false, err
+		}
+		if target == "" {
+			t.skipped[name] = true
+			return "", false, nil
+		}
+	} else if err := removeAll(target); err != nil {
+		return "", false, err
+	}
+	return target, true, os.Mkdir(target, 0755)
+}
+
+// Path returns the path of name in the destination, like the target of a hard link.
+func (t *Target) Path(name string) (string, error) {
+	name, err := clean(name)
+	if err != nil {
+		return "", err
+	}
+	target := t.path(name)
+	if err := t.checkParent(target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// Restored returns the path name has been restored to, it reports false if name has not been restored.
+func (t *Target) Restored(name string) (string, bool) {
+	name, err := clean(name)
+	if err != nil {
+		return "", false
+	}
+	target, ok := t.restored[name]
+	return target, ok
+}
+
+// Skipped reports whether name, or one of its parent directories, has not been restored because it existed
+// before the restore.
+func (t *Target) Skipped(name string) bool {
+	name, err := clean(name)
+	if err != nil {
+		return false
+	}
+	for ; name != "."; name = filepath.Dir(name) {
+		if t.skipped[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove removes name from the destination if it was restored by t, files existing before the restore are kept.
+func (t *Target) Remove(name string) error {
+	name, err := clean(name)
+	if err != nil {
+		return err
+	}
+	target, ok := t.restored[name]
+	if !ok {
+		return nil
+	}
+	delete(t.restored, name)
+	return removeAll(target)
+}
+
+// prepare checks name, creates its parent directory and returns the clean name and its path, or an empty path
+// if name is inside a skipped directory.
+func (t *Target) prepare(name string) (string, string, error) {
+	name, err := clean(name)
+	if err != nil {
+		return "", "", err
+	}
+	if name == "." {
+		return "", "", fmt.Errorf("%w: %s", ErrUnsafePath, name)
+	}
+	for dir := filepath.Dir(name); dir != "."; dir = filepath.Dir(dir) {
+		if t.skipped[dir] {
+			return name, "", nil
+		}
+	}
+	target := t.path(name)
+	if err := t.checkParent(target); err != nil {
+		return "", "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", "", err
+	}
+	return name, target, nil
+}
+
+// path returns the path of clean name, following renames of its parent directories.
+func (t *Target) path(name string) string {
+	if p, ok := t.restored[name]; ok {
+		return p
+	}
+	dir := filepath.Dir(name)
+	if dir == "." {
+		return filepath.Join(t.dir, name)
+	}
+	return filepath.Join(t.path(dir), filepath.Base(name))
+}
+
+// checkParent checks that the parent directory of target, once symlinks are resolved, is inside the destination.
+func (t *Target) checkParent(target string) error {
+	existing := filepath.Dir(target)
+	for {
+		_, err := os.Lstat(existing)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		existing = filepath.Dir(existing)
+	}
+	real, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return err
+	}
+	if real != t.realDir && !strings.HasPrefix(real, t.realDir+string(os.PathSeparator)) {
+		return fmt.Errorf("%w: %s", ErrUnsafePath, target)
+	}
+	return nil
+}
+
+// conflict applies t mode to name existing at target with info fi, and returns where its restored version must
+// be written, or an empty path if it must not be.
+func (t *Target) conflict(name string, target string, fi os.FileInfo, modTime time.Time) (string, error) {
+	t.conflicts++
+	switch t.mode {
+	case ModeSkipExisting:
+		return "", nil
+	case ModeKeepNewer:
+		if !modTime.After(fi.ModTime()) {
+			return "", nil
+		}
+	case ModeRenameConflicts:
+		for i := 0; ; i++ {
+			renamed := target + conflictSuffix
+			if i > 0 {
+				renamed += "." + strconv.Itoa(i)
+			}
+			if _, err := os.Lstat(renamed); os.IsNotExist(err) {
+				t.restored[name] = renamed
+				return renamed, nil
+			} else if err != nil {
+				return "", err
+			}
+		}
+	}
+	t.restored[name] = target
+	return target, removeAll(target)
+}
+
+// clean returns name cleaned, rejecting absolute names and names escaping the destination.
+func clean(name string) (string, error) {
+	c := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(c) || filepath.VolumeName(c) != "" || c == ".." || strings.HasPrefix(c, ".."+string(os.PathSeparator)) {
+		return "", fmt.Errorf("%w: %s", ErrUnsafePath, name)
+	}
+	return c, nil
+}
+
+// removeAll removes what is at target, never following a symlink.
+func removeAll(target string) error {
+	fi, err := os.Lstat(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return os.RemoveAll(target)
+	}
+	return os.Remove(target)
+}
@@ -0,0 +1,172 @@
+package restore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "bizfly-backup-restore-test-*")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func writeFile(t *testing.T, target *Target, name string, modTime time.Time, content string) string {
+	path, err := target.File(name, modTime)
+	require.NoError(t, err)
+	if path != "" {
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+	return path
+}
+
+func read(t *testing.T, name string) string {
+	data, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	return string(data)
+}
+
+func TestParseMode(t *testing.T) {
+	m, err := ParseMode("")
+	require.NoError(t, err)
+	assert.Equal(t, DefaultMode, m)
+	m, err = ParseMode("keep-newer")
+	require.NoError(t, err)
+	assert.Equal(t, ModeKeepNewer, m)
+	_, err = ParseMode("clobber")
+	assert.Error(t, err)
+}
+
+func TestModes(t *testing.T) {
+	old := time.Now().Add(-time.Hour)
+	recent := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		mode     Mode
+		modTime  time.Time
+		existing string
+		restored string
+	}{
+		{ModeOverwrite, old, "restored", ""},
+		{ModeSkipExisting, recent, "live", ""},
+		{ModeKeepNewer, old, "live", ""},
+		{ModeKeepNewer, recent, "restored", ""},
+		{ModeRenameConflicts, old, "live", "restored"},
+	}
+	for _, tc := range tests {
+		dir := tempDir(t)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), []byte("live"), 0644))
+		target, err := NewTarget(dir, tc.mode)
+		require.NoError(t, err)
+		writeFile(t, target, "file", tc.modTime, "restored")
+		writeFile(t, target, "new", tc.modTime, "new")
+
+		assert.Equal(t, tc.existing, read(t, filepath.Join(dir, "file")), tc.mode)
+		assert.Equal(t, "new", read(t, filepath.Join(dir, "new")), tc.mode)
+		if tc.restored != "" {
+			assert.Equal(t, tc.restored, read(t, filepath.Join(dir, "file.restored")), tc.mode)
+		}
+		assert.Equal(t, 1, target.Conflicts(), tc.mode)
+		_, restored := target.Restored("file")
+		assert.Equal(t, tc.existing == "restored" || tc.restored != "", restored, tc.mode)
+		assert.Equal(t, !restored, target.Skipped("file"), tc.mode)
+	}
+}
+
+func TestRestoredTwice(t *testing.T) {
+	dir := tempDir(t)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), []byte("live"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "kept"), []byte("live"), 0644))
+	target, err := NewTarget(dir, ModeRenameConflicts)
+	require.NoError(t, err)
+
+	// Files of a parent recovery point are replaced by those of its children.
+	assert.Equal(t, filepath.Join(dir, "file.restored"), writeFile(t, target, "file", time.Now(), "parent"))
+	assert.Equal(t, filepath.Join(dir, "file.restored"), writeFile(t, target, "file", time.Now(), "child"))
+	assert.Equal(t, "child", read(t, filepath.Join(dir, "file.restored")))
+
+	// Content of renamed directories follows them.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "sub"), []byte("live"), 0644))
+	path, apply, err := target.Mkdir("sub", time.Now())
+	require.NoError(t, err)
+	assert.True(t, apply)
+	assert.Equal(t, filepath.Join(dir, "sub.restored"), path)
+	assert.Equal(t, filepath.Join(dir, "sub.restored", "a"), writeFile(t, target, "sub/a", time.Now(), "a"))
+
+	require.NoError(t, target.Remove("file"))
+	require.NoError(t, target.Remove("kept"))
+	_, err = os.Stat(filepath.Join(dir, "file.restored"))
+	assert.True(t, os.IsNotExist(err))
+	assert.Equal(t, "live", read(t, filepath.Join(dir, "kept")))
+}
+
+func TestExistingDirectory(t *testing.T) {
+	dir := tempDir(t)
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "sub"), 0755))
+
+	target, err := NewTarget(dir, ModeSkipExisting)
+	require.NoError(t, err)
+	path, apply, err := target.Mkdir("sub", time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "sub"), path)
+	assert.False(t, apply)
+	assert.Equal(t, 0, target.Conflicts())
+
+	target, err = NewTarget(dir, ModeOverwrite)
+	require.NoError(t, err)
+	_, apply, err = target.Mkdir("sub", time.Now())
+	require.NoError(t, err)
+	assert.True(t, apply)
+
+	// Content of a directory conflicting with a file is skipped along with it.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "file"), []byte("live"), 0644))
+	target, err = NewTarget(dir, ModeSkipExisting)
+	require.NoError(t, err)
+	path, _, err = target.Mkdir("file", time.Now())
+	require.NoError(t, err)
+	assert.Empty(t, path)
+	assert.Empty(t, writeFile(t, target, "file/a", time.Now(), "a"))
+	assert.True(t, target.Skipped("file/a"))
+	_, ok := target.Restored("file/a")
+	assert.False(t, ok)
+}
+
+func TestUnsafePath(t *testing.T) {
+	outside := tempDir(t)
+	dir := tempDir(t)
+	require.NoError(t, os.Symlink(outside, filepath.Join(dir, "link")))
+	require.NoError(t, os.Symlink(".", filepath.Join(dir, "self")))
+
+	target, err := NewTarget(dir, ModeOverwrite)
+	require.NoError(t, err)
+	for _, name := range []string{"../evil", "/etc/passwd", "a/../../evil", "link/evil", "link/sub/evil", "."} {
+		_, err := target.File(name, time.Now())
+		assert.True(t, errors.Is(err, ErrUnsafePath), name)
+	}
+	_, err = target.Path("link/evil")
+	assert.True(t, errors.Is(err, ErrUnsafePath))
+
+	// Symlinks staying inside the destination are followed.
+	path, err := target.File("self/file", time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "self", "file"), path)
+
+	// The symlink itself is replaced, not written through.
+	path, err = target.File("link", time.Now())
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path, []byte("file"), 0644))
+	fi, err := os.Lstat(filepath.Join(dir, "link"))
+	require.NoError(t, err)
+	assert.True(t, fi.Mode().IsRegular())
+	files, err := ioutil.ReadDir(outside)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
@@ -0,0 +1,136 @@
+// Package retention selects the recovery points to keep with grandfather-father-son retention policies.
+//
+// A policy keeps the newest recovery point of each of its last hours, days, weeks and months which have one, so a
+// directory backed up hourly keeps one point per hour for the last Hours hours with backups, one per day beyond
+// that, and so on. Periods without recovery points do not count. The newest point is always kept, as are the
+// points incremental kept points are made on.
+package retention
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Policy is the number of hourly, daily, weekly and monthly recovery points to keep. A zero Policy keeps
+// everything.
+type Policy struct {
+	Hours  int `json:"hours,omitempty"`
+	Days   int `json:"days,omitempty"`
+	Weeks  int `json:"weeks,omitempty"`
+	Months int `json:"months,omitempty"`
+}
+
+// IsZero reports whether p keeps every recovery point.
+func (p Policy) IsZero() bool {
+	return p.Hours <= 0 && p.Days <= 0 && p.Weeks <= 0 && p.Months <= 0
+}
+
+func (p Policy) String() string {
+	var parts []string
+	for _, r := range p.rules() {
+		if r.count > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", r.count, r.name))
+		}
+	}
+	if len(parts) == 0 {
+		return "keep all"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// rule keeps the newest point of each of the last count periods with points, periods are identified by key.
+type rule struct {
+	name  string
+	count int
+	key   func(t time.Time) string
+}
+
+func (p Policy) rules() []rule {
+	return []rule{
+		{"hourly", p.Hours, func(t time.Time) string { return t.Format("2006-01-02 15h") }},
+		{"daily", p.Days, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", p.Weeks, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"monthly", p.Months, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+}
+
+// Point is a recovery point to apply policies to.
+type Point struct {
+	ID   string
+	Time time.Time
+	// PolicyID is the ID of the policy which made the point, it selects the policy applied to it.
+	PolicyID string
+	// Incremental points are made on the previous point, which must be kept along with them.
+	Incremental bool
+}
+
+// Decision tells whether a point is kept, and why.
+type Decision struct {
+	Point
+	Keep    bool
+	Reasons []string
+}
+
+func (d *Decision) keep(reason string) {
+	d.Keep = true
+	d.Reasons = append(d.Reasons, reason)
+}
+
+// Apply applies policies, keyed by policy ID, to points and returns a decision for each of them, newest first.
+// Points of a policy missing from policies or with a zero policy are kept. Periods are those of the location of
+// point times.
+func Apply(policies map[string]Policy, points []Point) []Decision {
+	ds := make([]Decision, len(points))
+	for i, p := range points {
+		ds[i] = Decision{Point: p}
+	}
+	sort.SliceStable(ds, func(i, j int) bool {
+		return ds[i].Time.After(ds[j].Time)
+	})
+
+	byPolicy := make(map[string][]*Decision)
+	for i := range ds {
+		policy, ok := policies[ds[i].PolicyID]
+		if !ok || policy.IsZero() {
+			ds[i].keep("no retention policy")
+			continue
+		}
+		byPolicy[ds[i].PolicyID] = append(byPolicy[ds[i].PolicyID], &ds[i])
+	}
+	for id, group := range byPolicy {
+		for _, r := range policies[id].rules() {
+			last, kept := "", 0
+			for _, d := range group {
+				if kept >= r.count {
+					break
+				}
+				if key := r.key(d.Time); key != last {
+					d.keep(r.name + " " + key)
+					last = key
+					kept++
+				}
+			}
+		}
+	}
+
+	if len(ds) > 0 {
+		ds[0].keep("latest")
+	}
+	// Points are made on the previous point, whatever its policy, up to the initial replica.
+	child := ""
+	for i := range ds {
+		if child != "" {
+			ds[i].keep("parent of " + child)
+		}
+		child = ""
+		if ds[i].Keep && ds[i].Incremental {
+			child = ds[i].ID
+		}
+	}
+	return ds
+}
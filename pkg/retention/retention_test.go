@@ -0,0 +1,75 @@
+package retention
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func kept(ds []Decision) []string {
+	var ids []string
+	for _, d := range ds {
+		if d.Keep {
+			ids = append(ids, d.ID)
+		}
+	}
+	return ids
+}
+
+func TestApply(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	points := []Point{
+		{ID: "oct-1", Time: at("2026-10-01 02:00"), PolicyID: "p"},
+		{ID: "sep-30", Time: at("2026-09-30 02:00"), PolicyID: "p"},
+		{ID: "sep-15", Time: at("2026-09-15 02:00"), PolicyID: "p"},
+		{ID: "oct-14", Time: at("2026-10-14 02:00"), PolicyID: "p"},
+		{ID: "oct-15-a", Time: at("2026-10-15 01:00"), PolicyID: "p"},
+		{ID: "oct-15-b", Time: at("2026-10-15 02:00"), PolicyID: "p"},
+		{ID: "oct-15-c", Time: at("2026-10-15 02:30"), PolicyID: "p"},
+		{ID: "manual", Time: at("2026-08-01 10:00")},
+	}
+	ds := Apply(map[string]Policy{"p": {Hours: 2, Days: 3, Months: 2}}, points)
+	assert.Equal(t, "oct-15-c", ds[0].ID)
+	assert.Equal(t, []string{"hourly 2026-10-15 02h", "daily 2026-10-15", "monthly 2026-10", "latest"}, ds[0].Reasons)
+	// oct-15-b shares its hour with oct-15-c, the two other days are kept daily, September monthly.
+	assert.Equal(t, []string{"oct-15-c", "oct-15-a", "oct-14", "oct-1", "sep-30", "manual"}, kept(ds))
+	for _, d := range ds {
+		if d.ID == "manual" {
+			assert.Equal(t, []string{"no retention policy"}, d.Reasons)
+		}
+		if d.ID == "oct-15-b" || d.ID == "sep-15" {
+			assert.Empty(t, d.Reasons)
+		}
+	}
+
+	// A zero policy keeps everything.
+	assert.Len(t, kept(Apply(map[string]Policy{"p": {}}, points)), len(points))
+}
+
+func TestApplyIncremental(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	points := []Point{
+		{ID: "full-1", Time: now.AddDate(0, 0, -4), PolicyID: "p"},
+		{ID: "inc-1", Time: now.AddDate(0, 0, -3), PolicyID: "p", Incremental: true},
+		{ID: "full-2", Time: now.AddDate(0, 0, -2), PolicyID: "p"},
+		{ID: "inc-2", Time: now.AddDate(0, 0, -1), PolicyID: "other", Incremental: true},
+		{ID: "inc-3", Time: now, PolicyID: "p", Incremental: true},
+	}
+	ds := Apply(map[string]Policy{"p": {Hours: 1}, "other": {Hours: 1}}, points)
+	// inc-3 is made on inc-2 and full-2, whatever their policy.
+	assert.Equal(t, []string{"inc-3", "inc-2", "full-2"}, kept(ds))
+	assert.Equal(t, []string{"parent of inc-3"}, ds[1].Reasons[1:])
+	assert.Equal(t, []string{"parent of inc-2"}, ds[2].Reasons)
+}
+
+func TestPolicy_String(t *testing.T) {
+	assert.Equal(t, "keep all", Policy{}.String())
+	assert.Equal(t, "24 hourly, 4 weekly", Policy{Hours: 24, Weeks: 4}.String())
+}
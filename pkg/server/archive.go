@@ -0,0 +1,473 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
+	"github.com/bizflycloud/bizfly-backup/pkg/compression"
+	"github.com/bizflycloud/bizfly-backup/pkg/filter"
+	"github.com/bizflycloud/bizfly-backup/pkg/manifest"
+	"github.com/bizflycloud/bizfly-backup/pkg/restore"
+	"github.com/bizflycloud/bizfly-backup/pkg/source"
+	"github.com/bizflycloud/bizfly-backup/pkg/tarball"
+)
+
+const (
+	// tarMagic is the magic of POSIX tar headers, at tarMagicOffset of the first header.
+	tarMagic       = "ustar"
+	tarMagicOffset = 257
+)
+
+// zipMethodZstd is the zip compression method of zstd, from APPNOTE.TXT.
+const zipMethodZstd = 93
+
+// archiveSpec describes how a directory is archived.
+type archiveSpec struct {
+	// format is one of backupapi.ArchiveFormat* constants, empty means zip.
+	format string
+	// codec is the compression codec name, empty means the default codec of format.
+	codec string
+	level int
+	// rules selects the files archived.
+	rules filter.Rules
+	// manifestKey signs the manifest written along with archive metadata, nil leaves it unsigned.
+	manifestKey []byte
+	// source is what is archived, the output of a command source is archived instead of a directory.
+	source source.Config
+	// files restricts the archive to these paths relative to the directory, with the content of directories. Empty
+	// means the whole directory.
+	files []string
+}
+
+func newArchiveSpec(bdc backupapi.BackupDirectoryConfig) archiveSpec {
+	return archiveSpec{format: bdc.ArchiveFormat, codec: bdc.Compression, level: bdc.CompressionLevel, source: bdc.Source}
+}
+
+// validate checks that an archive can be written as described by spec.
+func (spec archiveSpec) validate() error {
+	if err := spec.source.Validate(); err != nil {
+		return err
+	}
+	// Tar headers hold the size of files, unknown until a command exits.
+	if spec.source.IsCommand() && spec.format == backupapi.ArchiveFormatTar {
+		return errors.New("command sources are not supported with tar archive format")
+	}
+	aw, err := newArchiveWriter(ioutil.Discard, spec)
+	if err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+// compression returns the compression codec of spec.
+func (spec archiveSpec) compression() (compression.Codec, error) {
+	name := spec.codec
+	if name == "" {
+		name = compression.Deflate
+		if spec.format == backupapi.ArchiveFormatTar {
+			name = compression.Gzip
+		}
+	}
+	codec, err := compression.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if spec.format != backupapi.ArchiveFormatTar {
+		switch codec.Name() {
+		case compression.Store, compression.Deflate, compression.Gzip, compression.Zstd:
+		default:
+			return nil, fmt.Errorf("compression codec %s is not supported by zip archives", codec.Name())
+		}
+	}
+	return codec, nil
+}
+
+// archiveWriter writes files to an archive.
+type archiveWriter interface {
+	// add writes the header of file at path as name, and reports whether content of the file must be written next.
+	add(name string, path string, info os.FileInfo) (bool, error)
+	// Write writes content of the file added last.
+	Write(p []byte) (int, error)
+	// addData writes a file with given content.
+	addData(name string, data []byte) error
+	// addStream writes the header of a file named name whose content of unknown size is written next.
+	addStream(name string, mode os.FileMode, modTime time.Time) error
+	Close() error
+}
+
+func newArchiveWriter(w io.Writer, spec archiveSpec) (archiveWriter, error) {
+	codec, err := spec.compression()
+	if err != nil {
+		return nil, err
+	}
+	if spec.format == backupapi.ArchiveFormatTar {
+		cw, err := codec.NewWriter(w, spec.level)
+		if err != nil {
+			return nil, err
+		}
+		return &tarArchiveWriter{Writer: tarball.NewWriter(cw), cw: cw}, nil
+	}
+
+	zw := zip.NewWriter(w)
+	var method uint16
+	switch codec.Name() {
+	case compression.Store:
+		method = zip.Store
+	case compression.Deflate, compression.Gzip:
+		// zip entries hold raw deflate streams, gzip is the same compression.
+		method = zip.Deflate
+		level := spec.level
+		if level == 0 {
+			level = flate.DefaultCompression
+		}
+		if _, err := flate.NewWriter(ioutil.Discard, level); err != nil {
+			return nil, err
+		}
+		zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		})
+	case compression.Zstd:
+		method = zipMethodZstd
+		zw.RegisterCompressor(zipMethodZstd, func(w io.Writer) (io.WriteCloser, error) {
+			return codec.NewWriter(w, spec.level)
+		})
+	}
+	return &zipArchiveWriter{zw: zw, method: method}, nil
+}
+
+type zipArchiveWriter struct {
+	zw     *zip.Writer
+	method uint16
+	fw     io.Writer
+}
+
+func (z *zipArchiveWriter) add(name string, path string, info os.FileInfo) (bool, error) {
+	isSymlink := info.Mode()&os.ModeSymlink != 0
+	// zip archives keep regular files and symlinks to existing files only.
+	if info.IsDir() || (!isSymlink && !info.Mode().IsRegular()) {
+		return false, nil
+	}
+	if isSymlink {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return false, nil
+		}
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return false, err
+	}
+	header.Name = name
+	header.Method = z.method
+	header.SetMode(info.Mode())
+
+	z.fw, err = z.zw.CreateHeader(header)
+	if err != nil {
+		return false, err
+	}
+	return !isSymlink, nil
+}
+
+func (z *zipArchiveWriter) Write(p []byte) (int, error) {
+	return z.fw.Write(p)
+}
+
+func (z *zipArchiveWriter) addData(name string, data []byte) error {
+	fw, err := z.zw.CreateHeader(&zip.FileHeader{Name: name, Method: z.method})
+	if err != nil {
+		return err
+	}
+	_, err = fw.Write(data)
+	return err
+}
+
+func (z *zipArchiveWriter) addStream(name string, mode os.FileMode, modTime time.Time) error {
+	header := &zip.FileHeader{Name: name, Method: z.method, Modified: modTime}
+	header.SetMode(mode)
+	var err error
+	z.fw, err = z.zw.CreateHeader(header)
+	return err
+}
+
+func (z *zipArchiveWriter) Close() error {
+	return z.zw.Close()
+}
+
+type tarArchiveWriter struct {
+	*tarball.Writer
+	cw     io.WriteCloser
+	closed bool
+}
+
+func (t *tarArchiveWriter) add(name string, path string, info os.FileInfo) (bool, error) {
+	return t.Add(name, path, info)
+}
+
+func (t *tarArchiveWriter) addData(name string, data []byte) error {
+	return t.AddData(name, data)
+}
+
+func (t *tarArchiveWriter) addStream(name string, mode os.FileMode, modTime time.Time) error {
+	return errors.New("tar archives can not hold files of unknown size")
+}
+
+func (t *tarArchiveWriter) Close() error {
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	if err := t.Writer.Close(); err != nil {
+		return err
+	}
+	return t.cw.Close()
+}
+
+// archiveFormat detects format of archive at name from its content, and returns the compression codec of
+// tar archives.
+func archiveFormat(name string) (string, compression.Codec, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	header, _ := bufio.NewReader(f).Peek(tarMagicOffset + len(tarMagic))
+	if bytes.HasPrefix(header, []byte("PK")) {
+		return backupapi.ArchiveFormatZip, nil, nil
+	}
+	if len(header) == tarMagicOffset+len(tarMagic) && bytes.Equal(header[tarMagicOffset:], []byte(tarMagic)) {
+		codec, err := compression.Lookup(compression.Store)
+		return backupapi.ArchiveFormatTar, codec, err
+	}
+	if codec := compression.Detect(header); codec != nil {
+		return backupapi.ArchiveFormatTar, codec, nil
+	}
+	return "", nil, errors.New("unknown archive format")
+}
+
+// openTar returns the tar stream of archive at name compressed with codec.
+func openTar(name string, codec compression.Codec) (io.ReadCloser, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := codec.NewReader(bufio.NewReader(f))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, closers{r, f}}, nil
+}
+
+type closers []io.Closer
+
+func (cs closers) Close() error {
+	var err error
+	for _, c := range cs {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// openZip opens zip archive at name, with support of all compression methods written by agent.
+func openZip(name string) (*zip.ReadCloser, error) {
+	r, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, fmt.Errorf("zip.OpenReader: %w", err)
+	}
+	if err := registerZipDecompressors(&r.Reader); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// registerZipDecompressors registers to r decompressors of compression methods written by agent and not
+// supported by archive/zip.
+func registerZipDecompressors(r *zip.Reader) error {
+	codec, err := compression.Lookup(compression.Zstd)
+	if err != nil {
+		return err
+	}
+	r.RegisterDecompressor(zipMethodZstd, func(r io.Reader) io.ReadCloser {
+		rc, err := codec.NewReader(r)
+		if err != nil {
+			return ioutil.NopCloser(errReader{err})
+		}
+		return rc
+	})
+	return nil
+}
+
+type errReader struct {
+	err error
+}
+
+func (e errReader) Read([]byte) (int, error) {
+	return 0, e.err
+}
+
+// contextReader stops reading from r once ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// readArchiveMetadata reads the metadata of archive at name, it returns nil if the archive has none,
+// which is the case of archives made by older agents.
+func readArchiveMetadata(name string) (*archiveMetadata, error) {
+	data, err := readArchiveFile(name, metadataRecoveryPoint)
+	if err != nil {
+		return nil, err
+	}
+	return parseArchiveMetadata(data)
+}
+
+// readArchiveManifest reads the manifest of archive at name, it returns nil if the archive has none.
+func readArchiveManifest(name string) (*manifest.Manifest, error) {
+	data, err := readArchiveFile(name, metadataManifest)
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(data)
+}
+
+// readArchiveFile returns content of the regular file named entry in archive at name, or nil if the archive
+// has no such file.
+func readArchiveFile(name string, entry string) ([]byte, error) {
+	format, codec, err := archiveFormat(name)
+	if err != nil {
+		return nil, err
+	}
+	if format == backupapi.ArchiveFormatTar {
+		r, err := openTar(name, codec)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return tarball.ReadFile(r, entry)
+	}
+	r, err := openZip(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return readZipFile(&r.Reader, entry)
+}
+
+// walkArchive calls fn with the name, mode and content of every regular file of archive at name, including
+// agent metadata.
+func walkArchive(name string, fn func(name string, mode os.FileMode, content io.Reader) error) error {
+	format, codec, err := archiveFormat(name)
+	if err != nil {
+		return err
+	}
+	if format == backupapi.ArchiveFormatTar {
+		r, err := openTar(name, codec)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return tarball.Walk(r, func(hdr *tar.Header, content io.Reader) error {
+			if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+				return nil
+			}
+			return fn(hdr.Name, hdr.FileInfo().Mode(), content)
+		})
+	}
+	r, err := openZip(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for _, f := range r.File {
+		if !f.Mode().IsRegular() {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = fn(f.Name, f.Mode(), rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readZipFile returns content of the file named name in zip archive r, or nil if the archive has no such file.
+func readZipFile(r *zip.Reader, name string) ([]byte, error) {
+	for _, f := range r.File {
+		if f.Name != name {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, rc); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, nil
+}
+
+// parseArchiveMetadata parses metadata read from an archive, it returns nil if data is nil.
+func parseArchiveMetadata(data []byte) (*archiveMetadata, error) {
+	if data == nil {
+		return nil, nil
+	}
+	var meta archiveMetadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// extractArchive extracts files of archive at name selected by sel to t, the archive format is detected from
+// its content.
+func extractArchive(ctx context.Context, name string, t *restore.Target, sel *filter.Selection) error {
+	format, codec, err := archiveFormat(name)
+	if err != nil {
+		return err
+	}
+	if format != backupapi.ArchiveFormatTar {
+		return unzip(ctx, name, t, sel)
+	}
+	r, err := openTar(name, codec)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return tarball.Extract(contextReader{ctx: ctx, r: r}, t, func(name string) bool {
+		return name == metadataDir || strings.HasPrefix(name, metadataDir+"/") || !sel.Match(name, false)
+	})
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"io"
+
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+)
+
+// cacheWriter returns a writer caching the recovery point file as it is uploaded, or nil if there is no cache.
+func (s *Server) cacheWriter(recoveryPointID string, backupDirectoryID string) *cache.Writer {
+	if s.cache == nil {
+		return nil
+	}
+	w, err := s.cache.Create(recoveryPointID, backupDirectoryID)
+	if err != nil {
+		s.logger.Error("failed to cache recovery point", zap.Error(err), zap.String("recovery_point_id", recoveryPointID))
+		return nil
+	}
+	return w
+}
+
+// commitCache adds the file written by w to the cache once uploaded, or discards it if the upload failed. Cache
+// failures are only logged, the recovery point is stored by server anyway.
+func (s *Server) commitCache(w *cache.Writer, uploadErr error) {
+	if w == nil {
+		return
+	}
+	if uploadErr != nil {
+		w.Abort()
+		return
+	}
+	e, err := w.Commit()
+	if err != nil {
+		s.logger.Info("Recovery point not cached", zap.Error(err))
+		return
+	}
+	s.logger.Debug("Cached recovery point", zap.String("recovery_point_id", e.RecoveryPointID), zap.Int64("size", e.Size))
+}
+
+// cacheEntry returns the cache entry of the recovery point, if it is cached.
+func (s *Server) cacheEntry(recoveryPointID string) (cache.Entry, bool) {
+	if s.cache == nil {
+		return cache.Entry{}, false
+	}
+	return s.cache.Get(recoveryPointID)
+}
+
+// cachedRecoveryPoint copies the cached file of the recovery point to name, if the cache has one matching the
+// checksum recorded by server. It returns false if the file must be downloaded instead.
+func (s *Server) cachedRecoveryPoint(ctx context.Context, recoveryPointID string, name string) bool {
+	e, ok := s.cacheEntry(recoveryPointID)
+	if !ok {
+		return false
+	}
+	logger := s.logger.With(zap.String("recovery_point_id", recoveryPointID))
+	f, err := s.backupClient.GetFile(ctx, recoveryPointID)
+	if err != nil {
+		logger.Error("failed to get recovery point file, skip cache", zap.Error(err))
+		return false
+	}
+	if f.SHA256 == "" {
+		logger.Debug("Server has no checksum of recovery point file, skip cache")
+		return false
+	}
+	if f.SHA256 != e.SHA256 || int64(f.Size) != e.Size {
+		logger.Info("Cached recovery point file does not match server, remove it")
+		_ = s.cache.Remove(recoveryPointID)
+		return false
+	}
+	// A partial download of name would be resumed over the cached copy.
+	if err := backupapi.DiscardDownload(name); err != nil {
+		logger.Error("failed to discard partial download", zap.Error(err))
+		return false
+	}
+	if err := s.cache.CopyTo(recoveryPointID, name); err != nil {
+		logger.Error("failed to copy cached recovery point file", zap.Error(err))
+		return false
+	}
+	logger.Info("Using cached recovery point file")
+	return true
+}
+
+// downloadFile downloads the file of the recovery point to name, or copies it from the cache if possible.
+func (s *Server) downloadFile(ctx context.Context, createdAt string, restoreSessionKey string, recoveryPointID string, name string, pw io.Writer) error {
+	if s.cachedRecoveryPoint(ctx, recoveryPointID, name) {
+		return nil
+	}
+	return s.backupClient.DownloadFile(ctx, createdAt, restoreSessionKey, recoveryPointID, name, pw, s.downloadConcurrency)
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultDownloadConcurrency = 4
+	// contentTTL is how long decrypted content not served entirely is kept since it was last served, so
+	// interrupted downloads can be resumed.
+	contentTTL = time.Hour
+)
+
+// errInvalidRestoreSessionKey is returned for downloads of a recovery point with a restore session key which
+// does not authorize it.
+var errInvalidRestoreSessionKey = errors.New("invalid restore session key")
+
+// downloadDir returns the directory recovery points are downloaded to, only accessible by the agent user. Without
+// a state directory, it is a temporary directory of the agent process.
+func (s *Server) downloadDir() (string, error) {
+	if s.stateDir == "" {
+		s.tempDownloadDirOnce.Do(func() {
+			s.tempDownloadDir, s.tempDownloadDirErr = ioutil.TempDir("", "bizfly-backup-agent-downloads-")
+		})
+		return s.tempDownloadDir, s.tempDownloadDirErr
+	}
+	dir := filepath.Join(s.stateDir, "downloads")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, os.Chmod(dir, 0700)
+}
+
+// downloadPath returns the file given recovery point is downloaded to. The file is kept when download fails,
+// so the next download of the recovery point resumes it.
+func (s *Server) downloadPath(recoveryPointID string) (string, error) {
+	dir, err := s.downloadDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, recoveryPointID+".download"), nil
+}
+
+// recoveryPointContent returns the decrypted content of given recovery point, downloading it or copying it from
+// the cache if it is not available locally yet. The content is kept until it is served entirely, or for contentTTL.
+//
+// The restore session key is checked by the agent, since content available locally is served without asking the
+// backup server.
+func (s *Server) recoveryPointContent(ctx context.Context, createdAt string, restoreSessionKey string, recoveryPointID string) (*contentFile, error) {
+	want := s.backupClient.RestoreSessionKey(createdAt, recoveryPointID)
+	if createdAt == "" || subtle.ConstantTimeCompare([]byte(restoreSessionKey), []byte(want)) != 1 {
+		return nil, errInvalidRestoreSessionKey
+	}
+	name, err := s.downloadPath(recoveryPointID)
+	if err != nil {
+		return nil, err
+	}
+	contentName := filepath.Join(filepath.Dir(name), recoveryPointID+".content")
+	if _, err := os.Stat(contentName); os.IsNotExist(err) {
+		if err := s.downloadFile(ctx, createdAt, restoreSessionKey, recoveryPointID, name, ioutil.Discard); err != nil {
+			return nil, err
+		}
+		if err := s.decryptFile(name); err != nil {
+			os.Remove(name)
+			return nil, err
+		}
+		if err := os.Rename(name, contentName); err != nil {
+			os.Remove(name)
+			return nil, err
+		}
+	}
+	// The content expires contentTTL after it was last served.
+	now := time.Now()
+	if err := os.Chtimes(contentName, now, now); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(contentName)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &contentFile{File: f, size: fi.Size()}, nil
+}
+
+// contentFile records whether the end of file has been read.
+type contentFile struct {
+	*os.File
+	size int64
+	pos  int64
+	eof  bool
+}
+
+func (c *contentFile) Read(p []byte) (int, error) {
+	n, err := c.File.Read(p)
+	c.pos += int64(n)
+	if c.pos >= c.size {
+		c.eof = true
+	}
+	return n, err
+}
+
+func (c *contentFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := c.File.Seek(offset, whence)
+	if err == nil {
+		c.pos = pos
+	}
+	return pos, err
+}
+
+// served reports whether the end of content has been read.
+func (c *contentFile) served() bool {
+	return c.eof || c.size == 0
+}
+
+// removeExpiredContent removes decrypted content of recovery points which was not served for contentTTL.
+func (s *Server) removeExpiredContent() {
+	dir, err := s.downloadDir()
+	if err != nil {
+		s.logger.Error("failed to open download directory", zap.Error(err))
+		return
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		s.logger.Error("failed to list download directory", zap.Error(err))
+		return
+	}
+	for _, fi := range entries {
+		if !strings.HasSuffix(fi.Name(), ".content") || time.Since(fi.ModTime()) < contentTTL {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil && !os.IsNotExist(err) {
+			s.logger.Error("failed to remove expired content", zap.Error(err), zap.String("name", fi.Name()))
+		}
+	}
+}
+
+// removeExpiredContentLoop removes expired content of recovery points until ctx is done.
+func (s *Server) removeExpiredContentLoop(ctx context.Context) {
+	ticker := time.NewTicker(contentTTL / 4)
+	defer ticker.Stop()
+	for {
+		s.removeExpiredContent()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
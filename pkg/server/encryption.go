@@ -0,0 +1,64 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"os"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/encryption"
+)
+
+// decryptFile decrypts file at name in place if it is encrypted.
+func (s *Server) decryptFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	r, err := s.decryptReader(br)
+	if err != nil || r == io.Reader(br) {
+		return err
+	}
+
+	out, err := os.OpenFile(name+".decrypted", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), name)
+}
+
+// decryptReader returns a reader decrypting br if its content is encrypted, br itself otherwise.
+func (s *Server) decryptReader(br *bufio.Reader) (io.Reader, error) {
+	header, err := br.Peek(encryption.HeaderSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !encryption.IsEncrypted(header) {
+		return br, nil
+	}
+	if s.keyring == nil {
+		return nil, encryption.ErrNoPassphrase
+	}
+	return s.keyring.NewReader(br)
+}
+
+// encrypter returns a writer encrypting to w, or nil if encryption is disabled. A non nil header resumes
+// the encrypted stream it starts.
+func (s *Server) encrypter(w io.Writer, header []byte) (*encryption.Writer, error) {
+	if s.keyring == nil {
+		return nil, nil
+	}
+	if header != nil {
+		return s.keyring.ResumeWriter(w, header)
+	}
+	return s.keyring.NewWriter(w)
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/jobs"
+	"github.com/bizflycloud/bizfly-backup/pkg/progress"
+)
+
+// Types of job events.
+const (
+	// JobEventState is sent when a job is queued, starts or finishes.
+	JobEventState = "state"
+	// JobEventProgress is sent with the progress of a running job.
+	JobEventProgress = "progress"
+	// JobEventError is sent when the stream ends without the job finishing, like when no job is queued for a request.
+	JobEventError = "error"
+)
+
+const (
+	// eventBuffer is the number of events buffered for a subscriber, further events are dropped until it catches up.
+	eventBuffer = 64
+	// eventPollInterval is the interval at which a followed job is polled, in case its final event was dropped.
+	eventPollInterval = time.Second
+	// submitTimeout is how long a request waits for the backup server to queue the requested job.
+	submitTimeout = time.Minute
+)
+
+// JobEvent is a change of a job, streamed as JSON lines to clients following the job.
+type JobEvent struct {
+	Type     string             `json:"type"`
+	JobID    string             `json:"job_id,omitempty"`
+	Job      *jobs.Job          `json:"job,omitempty"`
+	Progress *progress.Snapshot `json:"progress,omitempty"`
+	Error    string             `json:"error,omitempty"`
+}
+
+// eventHub broadcasts job events to subscribers. Publishing never blocks, so slow subscribers miss events.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan JobEvent]struct{}
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan JobEvent]struct{})}
+}
+
+// subscribe returns a channel receiving events published from now on, and a func to unsubscribe.
+func (h *eventHub) subscribe() (<-chan JobEvent, func()) {
+	ch := make(chan JobEvent, eventBuffer)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs, ch)
+		h.mu.Unlock()
+	}
+}
+
+func (h *eventHub) publish(e JobEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// publishJob publishes a state event of job.
+func (h *eventHub) publishJob(job jobs.Job) {
+	h.publish(JobEvent{Type: JobEventState, JobID: job.ID, Job: &job})
+}
+
+// followJob streams events of the job with id to w as JSON lines, until the job finishes or ctx is done. If id is
+// empty, it follows the first job queued after subscribing for which match returns true.
+func (s *Server) followJob(ctx context.Context, w http.ResponseWriter, events <-chan JobEvent, id string, match func(jobs.Job) bool) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	send := func(e JobEvent) {
+		_ = enc.Encode(e)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	if id == "" {
+		timer := time.NewTimer(submitTimeout)
+		defer timer.Stop()
+		for id == "" {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+				send(JobEvent{Type: JobEventError, Error: "no job was queued for the request"})
+				return
+			case e := <-events:
+				if e.Type == JobEventState && e.Job.State == jobs.StateQueued && match(*e.Job) {
+					id = e.JobID
+					send(e)
+				}
+			}
+		}
+	}
+
+	ticker := time.NewTicker(eventPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-events:
+			if e.JobID != id {
+				continue
+			}
+			send(e)
+			if e.Type == JobEventState && e.Job.Finished() {
+				return
+			}
+		case <-ticker.C:
+			job, ok := s.job(id)
+			if !ok {
+				send(JobEvent{Type: JobEventError, JobID: id, Error: jobs.ErrNotFound.Error()})
+				return
+			}
+			if job.Finished() {
+				send(JobEvent{Type: JobEventState, JobID: id, Job: &job})
+				return
+			}
+		}
+	}
+}
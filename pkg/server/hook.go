@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
+	"github.com/bizflycloud/bizfly-backup/pkg/hooks"
+	"github.com/bizflycloud/bizfly-backup/pkg/jobs"
+)
+
+// runHook runs hook h of the job of ctx if it is not nil, and records its result in the job. env describes the job
+// to the hook, on top of the job ID and kind.
+func (s *Server) runHook(ctx context.Context, name string, h *hooks.Hook, env map[string]string) error {
+	if h == nil {
+		return nil
+	}
+	vars := map[string]string{"HOOK": name}
+	if job, ok := jobs.Current(ctx); ok {
+		vars["JOB_ID"] = job.ID
+		vars["JOB_KIND"] = job.Kind
+	}
+	for k, v := range env {
+		vars[k] = v
+	}
+	res, err := h.Run(ctx, name, vars)
+	jobs.Update(ctx, func(j *jobs.Job) {
+		j.Hooks = append(j.Hooks, res)
+	})
+	if err != nil {
+		s.logger.Error("hook failed", zap.Error(err), zap.Int("exit_code", res.ExitCode), zap.String("output", res.Output))
+		return err
+	}
+	s.logger.Info("hook succeeded", zap.String("hook", name), zap.Int64("duration_ms", res.Duration))
+	return nil
+}
+
+// runPreHook runs pre hook h, whose failure aborts the job only if the hook says so.
+func (s *Server) runPreHook(ctx context.Context, name string, h *hooks.Hook, env map[string]string) error {
+	if err := s.runHook(ctx, name, h, env); err != nil && h.AbortOnFailure {
+		return err
+	}
+	return nil
+}
+
+// runPostHook runs post hook h after the job ended with jobErr, if h runs after such an outcome. It is told the
+// status of the job, and runs until its own timeout even if ctx is canceled.
+func (s *Server) runPostHook(ctx context.Context, name string, h *hooks.Hook, env map[string]string, jobErr error) {
+	if h == nil || !h.RunsAfter(jobErr != nil) {
+		return
+	}
+	vars := map[string]string{"STATUS": string(jobs.StateSucceeded)}
+	if jobErr != nil {
+		vars["STATUS"] = string(jobs.StateFailed)
+		if errors.Is(jobErr, context.Canceled) {
+			vars["STATUS"] = string(jobs.StateCanceled)
+		}
+		vars["ERROR"] = jobErr.Error()
+	}
+	for k, v := range env {
+		vars[k] = v
+	}
+	_ = s.runHook(detachedContext{ctx}, name, h, vars)
+}
+
+// dropServerCommands removes hooks set by the backup server from cfg, unless server commands are allowed. It must be
+// called before local hooks are applied.
+func (s *Server) dropServerCommands(cfg *backupapi.Config) {
+	if s.serverCommands {
+		return
+	}
+	for i, bd := range cfg.BackupDirectories {
+		if bd.Hooks != (hooks.Config{}) {
+			s.logger.Warn("Ignore hooks of backup directory set by the server, server commands are not allowed", zap.String("backup_directory_id", bd.ID))
+			cfg.BackupDirectories[i].Hooks = hooks.Config{}
+		}
+	}
+}
+
+// restoreHooks returns the hooks of the backup directory containing destDir, and its ID. Restores into a backup
+// directory run its restore hooks, whatever directory the recovery point comes from.
+func (s *Server) restoreHooks(cfg *backupapi.Config, destDir string) (hooks.Config, string, error) {
+	dest, err := filepath.Abs(destDir)
+	if err != nil {
+		return hooks.Config{}, "", err
+	}
+	for _, bd := range cfg.BackupDirectories {
+		if bd.Path == "" {
+			continue
+		}
+		rel, err := filepath.Rel(filepath.Clean(bd.Path), dest)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return bd.Hooks, bd.ID, nil
+		}
+	}
+	return hooks.Config{}, "", nil
+}
+
+// detachedContext keeps the values of a context, but is never canceled.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
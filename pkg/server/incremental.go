@@ -0,0 +1,251 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
+	"github.com/bizflycloud/bizfly-backup/pkg/fileindex"
+	"github.com/bizflycloud/bizfly-backup/pkg/filter"
+	"github.com/bizflycloud/bizfly-backup/pkg/manifest"
+	"github.com/bizflycloud/bizfly-backup/pkg/restore"
+)
+
+const (
+	// metadataDir is the directory in archives which holds agent metadata instead of backed up files.
+	metadataDir = ".bizfly-backup-metadata"
+	// metadataRecoveryPoint is the archive entry describing the recovery point.
+	metadataRecoveryPoint = metadataDir + "/recovery_point.json"
+	// metadataManifest is the archive entry listing checksums of archived files.
+	metadataManifest = metadataDir + "/manifest.json"
+
+	defaultMaxIncrementals = 6
+	// maxRecoveryPointChain guards restore against a broken chain of parents.
+	maxRecoveryPointChain = 1000
+)
+
+// archiveMetadata is stored in every archive as metadataRecoveryPoint.
+type archiveMetadata struct {
+	RecoveryPointType     string `json:"recovery_point_type"`
+	ParentRecoveryPointID string `json:"parent_recovery_point_id,omitempty"`
+	// Deleted lists files removed since the parent recovery point.
+	Deleted []string `json:"deleted,omitempty"`
+	// Compression is the name of the compression codec of the archive.
+	Compression string `json:"compression,omitempty"`
+	// BackupDirectoryID is the ID of the backed up directory.
+	BackupDirectoryID string `json:"backup_directory_id,omitempty"`
+	// Source is the type of source of the backup directory, empty for older archives of directories.
+	Source string `json:"source,omitempty"`
+}
+
+func (s *Server) fileIndexPath(backupDirectoryID string) string {
+	return filepath.Join(s.stateDir, "index", backupDirectoryID+".json")
+}
+
+// incrementalBase returns the recovery point type to use for the next backup of given directory,
+// and for RecoveryPointTypePoint the index of the previous backup.
+//
+// An incremental backup is only possible when a previous backup has been recorded locally and
+// the chain since the last initial replica is shorter than maxIncrementals.
+func (s *Server) incrementalBase(backupDirectoryID string, recoveryPointType string) (string, *fileindex.Index) {
+	if recoveryPointType != backupapi.RecoveryPointTypePoint {
+		return recoveryPointType, nil
+	}
+	if s.stateDir == "" {
+		return backupapi.RecoveryPointTypeInitialReplica, nil
+	}
+	prev, err := fileindex.Load(s.fileIndexPath(backupDirectoryID))
+	if err != nil {
+		s.logger.Warn("failed to load file index, fallback to full backup", zap.Error(err), zap.String("backup_directory_id", backupDirectoryID))
+		return backupapi.RecoveryPointTypeInitialReplica, nil
+	}
+	if prev.RecoveryPointID == "" || prev.Incrementals >= s.maxIncrementals {
+		return backupapi.RecoveryPointTypeInitialReplica, nil
+	}
+	return backupapi.RecoveryPointTypePoint, prev
+}
+
+// saveFileIndex records idx as the base of the next incremental backup.
+func (s *Server) saveFileIndex(backupDirectoryID string, recoveryPointID string, prev, idx *fileindex.Index) {
+	if s.stateDir == "" {
+		return
+	}
+	idx.RecoveryPointID = recoveryPointID
+	if prev != nil {
+		idx.Incrementals = prev.Incrementals + 1
+	}
+	if err := idx.Save(s.fileIndexPath(backupDirectoryID)); err != nil {
+		s.logger.Error("failed to save file index", zap.Error(err), zap.String("backup_directory_id", backupDirectoryID))
+	}
+}
+
+// downloadRecoveryPoint downloads content of given recovery point to a local file, using a restore session
+// key computed locally. The caller must remove the returned file.
+func (s *Server) downloadRecoveryPoint(ctx context.Context, recoveryPointID string) (string, error) {
+	name, err := s.downloadPath(recoveryPointID)
+	if err != nil {
+		return "", err
+	}
+	createdAt := time.Now().UTC().Format(http.TimeFormat)
+	key := s.backupClient.RestoreSessionKey(createdAt, recoveryPointID)
+	if err := s.downloadFile(ctx, createdAt, key, recoveryPointID, name, ioutil.Discard); err != nil {
+		return "", err
+	}
+	if err := s.decryptFile(name); err != nil {
+		os.Remove(name)
+		return "", err
+	}
+	return name, nil
+}
+
+// recoveryPointArchive is the archive of a recovery point, downloaded or read remotely.
+type recoveryPointArchive interface {
+	// metadata returns the metadata of the archive, or nil if it has none.
+	metadata() (*archiveMetadata, error)
+	// manifest returns the manifest of the archive, or nil if it has none.
+	manifest() (*manifest.Manifest, error)
+	// extract extracts files of the archive selected by sel to t.
+	extract(ctx context.Context, t *restore.Target, sel *filter.Selection) error
+	// Close releases the archive.
+	Close() error
+}
+
+// localArchive is a downloaded archive, removed on Close if it is temporary.
+type localArchive struct {
+	name      string
+	temporary bool
+}
+
+func (a *localArchive) metadata() (*archiveMetadata, error) {
+	return readArchiveMetadata(a.name)
+}
+
+func (a *localArchive) manifest() (*manifest.Manifest, error) {
+	return readArchiveManifest(a.name)
+}
+
+func (a *localArchive) extract(ctx context.Context, t *restore.Target, sel *filter.Selection) error {
+	return extractArchive(ctx, a.name, t, sel)
+}
+
+func (a *localArchive) Close() error {
+	if a.temporary {
+		return os.Remove(a.name)
+	}
+	return nil
+}
+
+// openParentRecoveryPoint returns the archive of given parent recovery point. When only files selected by sel
+// are restored, it is read remotely if possible, it is downloaded otherwise.
+func (s *Server) openParentRecoveryPoint(ctx context.Context, recoveryPointID string, sel *filter.Selection) (recoveryPointArchive, error) {
+	if sel != nil {
+		createdAt := time.Now().UTC().Format(http.TimeFormat)
+		key := s.backupClient.RestoreSessionKey(createdAt, recoveryPointID)
+		a, err := s.openRemoteZip(ctx, createdAt, key, recoveryPointID)
+		if err != nil {
+			return nil, err
+		}
+		if a != nil {
+			return a, nil
+		}
+	}
+	s.logger.Debug("Downloading parent recovery point", zap.String("recovery_point_id", recoveryPointID))
+	name, err := s.downloadRecoveryPoint(ctx, recoveryPointID)
+	if err != nil {
+		return nil, err
+	}
+	return &localArchive{name: name, temporary: true}, nil
+}
+
+// restoreArchiveChain restores files of archive selected by sel to t. If the archive is an incremental recovery
+// point, its parents are fetched and applied first, up to the last initial replica.
+//
+// It returns the manifest of files selected by sel, as of the restored recovery point, or nil if an archive of
+// the chain has no manifest.
+func (s *Server) restoreArchiveChain(ctx context.Context, archive recoveryPointArchive, t *restore.Target, sel *filter.Selection) (*manifest.Manifest, error) {
+	chain := []recoveryPointArchive{archive}
+	var metas []*archiveMetadata
+	defer func() {
+		for _, a := range chain[1:] {
+			a.Close()
+		}
+	}()
+
+	for {
+		meta, err := chain[len(chain)-1].metadata()
+		if err != nil {
+			return nil, err
+		}
+		metas = append(metas, meta)
+		if meta == nil || meta.RecoveryPointType != backupapi.RecoveryPointTypePoint {
+			break
+		}
+		if meta.ParentRecoveryPointID == "" {
+			return nil, errors.New("incremental recovery point without parent")
+		}
+		if len(chain) >= maxRecoveryPointChain {
+			return nil, errors.New("recovery point chain is too long")
+		}
+		a, err := s.openParentRecoveryPoint(ctx, meta.ParentRecoveryPointID, sel)
+		if err != nil {
+			return nil, fmt.Errorf("download parent recovery point %s: %w", meta.ParentRecoveryPointID, err)
+		}
+		chain = append(chain, a)
+	}
+
+	// Apply from the initial replica to the requested recovery point.
+	files := make(map[string]manifest.Entry)
+	complete := true
+	for i := len(chain) - 1; i >= 0; i-- {
+		if err := chain[i].extract(ctx, t, sel); err != nil {
+			return nil, err
+		}
+		m, err := chain[i].manifest()
+		if err != nil {
+			return nil, err
+		}
+		if m == nil {
+			complete = false
+		} else {
+			if err := m.CheckSignature(s.manifestKey()); err != nil {
+				// Manifests are signed with the key of the machine which made them, which may not be this one.
+				s.logger.Warn("Can not check manifest signature", zap.Error(err))
+			}
+			for _, e := range m.Files {
+				if sel.Match(e.Path, false) {
+					files[e.Path] = e
+				}
+			}
+		}
+		if metas[i] == nil {
+			continue
+		}
+		// Only files restored from parents are removed, files existing before the restore are kept.
+		for _, p := range metas[i].Deleted {
+			if err := t.Remove(p); err != nil {
+				return nil, err
+			}
+			delete(files, filepath.ToSlash(p))
+		}
+	}
+	if !complete {
+		return nil, nil
+	}
+	restored := manifest.New()
+	for _, e := range files {
+		restored.Add(e)
+	}
+	sort.Slice(restored.Files, func(i, j int) bool {
+		return restored.Files[i].Path < restored.Files[j].Path
+	})
+	return restored, nil
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
+	"github.com/bizflycloud/bizfly-backup/pkg/jobs"
+	"github.com/bizflycloud/bizfly-backup/pkg/progress"
+)
+
+const (
+	// defaultJobConcurrency is the default number of backup and restore jobs running at the same time.
+	defaultJobConcurrency = 2
+	// progressInterval is the interval between progress messages of a running job.
+	progressInterval = 5 * time.Second
+	// progressEventInterval is the interval between progress events streamed to clients following a job.
+	progressEventInterval = time.Second
+)
+
+// openJobHistory records jobs to the job history of the state directory, if any.
+func (s *Server) openJobHistory() error {
+	if s.stateDir == "" {
+		return nil
+	}
+	h, err := jobs.OpenHistory(filepath.Join(s.stateDir, "jobs.log"), s.jobHistoryRetention)
+	if err != nil {
+		return fmt.Errorf("open job history: %w", err)
+	}
+	s.history = h
+	s.jobs.OnChange(func(job jobs.Job) {
+		if err := h.Put(job); err != nil {
+			s.logger.Error("failed to record job", zap.Error(err), zap.String("job_id", job.ID))
+		}
+	})
+	return nil
+}
+
+// listJobs returns the jobs of the job history, or of the running agent if there is no history, in submission
+// order. Jobs are filtered by backup directory and state if not empty, and only the last limit ones are returned
+// if limit is positive.
+func (s *Server) listJobs(backupDirectoryID string, state jobs.State, limit int) []jobs.Job {
+	all := s.jobs.Jobs()
+	if s.history != nil {
+		all = s.history.Jobs()
+	}
+	list := make([]jobs.Job, 0, len(all))
+	for _, job := range all {
+		if (backupDirectoryID == "" || job.BackupDirectoryID == backupDirectoryID) && (state == "" || job.State == state) {
+			list = append(list, job)
+		}
+	}
+	if limit > 0 && len(list) > limit {
+		list = list[len(list)-limit:]
+	}
+	return list
+}
+
+// job returns the job with id, from the job history if any.
+func (s *Server) job(id string) (jobs.Job, bool) {
+	if s.history != nil {
+		return s.history.Job(id)
+	}
+	return s.jobs.Job(id)
+}
+
+// submitBackup queues a backup of the backup directory, which runs once no other job works on its path.
+func (s *Server) submitBackup(ctx context.Context, backupDirectoryID string, policyID string, name string, recoveryPointType string) (jobs.Job, error) {
+	bdc, err := s.backupDirectoryConfig(ctx, backupDirectoryID)
+	if err != nil {
+		return jobs.Job{}, err
+	}
+	return s.queueBackup(bdc, policyID, name, recoveryPointType, false), nil
+}
+
+// queueBackup queues a backup of the backup directory configured by bdc. Scheduled backups prune the recovery
+// points of the directory once they succeed, if auto pruning is enabled.
+func (s *Server) queueBackup(bdc backupapi.BackupDirectoryConfig, policyID string, name string, recoveryPointType string, scheduled bool) jobs.Job {
+	job := s.jobs.Submit(jobs.Job{
+		Kind:              jobs.KindBackup,
+		Name:              bdc.ID,
+		Path:              bdc.Path,
+		BackupDirectoryID: bdc.ID,
+		PolicyID:          policyID,
+	}, func(ctx context.Context) error {
+		if err := s.backup(ctx, bdc, policyID, name, recoveryPointType, s.newTracker(ctx)); err != nil {
+			return err
+		}
+		if scheduled && s.autoPrune {
+			s.autoPruneDirectory(ctx, bdc)
+		}
+		return nil
+	})
+	s.logger.Info("queued backup",
+		zap.String("job_id", job.ID),
+		zap.String("backup_directory_id", bdc.ID),
+		zap.String("policy_id", policyID),
+	)
+	return job
+}
+
+// submitRestore queues a restore of the recovery point of the policy to destDir, see restore.
+func (s *Server) submitRestore(actionID string, createdAt string, restoreSessionKey string, recoveryPointID string, policyID string, destDir string, mode string, include []string) jobs.Job {
+	job := s.jobs.Submit(jobs.Job{
+		Kind:            jobs.KindRestore,
+		Name:            recoveryPointID,
+		Path:            destDir,
+		RecoveryPointID: recoveryPointID,
+		PolicyID:        policyID,
+		ActionID:        actionID,
+	}, func(ctx context.Context) error {
+		return s.restore(ctx, actionID, createdAt, restoreSessionKey, recoveryPointID, policyID, destDir, mode, include, s.newTracker(ctx))
+	})
+	s.logger.Info("queued restore",
+		zap.String("job_id", job.ID),
+		zap.String("recovery_point_id", recoveryPointID),
+		zap.String("destination", destDir),
+	)
+	return job
+}
+
+// submitLocalRestore queues a restore of the recovery point requested on the agent rather than by the backup server.
+// The restore session key is computed by the agent, and there is no server action to notify.
+func (s *Server) submitLocalRestore(recoveryPointID string, destDir string, mode string, include []string) jobs.Job {
+	createdAt := time.Now().UTC().Format(http.TimeFormat)
+	restoreSessionKey := s.backupClient.RestoreSessionKey(createdAt, recoveryPointID)
+	return s.submitRestore("", createdAt, restoreSessionKey, recoveryPointID, "", destDir, mode, include)
+}
+
+// backupDirectoryConfig returns the config of the backup directory, see jobConfig. A backup directory missing from
+// the agent config has a default config.
+func (s *Server) backupDirectoryConfig(ctx context.Context, backupDirectoryID string) (backupapi.BackupDirectoryConfig, error) {
+	cfg, err := s.jobConfig(ctx)
+	if err != nil {
+		return backupapi.BackupDirectoryConfig{}, err
+	}
+	if bdc, ok := cfg.BackupDirectory(backupDirectoryID); ok {
+		return bdc, nil
+	}
+	bd, err := s.backupClient.GetBackupDirectory(backupDirectoryID)
+	if err != nil {
+		return backupapi.BackupDirectoryConfig{}, err
+	}
+	return backupapi.BackupDirectoryConfig{ID: backupDirectoryID, Path: bd.Path}, nil
+}
+
+// cancelJobs cancels the job with jobID, or if jobID is empty, the unfinished backups of the backup directory and
+// restores of the recovery point.
+func (s *Server) cancelJobs(jobID string, backupDirectoryID string, recoveryPointID string) error {
+	if jobID != "" {
+		return s.jobs.Cancel(jobID)
+	}
+	for _, job := range s.jobs.Jobs() {
+		if job.Finished() {
+			continue
+		}
+		if (job.Kind == jobs.KindBackup && job.BackupDirectoryID == backupDirectoryID && backupDirectoryID != "") ||
+			(job.Kind == jobs.KindRestore && job.RecoveryPointID == recoveryPointID && recoveryPointID != "") {
+			if err := s.jobs.Cancel(job.ID); err != nil && !errors.Is(err, jobs.ErrFinished) {
+				return err
+			}
+			s.logger.Info("canceled job", zap.String("job_id", job.ID))
+		}
+	}
+	return nil
+}
+
+// newTracker returns a Tracker of the job of ctx, reporting its progress to server and to clients following it.
+func (s *Server) newTracker(ctx context.Context) *progress.Tracker {
+	notify := progress.Throttle(progress.ReporterFunc(func(p progress.Snapshot) {
+		job, _ := jobs.Current(ctx)
+		s.notifyProgress(job, p)
+	}), progressInterval)
+	publish := progress.ReporterFunc(func(p progress.Snapshot) {
+		job, _ := jobs.Current(ctx)
+		s.events.publish(JobEvent{Type: JobEventProgress, JobID: job.ID, Progress: &p})
+	})
+	return progress.NewTracker(progress.Multi(notify, publish), progressEventInterval)
+}
+
+// notifyProgress notifies server of the progress of job.
+func (s *Server) notifyProgress(job jobs.Job, p progress.Snapshot) {
+	s.notifyMsg(map[string]string{
+		"action_id":        job.ActionID,
+		"job_id":           job.ID,
+		"status":           statusProgress,
+		"phase":            string(p.Phase),
+		"files":            strconv.Itoa(p.Files),
+		"total_files":      strconv.Itoa(p.TotalFiles),
+		"bytes":            strconv.FormatInt(p.Bytes, 10),
+		"total_bytes":      strconv.FormatInt(p.TotalBytes, 10),
+		"percent":          strconv.FormatFloat(p.Percent, 'f', 1, 64),
+		"bytes_per_second": strconv.FormatInt(p.Rate, 10),
+		"eta_seconds":      strconv.FormatInt(p.ETA, 10),
+	})
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"reflect"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
+	"github.com/bizflycloud/bizfly-backup/pkg/ratelimit"
+)
+
+// sharedLimiter is the bandwidth limiter of a policy, with the config it was built from.
+type sharedLimiter struct {
+	config  ratelimit.Config
+	limiter *ratelimit.Limiter
+}
+
+// policyLimiter returns the limiter throttling transfers of policy, shared by every job of the policy so the
+// limit applies to their aggregate throughput. The limiter is rebuilt when the bandwidth limit of the policy
+// changes, jobs already running keep the previous one.
+func (s *Server) policyLimiter(policy backupapi.BackupDirectoryConfigPolicy) (*ratelimit.Limiter, error) {
+	s.limitersMu.Lock()
+	defer s.limitersMu.Unlock()
+	if l, ok := s.limiters[policy.ID]; ok && reflect.DeepEqual(l.config, policy.BandwidthLimit) {
+		return l.limiter, nil
+	}
+	limiter, err := ratelimit.NewFromConfig(policy.BandwidthLimit)
+	if err != nil {
+		return nil, err
+	}
+	if policy.ID == "" {
+		return limiter, nil
+	}
+	if s.limiters == nil {
+		s.limiters = make(map[string]sharedLimiter)
+	}
+	s.limiters[policy.ID] = sharedLimiter{config: policy.BandwidthLimit, limiter: limiter}
+	return limiter, nil
+}
+
+// dropPolicyLimiters forgets limiters of policies not in backupDirectories, the complete agent config.
+func (s *Server) dropPolicyLimiters(backupDirectories []backupapi.BackupDirectoryConfig) {
+	cfg := &backupapi.Config{BackupDirectories: backupDirectories}
+	s.limitersMu.Lock()
+	defer s.limitersMu.Unlock()
+	for id := range s.limiters {
+		if _, ok := cfg.Policy(id); !ok {
+			delete(s.limiters, id)
+		}
+	}
+}
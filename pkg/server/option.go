@@ -1,8 +1,17 @@
 package server
 
 import (
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
 	"github.com/bizflycloud/bizfly-backup/pkg/broker"
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/encryption"
+	"github.com/bizflycloud/bizfly-backup/pkg/hooks"
+	"github.com/bizflycloud/bizfly-backup/pkg/jobs"
+	"github.com/bizflycloud/bizfly-backup/pkg/source"
 )
 
 type Option func(s *Server) error
@@ -46,3 +55,138 @@ func WithBackupClient(c *backupapi.Client) Option {
 		return nil
 	}
 }
+
+// WithStateDir returns an Option which set the directory where server keeps its local state.
+func WithStateDir(dir string) Option {
+	return func(s *Server) error {
+		s.stateDir = dir
+		return nil
+	}
+}
+
+// WithMaxIncrementals returns an Option which set the maximum number of incremental recovery points
+// taken after an initial replica, before a new initial replica is taken.
+func WithMaxIncrementals(n int) Option {
+	return func(s *Server) error {
+		if n < 0 {
+			return errors.New("negative max incrementals")
+		}
+		s.maxIncrementals = n
+		return nil
+	}
+}
+
+// WithEncryptionPassphrase returns an Option which set the passphrase used to encrypt archives before upload.
+// Empty passphrase disables encryption.
+func WithEncryptionPassphrase(passphrase string) Option {
+	return func(s *Server) error {
+		if passphrase != "" {
+			s.keyring = encryption.NewKeyring(passphrase)
+		}
+		return nil
+	}
+}
+
+// WithDownloadConcurrency returns an Option which set the number of ranges of a recovery point downloaded in parallel.
+func WithDownloadConcurrency(n int) Option {
+	return func(s *Server) error {
+		if n < 1 {
+			return errors.New("download concurrency must be positive")
+		}
+		s.downloadConcurrency = n
+		return nil
+	}
+}
+
+// WithFilters returns an Option which set local filters of backup directories, keyed by backup directory ID.
+// Fields set in them override those of the backup directory config.
+func WithFilters(filters map[string]backupapi.BackupDirectoryFilter) Option {
+	return func(s *Server) error {
+		for id, f := range filters {
+			if _, err := f.Rules(time.Now()); err != nil {
+				return fmt.Errorf("filter of backup directory %s: %w", id, err)
+			}
+		}
+		s.filters = filters
+		return nil
+	}
+}
+
+// WithHooks returns an Option which set local hooks of backup directories, keyed by backup directory ID. Hooks set
+// in them override those of the backup directory config.
+func WithHooks(configs map[string]hooks.Config) Option {
+	return func(s *Server) error {
+		for id, h := range configs {
+			if err := h.Validate(); err != nil {
+				return fmt.Errorf("hooks of backup directory %s: %w", id, err)
+			}
+		}
+		s.hooks = configs
+		return nil
+	}
+}
+
+// WithServerCommands returns an Option which set whether commands set in the backup directory config by the backup
+// server, hooks and command sources, are run. They are not by default, only commands set locally are.
+func WithServerCommands(allowed bool) Option {
+	return func(s *Server) error {
+		s.serverCommands = allowed
+		return nil
+	}
+}
+
+// WithSources returns an Option which set local sources of backup directories, keyed by backup directory ID. They
+// replace the sources of the backup directory config.
+func WithSources(sources map[string]source.Config) Option {
+	return func(s *Server) error {
+		for id, src := range sources {
+			if err := src.Validate(); err != nil {
+				return fmt.Errorf("source of backup directory %s: %w", id, err)
+			}
+		}
+		s.sources = sources
+		return nil
+	}
+}
+
+// WithJobConcurrency returns an Option which set the number of backup and restore jobs running at the same time.
+// Jobs working on the same directory never run at the same time.
+func WithJobConcurrency(n int) Option {
+	return func(s *Server) error {
+		if n < 1 {
+			return errors.New("job concurrency must be positive")
+		}
+		s.jobConcurrency = n
+		return nil
+	}
+}
+
+// WithJobHistoryRetention returns an Option which set how long finished jobs are kept in the job history, stored in
+// the state directory.
+func WithJobHistoryRetention(r jobs.Retention) Option {
+	return func(s *Server) error {
+		if r.MaxAge < 0 || r.MaxJobs < 0 {
+			return errors.New("negative job history retention")
+		}
+		s.jobHistoryRetention = r
+		return nil
+	}
+}
+
+// WithCache returns an Option which set the cache of recovery point files. Files are cached as they are uploaded,
+// and restores and downloads use them instead of downloading the files again.
+func WithCache(c *cache.Cache) Option {
+	return func(s *Server) error {
+		s.cache = c
+		return nil
+	}
+}
+
+// WithAutoPrune returns an Option which set whether recovery points not kept by the retention policies of a backup
+// directory are deleted after each successful scheduled backup of it. It is enabled by default.
+func WithAutoPrune(enabled bool) Option {
+	return func(s *Server) error {
+		s.autoPrune = enabled
+		return nil
+	}
+}
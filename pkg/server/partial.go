@@ -0,0 +1,78 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
+	"github.com/bizflycloud/bizfly-backup/pkg/filter"
+	"github.com/bizflycloud/bizfly-backup/pkg/manifest"
+	"github.com/bizflycloud/bizfly-backup/pkg/restore"
+)
+
+// zipLocalHeaderMagic starts every zip archive with at least one file.
+const zipLocalHeaderMagic = "PK\x03\x04"
+
+// remoteZip is a zip archive read with range requests, only its central directory and the content of extracted
+// files are downloaded.
+type remoteZip struct {
+	r *zip.Reader
+}
+
+func (a *remoteZip) metadata() (*archiveMetadata, error) {
+	data, err := readZipFile(a.r, metadataRecoveryPoint)
+	if err != nil {
+		return nil, err
+	}
+	return parseArchiveMetadata(data)
+}
+
+func (a *remoteZip) manifest() (*manifest.Manifest, error) {
+	data, err := readZipFile(a.r, metadataManifest)
+	if err != nil {
+		return nil, err
+	}
+	return parseManifest(data)
+}
+
+func (a *remoteZip) extract(ctx context.Context, t *restore.Target, sel *filter.Selection) error {
+	return extractZip(ctx, a.r, t, sel)
+}
+
+func (a *remoteZip) Close() error {
+	return nil
+}
+
+// openRemoteZip returns the archive of given recovery point read with range requests. It returns nil if the
+// recovery point can not be read this way: when server does not support range requests, or when it is not a
+// plain zip archive, like encrypted or tar archives which can only be read sequentially.
+func (s *Server) openRemoteZip(ctx context.Context, createdAt string, restoreSessionKey string, recoveryPointID string) (*remoteZip, error) {
+	rr, err := s.backupClient.OpenFile(ctx, createdAt, restoreSessionKey, recoveryPointID)
+	if errors.Is(err, backupapi.ErrRangeNotSupported) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(zipLocalHeaderMagic))
+	if _, err := rr.ReadAt(header, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.Equal(header, []byte(zipLocalHeaderMagic)) {
+		return nil, nil
+	}
+	r, err := zip.NewReader(rr, rr.Size())
+	if err != nil {
+		return nil, err
+	}
+	if err := registerZipDecompressors(r); err != nil {
+		return nil, err
+	}
+	s.logger.Debug("Reading recovery point with range requests", zap.String("recovery_point_id", recoveryPointID))
+	return &remoteZip{r: r}, nil
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
+	"github.com/bizflycloud/bizfly-backup/pkg/retention"
+)
+
+// PruneReport is the outcome of the retention policies of a backup directory applied to its recovery points.
+type PruneReport struct {
+	BackupDirectoryID string `json:"backup_directory_id"`
+	DryRun            bool   `json:"dry_run"`
+	// RecoveryPoints are completed recovery points newest first, followed by the others which are always kept.
+	RecoveryPoints []PrunedRecoveryPoint `json:"recovery_points"`
+}
+
+// PrunedRecoveryPoint tells whether a recovery point is kept, and why.
+type PrunedRecoveryPoint struct {
+	backupapi.RecoveryPoint
+	Keep    bool     `json:"keep"`
+	Reasons []string `json:"reasons,omitempty"`
+	// Error is the error of the deletion of the recovery point, if it failed.
+	Error string `json:"error,omitempty"`
+	// Skipped tells that the recovery point was not deleted since the deletion of a newer one failed.
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+// prune applies the retention policies of the backup directory configured by bdc to its recovery points, and deletes those not kept
+// unless dryRun is true. Deletion goes from newest to oldest and stops at the first failure, so a point which failed
+// to be deleted never loses its parent.
+func (s *Server) prune(ctx context.Context, bdc backupapi.BackupDirectoryConfig, dryRun bool) (*PruneReport, error) {
+	backupDirectoryID := bdc.ID
+	policies := make(map[string]retention.Policy, len(bdc.Policies))
+	for _, p := range bdc.Policies {
+		policies[p.ID] = p.Retention()
+		if p.Retention().IsZero() {
+			s.logger.Warn("Policy has no retention in agent config, its recovery points are not pruned",
+				zap.String("backup_directory_id", backupDirectoryID), zap.String("policy_id", p.ID))
+		}
+	}
+	rps, err := s.backupClient.ListRecoveryPoints(ctx, backupDirectoryID)
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string]backupapi.RecoveryPoint, len(rps))
+	var points []retention.Point
+	var others []PrunedRecoveryPoint
+	for _, rp := range rps {
+		if rp.Status != backupapi.RecoveryPointStatusCompleted {
+			others = append(others, PrunedRecoveryPoint{RecoveryPoint: rp, Keep: true, Reasons: []string{"status " + strings.ToLower(rp.Status)}})
+			continue
+		}
+		created, err := rp.CreatedTime()
+		if err != nil {
+			others = append(others, PrunedRecoveryPoint{RecoveryPoint: rp, Keep: true, Reasons: []string{"unknown creation time"}})
+			continue
+		}
+		byID[rp.ID] = rp
+		points = append(points, retention.Point{
+			ID:          rp.ID,
+			Time:        created.Local(),
+			PolicyID:    rp.PolicyID,
+			Incremental: rp.RecoveryPointType == backupapi.RecoveryPointTypePoint,
+		})
+	}
+	report := &PruneReport{BackupDirectoryID: backupDirectoryID, DryRun: dryRun}
+	for _, d := range retention.Apply(policies, points) {
+		report.RecoveryPoints = append(report.RecoveryPoints, PrunedRecoveryPoint{RecoveryPoint: byID[d.ID], Keep: d.Keep, Reasons: d.Reasons})
+	}
+	report.RecoveryPoints = append(report.RecoveryPoints, others...)
+	if dryRun {
+		return report, nil
+	}
+
+	failedID := ""
+	skipped := 0
+	for i, p := range report.RecoveryPoints {
+		if p.Keep {
+			continue
+		}
+		if failedID != "" {
+			report.RecoveryPoints[i].Skipped = true
+			skipped++
+			continue
+		}
+		if err := s.backupClient.DeleteRecoveryPoint(ctx, backupDirectoryID, p.ID); err != nil {
+			s.logger.Error("failed to delete recovery point", zap.Error(err), zap.String("recovery_point_id", p.ID))
+			report.RecoveryPoints[i].Error = err.Error()
+			failedID = p.ID
+			continue
+		}
+		s.logger.Info("Deleted recovery point", zap.String("recovery_point_id", p.ID), zap.String("backup_directory_id", backupDirectoryID))
+		if s.cache != nil {
+			_ = s.cache.Remove(p.ID)
+		}
+	}
+	if failedID != "" {
+		return report, fmt.Errorf("failed to delete recovery point %s, skipped %d older ones", failedID, skipped)
+	}
+	return report, nil
+}
+
+// autoPruneDirectory prunes the backup directory after a successful scheduled backup, if any of its policies has
+// retention. Failures are only logged, the backup succeeded anyway.
+func (s *Server) autoPruneDirectory(ctx context.Context, bdc backupapi.BackupDirectoryConfig) {
+	backupDirectoryID := bdc.ID
+	hasRetention := false
+	for _, p := range bdc.Policies {
+		if !p.Retention().IsZero() {
+			hasRetention = true
+		}
+	}
+	if !hasRetention {
+		s.logger.Warn("No policy has retention in agent config, recovery points are not pruned", zap.String("backup_directory_id", backupDirectoryID))
+		return
+	}
+	if _, err := s.prune(ctx, bdc, false); err != nil {
+		s.logger.Error("failed to prune recovery points", zap.Error(err), zap.String("backup_directory_id", backupDirectoryID))
+	}
+}
+
+// PruneBackup applies the retention policies of the backup directory to its recovery points, and deletes those not
+// kept unless the body sets dry_run. It responds with the PruneReport, whose points tell deletion failures.
+func (s *Server) PruneBackup(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		DryRun bool `json:"dry_run"`
+	}
+	// An empty body prunes without dry run.
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`malformed body`))
+		return
+	}
+	backupDirectoryID := chi.URLParam(r, "backupID")
+	cfg, err := s.getConfig(r.Context())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	bdc, ok := cfg.BackupDirectory(backupDirectoryID)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = fmt.Fprintf(w, "unknown backup directory %s", backupDirectoryID)
+		return
+	}
+	report, err := s.prune(r.Context(), bdc, body.DryRun)
+	if report == nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(report)
+}
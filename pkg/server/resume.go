@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
+)
+
+// maxUploadAttempts is the number of times an interrupted upload is resumed before starting a new recovery point.
+const maxUploadAttempts = 3
+
+// pendingBackup records an upload in progress, so it can be resumed after a failure or an agent restart.
+type pendingBackup struct {
+	ActionID              string `json:"action_id"`
+	RecoveryPointID       string `json:"recovery_point_id"`
+	BackupDirectoryID     string `json:"backup_directory_id"`
+	PolicyID              string `json:"policy_id"`
+	Name                  string `json:"name"`
+	RecoveryPointType     string `json:"recovery_point_type"`
+	ParentRecoveryPointID string `json:"parent_recovery_point_id,omitempty"`
+	// EncryptionHeader is the header of the encrypted archive, the resumed archive must be encrypted the same way.
+	EncryptionHeader []byte                `json:"encryption_header,omitempty"`
+	Attempts         int                   `json:"attempts"`
+	Upload           backupapi.UploadState `json:"upload"`
+}
+
+func (s *Server) pendingBackupPath(backupDirectoryID string) string {
+	return filepath.Join(s.stateDir, "uploads", backupDirectoryID+".json")
+}
+
+// loadPendingBackup returns the pending backup of given directory, or nil if there is none.
+func (s *Server) loadPendingBackup(backupDirectoryID string) (*pendingBackup, error) {
+	if s.stateDir == "" {
+		return nil, nil
+	}
+	buf, err := ioutil.ReadFile(s.pendingBackupPath(backupDirectoryID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var p pendingBackup
+	if err := json.Unmarshal(buf, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (s *Server) savePendingBackup(p *pendingBackup) error {
+	if s.stateDir == "" {
+		return nil
+	}
+	name := s.pendingBackupPath(p.BackupDirectoryID)
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := json.NewEncoder(f).Encode(p); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+func (s *Server) removePendingBackup(backupDirectoryID string) {
+	if s.stateDir == "" {
+		return
+	}
+	if err := os.Remove(s.pendingBackupPath(backupDirectoryID)); err != nil && !os.IsNotExist(err) {
+		s.logger.Error("failed to remove pending backup", zap.Error(err), zap.String("backup_directory_id", backupDirectoryID))
+	}
+}
+
+// resumableBackup returns the pending backup of given directory if it can be resumed by a backup of
+// recoveryPointType based on parentRecoveryPointID. A pending backup which can not be resumed is discarded.
+func (s *Server) resumableBackup(backupDirectoryID string, recoveryPointType string, parentRecoveryPointID string) *pendingBackup {
+	p, err := s.loadPendingBackup(backupDirectoryID)
+	if err != nil {
+		s.logger.Warn("failed to load pending backup, start a new one", zap.Error(err), zap.String("backup_directory_id", backupDirectoryID))
+		s.removePendingBackup(backupDirectoryID)
+		return nil
+	}
+	if p == nil {
+		return nil
+	}
+	resumable := p.Upload.UploadID != "" &&
+		p.Attempts < maxUploadAttempts &&
+		p.RecoveryPointType == recoveryPointType &&
+		p.ParentRecoveryPointID == parentRecoveryPointID &&
+		(p.EncryptionHeader == nil) == (s.keyring == nil)
+	if resumable && s.keyring != nil {
+		// The passphrase may have changed since.
+		_, err := s.keyring.ResumeWriter(ioutil.Discard, p.EncryptionHeader)
+		resumable = err == nil
+	}
+	if !resumable {
+		s.logger.Info("discard pending backup", zap.String("backup_directory_id", backupDirectoryID), zap.String("recovery_point_id", p.RecoveryPointID))
+		s.removePendingBackup(backupDirectoryID)
+		return nil
+	}
+	return p
+}
+
+// resumePendingBackups resumes uploads interrupted by an agent restart.
+func (s *Server) resumePendingBackups() {
+	if s.stateDir == "" {
+		return
+	}
+	files, err := ioutil.ReadDir(filepath.Join(s.stateDir, "uploads"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.logger.Error("failed to list pending backups", zap.Error(err))
+		}
+		return
+	}
+	for _, fi := range files {
+		if fi.IsDir() || filepath.Ext(fi.Name()) != ".json" {
+			continue
+		}
+		p, err := s.loadPendingBackup(strings.TrimSuffix(fi.Name(), ".json"))
+		if err != nil || p == nil {
+			continue
+		}
+		s.logger.Info("resume pending backup", zap.String("backup_directory_id", p.BackupDirectoryID), zap.String("recovery_point_id", p.RecoveryPointID))
+		if _, err := s.submitBackup(context.Background(), p.BackupDirectoryID, p.PolicyID, p.Name, p.RecoveryPointType); err != nil {
+			s.logger.Error("failed to resume backup", zap.Error(err), zap.String("backup_directory_id", p.BackupDirectoryID))
+		}
+	}
+}
@@ -2,7 +2,11 @@ package server
 
 import (
 	"archive/zip"
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,6 +18,8 @@ import (
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -29,6 +35,18 @@ import (
 
 	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
 	"github.com/bizflycloud/bizfly-backup/pkg/broker"
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/encryption"
+	"github.com/bizflycloud/bizfly-backup/pkg/fileindex"
+	"github.com/bizflycloud/bizfly-backup/pkg/filter"
+	"github.com/bizflycloud/bizfly-backup/pkg/hooks"
+	"github.com/bizflycloud/bizfly-backup/pkg/jobs"
+	"github.com/bizflycloud/bizfly-backup/pkg/manifest"
+	"github.com/bizflycloud/bizfly-backup/pkg/progress"
+	"github.com/bizflycloud/bizfly-backup/pkg/ratelimit"
+	"github.com/bizflycloud/bizfly-backup/pkg/repository"
+	"github.com/bizflycloud/bizfly-backup/pkg/restore"
+	"github.com/bizflycloud/bizfly-backup/pkg/source"
 )
 
 var Version = "dev"
@@ -40,6 +58,8 @@ const (
 	statusDownloading = "DOWNLOADING"
 	statusRestoring   = "RESTORING"
 	statusFailed      = "FAILED"
+	statusCanceled    = "CANCELLED"
+	statusProgress    = "PROGRESS"
 )
 
 // Server defines parameters for running BizFly Backup HTTP server.
@@ -52,10 +72,49 @@ type Server struct {
 	useUnixSock     bool
 	backupClient    *backupapi.Client
 
-	// mu guards handle broker event.
+	// mu guards cron entries, updated by config events, and the last config got from the backup server.
 	mu                   sync.Mutex
 	cronManager          *cron.Cron
 	mappingToCronEntryID map[string]cron.EntryID
+	lastConfig           *backupapi.Config
+
+	// jobs runs backups and restores, history keeps them in the state directory.
+	jobs                *jobs.Manager
+	jobConcurrency      int
+	history             *jobs.History
+	jobHistoryRetention jobs.Retention
+	// events broadcasts job events to clients following jobs.
+	events *eventHub
+
+	// stateDir stores local state of agent, like file indexes for incremental backup.
+	stateDir        string
+	maxIncrementals int
+
+	// keyring encrypts archives before upload, nil means no encryption.
+	keyring *encryption.Keyring
+
+	downloadConcurrency int
+	// tempDownloadDir is the download directory when there is no state directory, created on first use.
+	tempDownloadDirOnce sync.Once
+	tempDownloadDir     string
+	tempDownloadDirErr  error
+
+	// filters override filters of backup directories config, keyed by backup directory ID.
+	filters map[string]backupapi.BackupDirectoryFilter
+	// hooks override hooks of backup directories config, keyed by backup directory ID.
+	hooks map[string]hooks.Config
+	// serverCommands runs commands set by the backup server in backup directories config, which run as the agent
+	// user, otherwise hooks are ignored and command sources fail.
+	serverCommands bool
+	// sources override sources of backup directories config, keyed by backup directory ID.
+	sources map[string]source.Config
+	// limitersMu guards limiters, the bandwidth limiters shared by the jobs of each policy, keyed by policy ID.
+	limitersMu sync.Mutex
+	limiters   map[string]sharedLimiter
+	// cache keeps files of recent recovery points, nil means no cache.
+	cache *cache.Cache
+	// autoPrune deletes recovery points not kept by retention policies after scheduled backups.
+	autoPrune bool
 
 	// signal chan use for testing.
 	testSignalCh chan os.Signal
@@ -65,7 +124,13 @@ type Server struct {
 
 // New creates new server instance.
 func New(opts ...Option) (*Server, error) {
-	s := &Server{}
+	s := &Server{
+		maxIncrementals:     defaultMaxIncrementals,
+		downloadConcurrency: defaultDownloadConcurrency,
+		jobConcurrency:      defaultJobConcurrency,
+		jobHistoryRetention: jobs.DefaultRetention,
+		autoPrune:           true,
+	}
 	for _, opt := range opts {
 		if err := opt(s); err != nil {
 			return nil, err
@@ -77,6 +142,9 @@ func New(opts ...Option) (*Server, error) {
 		cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)))
 	s.cronManager.Start()
 	s.mappingToCronEntryID = make(map[string]cron.EntryID)
+	s.jobs = jobs.NewManager(s.jobConcurrency)
+	s.events = newEventHub()
+	s.jobs.OnChange(s.events.publishJob)
 
 	if s.logger == nil {
 		l, err := zap.NewDevelopment()
@@ -86,6 +154,10 @@ func New(opts ...Option) (*Server, error) {
 		s.logger = l
 	}
 
+	if err := s.openJobHistory(); err != nil {
+		return nil, err
+	}
+
 	s.setupRoutes()
 	s.useUnixSock = strings.HasPrefix(s.Addr, "unix://")
 	s.Addr = strings.TrimPrefix(s.Addr, "unix://")
@@ -98,12 +170,21 @@ func (s *Server) setupRoutes() {
 		r.Get("/", s.ListBackup)
 		r.Post("/", s.RequestBackup)
 		r.Get("/{backupID}/recovery-points", s.ListRecoveryPoints)
+		r.Post("/{backupID}/prune", s.PruneBackup)
 		r.Post("/sync", s.SyncConfig)
 	})
 
 	s.router.Route("/recovery-points", func(r chi.Router) {
 		r.Get("/{recoveryPointID}/download", s.DownloadRecoveryPoint)
 		r.Post("/{recoveryPointID}/restore", s.RequestRestore)
+		r.Post("/{recoveryPointID}/verify", s.VerifyRecoveryPoint)
+	})
+
+	s.router.Route("/jobs", func(r chi.Router) {
+		r.Get("/", s.ListJobs)
+		r.Get("/{jobID}", s.GetJob)
+		r.Get("/{jobID}/events", s.JobEvents)
+		r.Delete("/{jobID}", s.CancelJob)
 	})
 
 	s.router.Route("/upgrade", func(r chi.Router) {
@@ -114,9 +195,9 @@ func (s *Server) setupRoutes() {
 	})
 }
 
+// handleBrokerEvent handles an event sent to agent. Backups and restores are queued as jobs, so events are handled
+// while they run.
 func (s *Server) handleBrokerEvent(e broker.Event) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
 	var msg broker.Message
 	if err := json.Unmarshal(e.Payload, &msg); err != nil {
 		return err
@@ -124,12 +205,19 @@ func (s *Server) handleBrokerEvent(e broker.Event) error {
 	s.logger.Debug("Got broker event", zap.String("event_type", msg.EventType))
 	switch msg.EventType {
 	case broker.BackupManual:
-		return s.backup(msg.BackupDirectoryID, msg.PolicyID, msg.Name, backupapi.RecoveryPointTypeInitialReplica, ioutil.Discard)
+		_, err := s.submitBackup(context.Background(), msg.BackupDirectoryID, msg.PolicyID, msg.Name, backupapi.RecoveryPointTypeInitialReplica)
+		return err
 	case broker.RestoreManual:
-		return s.restore(msg.ActionId, msg.CreatedAt, msg.RestoreSessionKey, msg.RecoveryPointID, msg.DestinationDirectory, ioutil.Discard)
+		s.submitRestore(msg.ActionId, msg.CreatedAt, msg.RestoreSessionKey, msg.RecoveryPointID, msg.PolicyID, msg.DestinationDirectory, msg.RestoreMode, msg.RestoreInclude)
+	case broker.JobCancel:
+		return s.cancelJobs(msg.JobID, msg.BackupDirectoryID, msg.RecoveryPointID)
 	case broker.ConfigUpdate:
+		s.mu.Lock()
+		defer s.mu.Unlock()
 		return s.handleConfigUpdate(msg.Action, msg.BackupDirectories)
 	case broker.ConfigRefresh:
+		s.mu.Lock()
+		defer s.mu.Unlock()
 		return s.handleConfigRefresh(msg.BackupDirectories)
 	case broker.AgentUpgrade:
 	case broker.StatusNotify:
@@ -165,6 +253,7 @@ func (s *Server) handleConfigRefresh(backupDirectories []backupapi.BackupDirecto
 	s.cronManager.Start()
 	s.mappingToCronEntryID = make(map[string]cron.EntryID)
 	s.addToCronManager(backupDirectories)
+	s.dropPolicyLimiters(backupDirectories)
 	return nil
 }
 
@@ -189,22 +278,17 @@ func (s *Server) addToCronManager(bdc []backupapi.BackupDirectoryConfig) {
 		if !bd.Activated {
 			continue
 		}
+		// Scheduled backups use the config of the event, with local config applied.
+		cfg := &backupapi.Config{BackupDirectories: []backupapi.BackupDirectoryConfig{bd}}
+		s.applyLocalConfig(cfg)
+		bdc := cfg.BackupDirectories[0]
 		for _, policy := range bd.Policies {
-			directoryID := bd.ID
 			policyID := policy.ID
 			entryID, err := s.cronManager.AddFunc(policy.SchedulePattern, func() {
 				name := "auto-" + time.Now().Format(time.RFC3339)
-				// improve when support incremental backup
-				recoveryPointType := backupapi.RecoveryPointTypeInitialReplica
-				if err := s.backup(directoryID, policyID, name, recoveryPointType, ioutil.Discard); err != nil {
-					zapFields := []zap.Field{
-						zap.Error(err),
-						zap.String("service", "cron"),
-						zap.String("backup_directory_id", directoryID),
-						zap.String("policy_id", policyID),
-					}
-					s.logger.Error("failed to run backup", zapFields...)
-				}
+				// backup falls back to an initial replica when there is no previous backup to increment on.
+				recoveryPointType := backupapi.RecoveryPointTypePoint
+				s.queueBackup(bdc, policyID, name, recoveryPointType, true)
 			})
 			if err != nil {
 				s.logger.Error("failed to add cron entry", zap.Error(err))
@@ -220,6 +304,10 @@ func (s *Server) RequestBackup(w http.ResponseWriter, r *http.Request) {
 		ID          string `json:"id"`
 		StorageType string `json:"storage_type"`
 		Name        string `json:"name"`
+		// Wait streams events of the backup until it finishes, see JobEvents.
+		Wait bool `json:"wait"`
+		// Local runs the backup right away, instead of waiting for the backup server to send a backup event.
+		Local bool `json:"local"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -227,13 +315,35 @@ func (s *Server) RequestBackup(w http.ResponseWriter, r *http.Request) {
 		return
 
 	}
+	// Subscribe before requesting, the backup may be queued before the request returns.
+	events, unsubscribe := s.events.subscribe()
+	defer unsubscribe()
+	if body.Local {
+		job, err := s.submitBackup(r.Context(), body.ID, "", body.Name, backupapi.RecoveryPointTypeInitialReplica)
+		if err != nil {
+			s.logger.Error("failed to queue local backup", zap.Error(err), zap.String("backup_directory_id", body.ID))
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		s.respondJob(w, r, events, job, body.Wait)
+		return
+	}
 	if err := s.requestBackup(body.ID, body.Name, body.StorageType); err != nil {
+		s.logger.Error("failed to request backup", zap.Error(err), zap.String("backup_directory_id", body.ID))
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(err.Error()))
 		return
 	}
+	if body.Wait {
+		s.followJob(r.Context(), w, events, "", func(job jobs.Job) bool {
+			return job.Kind == jobs.KindBackup && job.BackupDirectoryID == body.ID
+		})
+	}
 }
 
 func (s *Server) ListBackup(w http.ResponseWriter, r *http.Request) {
-	c, err := s.backupClient.GetConfig(r.Context())
+	c, err := s.getConfig(r.Context())
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		_, _ = w.Write([]byte(err.Error()))
@@ -257,17 +367,37 @@ func (s *Server) DownloadRecoveryPoint(w http.ResponseWriter, r *http.Request) {
 	recoveryPointID := chi.URLParam(r, "recoveryPointID")
 	createdAt := r.Header.Get("X-Session-Created-At")
 	restoreSessionKey := r.Header.Get("X-Restore-Session-Key")
-	if err := s.backupClient.DownloadFileContent(r.Context(), createdAt, restoreSessionKey, recoveryPointID, w); err != nil {
+	f, err := s.recoveryPointContent(r.Context(), createdAt, restoreSessionKey, recoveryPointID)
+	if errors.Is(err, errInvalidRestoreSessionKey) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		s.logger.Error("failed to download recovery point", zap.Error(err), zap.String("recovery_point_id", recoveryPointID))
 		w.WriteHeader(http.StatusInternalServerError)
 		_, _ = w.Write([]byte(err.Error()))
 		return
 	}
+	defer f.Close()
+	// Content supports range requests, so client can resume an interrupted download.
+	http.ServeContent(w, r, recoveryPointID+".zip", time.Time{}, f)
+	if f.served() {
+		_ = os.Remove(f.Name())
+	}
 }
 
 func (s *Server) RequestRestore(w http.ResponseWriter, r *http.Request) {
 	var body struct {
-		MachineID string `json:"machine_id"`
-		Path      string `json:"path"`
+		MachineID   string `json:"machine_id"`
+		Path        string `json:"path"`
+		RestoreMode string `json:"restore_mode"`
+		// RestoreInclude restricts the restore to matching files, see filter.Selection.
+		RestoreInclude []string `json:"restore_include"`
+		// Wait streams events of the restore until it finishes, see JobEvents.
+		Wait bool `json:"wait"`
+		// Local runs the restore right away, instead of waiting for the backup server to send a restore event.
+		Local bool `json:"local"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
@@ -275,17 +405,124 @@ func (s *Server) RequestRestore(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write([]byte(`malformed body`))
 		return
 	}
+	if _, err := restore.ParseMode(body.RestoreMode); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	if _, err := filter.NewSelection(body.RestoreInclude); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
 
 	body.MachineID = s.backupClient.Id
 
 	recoveryPointID := chi.URLParam(r, "recoveryPointID")
-	if err := s.requestRestore(recoveryPointID, body.MachineID, body.Path); err != nil {
+	events, unsubscribe := s.events.subscribe()
+	defer unsubscribe()
+	if body.Local {
+		job := s.submitLocalRestore(recoveryPointID, body.Path, body.RestoreMode, body.RestoreInclude)
+		s.respondJob(w, r, events, job, body.Wait)
 		return
 	}
+	if err := s.requestRestore(recoveryPointID, body.MachineID, body.Path, body.RestoreMode, body.RestoreInclude); err != nil {
+		s.logger.Error("failed to request restore", zap.Error(err), zap.String("recovery_point_id", recoveryPointID))
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	if body.Wait {
+		s.followJob(r.Context(), w, events, "", func(job jobs.Job) bool {
+			return job.Kind == jobs.KindRestore && job.RecoveryPointID == recoveryPointID
+		})
+	}
+}
+
+func (s *Server) VerifyRecoveryPoint(w http.ResponseWriter, r *http.Request) {
+	recoveryPointID := chi.URLParam(r, "recoveryPointID")
+	reports, err := s.verify(r.Context(), recoveryPointID)
+	if err != nil {
+		s.logger.Error("failed to verify recovery point", zap.Error(err), zap.String("recovery_point_id", recoveryPointID))
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(reports)
+}
+
+func (s *Server) ListJobs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := 0
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte("invalid limit"))
+			return
+		}
+		limit = n
+	}
+	_ = json.NewEncoder(w).Encode(s.listJobs(q.Get("backup_directory_id"), jobs.State(q.Get("state")), limit))
+}
+
+func (s *Server) GetJob(w http.ResponseWriter, r *http.Request) {
+	job, ok := s.job(chi.URLParam(r, "jobID"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(jobs.ErrNotFound.Error()))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(job)
+}
+
+// respondJob responds with job queued by the request, or streams its events until it finishes if wait is true.
+func (s *Server) respondJob(w http.ResponseWriter, r *http.Request, events <-chan JobEvent, job jobs.Job, wait bool) {
+	if wait {
+		s.followJob(r.Context(), w, events, job.ID, nil)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(job)
+}
+
+// JobEvents streams events of a job as JSON lines until it finishes, see JobEvent.
+func (s *Server) JobEvents(w http.ResponseWriter, r *http.Request) {
+	jobID := chi.URLParam(r, "jobID")
+	events, unsubscribe := s.events.subscribe()
+	defer unsubscribe()
+	job, ok := s.job(jobID)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(jobs.ErrNotFound.Error()))
+		return
+	}
+	if job.Finished() {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		_ = json.NewEncoder(w).Encode(JobEvent{Type: JobEventState, JobID: jobID, Job: &job})
+		return
+	}
+	s.followJob(r.Context(), w, events, jobID, nil)
+}
+
+func (s *Server) CancelJob(w http.ResponseWriter, r *http.Request) {
+	jobID := chi.URLParam(r, "jobID")
+	err := s.jobs.Cancel(jobID)
+	switch {
+	case errors.Is(err, jobs.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Is(err, jobs.ErrFinished):
+		w.WriteHeader(http.StatusConflict)
+	case err != nil:
+		w.WriteHeader(http.StatusInternalServerError)
+	default:
+		s.logger.Info("canceled job", zap.String("job_id", jobID))
+		return
+	}
+	_, _ = w.Write([]byte(err.Error()))
 }
 
 func (s *Server) SyncConfig(w http.ResponseWriter, r *http.Request) {
-	c, err := s.backupClient.GetConfig(r.Context())
+	c, err := s.getConfig(r.Context())
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		_, _ = w.Write([]byte(err.Error()))
@@ -466,6 +703,8 @@ func (s *Server) Run() error {
 	go s.subscribeBrokerLoop(baseCtx)
 	go s.shutdownSignalLoop(baseCtx, valv)
 	go s.upgradeLoop(baseCtx)
+	go s.removeExpiredContentLoop(baseCtx)
+	go s.resumePendingBackups()
 
 	srv := http.Server{Handler: chi.ServerBaseContext(baseCtx, s.router)}
 
@@ -488,23 +727,11 @@ func (s *Server) Run() error {
 	return srv.ListenAndServe()
 }
 
-func (s *Server) reportStartCompress(w io.Writer) {
-	_, _ = w.Write([]byte("Start compressing ..."))
-}
-
-func (s *Server) reportCompressDone(w io.Writer) {
-	_, _ = w.Write([]byte("Compressing done ..."))
-}
-
-func (s *Server) reportStartUpload(w io.Writer) {
-	_, _ = w.Write([]byte("Start uploading ..."))
-}
-
-func (s *Server) reportUploadCompleted(w io.Writer) {
-	_, _ = w.Write([]byte("Upload completed ..."))
-}
-
 func (s *Server) notifyMsg(msg map[string]string) {
+	// Jobs requested on the agent, like local restores, have no server action to notify.
+	if msg["action_id"] == "" {
+		return
+	}
 	payload, _ := json.Marshal(msg)
 	if err := s.b.Publish(s.publishTopic, payload); err != nil {
 		s.logger.Warn("failed to notify server", zap.Error(err), zap.Any("message", msg))
@@ -519,87 +746,398 @@ func (s *Server) notifyStatusFailed(recoveryPointID, reason string) {
 	})
 }
 
-// backup performs backup flow.
-func (s *Server) backup(backupDirectoryID string, policyID string, name string, recoveryPointType string, progressOutput io.Writer) error {
-	ctx := context.Background()
-	// Create recovery point
-	rp, err := s.backupClient.CreateRecoveryPoint(ctx, backupDirectoryID, &backupapi.CreateRecoveryPointRequest{
-		PolicyID:          policyID,
-		Name:              name,
-		RecoveryPointType: recoveryPointType,
+// notifyError notifies server that the action failed with err, or that it was canceled if ctx is done.
+func (s *Server) notifyError(ctx context.Context, actionID string, err error) {
+	if ctx.Err() == nil {
+		s.notifyStatusFailed(actionID, err.Error())
+		return
+	}
+	s.notifyMsg(map[string]string{
+		"action_id": actionID,
+		"status":    statusCanceled,
+		"reason":    err.Error(),
 	})
+}
+
+// getConfig returns the agent config, with local filters, hooks and sources applied.
+func (s *Server) getConfig(ctx context.Context) (*backupapi.Config, error) {
+	cfg, err := s.backupClient.GetConfig(ctx)
 	if err != nil {
+		return nil, err
+	}
+	s.applyLocalConfig(cfg)
+	s.mu.Lock()
+	s.lastConfig = cfg
+	s.mu.Unlock()
+	return cfg, nil
+}
+
+// applyLocalConfig applies local filters, hooks and sources to cfg, sent by the backup server.
+func (s *Server) applyLocalConfig(cfg *backupapi.Config) {
+	s.dropServerCommands(cfg)
+	cfg.OverrideFilters(s.filters)
+	cfg.OverrideHooks(s.hooks)
+	cfg.OverrideSources(s.sources)
+}
+
+// jobConfig returns the agent config for a job, like getConfig, or the last config got if the backup server can
+// not be reached, so a transient error does not fail the job.
+func (s *Server) jobConfig(ctx context.Context) (*backupapi.Config, error) {
+	cfg, err := s.getConfig(ctx)
+	if err == nil {
+		return cfg, nil
+	}
+	s.mu.Lock()
+	last := s.lastConfig
+	s.mu.Unlock()
+	if last == nil {
+		return nil, err
+	}
+	s.logger.Warn("failed to get config, use the last one", zap.Error(err))
+	return last, nil
+}
+
+// backup performs backup flow, until ctx is canceled or the maximum duration of the policy is exceeded.
+func (s *Server) backup(ctx context.Context, bdc backupapi.BackupDirectoryConfig, policyID string, name string, recoveryPointType string, t *progress.Tracker) (err error) {
+	backupDirectoryID := bdc.ID
+	// The post backup hook runs once the pre backup hook ran, and is told the final error of the backup.
+	hookEnv := map[string]string{"BACKUP_DIRECTORY_ID": backupDirectoryID, "POLICY_ID": policyID, "PATH": bdc.Path}
+	preHookRan := false
+	defer func() {
+		if preHookRan {
+			s.runPostHook(ctx, hooks.PostBackup, bdc.Hooks.PostBackup, hookEnv, err)
+		}
+	}()
+	var prev *fileindex.Index
+	if bdc.ArchiveFormat == backupapi.ArchiveFormatChunked && s.keyring != nil {
+		return errors.New("encryption is not supported with chunked archive format")
+	}
+	// Uploads of the backup are throttled by the policy limit, shared with other jobs of the policy, on top of
+	// the agent limit applied by backupClient.
+	policy, _ := bdc.Policy(policyID)
+	limiter, err := s.policyLimiter(policy)
+	if err != nil {
+		return fmt.Errorf("bandwidth limit of policy %s: %w", policyID, err)
+	}
+	if policy.MaxDuration != "" {
+		maxDuration, parseErr := time.ParseDuration(policy.MaxDuration)
+		if parseErr != nil {
+			return fmt.Errorf("max duration of policy %s: %w", policyID, parseErr)
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, maxDuration)
+		defer cancel()
+		defer func() {
+			if errors.Is(err, context.DeadlineExceeded) {
+				err = fmt.Errorf("backup exceeded maximum duration %s: %w", maxDuration, err)
+			}
+		}()
+	}
+	spec := newArchiveSpec(bdc)
+	spec.manifestKey = s.backupClient.ManifestKey()
+	if spec.rules, err = bdc.Filter.Rules(time.Now()); err != nil {
 		return err
 	}
+	switch {
+	case bdc.ArchiveFormat == backupapi.ArchiveFormatChunked:
+		if spec.source.Type != "" && spec.source.Type != source.TypeDirectory {
+			return fmt.Errorf("%s source is not supported with chunked archive format", spec.source.Type)
+		}
+		// Every chunked recovery point is complete, unchanged data is deduplicated by chunks instead.
+		recoveryPointType = backupapi.RecoveryPointTypeInitialReplica
+	case spec.source.IsCommand():
+		if !s.commandSourceAllowed(bdc) {
+			return errServerCommandSource
+		}
+		if err := spec.validate(); err != nil {
+			return err
+		}
+		// Command output has no files to compare with a previous recovery point.
+		recoveryPointType = backupapi.RecoveryPointTypeInitialReplica
+	default:
+		if err := spec.validate(); err != nil {
+			return err
+		}
+		recoveryPointType, prev = s.incrementalBase(backupDirectoryID, recoveryPointType)
+	}
+
+	parentRecoveryPointID := ""
+	if prev != nil {
+		parentRecoveryPointID = prev.RecoveryPointID
+	}
+	var pending *pendingBackup
+	// An interrupted upload of command output is not resumed, the command would not output the same content again.
+	if bdc.ArchiveFormat != backupapi.ArchiveFormatChunked && !spec.source.IsCommand() {
+		pending = s.resumableBackup(backupDirectoryID, recoveryPointType, parentRecoveryPointID)
+	}
+
+	var rp *backupapi.CreateRecoveryPointResponse
+	if pending != nil {
+		// Resume the interrupted upload of the same content.
+		rp = &backupapi.CreateRecoveryPointResponse{
+			ID:            pending.ActionID,
+			RecoveryPoint: &backupapi.RecoveryPoint{ID: pending.RecoveryPointID},
+		}
+		pending.Attempts++
+		if err := s.savePendingBackup(pending); err != nil {
+			return err
+		}
+	} else {
+		// Create recovery point
+		rp, err = s.backupClient.CreateRecoveryPoint(ctx, backupDirectoryID, &backupapi.CreateRecoveryPointRequest{
+			PolicyID:          policyID,
+			Name:              name,
+			RecoveryPointType: recoveryPointType,
+		})
+		if err != nil {
+			return err
+		}
+		pending = &pendingBackup{
+			ActionID:              rp.ID,
+			RecoveryPointID:       rp.RecoveryPoint.ID,
+			BackupDirectoryID:     backupDirectoryID,
+			PolicyID:              policyID,
+			Name:                  name,
+			RecoveryPointType:     recoveryPointType,
+			ParentRecoveryPointID: parentRecoveryPointID,
+		}
+	}
+
+	jobs.Update(ctx, func(j *jobs.Job) {
+		j.RecoveryPointID = rp.RecoveryPoint.ID
+		j.ActionID = rp.ID
+	})
 
 	// Get BackupDirectory
 	bd, err := s.backupClient.GetBackupDirectory(backupDirectoryID)
 	if err != nil {
-		s.notifyStatusFailed(rp.ID, err.Error())
+		s.notifyError(ctx, rp.ID, err)
+		return err
+	}
+	hookEnv["RECOVERY_POINT_ID"] = rp.RecoveryPoint.ID
+	hookEnv["PATH"] = bd.Path
+	preHookRan = true
+	if err := s.runPreHook(ctx, hooks.PreBackup, bdc.Hooks.PreBackup, hookEnv); err != nil {
+		s.notifyError(ctx, rp.ID, err)
 		return err
 	}
 
+	if bdc.ArchiveFormat == backupapi.ArchiveFormatChunked {
+		return s.backupChunked(ctx, rp, bd, spec.rules, limiter, t)
+	}
+	if spec.source.Type == source.TypeFiles {
+		if spec.files, err = spec.source.RelativeFiles(bd.Path); err != nil {
+			s.notifyError(ctx, rp.ID, err)
+			return err
+		}
+	}
+
 	s.notifyMsg(map[string]string{
 		"action_id": rp.ID,
 		"status":    statusZipFile,
 	})
-	wd := filepath.Dir(bd.Path)
-	backupDir := filepath.Base(bd.Path)
-
-	if err := os.Chdir(wd); err != nil {
-		s.notifyStatusFailed(rp.ID, err.Error())
+	codec, err := spec.compression()
+	if err != nil {
+		s.notifyError(ctx, rp.ID, err)
 		return err
 	}
-
-	// Compress directory
-	s.reportStartCompress(progressOutput)
-	fi, err := ioutil.TempFile("", "bizfly-backup-agent-backup-*")
+	meta := &archiveMetadata{
+		RecoveryPointType:     recoveryPointType,
+		ParentRecoveryPointID: parentRecoveryPointID,
+		Compression:           codec.Name(),
+		BackupDirectoryID:     backupDirectoryID,
+		Source:                spec.source.Type,
+	}
+	idx, err := s.uploadArchive(ctx, rp, bd.Path, spec, prev, meta, pending, limiter, t)
+	if errors.Is(err, backupapi.ErrUploadContentChanged) {
+		s.logger.Info("directory changed since upload was interrupted, restart upload", zap.String("recovery_point_id", rp.RecoveryPoint.ID))
+		// Server would otherwise keep the parts of the interrupted upload.
+		if err := s.backupClient.AbortMultipart(ctx, rp.RecoveryPoint.ID, pending.Upload.UploadID); err != nil {
+			s.logger.Error("failed to abort interrupted upload", zap.Error(err), zap.String("upload_id", pending.Upload.UploadID))
+		}
+		pending.Upload = backupapi.UploadState{}
+		pending.EncryptionHeader = nil
+		idx, err = s.uploadArchive(ctx, rp, bd.Path, spec, prev, meta, pending, limiter, t)
+	}
 	if err != nil {
-		s.notifyStatusFailed(rp.ID, err.Error())
+		if pending.Upload.UploadID == "" || pending.Attempts >= maxUploadAttempts {
+			s.removePendingBackup(backupDirectoryID)
+		}
+		s.notifyError(ctx, rp.ID, err)
 		return err
 	}
-	defer os.Remove(fi.Name())
-	if err := compressDir(backupDir, fi); err != nil {
-		s.notifyStatusFailed(rp.ID, err.Error())
-		return err
+	s.removePendingBackup(backupDirectoryID)
+	jobs.Update(ctx, func(j *jobs.Job) {
+		j.Files = len(idx.Entries)
+		j.Bytes = 0
+		for _, e := range idx.Entries {
+			j.Bytes += e.Size
+		}
+	})
+	s.saveFileIndex(backupDirectoryID, rp.RecoveryPoint.ID, prev, idx)
+	t.Done()
+
+	s.notifyMsg(map[string]string{
+		"action_id": rp.ID,
+		"status":    statusComplete,
+	})
+
+	return nil
+}
+
+// uploadArchive archives dir as described by spec and uploads the archive while it is being written, throttled by
+// limiter. The upload state is recorded in pending as the upload progresses, and an upload already recorded in
+// pending is resumed.
+func (s *Server) uploadArchive(ctx context.Context, rp *backupapi.CreateRecoveryPointResponse, dir string, spec archiveSpec, prev *fileindex.Index, meta *archiveMetadata, pending *pendingBackup, limiter *ratelimit.Limiter, t *progress.Tracker) (*fileindex.Index, error) {
+	// The size of command output is unknown until the command exits.
+	files, size := 0, int64(0)
+	if !spec.source.IsCommand() {
+		t.Start(progress.PhaseScanning, 0, 0)
+		var err error
+		if files, size, err = scanDir(ctx, dir, spec.rules, spec.files); err != nil {
+			return nil, err
+		}
 	}
-	if err := fi.Close(); err != nil {
-		s.notifyStatusFailed(rp.ID, err.Error())
-		return err
+	t.Start(progress.PhaseArchiving, files, size)
+	pr, aw := io.Pipe()
+	enc, err := s.encrypter(aw, pending.EncryptionHeader)
+	if err != nil {
+		return nil, err
+	}
+	if enc != nil {
+		pending.EncryptionHeader = enc.Header()
+	}
+	type archiveResult struct {
+		idx *fileindex.Index
+		err error
+	}
+	archived := make(chan archiveResult, 1)
+	go func() {
+		idx, err := writeArchive(ctx, dir, aw, spec, enc, prev, meta, t)
+		_ = aw.CloseWithError(err)
+		archived <- archiveResult{idx, err}
+	}()
+
+	s.notifyMsg(map[string]string{
+		"action_id": rp.ID,
+		"status":    statusUploadFile,
+	})
+	// Upload file to server, caching it as it is read.
+	save := func(*backupapi.UploadState) error {
+		return s.savePendingBackup(pending)
+	}
+	var r io.Reader = pr
+	cw := s.cacheWriter(rp.RecoveryPoint.ID, pending.BackupDirectoryID)
+	if cw != nil {
+		r = io.TeeReader(pr, cw)
 	}
-	s.reportCompressDone(progressOutput)
-	fi, err = os.Open(fi.Name())
+	err = s.backupClient.UploadStream(ctx, rp.RecoveryPoint.ID, ratelimit.NewReader(ctx, r, limiter), ioutil.Discard, backupapi.WithUploadState(&pending.Upload, save))
+	// Stop archiving if upload stopped early.
+	_ = pr.CloseWithError(err)
+	res := <-archived
+	if res.err != nil && !errors.Is(err, backupapi.ErrUploadContentChanged) {
+		// Archiving error is the cause of upload error, if any.
+		err = res.err
+	}
+	s.commitCache(cw, err)
 	if err != nil {
-		s.notifyStatusFailed(rp.ID, err.Error())
-		return err
+		return nil, err
+	}
+	return res.idx, nil
+}
+
+// writeArchive writes archive of dir, or of the output of its command source, described by spec to w, or to enc if not nil. Files archived are counted by t.
+func writeArchive(ctx context.Context, dir string, w io.Writer, spec archiveSpec, enc *encryption.Writer, prev *fileindex.Index, meta *archiveMetadata, t *progress.Tracker) (*fileindex.Index, error) {
+	if enc != nil {
+		w = enc
+	}
+	var idx *fileindex.Index
+	var err error
+	if spec.source.IsCommand() {
+		idx, err = archiveCommand(ctx, w, spec, meta, t)
+	} else {
+		idx, err = archiveDir(ctx, dir, w, spec, prev, meta, t)
 	}
-	defer fi.Close()
-	batch := false
-	if f, err := fi.Stat(); err == nil {
-		batch = f.Size() > backupapi.MultipartUploadLowerBound
+	if err != nil {
+		return nil, err
+	}
+	if enc != nil {
+		return idx, enc.Close()
 	}
+	return idx, nil
+}
 
+// backupChunked performs backup flow for ArchiveFormatChunked directory.
+//
+// Only chunks unknown to server are uploaded, throttled by limiter, the recovery point file is the index of the directory.
+func (s *Server) backupChunked(ctx context.Context, rp *backupapi.CreateRecoveryPointResponse, bd *backupapi.BackupDirectory, rules filter.Rules, limiter *ratelimit.Limiter, t *progress.Tracker) error {
 	s.notifyMsg(map[string]string{
 		"action_id": rp.ID,
 		"status":    statusUploadFile,
 	})
-	// Upload file to server
-	s.reportStartUpload(progressOutput)
-	pw := backupapi.NewProgressWriter(progressOutput)
-	if err := s.backupClient.UploadFile(rp.RecoveryPoint.ID, fi, pw, batch); err != nil {
-		s.notifyStatusFailed(rp.ID, err.Error())
+	t.Start(progress.PhaseScanning, 0, 0)
+	_, size, err := scanDir(ctx, bd.Path, rules, nil)
+	if err != nil {
+		s.notifyError(ctx, rp.ID, err)
+		return err
+	}
+	t.Start(progress.PhaseUploading, 0, size)
+	f, err := filter.New(bd.Path, rules)
+	if err != nil {
+		s.notifyError(ctx, rp.ID, err)
+		return err
+	}
+	var store repository.ChunkStore = s.backupClient
+	if limiter != nil {
+		store = limitedChunkStore{ChunkStore: store, limiter: limiter}
+	}
+	idx, stats, err := repository.Backup(ctx, store, bd.Path, f, t)
+	if err != nil {
+		s.notifyError(ctx, rp.ID, err)
+		return err
+	}
+	var buf bytes.Buffer
+	if err := repository.WriteIndex(&buf, idx); err != nil {
+		s.notifyError(ctx, rp.ID, err)
+		return err
+	}
+	if err := s.backupClient.UploadFile(ctx, rp.RecoveryPoint.ID, &buf, ioutil.Discard, false); err != nil {
+		s.notifyError(ctx, rp.ID, err)
 		return err
 	}
-	s.reportUploadCompleted(progressOutput)
+	jobs.Update(ctx, func(j *jobs.Job) {
+		j.Files = stats.Files
+		j.Bytes = stats.Bytes
+	})
+	t.Done()
+	s.logger.Info("Chunked backup done",
+		zap.String("recovery_point_id", rp.RecoveryPoint.ID),
+		zap.Int("files", stats.Files),
+		zap.Int64("bytes", stats.Bytes),
+		zap.Int("new_chunks", stats.NewChunks),
+		zap.Int64("uploaded_bytes", stats.UploadedBytes),
+	)
 
 	s.notifyMsg(map[string]string{
 		"action_id": rp.ID,
 		"status":    statusComplete,
 	})
-
 	return nil
 }
 
+// limitedChunkStore throttles uploads of chunks to a ChunkStore.
+type limitedChunkStore struct {
+	repository.ChunkStore
+	limiter *ratelimit.Limiter
+}
+
+func (l limitedChunkStore) PutChunk(ctx context.Context, id string, data []byte) error {
+	if err := l.limiter.Wait(ctx, len(data)); err != nil {
+		return err
+	}
+	return l.ChunkStore.PutChunk(ctx, id, data)
+}
+
 // requestBackup performs a request backup flow.
 func (s *Server) requestBackup(backupDirectoryID string, name string, storageType string) error {
 	if err := s.backupClient.RequestBackupDirectory(backupDirectoryID, &backupapi.CreateManualBackupRequest{
@@ -612,61 +1150,124 @@ func (s *Server) requestBackup(backupDirectoryID string, name string, storageTyp
 	return nil
 }
 
-func (s *Server) reportStartDownload(w io.Writer) {
-	_, _ = w.Write([]byte("Start downloading ..."))
-}
+// restore performs restore flow, files existing in destDir are handled according to restore mode. If include
+// patterns are given, only matching files are restored. Restore hooks of the backup directory containing destDir
+// run around the extraction of files.
+func (s *Server) restore(ctx context.Context, actionID string, createdAt string, restoreSessionKey string, recoveryPointID string, policyID string, destDir string, mode string, include []string, t *progress.Tracker) (err error) {
+	restoreMode, err := restore.ParseMode(mode)
+	if err != nil {
+		s.notifyError(ctx, actionID, err)
+		return err
+	}
+	sel, err := filter.NewSelection(include)
+	if err != nil {
+		s.notifyError(ctx, actionID, err)
+		return err
+	}
+	cfg, err := s.jobConfig(ctx)
+	if err != nil {
+		s.notifyError(ctx, actionID, err)
+		return err
+	}
+	hks, backupDirectoryID, err := s.restoreHooks(cfg, destDir)
+	if err != nil {
+		s.notifyError(ctx, actionID, err)
+		return err
+	}
+	// Downloads of the recovery point and its parents are throttled by the limit of its policy, shared with
+	// other jobs of the policy.
+	if policy, ok := cfg.Policy(policyID); ok {
+		limiter, err := s.policyLimiter(policy)
+		if err != nil {
+			err = fmt.Errorf("bandwidth limit of policy %s: %w", policyID, err)
+			s.notifyError(ctx, actionID, err)
+			return err
+		}
+		ctx = ratelimit.NewContext(ctx, limiter)
+	}
 
-func (s *Server) reportDownloadCompleted(w io.Writer) {
-	_, _ = w.Write([]byte("Download completed."))
-}
+	// Selected files of a zip archive are read remotely, instead of downloading the whole archive, unless it is
+	// cached.
+	var remote *remoteZip
+	if _, cached := s.cacheEntry(recoveryPointID); sel != nil && !cached {
+		if remote, err = s.openRemoteZip(ctx, createdAt, restoreSessionKey, recoveryPointID); err != nil {
+			s.notifyError(ctx, actionID, err)
+			return err
+		}
+	}
 
-func (s *Server) reportStartRestore(w io.Writer) {
-	_, _ = w.Write([]byte("Start restoring ..."))
-}
+	var name string
+	if remote == nil {
+		if name, err = s.downloadPath(recoveryPointID); err != nil {
+			s.notifyError(ctx, actionID, err)
+			return err
+		}
 
-func (s *Server) reportRestoreCompleted(w io.Writer) {
-	_, _ = w.Write([]byte("Restore completed."))
-}
+		s.notifyMsg(map[string]string{
+			"action_id": actionID,
+			"status":    statusDownloading,
+		})
 
-func (s *Server) restore(actionID string, createdAt string, restoreSessionKey string, recoveryPointID string, destDir string, progressOutput io.Writer) error {
-	ctx := context.Background()
+		t.Start(progress.PhaseDownloading, 0, 0)
+		// The partially downloaded file is kept on failure, the next restore resumes it.
+		if err := s.downloadFile(ctx, createdAt, restoreSessionKey, recoveryPointID, name, t); err != nil {
+			s.logger.Error("failed to download file content", zap.Error(err))
+			s.notifyError(ctx, actionID, err)
+			return err
+		}
+		defer os.Remove(name)
+	}
 
-	fi, err := ioutil.TempFile("", "bizfly-backup-agent-restore*")
-	if err != nil {
-		s.notifyStatusFailed(actionID, err.Error())
+	hookEnv := map[string]string{"BACKUP_DIRECTORY_ID": backupDirectoryID, "RECOVERY_POINT_ID": recoveryPointID, "PATH": destDir}
+	if err := s.runPreHook(ctx, hooks.PreRestore, hks.PreRestore, hookEnv); err != nil {
+		s.notifyError(ctx, actionID, err)
 		return err
 	}
-	defer os.Remove(fi.Name())
+	defer func() {
+		s.runPostHook(ctx, hooks.PostRestore, hks.PostRestore, hookEnv, err)
+	}()
 
 	s.notifyMsg(map[string]string{
 		"action_id": actionID,
-		"status":    statusDownloading,
+		"status":    statusRestoring,
 	})
-
-	s.reportStartDownload(progressOutput)
-	pw := backupapi.NewProgressWriter(progressOutput)
-	if err := s.backupClient.DownloadFileContent(ctx, createdAt, restoreSessionKey, recoveryPointID, io.MultiWriter(fi, pw)); err != nil {
-		s.logger.Error("failed to download file content", zap.Error(err))
-		s.notifyStatusFailed(actionID, err.Error())
+	t.Start(progress.PhaseRestoring, 0, 0)
+	target, err := restore.NewTarget(destDir, restoreMode)
+	if err != nil {
+		s.notifyError(ctx, actionID, err)
 		return err
 	}
-	s.reportDownloadCompleted(progressOutput)
-	if err := fi.Close(); err != nil {
-		s.logger.Error("failed to save to temporary file", zap.Error(err))
-		s.notifyStatusFailed(actionID, err.Error())
+	var restored *manifest.Manifest
+	if remote != nil {
+		restored, err = s.restoreArchiveChain(ctx, remote, target, sel)
+	} else {
+		restored, err = s.extract(ctx, cfg, name, target, sel)
+	}
+	if err != nil {
+		s.notifyError(ctx, actionID, err)
 		return err
 	}
-
-	s.notifyMsg(map[string]string{
-		"action_id": actionID,
-		"status":    statusRestoring,
-	})
-	s.reportStartRestore(progressOutput)
-	if err := unzip(fi.Name(), destDir); err != nil {
-		s.notifyStatusFailed(actionID, err.Error())
+	if err := s.verifyRestore(target, restored); err != nil {
+		s.notifyError(ctx, actionID, err)
 		return err
 	}
-	s.reportRestoreCompleted(progressOutput)
+	if restored != nil {
+		jobs.Update(ctx, func(j *jobs.Job) {
+			j.Files = len(restored.Files)
+			j.Bytes = 0
+			for _, e := range restored.Files {
+				j.Bytes += e.Size
+			}
+		})
+	}
+	if n := target.Conflicts(); n > 0 {
+		s.logger.Info("Restored files conflicting with existing ones",
+			zap.String("recovery_point_id", recoveryPointID),
+			zap.String("mode", string(restoreMode)),
+			zap.Int("conflicts", n),
+		)
+	}
+	t.Done()
 	s.notifyMsg(map[string]string{
 		"action_id": actionID,
 		"status":    statusComplete,
@@ -675,11 +1276,43 @@ func (s *Server) restore(actionID string, createdAt string, restoreSessionKey st
 	return nil
 }
 
+// extract restores files selected by sel of the downloaded recovery point file to t, the file format is detected
+// from its content. Command output is piped into the restore command of its backup directory in cfg instead, if
+// any. It returns the manifest of restored files, nil for chunked recovery points whose chunks are verified while
+// they are restored.
+func (s *Server) extract(ctx context.Context, cfg *backupapi.Config, name string, t *restore.Target, sel *filter.Selection) (*manifest.Manifest, error) {
+	if err := s.decryptFile(name); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	header, _ := br.Peek(16)
+	if !repository.IsIndex(header) {
+		if sel == nil {
+			if piped, err := s.restoreCommandOutput(ctx, cfg, name); piped || err != nil {
+				return nil, err
+			}
+		}
+		return s.restoreArchiveChain(ctx, &localArchive{name: name}, t, sel)
+	}
+	idx, err := repository.ReadIndex(br)
+	if err != nil {
+		return nil, err
+	}
+	return nil, repository.Restore(ctx, s.backupClient, idx, t, sel)
+}
+
 // requestRestore performs a request restore flow.
-func (s *Server) requestRestore(recoveryPointID string, machineID string, path string) error {
+func (s *Server) requestRestore(recoveryPointID string, machineID string, path string, mode string, include []string) error {
 	if err := s.backupClient.RequestRestore(recoveryPointID, &backupapi.CreateRestoreRequest{
-		MachineID: machineID,
-		Path:      path,
+		MachineID:      machineID,
+		Path:           path,
+		RestoreMode:    mode,
+		RestoreInclude: include,
 	}); err != nil {
 		return err
 	}
@@ -687,110 +1320,326 @@ func (s *Server) requestRestore(recoveryPointID string, machineID string, path s
 }
 
 func compressDir(src string, w io.Writer) error {
+	_, err := archiveDir(context.Background(), src, w, archiveSpec{}, nil, nil, nil)
+	return err
+}
+
+// archiveDir writes files of src selected by spec rules to archive w described by spec, and returns the index of them.
+//
+// If prev is not nil, only files changed since prev are written. If meta is not nil, it is written
+// to the archive, along with the files deleted since prev and the manifest of written files. Files are counted by t,
+// unchanged ones included.
+func archiveDir(ctx context.Context, src string, w io.Writer, spec archiveSpec, prev *fileindex.Index, meta *archiveMetadata, t *progress.Tracker) (*fileindex.Index, error) {
 	srcAbs, err := filepath.Abs(src)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// zip > buf
-	zw := zip.NewWriter(w)
-	defer zw.Close()
+	f, err := filter.New(srcAbs, spec.rules)
+	if err != nil {
+		return nil, err
+	}
+	aw, err := newArchiveWriter(w, spec)
+	if err != nil {
+		return nil, err
+	}
+	defer aw.Close()
 
+	idx := fileindex.New()
+	m := manifest.New()
 	walker := func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if info.IsDir() {
-			return nil
+		if err := ctx.Err(); err != nil {
+			return err
 		}
-		isSymlink := info.Mode()&os.ModeSymlink != 0
-		fi, err := os.Open(path)
-		if os.IsNotExist(err) && isSymlink {
+		if path == srcAbs {
 			return nil
 		}
+		name := strings.TrimPrefix(path, srcAbs+string(os.PathSeparator))
+		excluded, err := f.Excluded(name, info)
 		if err != nil {
 			return err
 		}
-		defer fi.Close()
-
-		header, err := zip.FileInfoHeader(info)
-		if err != nil {
+		if excluded {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			_, err := aw.add(name, path, info)
 			return err
 		}
+		isSymlink := info.Mode()&os.ModeSymlink != 0
 
-		header.Name = strings.TrimPrefix(path, srcAbs+string(os.PathSeparator))
-		header.Method = zip.Deflate
-		header.SetMode(info.Mode())
+		entry := fileindex.NewEntry(info)
+		if prev != nil {
+			ok, err := unchanged(prev, name, path, isSymlink, &entry)
+			if err != nil {
+				return err
+			}
+			if ok {
+				idx.Entries[name] = entry
+				if info.Mode().IsRegular() {
+					t.Add(info.Size())
+				}
+				t.FileDone()
+				return nil
+			}
+		}
 
-		fw, err := zw.CreateHeader(header)
+		hasContent, err := aw.add(name, path, info)
 		if err != nil {
 			return err
 		}
-
-		if isSymlink {
+		if !hasContent {
+			idx.Entries[name] = entry
+			t.FileDone()
 			return nil
 		}
 
-		_, err = io.Copy(fw, fi)
+		fi, err := os.Open(path)
 		if err != nil {
 			return err
 		}
+		defer fi.Close()
+		h := sha256.New()
+		n, err := io.Copy(aw, io.TeeReader(fi, io.MultiWriter(h, t)))
+		if err != nil {
+			return err
+		}
+		t.FileDone()
+		entry.Hash = hex.EncodeToString(h.Sum(nil))
+		idx.Entries[name] = entry
+		m.Add(manifest.Entry{Path: filepath.ToSlash(name), Size: n, Mode: info.Mode(), SHA256: entry.Hash})
 
 		return nil
 	}
 
-	// walk through every file in the folder and add to zip writer.
-	if err := filepath.Walk(srcAbs, walker); err != nil {
-		return err
+	// walk through every file in the folder and add to archive writer.
+	if err := walkFiles(srcAbs, spec.files, walker); err != nil {
+		return nil, err
 	}
 
-	if err := zw.Close(); err != nil {
-		return err
+	if meta != nil && prev != nil {
+		meta.Deleted = prev.Deleted(idx)
 	}
+	if err := finishArchive(aw, spec, meta, m); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
 
+// finishArchive writes metadata and the manifest m of the archive if meta is not nil, then closes aw.
+func finishArchive(aw archiveWriter, spec archiveSpec, meta *archiveMetadata, m *manifest.Manifest) error {
+	if meta != nil {
+		data, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		if err := aw.addData(metadataRecoveryPoint, data); err != nil {
+			return err
+		}
+		if err := m.Sign(spec.manifestKey); err != nil {
+			return err
+		}
+		if data, err = json.Marshal(m); err != nil {
+			return err
+		}
+		if err := aw.addData(metadataManifest, data); err != nil {
+			return err
+		}
+	}
+	return aw.Close()
+}
+
+// walkFiles walks the directory srcAbs, or only files and directories of it listed in files if not empty. Files
+// inside a listed directory are walked once, even if they are listed too.
+func walkFiles(srcAbs string, files []string, fn filepath.WalkFunc) error {
+	if len(files) == 0 {
+		return filepath.Walk(srcAbs, fn)
+	}
+	sorted := append([]string(nil), files...)
+	sort.Strings(sorted)
+	var walked []string
+	for _, name := range sorted {
+		inside := false
+		for _, dir := range walked {
+			if name == dir || strings.HasPrefix(name, dir+string(os.PathSeparator)) {
+				inside = true
+				break
+			}
+		}
+		if inside {
+			continue
+		}
+		walked = append(walked, name)
+		if err := filepath.Walk(filepath.Join(srcAbs, name), fn); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func unzip(zipFile, dest string) error {
-	r, err := zip.OpenReader(zipFile)
+// archiveCommand writes an archive of the output of the command source of spec to w, as a single file. The archive
+// fails if the command does, since its output is then likely incomplete.
+func archiveCommand(ctx context.Context, w io.Writer, spec archiveSpec, meta *archiveMetadata, t *progress.Tracker) (*fileindex.Index, error) {
+	aw, err := newArchiveWriter(w, spec)
 	if err != nil {
-		return fmt.Errorf("zip.OpenReader: %w", err)
+		return nil, err
 	}
-	defer r.Close()
+	defer aw.Close()
+
+	stream, err := spec.source.Start(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("source command: %w", err)
+	}
+	name := spec.source.Output()
+	now := time.Now()
+	if err := aw.addStream(name, 0600, now); err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(aw, io.TeeReader(stream, io.MultiWriter(h, t)))
+	if closeErr := stream.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("source command: %w", closeErr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.FileDone()
+
+	entry := fileindex.Entry{Size: n, ModTime: now, Hash: hex.EncodeToString(h.Sum(nil))}
+	idx := fileindex.New()
+	idx.Entries[name] = entry
+	m := manifest.New()
+	m.Add(manifest.Entry{Path: name, Size: n, Mode: 0600, SHA256: entry.Hash})
+	if err := finishArchive(aw, spec, meta, m); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// scanDir returns the number and total size of the files of src selected by rules, or of files of src listed in
+// files if not empty, which archiveDir archives.
+func scanDir(ctx context.Context, src string, rules filter.Rules, files []string) (int, int64, error) {
+	srcAbs, err := filepath.Abs(src)
+	if err != nil {
+		return 0, 0, err
+	}
+	f, err := filter.New(srcAbs, rules)
+	if err != nil {
+		return 0, 0, err
+	}
+	count, size := 0, int64(0)
+	err = walkFiles(srcAbs, files, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if path == srcAbs {
+			return nil
+		}
+		excluded, err := f.Excluded(strings.TrimPrefix(path, srcAbs+string(os.PathSeparator)), info)
+		if err != nil {
+			return err
+		}
+		if excluded && info.IsDir() {
+			return filepath.SkipDir
+		}
+		if excluded || info.IsDir() {
+			return nil
+		}
+		count++
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return count, size, err
+}
+
+// unchanged reports whether file at path is unchanged since prev. The file is only read when its size is
+// unchanged but its mtime or inode is, in which case its hash is compared. entry hash is updated accordingly.
+func unchanged(prev *fileindex.Index, name string, path string, isSymlink bool, entry *fileindex.Entry) (bool, error) {
+	old, ok := prev.Entries[name]
+	if !ok {
+		return false, nil
+	}
+	if old.SameMetadata(*entry) {
+		entry.Hash = old.Hash
+		return true, nil
+	}
+	if isSymlink || old.Size != entry.Size || old.Hash == "" {
+		return false, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return false, err
+	}
+	entry.Hash = hex.EncodeToString(h.Sum(nil))
+	return entry.Hash == old.Hash, nil
+}
 
-	if err := os.MkdirAll(dest, 0755); err != nil && !os.IsExist(err) {
+func unzip(ctx context.Context, zipFile string, t *restore.Target, sel *filter.Selection) error {
+	r, err := openZip(zipFile)
+	if err != nil {
 		return err
 	}
+	defer r.Close()
+	return extractZip(ctx, &r.Reader, t, sel)
+}
 
+// extractZip extracts files of zip archive r selected by sel to t. Only content of selected files is read.
+func extractZip(ctx context.Context, r *zip.Reader, t *restore.Target, sel *filter.Selection) error {
 	extractAndWriteFile := func(f *zip.File) error {
+		name := strings.TrimSuffix(f.Name, "/")
+		if f.FileInfo().IsDir() {
+			_, _, err := t.Mkdir(name, f.Modified)
+			return err
+		}
+		path, err := t.File(name, f.Modified)
+		if err != nil || path == "" {
+			return err
+		}
 		rc, err := f.Open()
 		if err != nil {
 			return fmt.Errorf("extractAndWriteFile: f.Open: %w", err)
 		}
 		defer rc.Close()
-		path := filepath.Join(dest, f.Name)
-
-		if f.FileInfo().IsDir() {
-			_ = os.MkdirAll(path, f.Mode())
-		} else {
-			_ = os.MkdirAll(filepath.Dir(path), 0755)
-			f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
-			if err != nil {
-				return fmt.Errorf("extractAndWriteFile: os.OpenFile: %w", err)
-			}
-			defer f.Close()
+		// The path is free, creating it exclusively never writes through a link.
+		out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, f.Mode().Perm())
+		if err != nil {
+			return fmt.Errorf("extractAndWriteFile: os.OpenFile: %w", err)
+		}
+		defer out.Close()
 
-			if _, err := io.Copy(f, rc); err != nil {
-				return fmt.Errorf("extractAndWriteFile: io.Copy: %w", err)
-			}
-			if err := f.Close(); err != nil {
-				return fmt.Errorf("extractAndWriteFile: f.Close: %w", err)
-			}
+		if _, err := io.Copy(out, rc); err != nil {
+			return fmt.Errorf("extractAndWriteFile: io.Copy: %w", err)
+		}
+		if err := out.Close(); err != nil {
+			return fmt.Errorf("extractAndWriteFile: f.Close: %w", err)
 		}
 		return nil
 	}
 
 	for _, f := range r.File {
+		if strings.HasPrefix(f.Name, metadataDir+"/") || !sel.Match(strings.TrimSuffix(f.Name, "/"), f.FileInfo().IsDir()) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		if err := extractAndWriteFile(f); err != nil {
 			return err
 		}
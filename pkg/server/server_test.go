@@ -3,14 +3,26 @@ package server
 import (
 	"archive/zip"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -19,10 +31,23 @@ import (
 	"github.com/robfig/cron/v3"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 
 	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
 	"github.com/bizflycloud/bizfly-backup/pkg/broker"
 	"github.com/bizflycloud/bizfly-backup/pkg/broker/mqtt"
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/compression"
+	"github.com/bizflycloud/bizfly-backup/pkg/encryption"
+	"github.com/bizflycloud/bizfly-backup/pkg/filter"
+	"github.com/bizflycloud/bizfly-backup/pkg/hooks"
+	"github.com/bizflycloud/bizfly-backup/pkg/jobs"
+	"github.com/bizflycloud/bizfly-backup/pkg/manifest"
+	"github.com/bizflycloud/bizfly-backup/pkg/progress"
+	"github.com/bizflycloud/bizfly-backup/pkg/ratelimit"
+	"github.com/bizflycloud/bizfly-backup/pkg/restore"
+	"github.com/bizflycloud/bizfly-backup/pkg/source"
 )
 
 var (
@@ -32,8 +57,9 @@ var (
 )
 
 func TestMain(m *testing.M) {
+	// Tests using the MQTT broker are skipped, the others publish to a fakeBroker.
 	if os.Getenv("EXCLUDE_MQTT") != "" {
-		os.Exit(0)
+		os.Exit(m.Run())
 	}
 
 	pool, err := dockertest.NewPool("")
@@ -66,7 +92,15 @@ func TestMain(m *testing.M) {
 	os.Exit(code)
 }
 
+// requireMQTT skips the test if there is no MQTT broker.
+func requireMQTT(t *testing.T) {
+	if b == nil {
+		t.Skip("EXCLUDE_MQTT is set")
+	}
+}
+
 func TestServerRun(t *testing.T) {
+	requireMQTT(t)
 	tests := []struct {
 		addr string
 	}{
@@ -91,6 +125,7 @@ func TestServerRun(t *testing.T) {
 }
 
 func TestServerEventHandler(t *testing.T) {
+	requireMQTT(t)
 	addr := "unix://" + filepath.Join(os.TempDir(), "bizfly-backup-test-server.sock")
 	s, err := New(WithAddr(addr), WithBroker(b))
 	require.NoError(t, err)
@@ -141,6 +176,33 @@ func Test_compressDir(t *testing.T) {
 	assert.Equal(t, 4, count)
 }
 
+func newTarget(t *testing.T, dir string) *restore.Target {
+	target, err := restore.NewTarget(dir, restore.ModeOverwrite)
+	require.NoError(t, err)
+	return target
+}
+
+func Test_unzipRejectsEscapingPath(t *testing.T) {
+	fi, err := ioutil.TempFile("", "bizfly-backup-agent-test-unzip-*")
+	require.NoError(t, err)
+	defer os.Remove(fi.Name())
+	zw := zip.NewWriter(fi)
+	w, err := zw.Create("../evil")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("evil"))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	require.NoError(t, fi.Close())
+
+	dest, err := ioutil.TempDir("", "bizfly-backup-agent-test-unzip-dir-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	err = unzip(context.Background(), fi.Name(), newTarget(t, dest), nil)
+	assert.True(t, errors.Is(err, restore.ErrUnsafePath), err)
+	_, err = os.Stat(filepath.Join(filepath.Dir(dest), "evil"))
+	assert.True(t, os.IsNotExist(err))
+}
+
 func Test_unzip(t *testing.T) {
 	fi, err := ioutil.TempFile("", "bizfly-backup-agent-test-unzip-*")
 	require.NoError(t, err)
@@ -152,7 +214,7 @@ func Test_unzip(t *testing.T) {
 	tempDir, err := ioutil.TempDir("", "bizfly-backup-agent-test-unzip-dir-*")
 	require.NoError(t, err)
 	defer os.RemoveAll(tempDir)
-	assert.NoError(t, unzip(fi.Name(), tempDir))
+	assert.NoError(t, unzip(context.Background(), fi.Name(), newTarget(t, tempDir), nil))
 
 	count := 0
 	walker := func(path string, info os.FileInfo, err error) error {
@@ -170,6 +232,449 @@ func Test_unzip(t *testing.T) {
 	assert.Equal(t, 4, count)
 }
 
+func Test_archiveDirIncremental(t *testing.T) {
+	src, err := ioutil.TempDir("", "bizfly-backup-agent-test-incremental-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(src)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(src, name), []byte(name), 0644))
+	}
+
+	var full bytes.Buffer
+	prev, err := archiveDir(context.Background(), src, &full, archiveSpec{}, nil, &archiveMetadata{RecoveryPointType: backupapi.RecoveryPointTypeInitialReplica}, nil)
+	require.NoError(t, err)
+	assert.Len(t, prev.Entries, 3)
+
+	mtime := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(src, "a.txt"), mtime, mtime))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "b.txt"), []byte("changed"), 0644))
+	require.NoError(t, os.Remove(filepath.Join(src, "c.txt")))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "d.txt"), []byte("d.txt"), 0644))
+
+	fi, err := ioutil.TempFile("", "bizfly-backup-agent-test-incremental-*")
+	require.NoError(t, err)
+	defer os.Remove(fi.Name())
+	meta := &archiveMetadata{RecoveryPointType: backupapi.RecoveryPointTypePoint, ParentRecoveryPointID: "rp1"}
+	files, size, err := scanDir(context.Background(), src, filter.Rules{}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 3, files)
+	assert.Equal(t, int64(17), size)
+	tracker := progress.NewTracker(nil, 0)
+	tracker.Start(progress.PhaseArchiving, files, size)
+	idx, err := archiveDir(context.Background(), src, fi, archiveSpec{}, prev, meta, tracker)
+	require.NoError(t, err)
+	require.NoError(t, fi.Close())
+	assert.Len(t, idx.Entries, 3)
+	// Unchanged files count in progress too.
+	p := tracker.Snapshot()
+	assert.Equal(t, files, p.Files)
+	assert.Equal(t, size, p.Bytes)
+	assert.Equal(t, 100.0, p.Percent)
+
+	zr, err := zip.OpenReader(fi.Name())
+	require.NoError(t, err)
+	defer zr.Close()
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	// a.txt was only touched, its content is unchanged.
+	assert.ElementsMatch(t, []string{"b.txt", "d.txt", metadataRecoveryPoint, metadataManifest}, names)
+
+	got, err := readArchiveMetadata(fi.Name())
+	require.NoError(t, err)
+	assert.Equal(t, "rp1", got.ParentRecoveryPointID)
+	assert.Equal(t, []string{"c.txt"}, got.Deleted)
+}
+
+func Test_archiveDirTar(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("tar archives preserve POSIX modes and symlinks")
+	}
+	src, err := ioutil.TempDir("", "bizfly-backup-agent-test-tar-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(src)
+	require.NoError(t, os.Mkdir(filepath.Join(src, "dir"), 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "dir", "a.txt"), []byte("a"), 0604))
+	require.NoError(t, os.Symlink("dir/a.txt", filepath.Join(src, "link")))
+
+	fi, err := ioutil.TempFile("", "bizfly-backup-agent-test-tar-*")
+	require.NoError(t, err)
+	defer os.Remove(fi.Name())
+	meta := &archiveMetadata{RecoveryPointType: backupapi.RecoveryPointTypeInitialReplica}
+	idx, err := archiveDir(context.Background(), src, fi, archiveSpec{format: backupapi.ArchiveFormatTar}, nil, meta, nil)
+	require.NoError(t, err)
+	require.NoError(t, fi.Close())
+	assert.Len(t, idx.Entries, 2)
+
+	format, codec, err := archiveFormat(fi.Name())
+	require.NoError(t, err)
+	assert.Equal(t, backupapi.ArchiveFormatTar, format)
+	assert.Equal(t, compression.Gzip, codec.Name())
+	got, err := readArchiveMetadata(fi.Name())
+	require.NoError(t, err)
+	assert.Equal(t, meta, got)
+
+	dest, err := ioutil.TempDir("", "bizfly-backup-agent-test-tar-dest-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	require.NoError(t, extractArchive(context.Background(), fi.Name(), newTarget(t, dest), nil))
+	info, err := os.Stat(filepath.Join(dest, "dir"))
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeDir|0700, info.Mode())
+	info, err = os.Stat(filepath.Join(dest, "dir", "a.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0604), info.Mode())
+	target, err := os.Readlink(filepath.Join(dest, "link"))
+	require.NoError(t, err)
+	assert.Equal(t, "dir/a.txt", target)
+	_, err = os.Stat(filepath.Join(dest, metadataDir))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func Test_archiveDirCompression(t *testing.T) {
+	src, err := ioutil.TempDir("", "bizfly-backup-agent-test-compression-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(src)
+	content := bytes.Repeat([]byte("log line\n"), 10000)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "app.log"), content, 0644))
+
+	for _, format := range []string{backupapi.ArchiveFormatZip, backupapi.ArchiveFormatTar} {
+		for _, codec := range []string{compression.Store, compression.Deflate, compression.Gzip, compression.Zstd} {
+			spec := archiveSpec{format: format, codec: codec, level: 3}
+			require.NoError(t, spec.validate())
+			fi, err := ioutil.TempFile("", "bizfly-backup-agent-test-compression-*")
+			require.NoError(t, err)
+			defer os.Remove(fi.Name())
+			meta := &archiveMetadata{RecoveryPointType: backupapi.RecoveryPointTypeInitialReplica, Compression: codec}
+			_, err = archiveDir(context.Background(), src, fi, spec, nil, meta, nil)
+			require.NoError(t, err)
+			info, err := fi.Stat()
+			require.NoError(t, err)
+			require.NoError(t, fi.Close())
+			if codec == compression.Store {
+				assert.Greater(t, info.Size(), int64(len(content)), "%s %s", format, codec)
+			} else {
+				assert.Less(t, info.Size(), int64(len(content)/10), "%s %s", format, codec)
+			}
+
+			got, err := readArchiveMetadata(fi.Name())
+			require.NoError(t, err)
+			assert.Equal(t, meta, got)
+			dest, err := ioutil.TempDir("", "bizfly-backup-agent-test-compression-dest-*")
+			require.NoError(t, err)
+			defer os.RemoveAll(dest)
+			require.NoError(t, extractArchive(context.Background(), fi.Name(), newTarget(t, dest), nil), "%s %s", format, codec)
+			restored, err := ioutil.ReadFile(filepath.Join(dest, "app.log"))
+			require.NoError(t, err)
+			assert.Equal(t, content, restored)
+		}
+	}
+
+	assert.Error(t, archiveSpec{codec: "lz4"}.validate())
+	assert.Error(t, archiveSpec{codec: compression.Deflate, level: 42}.validate())
+	assert.Error(t, archiveSpec{format: backupapi.ArchiveFormatTar, codec: compression.Gzip, level: 42}.validate())
+}
+
+func Test_archiveDirFilter(t *testing.T) {
+	src, err := ioutil.TempDir("", "bizfly-backup-agent-test-filter-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(src)
+	for name, content := range map[string]string{
+		"main.go":            "package main",
+		"debug.log":          "log",
+		"cache/data":         "cached",
+		"src/app.go":         "package app",
+		"src/build.tmp":      "tmp",
+		"src/.bizflyignore":  "*.tmp\n",
+		"src/vendor/dep.go":  "package dep",
+		"src/vendor/big.bin": strings.Repeat("0", 1000),
+	} {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, ioutil.WriteFile(p, []byte(content), 0644))
+	}
+
+	spec := archiveSpec{
+		format: backupapi.ArchiveFormatTar,
+		rules:  filter.Rules{Exclude: []string{"*.log", "/cache/"}, MaxFileSize: 100, IgnoreFile: filter.DefaultIgnoreFile},
+	}
+	fi, err := ioutil.TempFile("", "bizfly-backup-agent-test-filter-*")
+	require.NoError(t, err)
+	defer os.Remove(fi.Name())
+	idx, err := archiveDir(context.Background(), src, fi, spec, nil, nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, fi.Close())
+
+	var names []string
+	for name := range idx.Entries {
+		names = append(names, filepath.ToSlash(name))
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"main.go", "src/.bizflyignore", "src/app.go", "src/vendor/dep.go"}, names)
+
+	dest, err := ioutil.TempDir("", "bizfly-backup-agent-test-filter-dest-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	require.NoError(t, extractArchive(context.Background(), fi.Name(), newTarget(t, dest), nil))
+	_, err = os.Stat(filepath.Join(dest, "cache"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dest, "src", "build.tmp"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dest, "src", "vendor", "dep.go"))
+	assert.NoError(t, err)
+}
+
+// countingWriter counts bytes of responses.
+type countingWriter struct {
+	http.ResponseWriter
+	n *int64
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+func TestServer_restoreRemoteZip(t *testing.T) {
+	src, err := ioutil.TempDir("", "bizfly-backup-agent-test-partial-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(src)
+	big := make([]byte, 2*1024*1024)
+	_, _ = rand.Read(big)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "big.bin"), big, 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(src, "etc", "nginx"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "etc", "nginx", "nginx.conf"), []byte("v1"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "etc", "nginx", "old.conf"), []byte("old"), 0644))
+
+	archives := make(map[string][]byte)
+	var parent bytes.Buffer
+	prev, err := archiveDir(context.Background(), src, &parent, archiveSpec{}, nil, &archiveMetadata{RecoveryPointType: backupapi.RecoveryPointTypeInitialReplica}, nil)
+	require.NoError(t, err)
+	archives["parent"] = parent.Bytes()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "etc", "nginx", "nginx.conf"), []byte("v2"), 0644))
+	require.NoError(t, os.Remove(filepath.Join(src, "etc", "nginx", "old.conf")))
+	var child bytes.Buffer
+	_, err = archiveDir(context.Background(), src, &child, archiveSpec{}, prev, &archiveMetadata{RecoveryPointType: backupapi.RecoveryPointTypePoint, ParentRecoveryPointID: "parent"}, nil)
+	require.NoError(t, err)
+	archives["child"] = child.Bytes()
+
+	var served int64
+	mux := http.NewServeMux()
+	for id, content := range archives {
+		content := content
+		mux.HandleFunc("/api/v1/agent/recovery-points/"+id+"/file/download", func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(countingWriter{w, &served}, r, "", time.Time{}, bytes.NewReader(content))
+		})
+	}
+	s, _ := newTestServer(t, mux)
+
+	ctx := context.Background()
+	remote, err := s.openRemoteZip(ctx, "", "", "child")
+	require.NoError(t, err)
+	require.NotNil(t, remote)
+	dest, err := ioutil.TempDir("", "bizfly-backup-agent-test-partial-dest-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	sel, err := filter.NewSelection([]string{"etc/nginx/**"})
+	require.NoError(t, err)
+	restored, err := s.restoreArchiveChain(ctx, remote, newTarget(t, dest), sel)
+	require.NoError(t, err)
+	require.NotNil(t, restored)
+	require.Len(t, restored.Files, 1)
+	assert.Equal(t, "etc/nginx/nginx.conf", restored.Files[0].Path)
+
+	content, err := ioutil.ReadFile(filepath.Join(dest, "etc", "nginx", "nginx.conf"))
+	require.NoError(t, err)
+	assert.Equal(t, "v2", string(content))
+	_, err = os.Stat(filepath.Join(dest, "etc", "nginx", "old.conf"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dest, "big.bin"))
+	assert.True(t, os.IsNotExist(err))
+	// Content of big.bin is not downloaded.
+	assert.Less(t, atomic.LoadInt64(&served), int64(len(big)/2))
+}
+
+// rewriteZip copies zip archive at name, replacing content of entry with content.
+func rewriteZip(t *testing.T, name string, entry string, content string) {
+	zr, err := zip.OpenReader(name)
+	require.NoError(t, err)
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range zr.File {
+		fh := f.FileHeader
+		w, err := zw.CreateHeader(&fh)
+		require.NoError(t, err)
+		if f.Name == entry {
+			_, err = w.Write([]byte(content))
+		} else {
+			var rc io.ReadCloser
+			rc, err = f.Open()
+			require.NoError(t, err)
+			_, err = io.Copy(w, rc)
+			rc.Close()
+		}
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	require.NoError(t, zr.Close())
+	require.NoError(t, ioutil.WriteFile(name, buf.Bytes(), 0600))
+}
+
+func TestServer_verifyFile(t *testing.T) {
+	src, err := ioutil.TempDir("", "bizfly-backup-agent-test-verify-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(src)
+	require.NoError(t, os.Mkdir(filepath.Join(src, "dir"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "dir", "a.txt"), []byte("a"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "b.txt"), []byte("b"), 0600))
+
+	client, err := backupapi.NewClient(backupapi.WithSecretKey("secret"))
+	require.NoError(t, err)
+	s, err := New(WithBackupClient(client))
+	require.NoError(t, err)
+	other, err := backupapi.NewClient(backupapi.WithSecretKey("other"))
+	require.NoError(t, err)
+	otherServer, err := New(WithBackupClient(other))
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	for _, format := range []string{backupapi.ArchiveFormatZip, backupapi.ArchiveFormatTar} {
+		fi, err := ioutil.TempFile("", "bizfly-backup-agent-test-verify-*")
+		require.NoError(t, err)
+		defer os.Remove(fi.Name())
+		spec := archiveSpec{format: format, manifestKey: client.ManifestKey()}
+		meta := &archiveMetadata{RecoveryPointType: backupapi.RecoveryPointTypePoint, ParentRecoveryPointID: "parent"}
+		_, err = archiveDir(context.Background(), src, fi, spec, nil, meta, nil)
+		require.NoError(t, err)
+		require.NoError(t, fi.Close())
+
+		report, parent, err := s.verifyFile(ctx, fi.Name())
+		require.NoError(t, err, format)
+		assert.Equal(t, 2, report.Files, format)
+		assert.Empty(t, report.Mismatches, format)
+		assert.Equal(t, "parent", parent, format)
+
+		_, _, err = otherServer.verifyFile(ctx, fi.Name())
+		assert.True(t, errors.Is(err, manifest.ErrBadSignature), format)
+	}
+
+	fi, err := ioutil.TempFile("", "bizfly-backup-agent-test-verify-*")
+	require.NoError(t, err)
+	defer os.Remove(fi.Name())
+	_, err = archiveDir(context.Background(), src, fi, archiveSpec{manifestKey: client.ManifestKey()}, nil, &archiveMetadata{}, nil)
+	require.NoError(t, err)
+	require.NoError(t, fi.Close())
+	rewriteZip(t, fi.Name(), "b.txt", "tampered")
+	report, _, err := s.verifyFile(ctx, fi.Name())
+	require.NoError(t, err)
+	assert.Equal(t, []manifest.Mismatch{{Path: "b.txt", Reason: "size is 8, want 1"}}, report.Mismatches)
+
+	// Archives of older agents have no manifest.
+	var buf bytes.Buffer
+	require.NoError(t, compressDir(src, &buf))
+	require.NoError(t, ioutil.WriteFile(fi.Name(), buf.Bytes(), 0600))
+	_, _, err = s.verifyFile(ctx, fi.Name())
+	assert.Equal(t, errNoManifest, err)
+}
+
+func TestServer_verifyRestore(t *testing.T) {
+	src, err := ioutil.TempDir("", "bizfly-backup-agent-test-verify-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(src)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("a"), 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "b.txt"), []byte("b"), 0644))
+	fi, err := ioutil.TempFile("", "bizfly-backup-agent-test-verify-*")
+	require.NoError(t, err)
+	defer os.Remove(fi.Name())
+	_, err = archiveDir(context.Background(), src, fi, archiveSpec{}, nil, &archiveMetadata{RecoveryPointType: backupapi.RecoveryPointTypeInitialReplica}, nil)
+	require.NoError(t, err)
+	require.NoError(t, fi.Close())
+
+	s, err := New()
+	require.NoError(t, err)
+	dest, err := ioutil.TempDir("", "bizfly-backup-agent-test-verify-dest-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	// b.txt exists and is kept.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dest, "b.txt"), []byte("live"), 0644))
+	target, err := restore.NewTarget(dest, restore.ModeSkipExisting)
+	require.NoError(t, err)
+	restored, err := s.extract(context.Background(), &backupapi.Config{}, fi.Name(), target, nil)
+	require.NoError(t, err)
+	require.NoError(t, s.verifyRestore(target, restored))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dest, "a.txt"), []byte("corrupted"), 0644))
+	assert.Error(t, s.verifyRestore(target, restored))
+}
+
+func TestServer_decryptFile(t *testing.T) {
+	s, err := New(WithEncryptionPassphrase("passphrase"))
+	require.NoError(t, err)
+
+	fi, err := ioutil.TempFile("", "bizfly-backup-agent-test-decrypt-*")
+	require.NoError(t, err)
+	defer os.Remove(fi.Name())
+	enc, err := s.keyring.NewWriter(fi)
+	require.NoError(t, err)
+	require.NoError(t, compressDir("./testdata/test_compress_dir", enc))
+	require.NoError(t, enc.Close())
+	require.NoError(t, fi.Close())
+
+	noKey, err := New()
+	require.NoError(t, err)
+	assert.Equal(t, encryption.ErrNoPassphrase, noKey.decryptFile(fi.Name()))
+
+	wrongKey, err := New(WithEncryptionPassphrase("wrong"))
+	require.NoError(t, err)
+	assert.Equal(t, encryption.ErrWrongPassphrase, wrongKey.decryptFile(fi.Name()))
+
+	require.NoError(t, s.decryptFile(fi.Name()))
+	zr, err := zip.OpenReader(fi.Name())
+	require.NoError(t, err)
+	assert.Len(t, zr.File, 4)
+	require.NoError(t, zr.Close())
+
+	// Decrypting plaintext is a no-op.
+	require.NoError(t, s.decryptFile(fi.Name()))
+}
+
+func TestServer_resumableBackup(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "bizfly-backup-agent-test-state-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(stateDir)
+	s, err := New(WithStateDir(stateDir))
+	require.NoError(t, err)
+
+	assert.Nil(t, s.resumableBackup("bd1", backupapi.RecoveryPointTypePoint, "rp0"))
+
+	p := &pendingBackup{
+		ActionID:              "action1",
+		RecoveryPointID:       "rp1",
+		BackupDirectoryID:     "bd1",
+		RecoveryPointType:     backupapi.RecoveryPointTypePoint,
+		ParentRecoveryPointID: "rp0",
+		Upload: backupapi.UploadState{
+			UploadID:  "upload1",
+			PartSize:  backupapi.MultipartUploadLowerBound,
+			Parts:     []backupapi.Part{{PartNumber: 1, Size: 10, Etag: "etag"}},
+			Checksums: map[int]string{1: "sum"},
+		},
+	}
+	require.NoError(t, s.savePendingBackup(p))
+	got := s.resumableBackup("bd1", backupapi.RecoveryPointTypePoint, "rp0")
+	assert.Equal(t, p, got)
+
+	// Another parent means another content, the pending backup is discarded.
+	assert.Nil(t, s.resumableBackup("bd1", backupapi.RecoveryPointTypePoint, "rp2"))
+	assert.Nil(t, s.resumableBackup("bd1", backupapi.RecoveryPointTypePoint, "rp0"))
+
+	p.Attempts = maxUploadAttempts
+	require.NoError(t, s.savePendingBackup(p))
+	assert.Nil(t, s.resumableBackup("bd1", backupapi.RecoveryPointTypePoint, "rp0"))
+}
+
 func TestServerCron(t *testing.T) {
 	tests := []struct {
 		name               string
@@ -278,3 +783,901 @@ func TestServerCron(t *testing.T) {
 		})
 	}
 }
+
+// fakeBroker records published messages.
+type fakeBroker struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (f *fakeBroker) Connect() error                                    { return nil }
+func (f *fakeBroker) Disconnect() error                                 { return nil }
+func (f *fakeBroker) Subscribe(topics []string, h broker.Handler) error { return nil }
+func (f *fakeBroker) String() string                                    { return "fake" }
+
+func (f *fakeBroker) Publish(topic string, payload interface{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.messages = append(f.messages, string(payload.([]byte)))
+	return nil
+}
+
+// newTestServer returns a Server talking, as machine "machine" with secret key "secret", to a fake backup server
+// handled by mux, and the broker it publishes to.
+func newTestServer(t *testing.T, mux *http.ServeMux, opts ...Option) (*Server, *fakeBroker) {
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	client, err := backupapi.NewClient(backupapi.WithServerURL(srv.URL+"/api/v1"), backupapi.WithID("machine"), backupapi.WithSecretKey("secret"))
+	require.NoError(t, err)
+	fb := &fakeBroker{}
+	s, err := New(append([]Option{WithBackupClient(client), WithBroker(fb)}, opts...)...)
+	require.NoError(t, err)
+	return s, fb
+}
+
+// handleConfig serves the agent config formatted with args on mux.
+func handleConfig(mux *http.ServeMux, format string, args ...interface{}) {
+	mux.HandleFunc("/api/v1/agent/config", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, format, args...)
+	})
+}
+
+func TestServer_handleBrokerEventQueuesJobs(t *testing.T) {
+	fb := &fakeBroker{}
+	s, err := New(WithBroker(fb))
+	require.NoError(t, err)
+
+	dest, err := ioutil.TempDir("", "bizfly-backup-agent-test-jobs-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	for _, id := range []string{"rp1", "rp2"} {
+		payload := fmt.Sprintf(`{"event_type": %q, "action_id": "action-%s", "recovery_point_id": %q, "dest_directory": %q, "restore_mode": "bogus"}`,
+			broker.RestoreManual, id, id, dest)
+		require.NoError(t, s.handleBrokerEvent(broker.Event{Payload: []byte(payload)}))
+	}
+
+	queued := s.jobs.Jobs()
+	require.Len(t, queued, 2)
+	for i, j := range queued {
+		assert.Equal(t, jobs.KindRestore, j.Kind)
+		assert.Equal(t, []string{"rp1", "rp2"}[i], j.Name)
+		assert.Equal(t, dest, j.Path)
+		done, err := s.jobs.Wait(context.Background(), j.ID)
+		require.NoError(t, err)
+		assert.Equal(t, jobs.StateFailed, done.State)
+		assert.Contains(t, done.Error, "bogus")
+	}
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	assert.Len(t, fb.messages, 2)
+}
+
+func TestServer_CancelJob(t *testing.T) {
+	fb := &fakeBroker{}
+	s, err := New(WithBroker(fb))
+	require.NoError(t, err)
+
+	run := func(ctx context.Context) error {
+		<-ctx.Done()
+		s.notifyError(ctx, "action", ctx.Err())
+		return ctx.Err()
+	}
+	byID := s.jobs.Submit(jobs.Job{Kind: jobs.KindBackup, BackupDirectoryID: "bd1", Path: "/data/a"}, run)
+	// The name is only a label, restores are canceled by recovery point.
+	byRecoveryPoint := s.jobs.Submit(jobs.Job{Kind: jobs.KindRestore, Name: "label", RecoveryPointID: "rp1", Path: "/data/b"}, run)
+
+	cancel := func(id string) int {
+		rr := httptest.NewRecorder()
+		s.router.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/jobs/"+id, nil))
+		return rr.Code
+	}
+	assert.Equal(t, http.StatusOK, cancel(byID.ID))
+	j, err := s.jobs.Wait(context.Background(), byID.ID)
+	require.NoError(t, err)
+	assert.Equal(t, jobs.StateCanceled, j.State)
+	assert.Equal(t, http.StatusConflict, cancel(byID.ID))
+	assert.Equal(t, http.StatusNotFound, cancel("unknown"))
+
+	payload := fmt.Sprintf(`{"event_type": %q, "recovery_point_id": "rp1"}`, broker.JobCancel)
+	require.NoError(t, s.handleBrokerEvent(broker.Event{Payload: []byte(payload)}))
+	j, err = s.jobs.Wait(context.Background(), byRecoveryPoint.ID)
+	require.NoError(t, err)
+	assert.Equal(t, jobs.StateCanceled, j.State)
+
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	require.Len(t, fb.messages, 2)
+	assert.Contains(t, fb.messages[0], statusCanceled)
+}
+
+func Test_archiveDirCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := archiveDir(ctx, "./testdata/test_compress_dir", ioutil.Discard, archiveSpec{}, nil, nil, nil)
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+func TestServer_jobHistory(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "bizfly-backup-agent-test-history-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(stateDir)
+	s, err := New(WithBroker(&fakeBroker{}), WithStateDir(stateDir))
+	require.NoError(t, err)
+
+	for _, id := range []string{"rp1", "rp2"} {
+		payload := fmt.Sprintf(`{"event_type": %q, "action_id": "action-%s", "recovery_point_id": %q, "dest_directory": %q, "restore_mode": "bogus"}`,
+			broker.RestoreManual, id, id, stateDir)
+		require.NoError(t, s.handleBrokerEvent(broker.Event{Payload: []byte(payload)}))
+	}
+	for _, j := range s.jobs.Jobs() {
+		_, err := s.jobs.Wait(context.Background(), j.ID)
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.history.Close())
+
+	// Jobs are known after a restart.
+	s, err = New(WithStateDir(stateDir))
+	require.NoError(t, err)
+	defer s.history.Close()
+	get := func(url string, v interface{}) int {
+		rr := httptest.NewRecorder()
+		s.router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, url, nil))
+		if rr.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(rr.Body).Decode(v))
+		}
+		return rr.Code
+	}
+	var list []jobs.Job
+	require.Equal(t, http.StatusOK, get("/jobs?limit=1", &list))
+	require.Len(t, list, 1)
+	assert.Equal(t, "rp2", list[0].RecoveryPointID)
+	assert.Equal(t, jobs.StateFailed, list[0].State)
+	assert.Contains(t, list[0].Error, "bogus")
+
+	var job jobs.Job
+	require.Equal(t, http.StatusOK, get("/jobs/"+list[0].ID, &job))
+	assert.Equal(t, list[0], job)
+	assert.Equal(t, http.StatusNotFound, get("/jobs/unknown", &job))
+	assert.Equal(t, http.StatusBadRequest, get("/jobs?limit=x", &list))
+}
+
+func TestServer_newTracker(t *testing.T) {
+	fb := &fakeBroker{}
+	s, err := New(WithBroker(fb))
+	require.NoError(t, err)
+
+	job := s.jobs.Submit(jobs.Job{Kind: jobs.KindRestore, ActionID: "action"}, func(ctx context.Context) error {
+		tracker := s.newTracker(ctx)
+		tracker.Start(progress.PhaseDownloading, 0, 0)
+		tracker.SetTotal(1000, 250)
+		return nil
+	})
+	_, err = s.jobs.Wait(context.Background(), job.ID)
+	require.NoError(t, err)
+
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	// Progress is sent at phase changes, then once per interval.
+	require.Len(t, fb.messages, 1)
+	var msg map[string]string
+	require.NoError(t, json.Unmarshal([]byte(fb.messages[0]), &msg))
+	assert.Equal(t, "action", msg["action_id"])
+	assert.Equal(t, job.ID, msg["job_id"])
+	assert.Equal(t, statusProgress, msg["status"])
+	assert.Equal(t, string(progress.PhaseDownloading), msg["phase"])
+	assert.Equal(t, "-1.0", msg["percent"])
+}
+
+func TestServer_JobEvents(t *testing.T) {
+	s, err := New(WithBroker(&fakeBroker{}))
+	require.NoError(t, err)
+
+	subscribed := func() bool {
+		s.events.mu.Lock()
+		defer s.events.mu.Unlock()
+		return len(s.events.subs) > 0
+	}
+	run := func(ctx context.Context) error {
+		for !subscribed() {
+			time.Sleep(time.Millisecond)
+		}
+		tracker := s.newTracker(ctx)
+		tracker.Start(progress.PhaseUploading, 1, 10)
+		return errors.New("boom")
+	}
+	decode := func(body io.Reader) []JobEvent {
+		var events []JobEvent
+		dec := json.NewDecoder(body)
+		for dec.More() {
+			var e JobEvent
+			require.NoError(t, dec.Decode(&e))
+			events = append(events, e)
+		}
+		return events
+	}
+
+	job := s.jobs.Submit(jobs.Job{Kind: jobs.KindBackup, BackupDirectoryID: "bd1", Path: "/data/a"}, run)
+	rr := httptest.NewRecorder()
+	s.router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/jobs/"+job.ID+"/events", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/x-ndjson", rr.Header().Get("Content-Type"))
+	events := decode(rr.Body)
+	require.NotEmpty(t, events)
+	last := events[len(events)-1]
+	assert.Equal(t, JobEventState, last.Type)
+	assert.Equal(t, jobs.StateFailed, last.Job.State)
+	assert.Equal(t, "boom", last.Job.Error)
+	var sawProgress bool
+	for _, e := range events {
+		assert.Equal(t, job.ID, e.JobID)
+		sawProgress = sawProgress || (e.Type == JobEventProgress && e.Progress.Phase == progress.PhaseUploading)
+	}
+	assert.True(t, sawProgress)
+
+	// A finished job streams its final state only.
+	rr = httptest.NewRecorder()
+	s.router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/jobs/"+job.ID+"/events", nil))
+	events = decode(rr.Body)
+	require.Len(t, events, 1)
+	assert.Equal(t, jobs.StateFailed, events[0].Job.State)
+
+	rr = httptest.NewRecorder()
+	s.router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/jobs/unknown/events", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	// Jobs queued by the backup server are followed once they match the request.
+	events2, unsubscribe := s.events.subscribe()
+	defer unsubscribe()
+	s.jobs.Submit(jobs.Job{Kind: jobs.KindBackup, BackupDirectoryID: "other", Path: "/data/b"}, func(context.Context) error { return nil })
+	want := s.jobs.Submit(jobs.Job{Kind: jobs.KindBackup, BackupDirectoryID: "bd1", Path: "/data/c"}, run)
+	rr = httptest.NewRecorder()
+	s.followJob(context.Background(), rr, events2, "", func(job jobs.Job) bool {
+		return job.BackupDirectoryID == "bd1"
+	})
+	events = decode(rr.Body)
+	require.NotEmpty(t, events)
+	assert.Equal(t, want.ID, events[0].JobID)
+	assert.Equal(t, jobs.StateQueued, events[0].Job.State)
+	assert.Equal(t, jobs.StateFailed, events[len(events)-1].Job.State)
+}
+
+func TestServer_RequestRestoreLocal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks are run by sh in tests")
+	}
+	var archive bytes.Buffer
+	require.NoError(t, compressDir("./testdata/test_compress_dir", &archive))
+	var s *Server
+	dest, err := ioutil.TempDir("", "bizfly-backup-agent-test-local-restore-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	hookOut := filepath.Join(dest, "..", filepath.Base(dest)+".hook")
+	defer os.Remove(hookOut)
+	mux := http.NewServeMux()
+	handleConfig(mux, `backup_directories:
+- id: bd1
+  path: %s
+  hooks:
+    pre_restore:
+      command: echo "pre $BIZFLY_BACKUP_RECOVERY_POINT_ID $BIZFLY_BACKUP_BACKUP_DIRECTORY_ID" >> %s
+    post_restore:
+      command: echo "post $BIZFLY_BACKUP_STATUS" >> %s
+      when: on-success
+`, dest, hookOut, hookOut)
+	mux.HandleFunc("/api/v1/agent/recovery-points/rp1/file/download", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Restore-Session-Key") != s.backupClient.RestoreSessionKey(r.Header.Get("X-Session-Created-At"), "rp1") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(archive.Bytes()))
+	})
+	s, fb := newTestServer(t, mux, WithServerCommands(true))
+
+	body := fmt.Sprintf(`{"path": %q, "restore_mode": %q, "local": true, "wait": true}`, dest, restore.DefaultMode)
+	rr := httptest.NewRecorder()
+	s.router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/recovery-points/rp1/restore", strings.NewReader(body)))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	var last JobEvent
+	dec := json.NewDecoder(rr.Body)
+	for dec.More() {
+		require.NoError(t, dec.Decode(&last))
+	}
+	require.NotNil(t, last.Job)
+	assert.Equal(t, jobs.StateSucceeded, last.Job.State, last.Job.Error)
+	assert.Equal(t, "rp1", last.Job.RecoveryPointID)
+	_, err = os.Stat(filepath.Join(dest, "foo.txt"))
+	assert.NoError(t, err)
+
+	// Restore hooks of the backup directory containing the destination run around the restore.
+	require.Len(t, last.Job.Hooks, 2)
+	assert.Equal(t, hooks.PreRestore, last.Job.Hooks[0].Name)
+	assert.Equal(t, hooks.PostRestore, last.Job.Hooks[1].Name)
+	out, err := ioutil.ReadFile(hookOut)
+	require.NoError(t, err)
+	assert.Equal(t, "pre rp1 bd1\npost succeeded\n", string(out))
+
+	// There is no server action to notify.
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	assert.Empty(t, fb.messages)
+}
+
+func TestServer_backupHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks are run by sh in tests")
+	}
+	dir, err := ioutil.TempDir("", "bizfly-backup-agent-test-hooks-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	hookOut := filepath.Join(dir, "hook.out")
+	var configRequests int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/agent/config", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&configRequests, 1)
+		_, _ = fmt.Fprintf(w, `backup_directories:
+- id: bd1
+  path: %s
+  hooks:
+    pre_backup:
+      command: echo dumping; exit 2
+      abort_on_failure: true
+    post_backup:
+      command: echo "$BIZFLY_BACKUP_STATUS $BIZFLY_BACKUP_RECOVERY_POINT_ID $BIZFLY_BACKUP_JOB_KIND" > %s
+      when: on-failure
+`, dir, hookOut)
+	})
+	mux.HandleFunc("/api/v1/agent/backup-directories/bd1/recovery-points", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"id": "action1", "recovery_point": {"id": "rp1"}}`))
+	})
+	mux.HandleFunc("/api/v1/agent/backup-directories/bd1", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(backupapi.BackupDirectory{ID: "bd1", Path: dir})
+	})
+	s, fb := newTestServer(t, mux, WithServerCommands(true))
+
+	job, err := s.submitBackup(context.Background(), "bd1", "", "name", backupapi.RecoveryPointTypeInitialReplica)
+	require.NoError(t, err)
+	job, err = s.jobs.Wait(context.Background(), job.ID)
+	require.NoError(t, err)
+	assert.Equal(t, jobs.StateFailed, job.State)
+	assert.Contains(t, job.Error, hooks.PreBackup)
+	// The config is got once for the whole job.
+	assert.Equal(t, int32(1), atomic.LoadInt32(&configRequests))
+	require.Len(t, job.Hooks, 2)
+	assert.Equal(t, 2, job.Hooks[0].ExitCode)
+	assert.Equal(t, "dumping\n", job.Hooks[0].Output)
+	assert.Equal(t, 0, job.Hooks[1].ExitCode)
+	out, err := ioutil.ReadFile(hookOut)
+	require.NoError(t, err)
+	assert.Equal(t, "failed rp1 backup\n", string(out))
+
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	require.Len(t, fb.messages, 1)
+	assert.Contains(t, fb.messages[0], statusFailed)
+}
+
+func TestServer_jobConfig(t *testing.T) {
+	var failing int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/agent/config", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte(`backup_directories:
+- id: bd1
+  path: /bd1
+`))
+	})
+	s, _ := newTestServer(t, mux)
+
+	// Without a previous config, jobs fail when the config can not be got.
+	atomic.StoreInt32(&failing, 1)
+	_, err := s.jobConfig(context.Background())
+	assert.Error(t, err)
+
+	atomic.StoreInt32(&failing, 0)
+	_, err = s.getConfig(context.Background())
+	require.NoError(t, err)
+
+	// Transient errors then fall back to the last config.
+	atomic.StoreInt32(&failing, 1)
+	bdc, err := s.backupDirectoryConfig(context.Background(), "bd1")
+	require.NoError(t, err)
+	assert.Equal(t, "/bd1", bdc.Path)
+}
+
+func TestServer_serverCommands(t *testing.T) {
+	mux := http.NewServeMux()
+	handleConfig(mux, `backup_directories:
+- id: bd1
+  path: /bd1
+  hooks:
+    pre_backup:
+      command: echo server
+- id: bd2
+  path: /bd2
+  hooks:
+    pre_backup:
+      command: echo server
+    post_backup:
+      command: echo server
+`)
+	local := map[string]hooks.Config{"bd2": {PreBackup: &hooks.Hook{Command: "echo local"}}}
+
+	// Only local hooks are run by default.
+	s, _ := newTestServer(t, mux, WithHooks(local))
+	cfg, err := s.getConfig(context.Background())
+	require.NoError(t, err)
+	bdc, _ := cfg.BackupDirectory("bd1")
+	assert.Equal(t, hooks.Config{}, bdc.Hooks)
+	bdc, _ = cfg.BackupDirectory("bd2")
+	assert.Equal(t, hooks.Config{PreBackup: &hooks.Hook{Command: "echo local"}}, bdc.Hooks)
+
+	s, _ = newTestServer(t, mux, WithHooks(local), WithServerCommands(true))
+	cfg, err = s.getConfig(context.Background())
+	require.NoError(t, err)
+	bdc, _ = cfg.BackupDirectory("bd1")
+	assert.Equal(t, hooks.Config{PreBackup: &hooks.Hook{Command: "echo server"}}, bdc.Hooks)
+	bdc, _ = cfg.BackupDirectory("bd2")
+	assert.Equal(t, hooks.Config{PreBackup: &hooks.Hook{Command: "echo local"}, PostBackup: &hooks.Hook{Command: "echo server"}}, bdc.Hooks)
+}
+
+func Test_archiveDirFiles(t *testing.T) {
+	src, err := ioutil.TempDir("", "bizfly-backup-agent-test-files-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(src)
+	for _, name := range []string{"main.go", "other.go", "src/app.go", "src/lib/lib.go", "docs/README"} {
+		p := filepath.Join(src, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, ioutil.WriteFile(p, []byte(name), 0644))
+	}
+
+	files, err := source.Config{Type: source.TypeFiles, Files: []string{"src/lib/lib.go", "src", filepath.Join(src, "main.go")}}.RelativeFiles(src)
+	require.NoError(t, err)
+	spec := archiveSpec{files: files}
+	count, size, err := scanDir(context.Background(), src, spec.rules, spec.files)
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+	assert.Equal(t, int64(len("main.go")+len("src/app.go")+len("src/lib/lib.go")), size)
+
+	var buf bytes.Buffer
+	idx, err := archiveDir(context.Background(), src, &buf, spec, nil, nil, nil)
+	require.NoError(t, err)
+	var names []string
+	for name := range idx.Entries {
+		names = append(names, filepath.ToSlash(name))
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"main.go", "src/app.go", "src/lib/lib.go"}, names)
+}
+
+func TestServer_commandSource(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("commands are run by sh in tests")
+	}
+	dir, err := ioutil.TempDir("", "bizfly-backup-agent-test-command-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	restored := filepath.Join(dir, "restored.sql")
+	mux := http.NewServeMux()
+	handleConfig(mux, `backup_directories:
+- id: bd1
+  path: %s
+  source:
+    type: command
+    command: printf 'CREATE TABLE app;'
+    output_name: app.sql
+    restore_command: cat > %s
+`, dir, restored)
+	s, _ := newTestServer(t, mux)
+	cfg, err := s.getConfig(context.Background())
+	require.NoError(t, err)
+	bdc, ok := cfg.BackupDirectory("bd1")
+	require.True(t, ok)
+
+	spec := newArchiveSpec(bdc)
+	require.NoError(t, spec.validate())
+	archive := filepath.Join(dir, "archive.zip")
+	f, err := os.Create(archive)
+	require.NoError(t, err)
+	meta := &archiveMetadata{RecoveryPointType: backupapi.RecoveryPointTypeInitialReplica, BackupDirectoryID: "bd1", Source: source.TypeCommand}
+	idx, err := archiveCommand(context.Background(), f, spec, meta, nil)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.Contains(t, idx.Entries, "app.sql")
+	assert.Equal(t, int64(len("CREATE TABLE app;")), idx.Entries["app.sql"].Size)
+
+	// Without restore command, the output is restored as a file.
+	dest := filepath.Join(dir, "dest")
+	require.NoError(t, extractArchive(context.Background(), archive, newTarget(t, dest), nil))
+	data, err := ioutil.ReadFile(filepath.Join(dest, "app.sql"))
+	require.NoError(t, err)
+	assert.Equal(t, "CREATE TABLE app;", string(data))
+
+	// Commands set by the server only run if allowed, the output is restored as a file otherwise.
+	piped, err := s.restoreCommandOutput(context.Background(), cfg, archive)
+	require.NoError(t, err)
+	assert.False(t, piped)
+	_, err = os.Stat(restored)
+	assert.True(t, os.IsNotExist(err), err)
+	assert.Equal(t, errServerCommandSource, s.backup(context.Background(), bdc, "", "name", backupapi.RecoveryPointTypeInitialReplica, nil))
+
+	s.serverCommands = true
+	piped, err = s.restoreCommandOutput(context.Background(), cfg, archive)
+	require.NoError(t, err)
+	assert.True(t, piped)
+	data, err = ioutil.ReadFile(restored)
+	require.NoError(t, err)
+	assert.Equal(t, "CREATE TABLE app;", string(data))
+
+	// Manifests signed on another machine are not rejected, like those of restored files.
+	require.NoError(t, os.Remove(restored))
+	signed := spec
+	signed.manifestKey = []byte("other machine")
+	f, err = os.Create(archive)
+	require.NoError(t, err)
+	_, err = archiveCommand(context.Background(), f, signed, meta, nil)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	piped, err = s.restoreCommandOutput(context.Background(), cfg, archive)
+	require.NoError(t, err)
+	assert.True(t, piped)
+	data, err = ioutil.ReadFile(restored)
+	require.NoError(t, err)
+	assert.Equal(t, "CREATE TABLE app;", string(data))
+
+	// Output which does not match the manifest never reaches the restore command.
+	require.NoError(t, os.Remove(restored))
+	rewriteZip(t, archive, "app.sql", "DROP TABLE app;")
+	piped, err = s.restoreCommandOutput(context.Background(), cfg, archive)
+	require.Error(t, err)
+	assert.True(t, piped)
+	assert.Contains(t, err.Error(), "does not match manifest")
+	_, err = os.Stat(restored)
+	assert.True(t, os.IsNotExist(err), err)
+
+	// The archive fails with the command.
+	spec.source.Command = "echo partial; echo broken >&2; exit 3"
+	_, err = archiveCommand(context.Background(), ioutil.Discard, spec, meta, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "exit status 3")
+	assert.Contains(t, err.Error(), "broken")
+}
+
+func TestServer_PruneBackup(t *testing.T) {
+	now := time.Now().UTC()
+	createdAt := func(days int) string {
+		return now.AddDate(0, 0, -days).Format(time.RFC3339)
+	}
+	rps := []backupapi.RecoveryPoint{
+		{ID: "rp1", PolicyID: "p1", Status: backupapi.RecoveryPointStatusCompleted, RecoveryPointType: backupapi.RecoveryPointTypeInitialReplica, CreatedAt: createdAt(3)},
+		{ID: "rp2", PolicyID: "p1", Status: backupapi.RecoveryPointStatusCompleted, RecoveryPointType: backupapi.RecoveryPointTypePoint, CreatedAt: createdAt(2)},
+		{ID: "rp3", PolicyID: "p1", Status: backupapi.RecoveryPointStatusCompleted, RecoveryPointType: backupapi.RecoveryPointTypeInitialReplica, CreatedAt: createdAt(1)},
+		{ID: "rp4", PolicyID: "p1", Status: backupapi.RecoveryPointStatusFAILED, RecoveryPointType: backupapi.RecoveryPointTypePoint, CreatedAt: createdAt(1)},
+		{ID: "rp5", PolicyID: "p1", Status: backupapi.RecoveryPointStatusCompleted, RecoveryPointType: backupapi.RecoveryPointTypePoint, CreatedAt: createdAt(0)},
+		{ID: "manual", Status: backupapi.RecoveryPointStatusCompleted, RecoveryPointType: backupapi.RecoveryPointTypeInitialReplica, CreatedAt: createdAt(10)},
+	}
+	var mu sync.Mutex
+	var deleted []string
+	failing := ""
+	retentionHours := 1
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/agent/config", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		_, _ = fmt.Fprintf(w, `backup_directories:
+- id: bd1
+  path: /tmp
+  policies:
+  - id: p1
+    schedule_pattern: '0 * * * *'
+    retention_hours: %d
+`, retentionHours)
+	})
+	mux.HandleFunc("/api/v1/agent/backup-directories/bd1/recovery-points", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(rps)
+	})
+	mux.HandleFunc("/api/v1/agent/backup-directories/bd1/recovery-points/", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodDelete, r.Method)
+		mu.Lock()
+		defer mu.Unlock()
+		if path.Base(r.URL.Path) == failing {
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte("recovery point is locked"))
+			return
+		}
+		deleted = append(deleted, path.Base(r.URL.Path))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	s, _ := newTestServer(t, mux)
+
+	prune := func(dryRun bool) PruneReport {
+		rr := httptest.NewRecorder()
+		// No body means no dry run.
+		body := ""
+		if dryRun {
+			body = `{"dry_run": true}`
+		}
+		s.router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/backups/bd1/prune", strings.NewReader(body)))
+		require.Equal(t, http.StatusOK, rr.Code, rr.Body.String())
+		var report PruneReport
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&report))
+		return report
+	}
+
+	report := prune(true)
+	assert.True(t, report.DryRun)
+	actions := make(map[string]bool)
+	for _, rp := range report.RecoveryPoints {
+		actions[rp.ID] = rp.Keep
+	}
+	// rp5 is the only hourly point kept, it is made on rp3. Failed and manual points are kept.
+	assert.Equal(t, map[string]bool{"rp1": false, "rp2": false, "rp3": true, "rp4": true, "rp5": true, "manual": true}, actions)
+	assert.Empty(t, deleted)
+
+	report = prune(false)
+	assert.False(t, report.DryRun)
+	// Newest points are deleted first.
+	assert.Equal(t, []string{"rp2", "rp1"}, deleted)
+
+	// Deletion stops at the first failure, rp1 is kept as the parent of rp2.
+	mu.Lock()
+	deleted = nil
+	failing = "rp2"
+	mu.Unlock()
+	report = prune(false)
+	assert.Empty(t, deleted)
+	for _, rp := range report.RecoveryPoints {
+		switch rp.ID {
+		case "rp2":
+			assert.Equal(t, "recovery point is locked", rp.Error)
+			assert.False(t, rp.Skipped)
+		case "rp1":
+			assert.Empty(t, rp.Error)
+			assert.True(t, rp.Skipped)
+		default:
+			assert.False(t, rp.Skipped, rp.ID)
+		}
+	}
+
+	// Servers which do not send retention in agent config prune nothing, with a warning.
+	mu.Lock()
+	failing = ""
+	retentionHours = 0
+	mu.Unlock()
+	core, logs := observer.New(zap.WarnLevel)
+	s.logger = zap.New(core)
+	cfg, err := s.getConfig(context.Background())
+	require.NoError(t, err)
+	bdc, _ := cfg.BackupDirectory("bd1")
+	s.autoPruneDirectory(context.Background(), bdc)
+	report = prune(false)
+	assert.Empty(t, deleted)
+	for _, rp := range report.RecoveryPoints {
+		assert.True(t, rp.Keep, rp.ID)
+	}
+	assert.Equal(t, 1, logs.FilterMessageSnippet("No policy has retention").Len())
+	assert.Equal(t, 1, logs.FilterMessageSnippet("Policy has no retention").Len())
+}
+
+func TestServer_cache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bizfly-backup-agent-test-cache-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	require.NoError(t, os.MkdirAll(src, 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "foo.txt"), []byte("foo"), 0600))
+
+	var (
+		mu        sync.Mutex
+		uploaded  []byte
+		checksum  string
+		downloads int
+	)
+	mux := http.NewServeMux()
+	handleConfig(mux, "backup_directories:\n- id: bd1\n  path: %s\n", src)
+	mux.HandleFunc("/api/v1/agent/backup-directories/bd1/recovery-points", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"id": "action1", "recovery_point": {"id": "rp1"}}`))
+	})
+	mux.HandleFunc("/api/v1/agent/backup-directories/bd1", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(backupapi.BackupDirectory{ID: "bd1", Path: src})
+	})
+	mux.HandleFunc("/api/v1/agent/recovery-points/rp1/file", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == http.MethodPost {
+			file, _, err := r.FormFile("data")
+			require.NoError(t, err)
+			defer file.Close()
+			uploaded, err = ioutil.ReadAll(file)
+			require.NoError(t, err)
+			sum := sha256.Sum256(uploaded)
+			checksum = hex.EncodeToString(sum[:])
+			return
+		}
+		_ = json.NewEncoder(w).Encode(backupapi.File{Name: "rp1", Size: len(uploaded), SHA256: checksum})
+	})
+	mux.HandleFunc("/api/v1/agent/recovery-points/rp1/file/download", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		downloads++
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(uploaded))
+	})
+	c, err := cache.Open(filepath.Join(dir, "cache"), 2, 0)
+	require.NoError(t, err)
+	s, _ := newTestServer(t, mux, WithStateDir(filepath.Join(dir, "state")), WithCache(c))
+
+	job, err := s.submitBackup(context.Background(), "bd1", "", "name", backupapi.RecoveryPointTypeInitialReplica)
+	require.NoError(t, err)
+	job, err = s.jobs.Wait(context.Background(), job.ID)
+	require.NoError(t, err)
+	require.Equal(t, jobs.StateSucceeded, job.State, job.Error)
+	e, ok := c.Get("rp1")
+	require.True(t, ok)
+	assert.Equal(t, checksum, e.SHA256)
+	assert.Equal(t, "bd1", e.BackupDirectoryID)
+
+	restoreTo := func(dest string) {
+		job := s.submitLocalRestore("rp1", dest, string(restore.DefaultMode), nil)
+		job, err := s.jobs.Wait(context.Background(), job.ID)
+		require.NoError(t, err)
+		require.Equal(t, jobs.StateSucceeded, job.State, job.Error)
+		data, err := ioutil.ReadFile(filepath.Join(dest, "foo.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "foo", string(data))
+	}
+	restoreTo(filepath.Join(dir, "dest1"))
+	assert.Equal(t, 0, downloads)
+
+	// A cached file not matching the server record is removed, and the file is downloaded.
+	mu.Lock()
+	checksum = strings.Repeat("0", 64)
+	mu.Unlock()
+	restoreTo(filepath.Join(dir, "dest2"))
+	assert.Equal(t, 1, downloads)
+	_, ok = c.Get("rp1")
+	assert.False(t, ok)
+}
+
+func TestServer_policyLimiter(t *testing.T) {
+	s, err := New()
+	require.NoError(t, err)
+	policy := backupapi.BackupDirectoryConfigPolicy{ID: "p1", BandwidthLimit: ratelimit.Config{Rate: "1MB"}}
+
+	// Jobs of a policy share its limiter.
+	l1, err := s.policyLimiter(policy)
+	require.NoError(t, err)
+	require.NotNil(t, l1)
+	l2, err := s.policyLimiter(policy)
+	require.NoError(t, err)
+	assert.Same(t, l1, l2)
+
+	// It is rebuilt when the limit changes.
+	policy.BandwidthLimit.Rate = "2MB"
+	l3, err := s.policyLimiter(policy)
+	require.NoError(t, err)
+	assert.False(t, l1 == l3)
+
+	policy.BandwidthLimit = ratelimit.Config{}
+	l4, err := s.policyLimiter(policy)
+	require.NoError(t, err)
+	assert.Nil(t, l4)
+
+	_, err = s.policyLimiter(backupapi.BackupDirectoryConfigPolicy{ID: "p2", BandwidthLimit: ratelimit.Config{Rate: "x"}})
+	assert.Error(t, err)
+
+	// Limiters of policies removed from the config are dropped.
+	_, err = s.policyLimiter(backupapi.BackupDirectoryConfigPolicy{ID: "p3", BandwidthLimit: ratelimit.Config{Rate: "1MB"}})
+	require.NoError(t, err)
+	s.dropPolicyLimiters([]backupapi.BackupDirectoryConfig{{ID: "bd1", Policies: []backupapi.BackupDirectoryConfigPolicy{{ID: "p1"}}}})
+	assert.Contains(t, s.limiters, "p1")
+	assert.NotContains(t, s.limiters, "p3")
+}
+
+func TestServer_restorePolicyLimit(t *testing.T) {
+	src, err := ioutil.TempDir("", "bizfly-backup-agent-test-restore-limit-src-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(src)
+	data := make([]byte, 200*1024)
+	_, _ = rand.Read(data)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "random"), data, 0600))
+	var archive bytes.Buffer
+	require.NoError(t, compressDir(src, &archive))
+	dest, err := ioutil.TempDir("", "bizfly-backup-agent-test-restore-limit-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+
+	mux := http.NewServeMux()
+	handleConfig(mux, `backup_directories:
+- id: bd1
+  path: /bd1
+  policies:
+  - id: p1
+    bandwidth_limit:
+      rate: 100KB
+`)
+	mux.HandleFunc("/api/v1/agent/recovery-points/rp1/file/download", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(archive.Bytes()))
+	})
+	s, _ := newTestServer(t, mux)
+
+	start := time.Now()
+	require.NoError(t, s.restore(context.Background(), "", "", "", "rp1", "p1", dest, string(restore.DefaultMode), nil, nil))
+	// The first 100KB are the initial burst.
+	assert.True(t, time.Since(start) >= 900*time.Millisecond, time.Since(start))
+	got, err := ioutil.ReadFile(filepath.Join(dest, "random"))
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestServer_DownloadRecoveryPoint(t *testing.T) {
+	content := []byte("recovery point content")
+	var downloads int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/agent/recovery-points/rp1/file/download", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	})
+	stateDir, err := ioutil.TempDir("", "bizfly-backup-agent-test-download-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(stateDir)
+	s, _ := newTestServer(t, mux, WithStateDir(stateDir))
+	contentName := filepath.Join(stateDir, "downloads", "rp1.content")
+
+	createdAt := time.Now().UTC().Format(http.TimeFormat)
+	download := func(key string, rangeHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/recovery-points/rp1/download", nil)
+		req.Header.Set("X-Session-Created-At", createdAt)
+		req.Header.Set("X-Restore-Session-Key", key)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		rr := httptest.NewRecorder()
+		s.router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Content is only served with a restore session key of the agent.
+	rr := download("invalid", "")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Zero(t, atomic.LoadInt32(&downloads))
+
+	// Content not served entirely is kept for the download to be resumed, only readable by the agent user.
+	key := s.backupClient.RestoreSessionKey(createdAt, "rp1")
+	rr = download(key, "bytes=0-7")
+	assert.Equal(t, http.StatusPartialContent, rr.Code)
+	assert.Equal(t, content[:8], rr.Body.Bytes())
+	fi, err := os.Stat(contentName)
+	require.NoError(t, err)
+	if runtime.GOOS != "windows" {
+		assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+		di, err := os.Stat(filepath.Dir(contentName))
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0700), di.Mode().Perm())
+	}
+
+	// Cached content is not served with an invalid key either.
+	rr = download("invalid", "bytes=8-")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	rr = download(key, "bytes=8-")
+	assert.Equal(t, http.StatusPartialContent, rr.Code)
+	assert.Equal(t, content[8:], rr.Body.Bytes())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&downloads))
+	_, err = os.Stat(contentName)
+	assert.True(t, os.IsNotExist(err), err)
+
+	// Content not served for contentTTL is removed.
+	rr = download(key, "bytes=0-7")
+	assert.Equal(t, http.StatusPartialContent, rr.Code)
+	s.removeExpiredContent()
+	_, err = os.Stat(contentName)
+	require.NoError(t, err)
+	old := time.Now().Add(-contentTTL)
+	require.NoError(t, os.Chtimes(contentName, old, old))
+	s.removeExpiredContent()
+	_, err = os.Stat(contentName)
+	assert.True(t, os.IsNotExist(err), err)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
+	"github.com/bizflycloud/bizfly-backup/pkg/manifest"
+	"github.com/bizflycloud/bizfly-backup/pkg/source"
+)
+
+// errServerCommandSource is returned by backups of a command source set by the backup server, when server commands
+// are not allowed.
+var errServerCommandSource = errors.New("command source set by the backup server is not allowed, set allow_server_commands in agent config to run it")
+
+// commandSourceAllowed reports whether commands of the source of bdc may run: sources set locally always may, those
+// set by the backup server only if server commands are allowed.
+func (s *Server) commandSourceAllowed(bdc backupapi.BackupDirectoryConfig) bool {
+	_, local := s.sources[bdc.ID]
+	return local || s.serverCommands
+}
+
+// restoreCommandOutput pipes the command output held by archive at name into the restore command of its backup
+// directory in cfg. It returns false without restoring anything if the archive does not hold command output, or if
+// the backup directory has no restore command it may run, in which case the output is restored as a file.
+func (s *Server) restoreCommandOutput(ctx context.Context, cfg *backupapi.Config, name string) (bool, error) {
+	meta, err := readArchiveMetadata(name)
+	if err != nil || meta == nil || meta.Source != source.TypeCommand {
+		return false, err
+	}
+	bdc, _ := cfg.BackupDirectory(meta.BackupDirectoryID)
+	if bdc.Source.RestoreCommand == "" {
+		return false, nil
+	}
+	if !s.commandSourceAllowed(bdc) {
+		s.logger.Warn("Restore command output as a file, restore command set by the server is not allowed", zap.String("backup_directory_id", bdc.ID))
+		return false, nil
+	}
+	m, err := readArchiveManifest(name)
+	if err != nil {
+		return false, err
+	}
+	if m == nil {
+		return false, errNoManifest
+	}
+	if err := m.CheckSignature(s.manifestKey()); err != nil {
+		// Manifests are signed with the key of the machine which made them, which may not be this one.
+		s.logger.Warn("Can not check manifest signature", zap.Error(err))
+	}
+	// The output is checked before any of it reaches the restore command.
+	output, err := checkCommandOutput(name, m)
+	if err != nil {
+		return true, err
+	}
+
+	s.logger.Info("Restore command output", zap.String("backup_directory_id", meta.BackupDirectoryID))
+	err = walkArchive(name, func(entry string, mode os.FileMode, content io.Reader) error {
+		if entry != output {
+			return nil
+		}
+		return bdc.Source.Restore(ctx, contextReader{ctx: ctx, r: content})
+	})
+	return true, err
+}
+
+// checkCommandOutput checks that the archive at name holds a single file of command output, matching manifest m,
+// and returns its entry.
+func checkCommandOutput(name string, m *manifest.Manifest) (string, error) {
+	var output string
+	err := walkArchive(name, func(entry string, mode os.FileMode, content io.Reader) error {
+		if strings.HasPrefix(entry, metadataDir+"/") {
+			return nil
+		}
+		if output != "" {
+			return fmt.Errorf("command output archive has more than one file: %s", entry)
+		}
+		output = entry
+		h := sha256.New()
+		if _, err := io.Copy(h, content); err != nil {
+			return err
+		}
+		for _, e := range m.Files {
+			if e.Path == entry {
+				if sum := hex.EncodeToString(h.Sum(nil)); sum != e.SHA256 {
+					return fmt.Errorf("command output %s does not match manifest: sha256 %s, want %s", entry, sum, e.SHA256)
+				}
+				return nil
+			}
+		}
+		return fmt.Errorf("command output %s is not in manifest", entry)
+	})
+	if err != nil {
+		return "", err
+	}
+	if output == "" {
+		return "", errors.New("command output archive has no file")
+	}
+	return output, nil
+}
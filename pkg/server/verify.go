@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
+	"github.com/bizflycloud/bizfly-backup/pkg/manifest"
+	"github.com/bizflycloud/bizfly-backup/pkg/repository"
+	"github.com/bizflycloud/bizfly-backup/pkg/restore"
+)
+
+// errNoManifest indicates that a recovery point can not be verified, since it was made by an older agent.
+var errNoManifest = errors.New("recovery point has no manifest")
+
+// VerifyReport is the result of the verification of a recovery point.
+type VerifyReport struct {
+	RecoveryPointID string `json:"recovery_point_id"`
+	manifest.Report
+}
+
+// manifestKey returns the key signing manifests of recovery points made by the agent.
+func (s *Server) manifestKey() []byte {
+	if s.backupClient == nil {
+		return nil
+	}
+	return s.backupClient.ManifestKey()
+}
+
+// parseManifest parses a manifest read from an archive, it returns nil if data is nil.
+func parseManifest(data []byte) (*manifest.Manifest, error) {
+	if data == nil {
+		return nil, nil
+	}
+	return manifest.Parse(data)
+}
+
+// verify downloads given recovery point and checks every file of it against its manifest. Parents of an
+// incremental recovery point are verified too, since they are needed to restore it.
+func (s *Server) verify(ctx context.Context, recoveryPointID string) ([]VerifyReport, error) {
+	var reports []VerifyReport
+	for id := recoveryPointID; id != ""; {
+		if len(reports) >= maxRecoveryPointChain {
+			return nil, errors.New("recovery point chain is too long")
+		}
+		s.logger.Info("Verifying recovery point", zap.String("recovery_point_id", id))
+		name, err := s.downloadRecoveryPoint(ctx, id)
+		if err != nil {
+			return nil, fmt.Errorf("download recovery point %s: %w", id, err)
+		}
+		report, parent, err := s.verifyFile(ctx, name)
+		os.Remove(name)
+		if err != nil {
+			return nil, fmt.Errorf("verify recovery point %s: %w", id, err)
+		}
+		reports = append(reports, VerifyReport{RecoveryPointID: id, Report: *report})
+		id = parent
+	}
+	return reports, nil
+}
+
+// verifyFile checks the downloaded and decrypted recovery point file at name, and returns the parent recovery
+// point of an incremental one.
+func (s *Server) verifyFile(ctx context.Context, name string) (*manifest.Report, string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	header, _ := br.Peek(16)
+	if repository.IsIndex(header) {
+		idx, err := repository.ReadIndex(br)
+		if err != nil {
+			return nil, "", err
+		}
+		report, err := repository.Verify(ctx, s.backupClient, idx)
+		return report, "", err
+	}
+
+	files, m, meta, err := hashArchive(name)
+	if err != nil {
+		return nil, "", err
+	}
+	if m == nil {
+		return nil, "", errNoManifest
+	}
+	if err := m.CheckSignature(s.manifestKey()); err != nil {
+		return nil, "", err
+	}
+	parent := ""
+	if meta != nil && meta.RecoveryPointType == backupapi.RecoveryPointTypePoint {
+		parent = meta.ParentRecoveryPointID
+	}
+	return m.Compare(files, true), parent, nil
+}
+
+// hashArchive returns the files of archive at name, along with its manifest and metadata, nil if it has none.
+func hashArchive(name string) (map[string]manifest.Entry, *manifest.Manifest, *archiveMetadata, error) {
+	files := make(map[string]manifest.Entry)
+	var manifestData, metadataData []byte
+	err := walkArchive(name, func(name string, mode os.FileMode, content io.Reader) error {
+		var err error
+		switch {
+		case name == metadataManifest:
+			manifestData, err = ioutil.ReadAll(content)
+		case name == metadataRecoveryPoint:
+			metadataData, err = ioutil.ReadAll(content)
+		case strings.HasPrefix(name, metadataDir+"/"):
+		default:
+			var e manifest.Entry
+			if e.Size, e.SHA256, err = manifest.Sum(content); err != nil {
+				return fmt.Errorf("read %s: %w", name, err)
+			}
+			e.Path, e.Mode = name, mode
+			files[name] = e
+		}
+		return err
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	m, err := parseManifest(manifestData)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	meta, err := parseArchiveMetadata(metadataData)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return files, m, meta, nil
+}
+
+// verifyRestore checks files restored to t against restored, the manifest of restored files. Files kept
+// because they existed before the restore are not checked. Nothing is checked if restored is nil.
+func (s *Server) verifyRestore(t *restore.Target, restored *manifest.Manifest) error {
+	if restored == nil {
+		s.logger.Debug("Restored recovery point has no manifest, skip verification")
+		return nil
+	}
+	checked := manifest.New()
+	files := make(map[string]manifest.Entry)
+	for _, e := range restored.Files {
+		if t.Skipped(e.Path) {
+			continue
+		}
+		checked.Add(e)
+		path, ok := t.Restored(e.Path)
+		if !ok {
+			continue
+		}
+		size, sum, err := manifest.SumFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		files[e.Path] = manifest.Entry{Path: e.Path, Size: size, SHA256: sum}
+	}
+	report := checked.Compare(files, false)
+	for _, m := range report.Mismatches {
+		s.logger.Error("Restored file does not match manifest", zap.String("path", m.Path), zap.String("reason", m.Reason))
+	}
+	if err := report.Err(); err != nil {
+		return fmt.Errorf("restore verification failed: %w", err)
+	}
+	s.logger.Info("Restored files verified", zap.Int("files", report.Files))
+	return nil
+}
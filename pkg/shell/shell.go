@@ -0,0 +1,58 @@
+// Package shell runs commands of the agent configuration, like hooks and backup sources, with the shell of the
+// system.
+package shell
+
+import (
+	"bytes"
+	"context"
+	"os/exec"
+)
+
+// Start starts cmd, which is killed with the processes it started once ctx is done. The returned func waits for
+// cmd to exit, it must be called once.
+func Start(ctx context.Context, cmd *exec.Cmd) (func() error, error) {
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = Kill(cmd)
+		case <-done:
+		}
+	}()
+	return func() error {
+		defer close(done)
+		return cmd.Wait()
+	}, nil
+}
+
+// TailBuffer keeps the last Max bytes written to it, to capture the output of commands.
+type TailBuffer struct {
+	Max       int
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (b *TailBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(p) > b.Max {
+		p = p[len(p)-b.Max:]
+		b.truncated = true
+	}
+	if extra := b.buf.Len() + len(p) - b.Max; extra > 0 {
+		b.buf.Next(extra)
+		b.truncated = true
+	}
+	b.buf.Write(p)
+	return n, nil
+}
+
+// String returns the bytes kept, marked as truncated if earlier ones were dropped.
+func (b *TailBuffer) String() string {
+	if b.truncated {
+		return "[output truncated]\n" + b.buf.String()
+	}
+	return b.buf.String()
+}
@@ -0,0 +1,18 @@
+package shell
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTailBuffer(t *testing.T) {
+	b := &TailBuffer{Max: 4}
+	_, _ = b.Write([]byte("ab"))
+	assert.Equal(t, "ab", b.String())
+	_, _ = b.Write([]byte("cde"))
+	assert.Equal(t, "[output truncated]\nbcde", b.String())
+	_, _ = b.Write([]byte(strings.Repeat("x", 10)))
+	assert.Equal(t, "[output truncated]\nxxxx", b.String())
+}
@@ -0,0 +1,15 @@
+package shell
+
+import (
+	"os/exec"
+)
+
+// Command returns the command running command with cmd.
+func Command(command string) *exec.Cmd {
+	return exec.Command("cmd", "/C", command)
+}
+
+// Kill kills the process of cmd.
+func Kill(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
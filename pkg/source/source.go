@@ -0,0 +1,233 @@
+// Package source describes what is backed up for a backup directory: the directory itself, an explicit list of its
+// files, or the output of a command like a database dump, streamed to the backup without an intermediate file.
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/shell"
+)
+
+// Types of sources.
+const (
+	// TypeDirectory backs up the files of the backup directory. This is the default.
+	TypeDirectory = "directory"
+	// TypeFiles backs up the files listed by the source, and the content of listed directories.
+	TypeFiles = "files"
+	// TypeCommand backs up the standard output of a command, as a single file.
+	TypeCommand = "command"
+)
+
+const (
+	// DefaultOutputName is the name of the file holding the output of command sources which set none.
+	DefaultOutputName = "output"
+	// maxStderr is the number of bytes of the standard error of commands reported on failure.
+	maxStderr = 4 * 1024
+)
+
+// Config is the source of a backup directory.
+type Config struct {
+	// Type is one of Type* constants, empty means TypeDirectory.
+	Type string `json:"type,omitempty" yaml:"type,omitempty" mapstructure:"type"`
+	// Files lists the files and directories of TypeFiles sources, relative to the backup directory or absolute
+	// within it.
+	Files []string `json:"files,omitempty" yaml:"files,omitempty" mapstructure:"files"`
+	// Command is run by the shell for TypeCommand sources, its standard output is backed up.
+	Command string `json:"command,omitempty" yaml:"command,omitempty" mapstructure:"command"`
+	// OutputName is the name of the file holding the command output in recovery points, like "app.sql". Empty
+	// means DefaultOutputName.
+	OutputName string `json:"output_name,omitempty" yaml:"output_name,omitempty" mapstructure:"output_name"`
+	// RestoreCommand is run by the shell on restore of TypeCommand sources, with the command output as standard
+	// input. Empty restores the output as a file of the destination directory.
+	RestoreCommand string `json:"restore_command,omitempty" yaml:"restore_command,omitempty" mapstructure:"restore_command"`
+	// Timeout is the duration after which commands are killed, like "2h". Empty means no limit.
+	Timeout string `json:"timeout,omitempty" yaml:"timeout,omitempty" mapstructure:"timeout"`
+}
+
+// Validate checks that c is a valid source.
+func (c Config) Validate() error {
+	switch c.Type {
+	case "", TypeDirectory:
+	case TypeFiles:
+		if len(c.Files) == 0 {
+			return errors.New("files source lists no file")
+		}
+	case TypeCommand:
+		if strings.TrimSpace(c.Command) == "" {
+			return errors.New("command source has no command")
+		}
+		if name := c.OutputName; name != "" && (strings.ContainsAny(name, `/\`) || name == "." || name == "..") {
+			return fmt.Errorf("invalid output name %q", name)
+		}
+		if _, err := c.timeout(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown source type %q, want %s, %s or %s", c.Type, TypeDirectory, TypeFiles, TypeCommand)
+	}
+	return nil
+}
+
+// IsCommand reports whether c is a TypeCommand source.
+func (c Config) IsCommand() bool {
+	return c.Type == TypeCommand
+}
+
+// Output returns the name of the file holding the command output in recovery points.
+func (c Config) Output() string {
+	if c.OutputName == "" {
+		return DefaultOutputName
+	}
+	return c.OutputName
+}
+
+// RelativeFiles returns Files relative to dir, with OS separators. Files outside dir are rejected.
+func (c Config) RelativeFiles(dir string) ([]string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]string, 0, len(c.Files))
+	for _, f := range c.Files {
+		path := filepath.FromSlash(f)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		rel, err := filepath.Rel(dir, filepath.Clean(path))
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("file %s is not inside backup directory %s", f, dir)
+		}
+		files = append(files, rel)
+	}
+	return files, nil
+}
+
+func (c Config) timeout() (time.Duration, error) {
+	if c.Timeout == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(c.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timeout: %w", err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid timeout %s", c.Timeout)
+	}
+	return d, nil
+}
+
+// withTimeout returns ctx bounded by the timeout of c, if any.
+func (c Config) withTimeout(ctx context.Context) (context.Context, context.CancelFunc, error) {
+	d, err := c.timeout()
+	if err != nil {
+		return nil, nil, err
+	}
+	if d == 0 {
+		ctx, cancel := context.WithCancel(ctx)
+		return ctx, cancel, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, d)
+	return ctx, cancel, nil
+}
+
+// Stream is the output of the command of a source.
+type Stream struct {
+	stdout io.ReadCloser
+	stderr *shell.TailBuffer
+	wait   func() error
+	cancel context.CancelFunc
+	ctx    context.Context
+}
+
+// Start starts the command of c, whose output is read from the returned Stream. The command is killed once ctx is
+// done or its timeout is exceeded.
+func (c Config) Start(ctx context.Context) (*Stream, error) {
+	ctx, cancel, err := c.withTimeout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cmd := shell.Command(c.Command)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	s := &Stream{stdout: stdout, stderr: &shell.TailBuffer{Max: maxStderr}, cancel: cancel, ctx: ctx}
+	cmd.Stderr = s.stderr
+	if s.wait, err = shell.Start(ctx, cmd); err != nil {
+		cancel()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Read reads the output of the command.
+func (s *Stream) Read(p []byte) (int, error) {
+	return s.stdout.Read(p)
+}
+
+// Close waits for the command to exit, killing it if its output was not read to the end. It returns an error if
+// the command failed, since its output is then likely incomplete.
+func (s *Stream) Close() error {
+	defer s.cancel()
+	// Reading the rest of the output would block on a command whose output is not wanted anymore.
+	_ = s.stdout.Close()
+	return commandError(s.ctx, s.wait(), s.stderr)
+}
+
+// Restore runs the restore command of c, with the content of r as standard input.
+func (c Config) Restore(ctx context.Context, r io.Reader) error {
+	if c.RestoreCommand == "" {
+		return errors.New("source has no restore command")
+	}
+	ctx, cancel, err := c.withTimeout(ctx)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	cmd := shell.Command(c.RestoreCommand)
+	stderr := &shell.TailBuffer{Max: maxStderr}
+	cmd.Stdout = stderr
+	cmd.Stderr = stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	wait, err := shell.Start(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	_, copyErr := io.Copy(stdin, r)
+	_ = stdin.Close()
+	if err := commandError(ctx, wait(), stderr); err != nil {
+		return fmt.Errorf("restore command: %w", err)
+	}
+	if copyErr != nil {
+		return fmt.Errorf("restore command: %w", copyErr)
+	}
+	return nil
+}
+
+// commandError returns the error of a command which exited with err, including the end of its output.
+func commandError(ctx context.Context, err error, output *shell.TailBuffer) error {
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) || ctx.Err() != nil {
+		if out := strings.TrimSpace(output.String()); out != "" {
+			return fmt.Errorf("%w: %s", err, out)
+		}
+	}
+	return err
+}
@@ -0,0 +1,85 @@
+package source
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigValidate(t *testing.T) {
+	assert.NoError(t, Config{}.Validate())
+	assert.NoError(t, Config{Type: TypeFiles, Files: []string{"a"}}.Validate())
+	assert.NoError(t, Config{Type: TypeCommand, Command: "pg_dump app", OutputName: "app.sql", Timeout: "1h"}.Validate())
+	assert.Error(t, Config{Type: "socket"}.Validate())
+	assert.Error(t, Config{Type: TypeFiles}.Validate())
+	assert.Error(t, Config{Type: TypeCommand}.Validate())
+	assert.Error(t, Config{Type: TypeCommand, Command: "true", OutputName: "../app.sql"}.Validate())
+	assert.Error(t, Config{Type: TypeCommand, Command: "true", Timeout: "later"}.Validate())
+}
+
+func TestConfigRelativeFiles(t *testing.T) {
+	dir, err := filepath.Abs(filepath.Join("testdata", "dir"))
+	require.NoError(t, err)
+	files, err := Config{Files: []string{"etc/app.conf", filepath.Join(dir, "data")}}.RelativeFiles(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join("etc", "app.conf"), "data"}, files)
+
+	for _, f := range []string{"../other", "/elsewhere", ".", "a/../../b"} {
+		_, err := Config{Files: []string{f}}.RelativeFiles(dir)
+		assert.Error(t, err, f)
+	}
+}
+
+func TestConfigStart(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("commands are run by sh in tests")
+	}
+	s, err := Config{Type: TypeCommand, Command: "echo dump; echo progress >&2"}.Start(context.Background())
+	require.NoError(t, err)
+	out, err := ioutil.ReadAll(s)
+	require.NoError(t, err)
+	assert.Equal(t, "dump\n", string(out))
+	assert.NoError(t, s.Close())
+
+	// A failing command fails the stream, with its error output.
+	s, err = Config{Type: TypeCommand, Command: "echo partial; echo 'connection refused' >&2; exit 1"}.Start(context.Background())
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(s)
+	require.NoError(t, err)
+	err = s.Close()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "connection refused")
+
+	s, err = Config{Type: TypeCommand, Command: "sleep 10", Timeout: "50ms"}.Start(context.Background())
+	require.NoError(t, err)
+	_, _ = ioutil.ReadAll(s)
+	assert.Error(t, s.Close())
+}
+
+func TestConfigRestore(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("commands are run by sh in tests")
+	}
+	dir, err := ioutil.TempDir("", "bizfly-backup-source-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "restored")
+	c := Config{Type: TypeCommand, RestoreCommand: "cat > " + out}
+	require.NoError(t, c.Restore(context.Background(), strings.NewReader("dump\n")))
+	content, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "dump\n", string(content))
+
+	c.RestoreCommand = "echo 'syntax error' >&2; exit 3"
+	err = c.Restore(context.Background(), strings.NewReader("dump\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "syntax error")
+	assert.Error(t, Config{}.Restore(context.Background(), strings.NewReader("")))
+}
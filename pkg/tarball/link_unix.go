@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package tarball
+
+import (
+	"os"
+	"syscall"
+)
+
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// hardLinkID returns the identity of file with info if it has several links.
+func hardLinkID(info os.FileInfo) (fileID, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
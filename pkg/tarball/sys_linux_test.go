@@ -0,0 +1,42 @@
+package tarball
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/restore"
+)
+
+func TestXattrsAndSpecialFiles(t *testing.T) {
+	src, err := ioutil.TempDir("", "bizfly-backup-tarball-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(src)
+
+	name := filepath.Join(src, "file")
+	require.NoError(t, ioutil.WriteFile(name, []byte("content"), 0600))
+	if err := unix.Setxattr(name, "user.foo", []byte("bar"), 0); err != nil {
+		t.Skipf("extended attributes are not supported: %v", err)
+	}
+	require.NoError(t, unix.Mkfifo(filepath.Join(src, "fifo"), 0600))
+
+	dest, err := ioutil.TempDir("", "bizfly-backup-tarball-test-dest-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	require.NoError(t, Extract(archive(t, src), newTarget(t, dest, restore.ModeOverwrite), nil))
+
+	value, err := getXattr(filepath.Join(dest, "file"), "user.foo")
+	require.NoError(t, err)
+	assert.Equal(t, "bar", string(value))
+
+	fi, err := os.Lstat(filepath.Join(dest, "fifo"))
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeNamedPipe, fi.Mode()&os.ModeType)
+	assert.EqualValues(t, syscall.S_IFIFO, fi.Sys().(*syscall.Stat_t).Mode&syscall.S_IFMT)
+}
@@ -0,0 +1,30 @@
+//go:build !linux
+// +build !linux
+
+package tarball
+
+import (
+	"archive/tar"
+	"errors"
+	"time"
+)
+
+var errXattrNotSupported = errors.New("extended attributes are not supported")
+
+// listXattrs returns extended attributes of path, they are only supported on Linux.
+func listXattrs(path string) (map[string]string, error) {
+	return nil, nil
+}
+
+func setXattr(path string, name string, value []byte) error {
+	return errXattrNotSupported
+}
+
+func mknod(path string, hdr *tar.Header) error {
+	return errors.New("special files are only supported on Linux")
+}
+
+// lutimes does nothing, times of symlinks are only restored on Linux.
+func lutimes(path string, mtime time.Time) error {
+	return nil
+}
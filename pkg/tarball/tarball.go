@@ -0,0 +1,320 @@
+// Package tarball writes and extracts tar archives preserving POSIX metadata: ownership, permissions,
+// timestamps, hard links, symlinks, device files, extended attributes and POSIX ACLs.
+//
+// Extended attributes, including POSIX ACLs which Linux stores as system.posix_acl_* attributes, are
+// recorded as SCHILY.xattr PAX records, like GNU tar and bsdtar do.
+package tarball
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/restore"
+)
+
+const xattrPAXPrefix = "SCHILY.xattr."
+
+// Writer writes files to a tar archive.
+type Writer struct {
+	tw *tar.Writer
+	// links maps identity of files with several links to the name of the first one written.
+	links map[fileID]string
+}
+
+// NewWriter creates a Writer writing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{tw: tar.NewWriter(w), links: make(map[fileID]string)}
+}
+
+// Add writes the header of file at path, with info returned by os.Lstat, as name in the archive.
+//
+// It reports whether content of the file must then be written with Write, which is the case of regular files
+// except hard links to a file already in the archive.
+func (w *Writer) Add(name string, path string, info os.FileInfo) (bool, error) {
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			return false, err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return false, err
+	}
+	hdr.Name = filepath.ToSlash(name)
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	// PAX format keeps sub-second timestamps, long names and extended attributes.
+	hdr.Format = tar.FormatPAX
+
+	if info.Mode().IsRegular() {
+		if id, ok := hardLinkID(info); ok {
+			if first, seen := w.links[id]; seen {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+				return false, w.tw.WriteHeader(hdr)
+			}
+			w.links[id] = hdr.Name
+		}
+	}
+
+	attrs, err := listXattrs(path)
+	if err != nil {
+		return false, fmt.Errorf("read extended attributes of %s: %w", path, err)
+	}
+	for k, v := range attrs {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords[xattrPAXPrefix+k] = v
+	}
+
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return false, err
+	}
+	return hdr.Typeflag == tar.TypeReg, nil
+}
+
+// Write writes content of the file added last.
+func (w *Writer) Write(p []byte) (int, error) {
+	return w.tw.Write(p)
+}
+
+// AddData writes a regular file named name with given content.
+func (w *Writer) AddData(name string, data []byte) error {
+	if err := w.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0600,
+		Size:     int64(len(data)),
+	}); err != nil {
+		return err
+	}
+	_, err := w.tw.Write(data)
+	return err
+}
+
+// Close writes the end of archive, it does not close the underlying writer.
+func (w *Writer) Close() error {
+	return w.tw.Close()
+}
+
+// ReadFile returns content of the regular file named name in tar archive read from r, or nil if the archive
+// has no such file.
+func ReadFile(r io.Reader, name string) ([]byte, error) {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Name == name && hdr.Typeflag == tar.TypeReg {
+			return ioutil.ReadAll(tr)
+		}
+	}
+}
+
+// Walk calls fn with the header of every entry of tar archive read from r, and a reader of the entry content.
+func Walk(r io.Reader, fn func(hdr *tar.Header, content io.Reader) error) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// Extract extracts tar archive read from r to t, skipping entries for which skip returns true.
+//
+// Ownership is restored when running as root, otherwise files belong to the current user.
+func Extract(r io.Reader, t *restore.Target, skip func(name string) bool) error {
+	root := os.Geteuid() == 0
+	type dir struct {
+		hdr    *tar.Header
+		target string
+	}
+	var dirs []dir
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := strings.TrimSuffix(hdr.Name, "/")
+		if skip != nil && skip(name) {
+			continue
+		}
+		if path.Clean(name) == "." {
+			continue
+		}
+
+		if hdr.Typeflag == tar.TypeDir {
+			target, apply, err := t.Mkdir(name, hdr.ModTime)
+			if err != nil {
+				return err
+			}
+			if target == "" || !apply {
+				continue
+			}
+			// The directory may exist with a mode preventing extraction of its content.
+			if err := os.Chmod(target, 0700); err != nil {
+				return err
+			}
+			// Metadata of directories is restored once their content is extracted.
+			dirs = append(dirs, dir{hdr: hdr, target: target})
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA, tar.TypeSymlink, tar.TypeLink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		default:
+			// Other entry types, like GNU sparse files, are not produced by Writer.
+			continue
+		}
+		target, err := t.File(name, hdr.ModTime)
+		if err != nil {
+			return err
+		}
+		if target == "" {
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			if err := writeFile(target, tr); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			linked, err := t.Path(hdr.Linkname)
+			if err != nil {
+				return err
+			}
+			if err := os.Link(linked, target); err != nil {
+				return err
+			}
+			// A hard link shares metadata of the file it links to.
+			continue
+		default:
+			if err := mknod(target, hdr); err != nil {
+				return fmt.Errorf("create special file %s: %w", target, err)
+			}
+		}
+		if err := restoreMetadata(target, hdr, root); err != nil {
+			return err
+		}
+	}
+
+	// Deepest directories first, so restoring a directory does not change its parent mtime.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := restoreMetadata(dirs[i].target, dirs[i].hdr, root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeFile(target string, r io.Reader) error {
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// restoreMetadata applies ownership, mode, extended attributes and times of hdr to target, in this order since
+// changing owner clears setuid bits and setting ACLs changes mode.
+func restoreMetadata(target string, hdr *tar.Header, root bool) error {
+	isSymlink := hdr.Typeflag == tar.TypeSymlink
+	if root {
+		if err := os.Lchown(target, lookupID(hdr.Uname, hdr.Uid, lookupUser), lookupID(hdr.Gname, hdr.Gid, lookupGroup)); err != nil {
+			return err
+		}
+	}
+	if !isSymlink {
+		if err := os.Chmod(target, hdr.FileInfo().Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return err
+		}
+	}
+	for k, v := range hdr.PAXRecords {
+		if !strings.HasPrefix(k, xattrPAXPrefix) {
+			continue
+		}
+		if err := setXattr(target, strings.TrimPrefix(k, xattrPAXPrefix), []byte(v)); err != nil {
+			// Unprivileged users can not set every attribute, and the filesystem may not support them.
+			if root && !errors.Is(err, errXattrNotSupported) {
+				return fmt.Errorf("set extended attribute %s of %s: %w", k, target, err)
+			}
+		}
+	}
+	if isSymlink {
+		return lutimes(target, hdr.ModTime)
+	}
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	return os.Chtimes(target, atime, hdr.ModTime)
+}
+
+func lookupUser(name string) (string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return u.Uid, nil
+}
+
+func lookupGroup(name string) (string, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return "", err
+	}
+	return g.Gid, nil
+}
+
+// lookupID returns the local id of user or group name, or id if name is unknown locally.
+func lookupID(name string, id int, lookup func(string) (string, error)) int {
+	if name == "" {
+		return id
+	}
+	s, err := lookup(name)
+	if err != nil {
+		return id
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return id
+	}
+	return n
+}
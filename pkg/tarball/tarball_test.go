@@ -0,0 +1,166 @@
+package tarball
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/restore"
+)
+
+func archive(t *testing.T, src string) *bytes.Buffer {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == src {
+			return err
+		}
+		name, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		hasContent, err := w.Add(name, path, info)
+		if err != nil || !hasContent {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		return err
+	})
+	require.NoError(t, err)
+	require.NoError(t, w.AddData("meta/data.json", []byte("{}")))
+	require.NoError(t, w.Close())
+	return &buf
+}
+
+func newTarget(t *testing.T, dest string, mode restore.Mode) *restore.Target {
+	target, err := restore.NewTarget(dest, mode)
+	require.NoError(t, err)
+	return target
+}
+
+func TestArchiveExtract(t *testing.T) {
+	src, err := ioutil.TempDir("", "bizfly-backup-tarball-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(src)
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 6000, time.UTC)
+	require.NoError(t, os.Mkdir(filepath.Join(src, "dir"), 0750))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "dir", "file"), []byte("content"), 0640))
+	require.NoError(t, os.Chmod(filepath.Join(src, "dir", "file"), 0640|os.ModeSetgid))
+	require.NoError(t, os.Link(filepath.Join(src, "dir", "file"), filepath.Join(src, "hardlink")))
+	require.NoError(t, os.Symlink("dir/file", filepath.Join(src, "symlink")))
+	require.NoError(t, os.Chtimes(filepath.Join(src, "dir", "file"), mtime, mtime))
+	require.NoError(t, os.Chtimes(filepath.Join(src, "dir"), mtime, mtime))
+	root := os.Geteuid() == 0
+	if root {
+		require.NoError(t, os.Lchown(filepath.Join(src, "dir", "file"), 1234, 5678))
+	}
+
+	buf := archive(t, src)
+	data, err := ReadFile(bytes.NewReader(buf.Bytes()), "meta/data.json")
+	require.NoError(t, err)
+	assert.Equal(t, "{}", string(data))
+
+	dest, err := ioutil.TempDir("", "bizfly-backup-tarball-test-dest-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	skip := func(name string) bool { return strings.HasPrefix(name, "meta") }
+	require.NoError(t, Extract(buf, newTarget(t, dest, restore.ModeOverwrite), skip))
+
+	_, err = os.Lstat(filepath.Join(dest, "meta"))
+	assert.True(t, os.IsNotExist(err))
+
+	fi, err := os.Stat(filepath.Join(dest, "dir"))
+	require.NoError(t, err)
+	assert.Equal(t, os.ModeDir|0750, fi.Mode())
+	assert.True(t, mtime.Equal(fi.ModTime()), fi.ModTime())
+
+	fi, err = os.Stat(filepath.Join(dest, "dir", "file"))
+	require.NoError(t, err)
+	assert.Equal(t, 0640|os.ModeSetgid, fi.Mode())
+	assert.True(t, mtime.Equal(fi.ModTime()), fi.ModTime())
+	st := fi.Sys().(*syscall.Stat_t)
+	assert.EqualValues(t, 2, st.Nlink)
+	if root {
+		assert.EqualValues(t, 1234, st.Uid)
+		assert.EqualValues(t, 5678, st.Gid)
+	}
+	linked, err := os.Stat(filepath.Join(dest, "hardlink"))
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(fi, linked))
+
+	target, err := os.Readlink(filepath.Join(dest, "symlink"))
+	require.NoError(t, err)
+	assert.Equal(t, "dir/file", target)
+
+	// Extracting again over existing files replaces them.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(src, "dir", "file"), []byte("changed"), 0640))
+	require.NoError(t, Extract(archive(t, src), newTarget(t, dest, restore.ModeOverwrite), skip))
+	content, err := ioutil.ReadFile(filepath.Join(dest, "hardlink"))
+	require.NoError(t, err)
+	assert.Equal(t, "changed", string(content))
+
+	// Or keeps them aside.
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dest, "dir", "file"), []byte("live"), 0640))
+	require.NoError(t, Extract(archive(t, src), newTarget(t, dest, restore.ModeRenameConflicts), skip))
+	content, err = ioutil.ReadFile(filepath.Join(dest, "dir", "file"))
+	require.NoError(t, err)
+	assert.Equal(t, "live", string(content))
+	content, err = ioutil.ReadFile(filepath.Join(dest, "dir", "file.restored"))
+	require.NoError(t, err)
+	assert.Equal(t, "changed", string(content))
+}
+
+func TestExtractRejectsEscapingPath(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	require.NoError(t, w.AddData("../evil", []byte("evil")))
+	require.NoError(t, w.Close())
+
+	dest, err := ioutil.TempDir("", "bizfly-backup-tarball-test-dest-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	assert.Error(t, Extract(&buf, newTarget(t, dest, restore.ModeOverwrite), nil))
+}
+
+func TestExtractRejectsSymlinkEscape(t *testing.T) {
+	outside, err := ioutil.TempDir("", "bizfly-backup-tarball-test-outside-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(outside)
+	src, err := ioutil.TempDir("", "bizfly-backup-tarball-test-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(src)
+	require.NoError(t, os.Symlink(outside, filepath.Join(src, "link")))
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	info, err := os.Lstat(filepath.Join(src, "link"))
+	require.NoError(t, err)
+	_, err = w.Add("link", filepath.Join(src, "link"), info)
+	require.NoError(t, err)
+	require.NoError(t, w.AddData("link/evil", []byte("evil")))
+	require.NoError(t, w.Close())
+
+	dest, err := ioutil.TempDir("", "bizfly-backup-tarball-test-dest-*")
+	require.NoError(t, err)
+	defer os.RemoveAll(dest)
+	err = Extract(&buf, newTarget(t, dest, restore.ModeOverwrite), nil)
+	assert.True(t, errors.Is(err, restore.ErrUnsafePath), err)
+	_, err = os.Lstat(filepath.Join(outside, "evil"))
+	assert.True(t, os.IsNotExist(err))
+}